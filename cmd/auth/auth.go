@@ -21,18 +21,14 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
+	"github.com/networknext/udpx/modules/auth"
 	"github.com/networknext/udpx/modules/core"
 	"github.com/networknext/udpx/modules/envvar"
-
-	"github.com/gorilla/mux"
 )
 
 // Allows us to return an exit code and allows log flushes and deferred functions
@@ -41,65 +37,56 @@ func main() {
 	os.Exit(mainReturnWithCode())
 }
 
-var GatewayAddress *net.UDPAddr
-var GatewayPublicKey [core.PublicKeyBytes_Box]byte
-var GatewayPrivateKey [core.PrivateKeyBytes_Box]byte
-var AuthPublicKey [core.PublicKeyBytes_Box]byte
-var AuthPrivateKey [core.PrivateKeyBytes_Box]byte
+func NewReloadableConfig(config *envvar.Config) *auth.ReloadableConfig {
+	reloadable := &auth.ReloadableConfig{}
+	reloadable.GatewayAddress = config.Address("GATEWAY_ADDRESS")
+	reloadable.GatewayPublicKey = config.Base64("GATEWAY_PUBLIC_KEY")
+	reloadable.GatewayPrivateKey = config.Base64("GATEWAY_PRIVATE_KEY")
+	reloadable.AuthPublicKey = config.Base64("AUTH_PUBLIC_KEY")
+	reloadable.AuthPrivateKey = config.Base64("AUTH_PRIVATE_KEY")
+	return reloadable
+}
+
+var settings = []envvar.Setting{
+	{Name: "HTTP_PORT", Type: envvar.Type_Port, Default: "60000", Description: "port for the connect token and session token endpoints"},
+	{Name: "LOG_LEVEL_SECRET", Type: envvar.Type_String, Secret: true, Description: "bearer token for changing log levels at /log_level. /log_level is only served if this is set"},
+	{Name: "GATEWAY_ADDRESS", Type: envvar.Type_Address, Default: "127.0.0.1:40000", Reloadable: true, Description: "public address of the gateway clients connect to"},
+	{Name: "GATEWAY_PUBLIC_KEY", Type: envvar.Type_Base64, Bytes: core.PublicKeyBytes_Box, Required: true, Reloadable: true, Description: "gateway public key"},
+	{Name: "GATEWAY_PRIVATE_KEY", Type: envvar.Type_Base64, Bytes: core.PrivateKeyBytes_Box, Required: true, Secret: true, Reloadable: true, Description: "gateway private key"},
+	{Name: "AUTH_PUBLIC_KEY", Type: envvar.Type_Base64, Bytes: core.PublicKeyBytes_Box, Required: true, Reloadable: true, Description: "auth public key"},
+	{Name: "AUTH_PRIVATE_KEY", Type: envvar.Type_Base64, Bytes: core.PrivateKeyBytes_Box, Required: true, Secret: true, Reloadable: true, Description: "auth private key, for signing tokens"},
+}
 
 func mainReturnWithCode() int {
 
 	serviceName := "udpx auth"
 
-	core.Info("%s", serviceName)
-
-	// configure
+	core.SetLogService("auth")
 
-	gatewayAddress, err := envvar.GetAddress("GATEWAY_ADDRESS", core.ParseAddress("127.0.0.1:40000"))
+	config, done, err := envvar.Load(settings, os.Args[1:], os.Stdout)
 	if err != nil {
-		core.Error("invalid GATEWAY_ADDRESS: %v", err)
+		core.Error("invalid config: %v", err)
 		return 1
 	}
 
-	gatewayPublicKey, err := envvar.GetBase64("GATEWAY_PUBLIC_KEY", nil)
-	if err != nil || len(gatewayPublicKey) != core.PublicKeyBytes_Box {
-		core.Error("missing or invalid GATEWAY_PUBLIC_KEY: %v", err)
-		return 1
-	}
-
-	gatewayPrivateKey, err := envvar.GetBase64("GATEWAY_PRIVATE_KEY", nil)
-	if err != nil || len(gatewayPrivateKey) != core.PrivateKeyBytes_Box {
-		core.Error("missing or invalid GATEWAY_PRIVATE_KEY: %v", err)
-		return 1
+	if done {
+		return 0
 	}
 
-	authPublicKey, err := envvar.GetBase64("AUTH_PUBLIC_KEY", nil)
-	if err != nil || len(authPublicKey) != core.PublicKeyBytes_Box {
-		core.Error("missing or invalid AUTH_PUBLIC_KEY: %v", err)
-		return 1
-	}
+	core.Info("%s", serviceName)
 
-	authPrivateKey, err := envvar.GetBase64("AUTH_PRIVATE_KEY", nil)
-	if err != nil || len(authPrivateKey) != core.PrivateKeyBytes_Box {
-		core.Error("missing or invalid AUTH_PRIVATE_KEY: %v", err)
-		return 1
-	}
+	// configure
 
-	GatewayAddress = gatewayAddress
-	copy(GatewayPublicKey[:], gatewayPublicKey[:])
-	copy(GatewayPrivateKey[:], gatewayPrivateKey[:])
-	copy(AuthPublicKey[:], authPublicKey[:])
-	copy(AuthPrivateKey[:], authPrivateKey[:])
+	a := auth.New(NewReloadableConfig(config), core.SystemClock)
 
 	// start web server
 	{
-		router := mux.NewRouter()
-		router.HandleFunc("/health", healthHandler).Methods("GET")
-		router.HandleFunc("/status", statusHandler).Methods("GET")
-		router.HandleFunc("/connect_token", connectTokenHandler).Methods("GET")
-		router.HandleFunc("/session_token", sessionTokenHandler).Methods("POST")
+		router := a.Router()
+		if logLevelSecret := config.String("LOG_LEVEL_SECRET"); logLevelSecret != "" {
+			router.HandleFunc("/log_level", core.LogLevelHandler(logLevelSecret)).Methods("GET", "POST")
+		}
 
-		httpPort := envvar.Get("HTTP_PORT", "60000")
+		httpPort := config.Port("HTTP_PORT")
 
 		srv := &http.Server{
 			Addr:    ":" + httpPort,
@@ -116,6 +103,26 @@ func mainReturnWithCode() int {
 		}()
 	}
 
+	// reload keys and the gateway address on SIGHUP
+
+	go func() {
+		hupChan := make(chan os.Signal, 1)
+		signal.Notify(hupChan, syscall.SIGHUP)
+		for range hupChan {
+			reloaded, restart, err := config.Reload()
+			if err != nil {
+				core.Error("could not reload config: %v", err)
+				continue
+			}
+			for i := range restart {
+				core.Warn("%s has changed, but only takes effect on restart", restart[i])
+			}
+			config = reloaded
+			a.Reload(NewReloadableConfig(config))
+			core.Info("reloaded config")
+		}
+	}()
+
 	// wait for shutdown
 
 	termChan := make(chan os.Signal, 1)
@@ -126,84 +133,3 @@ func mainReturnWithCode() int {
 
 	return 0
 }
-
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	_, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer r.Body.Close()
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(http.StatusText(http.StatusOK)))
-}
-
-func statusHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "hello world\n")
-}
-
-func connectTokenHandler(w http.ResponseWriter, r *http.Request) {
-	// todo: potentially may want to read in user id from POST binary request data
-	var userId [core.UserIdBytes]byte
-	envelopeUpKbps := uint32(2500)
-	envelopeDownKbps := uint32(10000)
-	packetsPerSecond := uint8(100)
-	connectToken := core.GenerateConnectToken(userId[:], envelopeUpKbps, envelopeDownKbps, packetsPerSecond, GatewayAddress, GatewayPublicKey[:], AuthPrivateKey[:], GatewayPublicKey[:])
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.WriteHeader(http.StatusOK)
-	w.Write(connectToken)
-}
-
-func sessionTokenHandler(w http.ResponseWriter, r *http.Request) {
-
-	requestData, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		// todo: core debug
-		fmt.Printf("could not read request data: %v\n", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	if len(requestData) != core.EncryptedSessionTokenBytes {
-		// todo: core debug
-		fmt.Printf("bad request length (%d)\n", len(requestData))
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	index := 0
-	var sessionToken core.SessionToken
-	result := core.ReadEncryptedSessionToken(requestData, &index, &sessionToken, AuthPublicKey[:], GatewayPrivateKey[:])
-	if !result {
-		// todo: core debug
-		fmt.Printf("invalid session token\n")
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	if sessionToken.ExpireTimestamp > uint64(time.Now().Unix())+core.SessionTokenExtensionSeconds {
-		// todo: core debug
-		fmt.Printf("too soon\n")
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	if sessionToken.ExpireTimestamp < uint64(time.Now().Unix()) {
-		// todo: core debug
-		fmt.Printf("session token has expired\n")
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	sessionToken.ExpireTimestamp += core.SessionTokenExtensionSeconds
-
-	index = 0
-	responseData := [core.EncryptedSessionTokenBytes]byte{}
-	core.WriteEncryptedSessionToken(responseData[:], &index, &sessionToken, AuthPrivateKey[:], GatewayPublicKey[:])
-
-	core.Info("updated session token %s", core.IdString(sessionToken.SessionId[:]))
-
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.WriteHeader(http.StatusOK)
-	w.Write(responseData[:])
-}
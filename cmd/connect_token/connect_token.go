@@ -25,35 +25,41 @@ import (
 	"fmt"
 	"github.com/networknext/udpx/modules/core"
 	"github.com/networknext/udpx/modules/envvar"
+	"os"
+	"time"
 )
 
+var settings = []envvar.Setting{
+	{Name: "GATEWAY_ADDRESS", Type: envvar.Type_Address, Default: "127.0.0.1:40000", Description: "public address of the gateway"},
+	{Name: "GATEWAY_PUBLIC_KEY", Type: envvar.Type_Base64, Bytes: core.PublicKeyBytes_Box, Required: true, Description: "gateway public key"},
+	{Name: "AUTH_PRIVATE_KEY", Type: envvar.Type_Base64, Bytes: core.PrivateKeyBytes_Box, Required: true, Secret: true, Description: "auth private key, for signing the connect token"},
+	{Name: "CLIENT_PUBLIC_KEY", Type: envvar.Type_Base64, Bytes: core.PublicKeyBytes_Box, Required: true, Description: "public key of the client the token is for"},
+}
+
 func main() {
 
 	var userId [core.UserIdBytes]byte
 
-	gatewayAddress, err := envvar.GetAddress("GATEWAY_ADDRESS", core.ParseAddress("127.0.0.1:40000"))
+	config, done, err := envvar.Load(settings, os.Args[1:], os.Stdout)
 	if err != nil {
-		core.Error("invalid GATEWAY_ADDRESS: %v", err)
+		core.Error("invalid config: %v", err)
 		return
 	}
 
-	gatewayPublicKey, err := envvar.GetBase64("GATEWAY_PUBLIC_KEY", nil)
-	if err != nil || len(gatewayPublicKey) != core.PublicKeyBytes_Box {
-		core.Error("missing or invalid GATEWAY_PUBLIC_KEY: %v", err)
+	if done {
 		return
 	}
 
-	authPrivateKey, err := envvar.GetBase64("AUTH_PRIVATE_KEY", nil)
-	if err != nil || len(authPrivateKey) != core.PrivateKeyBytes_Box {
-		core.Error("missing or invalid AUTH_PRIVATE_KEY: %v", err)
-		return
-	}
+	gatewayAddress := config.Address("GATEWAY_ADDRESS")
+	gatewayPublicKey := config.Base64("GATEWAY_PUBLIC_KEY")
+	authPrivateKey := config.Base64("AUTH_PRIVATE_KEY")
+	clientPublicKey := config.Base64("CLIENT_PUBLIC_KEY")
 
 	envelopeUpKbps := uint32(2500)
 	envelopeDownKbps := uint32(10000)
 	packetsPerSecond := uint8(100)
 
-	connect_token := core.GenerateConnectToken(userId[:], envelopeUpKbps, envelopeDownKbps, packetsPerSecond, gatewayAddress, gatewayPublicKey[:], authPrivateKey, gatewayPublicKey)
+	connect_token := core.GenerateConnectToken(clientPublicKey, userId[:], envelopeUpKbps, envelopeDownKbps, packetsPerSecond, gatewayAddress, gatewayPublicKey[:], authPrivateKey, gatewayPublicKey, time.Now())
 
 	connect_token_base64 := base64.StdEncoding.EncodeToString(connect_token)
 
@@ -23,8 +23,13 @@ import (
 	"encoding/base64"
 	"fmt"
 	"github.com/networknext/udpx/modules/core"
+	"io/ioutil"
+	"os"
 )
 
+// keygen prints a new keypair. Given a path prefix, it writes the keys to <prefix>_public_key and
+// <prefix>_private_key instead, for use with the *_FILE settings. The private key file is only readable by its owner.
+
 func main() {
 
 	publicKey, privateKey := core.Keygen_Box()
@@ -32,6 +37,23 @@ func main() {
 	publicKey_base64 := base64.StdEncoding.EncodeToString(publicKey)
 	privateKey_base64 := base64.StdEncoding.EncodeToString(privateKey)
 
-	fmt.Printf("public key: %s\n", publicKey_base64)
-	fmt.Printf("private key: %s\n", privateKey_base64)
+	if len(os.Args) < 2 {
+		fmt.Printf("public key: %s\n", publicKey_base64)
+		fmt.Printf("private key: %s\n", privateKey_base64)
+		return
+	}
+
+	prefix := os.Args[1]
+
+	if err := ioutil.WriteFile(prefix+"_public_key", []byte(publicKey_base64+"\n"), 0644); err != nil {
+		core.Error("could not write public key: %v", err)
+		os.Exit(1)
+	}
+
+	if err := ioutil.WriteFile(prefix+"_private_key", []byte(privateKey_base64+"\n"), 0600); err != nil {
+		core.Error("could not write private key: %v", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("wrote %s_public_key and %s_private_key\n", prefix, prefix)
 }
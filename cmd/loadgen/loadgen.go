@@ -0,0 +1,192 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/envvar"
+	"github.com/networknext/udpx/modules/loadgen"
+)
+
+// loadgen drives thousands of simulated client sessions through a gateway from one process, and reports the
+// throughput, drops and round trip latency it sees. Every socket sends from the same address, so for a real
+// load test raise CHALLENGE_RATE_PER_ADDRESS on the gateway, or sessions will only get through the handshake
+// a few at a time.
+
+var settings = []envvar.Setting{
+	{Name: "AUTH_URL", Type: envvar.Type_String, Default: "http://127.0.0.1:60000", Description: "auth service to request connect tokens from"},
+	{Name: "SESSIONS", Type: envvar.Type_Int, Default: "1000", Positive: true, Description: "number of simulated client sessions"},
+	{Name: "SOCKETS", Type: envvar.Type_Int, Default: "16", Positive: true, Description: "number of sockets the sessions are spread over, each with a send and receive thread"},
+	{Name: "BIND_ADDRESS", Type: envvar.Type_String, Default: "0.0.0.0", Description: "local address the sockets bind to"},
+	{Name: "BASE_PORT", Type: envvar.Type_Port, Default: "0", Description: "port of the first socket, the rest follow it. 0 for any"},
+	{Name: "CLIENT_IP", Type: envvar.Type_String, Default: "127.0.0.1", Description: "address the gateway sees packets from"},
+	{Name: "PAYLOAD_BYTES", Type: envvar.Type_Int, Default: strconv.Itoa(core.MinPayloadBytes), Positive: true, Description: fmt.Sprintf("payload size, from %d to %d bytes", core.MinPayloadBytes, core.MaxPayloadBytes)},
+	{Name: "PACKETS_PER_SECOND", Type: envvar.Type_Int, Default: "0", Description: "packets each session sends per second, or 0 for the rate in its connect token"},
+	{Name: "DURATION", Type: envvar.Type_Duration, Default: "1m", Positive: true, Description: "how long to run for"},
+	{Name: "RAMP_TIME", Type: envvar.Type_Duration, Default: "10s", Description: "time over which sessions are started"},
+	{Name: "REPORT_TIME", Type: envvar.Type_Duration, Default: "5s", Positive: true, Description: "time between progress reports"},
+	{Name: "READ_BUFFER", Type: envvar.Type_Int, Default: "4000000", Positive: true, Description: "socket read buffer size in bytes"},
+	{Name: "WRITE_BUFFER", Type: envvar.Type_Int, Default: "4000000", Positive: true, Description: "socket write buffer size in bytes"},
+	{Name: "BATCH_SIZE", Type: envvar.Type_Int, Default: strconv.Itoa(core.DefaultBatchSize), Positive: true, Description: "packets read and written per system call"},
+}
+
+func main() {
+	os.Exit(mainReturnWithCode())
+}
+
+func mbps(bytes uint64, duration time.Duration) float64 {
+	return float64(bytes) * 8 / 1000000 / duration.Seconds()
+}
+
+func rate(count uint64, duration time.Duration) float64 {
+	return float64(count) / duration.Seconds()
+}
+
+// dropRate is the fraction of packets sent that never came back. Packets still in flight count as dropped,
+// so it is only accurate over intervals much longer than the round trip time.
+func dropRate(sent uint64, received uint64) float64 {
+	if sent == 0 || received >= sent {
+		return 0
+	}
+	return 1 - float64(received)/float64(sent)
+}
+
+func mainReturnWithCode() int {
+
+	serviceName := "udpx loadgen"
+
+	core.SetLogService("loadgen")
+
+	config, done, err := envvar.Load(settings, os.Args[1:], os.Stdout)
+	if err != nil {
+		core.Error("invalid config: %v", err)
+		return 1
+	}
+
+	if done {
+		return 0
+	}
+
+	core.Info("%s", serviceName)
+
+	// configure
+
+	clientIP := net.ParseIP(config.String("CLIENT_IP"))
+	if clientIP == nil {
+		core.Error("invalid config: CLIENT_IP is not an ip address: %s", config.String("CLIENT_IP"))
+		return 1
+	}
+
+	basePort, _ := strconv.Atoi(config.Port("BASE_PORT"))
+
+	loadgenConfig := loadgen.Config{}
+	loadgenConfig.AuthURL = config.String("AUTH_URL")
+	loadgenConfig.BindAddress = config.String("BIND_ADDRESS")
+	loadgenConfig.BasePort = basePort
+	loadgenConfig.ClientIP = clientIP
+	loadgenConfig.Sessions = config.Int("SESSIONS")
+	loadgenConfig.Sockets = config.Int("SOCKETS")
+	loadgenConfig.PayloadBytes = config.Int("PAYLOAD_BYTES")
+	loadgenConfig.PacketsPerSecond = config.Int("PACKETS_PER_SECOND")
+	loadgenConfig.RampTime = config.Duration("RAMP_TIME")
+	loadgenConfig.ReadBuffer = config.Int("READ_BUFFER")
+	loadgenConfig.WriteBuffer = config.Int("WRITE_BUFFER")
+	loadgenConfig.BatchSize = config.Int("BATCH_SIZE")
+
+	duration := config.Duration("DURATION")
+	reportTime := config.Duration("REPORT_TIME")
+
+	l := loadgen.New(&loadgenConfig, core.UDP)
+
+	if err := l.Start(); err != nil {
+		core.Error("%v", err)
+		return 1
+	}
+
+	// report progress until the run is over, or we are told to stop
+
+	termChan := make(chan os.Signal, 1)
+	signal.Notify(termChan, os.Interrupt, syscall.SIGTERM)
+
+	startTime := time.Now()
+	endTimer := time.NewTimer(duration)
+	reportTicker := time.NewTicker(reportTime)
+	defer reportTicker.Stop()
+
+	last := l.Counters()
+	lastTime := startTime
+
+	running := true
+	for running {
+		select {
+		case <-termChan:
+			running = false
+		case <-endTimer.C:
+			running = false
+		case <-reportTicker.C:
+			counters := l.Counters()
+			currentTime := time.Now()
+			interval := currentTime.Sub(lastTime)
+			latency := l.Latency()
+			core.Info("%d/%d sessions connected, sent %.0f pps %.1f mbps, received %.0f pps %.1f mbps, dropped %.2f%%, rtt p50 %s p99 %s",
+				l.Connected(), loadgenConfig.Sessions,
+				rate(counters.PacketsSent-last.PacketsSent, interval), mbps(counters.BytesSent-last.BytesSent, interval),
+				rate(counters.PacketsReceived-last.PacketsReceived, interval), mbps(counters.BytesReceived-last.BytesReceived, interval),
+				100*dropRate(counters.PacketsSent-last.PacketsSent, counters.PacketsReceived-last.PacketsReceived),
+				latency.Percentile(50), latency.Percentile(99))
+			last = counters
+			lastTime = currentTime
+		}
+	}
+
+	core.Info("stopping")
+
+	l.Stop()
+
+	// report
+
+	elapsed := time.Since(startTime)
+	counters := l.Counters()
+	latency := l.Latency()
+
+	fmt.Printf("\n%d sessions on %d sockets for %s, %d byte payloads\n\n", loadgenConfig.Sessions, loadgenConfig.Sockets, elapsed.Round(time.Second), loadgenConfig.PayloadBytes)
+	fmt.Printf("    sessions started:        %d\n", counters.SessionsStarted)
+	fmt.Printf("    sessions connected:      %d\n", counters.SessionsConnected)
+	fmt.Printf("    sessions timed out:      %d\n", counters.SessionsTimedOut)
+	fmt.Printf("    sessions disconnected:   %d\n", counters.SessionsDisconnected)
+	fmt.Printf("    connect token failures:  %d\n", counters.ConnectTokenFailures)
+	fmt.Printf("    challenge packets:       %d\n", counters.ChallengePacketsReceived)
+	fmt.Printf("    packets sent:            %d (%.0f pps, %.1f mbps)\n", counters.PacketsSent, rate(counters.PacketsSent, elapsed), mbps(counters.BytesSent, elapsed))
+	fmt.Printf("    packets received:        %d (%.0f pps, %.1f mbps)\n", counters.PacketsReceived, rate(counters.PacketsReceived, elapsed), mbps(counters.BytesReceived, elapsed))
+	fmt.Printf("    packets acked:           %d\n", counters.PacketsAcked)
+	fmt.Printf("    dropped:                 %.3f%%\n", 100*dropRate(counters.PacketsSent, counters.PacketsReceived))
+	fmt.Printf("    round trip time:         p50 %s, p90 %s, p99 %s, p99.9 %s, max %s\n\n",
+		latency.Percentile(50), latency.Percentile(90), latency.Percentile(99), latency.Percentile(99.9), latency.Max())
+
+	return 0
+}
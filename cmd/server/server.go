@@ -21,38 +21,31 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"io/ioutil"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"sync"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/networknext/udpx/modules/core"
 	"github.com/networknext/udpx/modules/envvar"
+	"github.com/networknext/udpx/modules/server"
 
 	"github.com/gorilla/mux"
-	"golang.org/x/sys/unix"
 )
 
-const MaxPacketSize = 1500
-const SessionMapSwapTime = 60
-const SequenceBufferSize = 1024
-const QueueSize = 1024
-
-type SessionEntry struct {
-	SendSequence                  uint64
-	ReceiveSequence               uint64
-	AckedPackets                  [SequenceBufferSize]uint64
-	ReceivedPackets               [SequenceBufferSize]uint64
-	SendPayloadId                 uint64
-	SequenceToPayloadId           [SequenceBufferSize]uint64
-	SendBandwidthBitsAccumulator  uint64
-	SendBandwidthBitsPerSecondMax uint64
-	SendBandwidthBitsResetTime    time.Time
+var settings = []envvar.Setting{
+	{Name: "UDP_PORT", Type: envvar.Type_Port, Default: "50000", Description: "port gateways forward packets to"},
+	{Name: "HTTP_PORT", Type: envvar.Type_Port, Default: "50000", Description: "port for health, status and log level endpoints"},
+	{Name: "LOG_LEVEL_SECRET", Type: envvar.Type_String, Secret: true, Description: "bearer token for changing log levels at /log_level. /log_level is only served if this is set"},
+	{Name: "NUM_THREADS", Type: envvar.Type_Int, Default: "1", Positive: true, Description: "number of sockets and threads"},
+	{Name: "READ_BUFFER", Type: envvar.Type_Int, Default: "100000", Positive: true, Description: "socket read buffer size in bytes"},
+	{Name: "WRITE_BUFFER", Type: envvar.Type_Int, Default: "100000", Positive: true, Description: "socket write buffer size in bytes"},
+	{Name: "BATCH_SIZE", Type: envvar.Type_Int, Default: strconv.Itoa(core.DefaultBatchSize), Positive: true, Description: "packets read and written per system call"},
+	{Name: "TICK_RATE", Type: envvar.Type_Int, Default: strconv.Itoa(server.DefaultTickRate), Positive: true, Description: "payload packets sent to each session per second"},
+	{Name: "SHUTDOWN_TIMEOUT", Type: envvar.Type_Duration, Default: "5s", Positive: true, Description: "time allowed to drain sessions and close sockets on SIGTERM"},
+	{Name: "VALIDATE_TEST_MESSAGES", Type: envvar.Type_Bool, Default: "false", Description: "count messages that aren't client test traffic as payload mismatches, for load and soak tests"},
 }
 
 // Allows us to return an exit code and allows log flushes and deferred functions
@@ -65,57 +58,57 @@ func mainReturnWithCode() int {
 
 	serviceName := "udpx server"
 
-	core.Info("%s", serviceName)
-
-	// configure
+	core.SetLogService("server")
 
-	ctx, ctxCancelFunc := context.WithCancel(context.Background())
-
-	numThreads, err := envvar.GetInt("NUM_THREADS", 1)
+	config, done, err := envvar.Load(settings, os.Args[1:], os.Stdout)
 	if err != nil {
-		core.Error("invalid NUM_THREADS: %v", err)
+		core.Error("invalid config: %v", err)
 		return 1
 	}
 
-	readBuffer, err := envvar.GetInt("READ_BUFFER", 100000)
-	if err != nil {
-		core.Error("invalid READ_BUFFER: %v", err)
-		return 1
+	if done {
+		return 0
 	}
 
-	writeBuffer, err := envvar.GetInt("WRITE_BUFFER", 100000)
-	if err != nil {
-		core.Error("invalid WRITE_BUFFER: %v", err)
-		return 1
-	}
-
-	udpPort := envvar.Get("UDP_PORT", "50000")
+	core.Info("%s", serviceName)
 
-	serverId := core.RandomBytes(core.ServerIdBytes)
+	// configure
 
-	core.Info("starting server on port %s", udpPort)
+	serverConfig := server.Config{}
+	serverConfig.BindAddress = "0.0.0.0:" + config.Port("UDP_PORT")
+	serverConfig.NumThreads = config.Int("NUM_THREADS")
+	serverConfig.ReadBuffer = config.Int("READ_BUFFER")
+	serverConfig.WriteBuffer = config.Int("WRITE_BUFFER")
+	serverConfig.BatchSize = config.Int("BATCH_SIZE")
+	serverConfig.TickRate = config.Int("TICK_RATE")
+	serverConfig.ShutdownTimeout = config.Duration("SHUTDOWN_TIMEOUT")
+	serverConfig.ValidateTestMessages = config.Bool("VALIDATE_TEST_MESSAGES")
 
-	core.Info("server id is %s", core.IdString(serverId))
+	s := server.New(&serverConfig, core.UDP)
 
 	// --------------------------------------------------------------------
 
 	// start web server
+
+	srv := &http.Server{}
 	{
 		router := mux.NewRouter()
-		router.HandleFunc("/health", healthHandler).Methods("GET")
-		router.HandleFunc("/status", statusHandler).Methods("GET")
+		router.HandleFunc("/health", s.HealthHandler).Methods("GET")
+		router.HandleFunc("/status", s.StatusHandler).Methods("GET")
+		router.HandleFunc("/metrics", s.MetricsHandler).Methods("GET")
+		if logLevelSecret := config.String("LOG_LEVEL_SECRET"); logLevelSecret != "" {
+			router.HandleFunc("/log_level", core.LogLevelHandler(logLevelSecret)).Methods("GET", "POST")
+		}
 
-		httpPort := envvar.Get("HTTP_PORT", "50000")
+		httpPort := config.Port("HTTP_PORT")
 
-		srv := &http.Server{
-			Addr:    ":" + httpPort,
-			Handler: router,
-		}
+		srv.Addr = ":" + httpPort
+		srv.Handler = router
 
 		go func() {
 			core.Debug("started http server on port %s", httpPort)
 			err := srv.ListenAndServe()
-			if err != nil {
+			if err != nil && err != http.ErrServerClosed {
 				core.Error("failed to start http server: %v", err)
 				return
 			}
@@ -126,394 +119,35 @@ func mainReturnWithCode() int {
 
 	// start udp server
 
-	var wg sync.WaitGroup
-
-	wg.Add(numThreads)
-
-	lc := net.ListenConfig{
-		Control: func(network string, address string, c syscall.RawConn) error {
-			err := c.Control(func(fileDescriptor uintptr) {
-				err := unix.SetsockoptInt(int(fileDescriptor), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
-				if err != nil {
-					panic(fmt.Sprintf("failed to set reuse address socket option: %v", err))
-				}
-
-				err = unix.SetsockoptInt(int(fileDescriptor), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
-				if err != nil {
-					panic(fmt.Sprintf("failed to set reuse port socket option: %v", err))
-				}
-			})
-
-			return err
-		},
-	}
-
-	for i := 0; i < numThreads; i++ {
-
-		go func(thread int) {
-
-			lp, err := lc.ListenPacket(ctx, "udp", "0.0.0.0:"+udpPort)
-			if err != nil {
-				panic(fmt.Sprintf("could not bind socket: %v", err))
-			}
-
-			conn := lp.(*net.UDPConn)
-			defer conn.Close()
-
-			if err := conn.SetReadBuffer(readBuffer); err != nil {
-				panic(fmt.Sprintf("could not set connection read buffer size: %v", err))
-			}
-
-			if err := conn.SetWriteBuffer(writeBuffer); err != nil {
-				panic(fmt.Sprintf("could not set connection write buffer size: %v", err))
-			}
-
-			buffer := [MaxPacketSize]byte{}
-
-			sessionMap_Old := make(map[[core.SessionIdBytes]byte]*SessionEntry)
-			sessionMap_New := make(map[[core.SessionIdBytes]byte]*SessionEntry)
-
-			swapTime := time.Now().Unix() + SessionMapSwapTime
-			swapCount := 0
-
-			for {
-
-				// read packet
-
-				packetBytes, _, err := conn.ReadFromUDP(buffer[:])
-				if err != nil {
-					core.Debug("failed to read udp packet: %v", err)
-					break
-				}
-
-				if packetBytes <= 0 {
-					continue
-				}
-
-				packetData := buffer[:packetBytes]
-
-				// swap session map periodically. times out old sessions without O(n) walk or contention
-
-				swapCount++
-				if swapCount > 100 {
-					currentTime := time.Now().Unix()
-					if currentTime >= swapTime {
-						swapCount = 0
-						swapTime = currentTime + SessionMapSwapTime
-						sessionMap_Old = sessionMap_New
-						sessionMap_New = make(map[[core.SessionIdBytes]byte]*SessionEntry)
-					}
-				}
-
-				// read packet
-
-				index := 0
-
-				var version uint8
-				var gatewayInternalAddress net.UDPAddr
-				var clientAddress net.UDPAddr
-				var sessionId [core.SessionIdBytes]byte
-				var sequence uint64
-				var ack uint64
-				var ack_bits [core.AckBitsBytes]byte
-				var packetGatewayId [core.GatewayIdBytes]byte
-				var packetServerId [core.ServerIdBytes]byte
-				var packetType byte
-				var flags byte
-
-				core.ReadUint8(packetData, &index, &version)
-
-				if version != 0 {
-					core.Debug("unknown packet version: %d", version)
-					continue
-				}
-
-				core.ReadAddress(packetData, &index, &gatewayInternalAddress)
-				core.ReadAddress(packetData, &index, &clientAddress)
-				sessionTokenData := packetData[index : index+core.EncryptedSessionTokenBytes]
-				index += core.EncryptedSessionTokenBytes
-				sessionTokenSequence := packetData[index : index+core.SequenceBytes]
-				index += core.SequenceBytes
-				core.ReadBytes(packetData, &index, sessionId[:], core.SessionIdBytes)
-				core.ReadUint64(packetData, &index, &sequence)
-				core.ReadUint64(packetData, &index, &ack)
-				core.ReadBytes(packetData, &index, ack_bits[:], core.AckBitsBytes)
-				core.ReadBytes(packetData, &index, packetGatewayId[:], core.GatewayIdBytes)
-				core.ReadBytes(packetData, &index, packetServerId[:], core.ServerIdBytes)
-				core.ReadUint8(packetData, &index, &packetType)
-				core.ReadUint8(packetData, &index, &flags)
-
-				if packetType != core.PayloadPacket {
-					core.Debug("unknown packet type: %d", packetType)
-					continue
-				}
-
-				if flags != 0 {
-					core.Debug("unknown flags")
-					continue
-				}
-
-				core.Debug("recv packet sequence = %d", sequence)
-				core.Debug("recv packet ack = %d", ack)
-				core.Debug("recv packet ack_bits = [%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x]",
-					ack_bits[0],
-					ack_bits[1],
-					ack_bits[2],
-					ack_bits[3],
-					ack_bits[4],
-					ack_bits[5],
-					ack_bits[6],
-					ack_bits[7],
-					ack_bits[8],
-					ack_bits[9],
-					ack_bits[10],
-					ack_bits[11],
-					ack_bits[12],
-					ack_bits[13],
-					ack_bits[14],
-					ack_bits[15],
-					ack_bits[16],
-					ack_bits[17],
-					ack_bits[18],
-					ack_bits[19],
-					ack_bits[20],
-					ack_bits[21],
-					ack_bits[22],
-					ack_bits[23],
-					ack_bits[24],
-					ack_bits[25],
-					ack_bits[26],
-					ack_bits[27],
-					ack_bits[28],
-					ack_bits[29],
-					ack_bits[30],
-					ack_bits[31])
-
-				// lookup or create a session entry
-
-				sessionEntry := sessionMap_New[sessionId]
-				
-				if sessionEntry == nil {
-				
-					sessionEntry = sessionMap_Old[sessionId]
-				
-					if sessionEntry == nil {
-						
-						// add new session entry
-
-						sessionEntry = &SessionEntry{}
-						sessionEntry.SendSequence = ack + 10000
-						sessionEntry.ReceiveSequence = sequence
-						sessionEntry.SendBandwidthBitsPerSecondMax = 10000 * 1000 // todo: gateway needs to pass this up to server (envelopeDownKbps)
-						sessionEntry.SendBandwidthBitsResetTime = time.Now().Add(time.Second)
-						for i := range sessionEntry.SequenceToPayloadId {
-							sessionEntry.SequenceToPayloadId[i] = ^uint64(0)
-						}
-						
-						sessionMap_New[sessionId] = sessionEntry
-						
-						core.Info("new session %s from %s", core.IdString(sessionId[:]), clientAddress.String())
-				
-					} else {
-				
-						// migrate old -> new session map
-						sessionMap_New[sessionId] = sessionEntry
-				
-					}
-				}
-
-				if sessionEntry == nil {
-					// this should never happen
-					panic("no session entry")
-				}
-
-				// update received packet reliability
-
-				if sessionEntry.ReceiveSequence < sequence {
-					sessionEntry.ReceiveSequence = sequence
-				}
-
-				sessionEntry.ReceivedPackets[sequence%SequenceBufferSize] = sequence
-
-				// validate payload (temporary)
-
-				payload := packetData[index:]
-
-				core.Debug("received packet %d from %s with %d byte payload", sequence, core.IdString(sessionId[:]), len(payload))
-
-				if len(payload) != core.MinPayloadBytes {
-					panic(fmt.Sprintf("payload size mismatch. expected %d, got %d\n", core.MinPayloadBytes, len(payload)))
-				}
-
-				for i := 0; i < core.MinPayloadBytes; i++ {
-					if payload[i] != byte(i) {
-						panic(fmt.Sprintf("payload data mismatch at index %d. expected %d, got %d\n", i, byte(i), payload[i]))
-					}
-				}
-
-				// process packet acks
-
-				var ackBuffer [SequenceBufferSize]uint64
-
-				acks := core.ProcessAcks(ack, ack_bits[:], sessionEntry.AckedPackets[:], ackBuffer[:])
-
-				for i := range acks {
-					core.Debug("ack packet %d", acks[i])
-					sessionEntry.AckedPackets[acks[i]%SequenceBufferSize] = acks[i]
-					payloadAck := sessionEntry.SequenceToPayloadId[acks[i]%SequenceBufferSize]
-					if payloadAck != ^uint64(0) {
-						core.Debug("ack payload %d for session %s", payloadAck, core.IdString(sessionId[:]))
-					}
-				}
-
-				// get response payload (temporary)
-
-				responsePayload := make([]byte, core.MinPayloadBytes)
-				for i := 0; i < core.MinPayloadBytes; i++ {
-					responsePayload[i] = byte(i)
-				}
-
-				// do we have enough bandwidth available to send this packet?
-
-				if sessionEntry.SendBandwidthBitsResetTime.Before(time.Now()) {
-					sendBandwidthMbps := float64(sessionEntry.SendBandwidthBitsAccumulator) / 1000000.0
-					sessionEntry.SendBandwidthBitsResetTime = time.Now().Add(time.Second)
-					sessionEntry.SendBandwidthBitsAccumulator = 0
-					core.Debug("session %s is %.2f mbps", core.IdString(sessionId[:]), sendBandwidthMbps)
-				}
-
-				gatewayPacketBytes := core.PacketBytesFromPayload(len(responsePayload))
-
-				wireBits := uint64(core.WirePacketBits(gatewayPacketBytes))
-
-				canSendPacket := true
-
-				if sessionEntry.SendBandwidthBitsAccumulator + wireBits <= sessionEntry.SendBandwidthBitsPerSecondMax {
-					sessionEntry.SendBandwidthBitsAccumulator += wireBits
-				} else {
-					canSendPacket = false
-				}
-
-				if !canSendPacket {
-					core.Info("choke")
-					continue
-				}
-
-				// build response payload packet
-
-				version = byte(0)
-				flags = byte(0)
-
-				send_sequence := sessionEntry.SendSequence
-				send_ack := sessionEntry.ReceiveSequence
-				var send_ack_bits [core.AckBitsBytes]byte
-
-				core.GetAckBits(sessionEntry.ReceiveSequence, sessionEntry.ReceivedPackets[:], send_ack_bits[:])
-
-				core.Debug("send packet sequence = %d", send_sequence)
-				core.Debug("send packet ack = %d", send_ack)
-				core.Debug("send packet ack_bits = [%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x]",
-					send_ack_bits[0],
-					send_ack_bits[1],
-					send_ack_bits[2],
-					send_ack_bits[3],
-					send_ack_bits[4],
-					send_ack_bits[5],
-					send_ack_bits[6],
-					send_ack_bits[7],
-					send_ack_bits[8],
-					send_ack_bits[9],
-					send_ack_bits[10],
-					send_ack_bits[11],
-					send_ack_bits[12],
-					send_ack_bits[13],
-					send_ack_bits[14],
-					send_ack_bits[15],
-					send_ack_bits[16],
-					send_ack_bits[17],
-					send_ack_bits[18],
-					send_ack_bits[19],
-					send_ack_bits[20],
-					send_ack_bits[21],
-					send_ack_bits[22],
-					send_ack_bits[23],
-					send_ack_bits[24],
-					send_ack_bits[25],
-					send_ack_bits[26],
-					send_ack_bits[27],
-					send_ack_bits[28],
-					send_ack_bits[29],
-					send_ack_bits[30],
-					send_ack_bits[31])
-
-				// write response payload packet
-
-				responsePacketData := make([]byte, MaxPacketSize)
-
-				index = 0
-
-				core.WriteUint8(responsePacketData, &index, version)
-				core.WriteUint8(responsePacketData, &index, core.PayloadPacket)
-				core.WriteAddress(responsePacketData, &index, &clientAddress)
-				core.WriteBytes(responsePacketData, &index, sessionTokenData[:], core.EncryptedSessionTokenBytes)
-				core.WriteBytes(responsePacketData, &index, sessionTokenSequence[:], core.SequenceBytes)
-				core.WriteBytes(responsePacketData, &index, sessionId[:], core.SessionIdBytes)
-				core.WriteUint64(responsePacketData, &index, send_sequence)
-				core.WriteUint64(responsePacketData, &index, send_ack)
-				core.WriteBytes(responsePacketData, &index, send_ack_bits[:], len(send_ack_bits))
-				core.WriteBytes(responsePacketData, &index, packetGatewayId[:], core.GatewayIdBytes)
-				core.WriteBytes(responsePacketData, &index, serverId[:], core.ServerIdBytes)
-				core.WriteUint8(responsePacketData, &index, core.PayloadPacket)
-				core.WriteUint8(responsePacketData, &index, flags)
-				core.WriteBytes(responsePacketData, &index, responsePayload, len(responsePayload))
-
-				responsePacketBytes := index
-				responsePacketData = responsePacketData[:responsePacketBytes]
-
-				// send it to the client
-
-				if _, err := conn.WriteToUDP(responsePacketData, &gatewayInternalAddress); err != nil {
-					core.Error("failed to send response payload to gateway: %v", err)
-				}
-
-				core.Debug("send %d byte response to %s", responsePacketBytes, gatewayInternalAddress.String())
-
-				// update reliability
-
-				sessionEntry.SequenceToPayloadId[sessionEntry.SendPayloadId%SequenceBufferSize] = sessionEntry.SendPayloadId
-				sessionEntry.SendPayloadId++
-				sessionEntry.SendSequence++
-			}
-
-			wg.Done()
-
-		}(i)
+	if err := s.Start(); err != nil {
+		core.Error("%v", err)
+		return 1
 	}
 
 	termChan := make(chan os.Signal, 1)
 	signal.Notify(termChan, os.Interrupt, syscall.SIGTERM)
 	<-termChan
 
-	fmt.Println("\nshutting down")
+	core.Info("shutting down")
 
-	ctxCancelFunc()
+	shutdownStartTime := time.Now()
+	shutdownDeadline := shutdownStartTime.Add(serverConfig.ShutdownTimeout)
 
-	fmt.Println("shutdown completed")
+	completed := s.Shutdown()
 
-	return 0
-}
+	ctx, ctxCancelFunc := context.WithDeadline(context.Background(), shutdownDeadline)
+	defer ctxCancelFunc()
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	_, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	if err := srv.Shutdown(ctx); err != nil {
+		completed = false
 	}
-	defer r.Body.Close()
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(http.StatusText(http.StatusOK)))
-}
 
-func statusHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "hello world\n")
+	if !completed {
+		core.Warn("shutdown did not complete within %s", serverConfig.ShutdownTimeout)
+		return 1
+	}
+
+	core.Info("shutdown completed in %s", time.Since(shutdownStartTime).Round(time.Millisecond))
+
+	return 0
 }
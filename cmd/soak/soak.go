@@ -20,149 +20,641 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/envvar"
+	"github.com/networknext/udpx/modules/soak"
 )
 
+// soak runs auth, gateways, servers and clients as real processes for the length of a scenario, restarting
+// them as the scenario says, then checks the stats it collected against the scenario thresholds. It exits
+// non-zero if any are broken, so it can gate a nightly build.
+
+var settings = []envvar.Setting{
+	{Name: "SCENARIO", Type: envvar.Type_String, Required: true, Description: "scenario file to run"},
+	{Name: "DIST_DIR", Type: envvar.Type_String, Default: "./dist", Description: "directory with the auth, gateway, server and client binaries"},
+	{Name: "LOG_DIR", Type: envvar.Type_String, Description: "directory to write the log of each process to, or empty to discard them"},
+}
+
+// port layout. auth i hands out gateway i, and gateway i forwards to server i % servers. each gateway takes a
+// block of ports: public and http, internal, then the impairing proxy clients actually send to
+const ClientBasePort = 30000
+const UpstreamBasePort = 32000
+const GatewayBasePort = 40000
+const ServerBasePort = 50000
+const AuthBasePort = 60000
+const PortStride = 10
+
+const TickTime = time.Second
+const ProgressTime = 10 * time.Second
+const StartTimeout = 10 * time.Second
+const StopTimeout = 15 * time.Second
+
+// client exit codes, see cmd/client
 const (
-	clientBin       = "./dist/client"
-	gatewayBin      = "./dist/gateway"
-	serverBin       = "./dist/server"
-	authBin         = "./dist/auth"
-	connectTokenBin = "./dist/connect_token"
+	ExitCode_Stopped        = 0
+	ExitCode_SessionTimeout = 2
+	ExitCode_Disconnected   = 3
 )
 
-func client(port uint16) *exec.Cmd {
+func main() {
+	os.Exit(mainReturnWithCode())
+}
 
-	// get connect token
+// process is one run of a service or client. Its counters are scraped from /metrics every tick, and the last
+// ones seen are added to the totals when it exits, so counters from processes that have been restarted are kept.
+type process struct {
+	service  string
+	name     string
+	path     string
+	env      []string
+	httpPort int
+	cmd      *exec.Cmd
+	exited   chan struct{}
+	exitCode int
+	stopping bool
+	metrics  map[string]uint64
+}
 
-	connect_token_cmd := exec.Command(connectTokenBin)
-	if connect_token_cmd == nil {
-		panic("could not exec connect token")
+func (p *process) start(logDir string) error {
+	p.exited = make(chan struct{})
+	p.exitCode = 0
+	p.stopping = false
+	p.cmd = exec.Command(p.path)
+	p.cmd.Env = append(os.Environ(), p.env...)
+	var logFile *os.File
+	if logDir != "" {
+		var err error
+		logFile, err = os.OpenFile(filepath.Join(logDir, p.name+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			p.exitCode = -1
+			close(p.exited)
+			return fmt.Errorf("could not open log file: %v", err)
+		}
+		p.cmd.Stdout = logFile
+		p.cmd.Stderr = logFile
 	}
+	if err := p.cmd.Start(); err != nil {
+		if logFile != nil {
+			logFile.Close()
+		}
+		p.exitCode = -1
+		close(p.exited)
+		return fmt.Errorf("could not start %s: %v", p.name, err)
+	}
+	go func() {
+		if err := p.cmd.Wait(); err != nil {
+			p.exitCode = -1
+			if exitError, ok := err.(*exec.ExitError); ok {
+				p.exitCode = exitError.ExitCode()
+			}
+		}
+		if logFile != nil {
+			logFile.Close()
+		}
+		close(p.exited)
+	}()
+	return nil
+}
 
-	connect_token_cmd.Env = os.Environ()
-	connect_token_cmd.Env = append(connect_token_cmd.Env, "GATEWAY_ADDRESS=127.0.0.1:40000")
-	connect_token_cmd.Env = append(connect_token_cmd.Env, "GATEWAY_PUBLIC_KEY=vnIjsJWZzgq+nS9t3KU7ch5BFhgDkm2U2bm7/2W6eRs=")
-	connect_token_cmd.Env = append(connect_token_cmd.Env, "GATEWAY_PRIVATE_KEY=qmnxBZs2UElVT4SXCdDuX4td+qtPkuXLL5VdOE0vvcA=")
-	connect_token_cmd.Env = append(connect_token_cmd.Env, "AUTH_PRIVATE_KEY=VmmdIRwxUb7vmzupzHbBHqJF3WPpLrp0Y0EzepAzny0=")
-
-	connectToken, err := connect_token_cmd.Output()
-	if err != nil {
-		panic("could not get connect token output")
+func (p *process) hasExited() bool {
+	select {
+	case <-p.exited:
+		return true
+	default:
+		return false
 	}
+}
 
-	// run client
+// signalStop asks the process to shut down. waitStop waits for it, killing it if it takes too long, and returns
+// false if it had to be killed or exited with an error.
+func (p *process) signalStop() {
+	p.stopping = true
+	p.cmd.Process.Signal(syscall.SIGTERM)
+}
 
-	client_cmd := exec.Command(clientBin)
-	if client_cmd == nil {
-		panic("could not exec client!\n")
-		return nil
+func (p *process) waitStop(timeout time.Duration) bool {
+	select {
+	case <-p.exited:
+		return p.exitCode == 0
+	case <-time.After(timeout):
+		core.Warn("%s did not stop within %s. killing it", p.name, timeout)
+		p.cmd.Process.Kill()
+		<-p.exited
+		return false
 	}
+}
 
-	client_cmd.Env = os.Environ()
-	client_cmd.Env = append(client_cmd.Env, fmt.Sprintf("CONNECT_TOKEN=%s", connectToken))
-	client_cmd.Env = append(client_cmd.Env, fmt.Sprintf("UDP_PORT=%d", port))
-	client_cmd.Env = append(client_cmd.Env, fmt.Sprintf("CLIENT_ADDRESS=127.0.0.1:%d", port))
+type runner struct {
+	scenario   *soak.Scenario
+	distDir    string
+	logDir     string
+	keyEnv     []string
+	auths      []*process
+	gateways   []*process
+	servers    []*process
+	clients    []*process
+	proxies    []*soak.Proxy
+	stats      soak.Stats
+	totals     map[string]map[string]uint64
+	random     *rand.Rand
+	httpClient *http.Client
+}
 
-	// client_cmd.Stdout = os.Stdout
-	// client_cmd.Stderr = os.Stderr
+func gatewayPort(index int) int {
+	return GatewayBasePort + index*PortStride
+}
 
-	client_cmd.Start()
+func proxyAddress(index int) string {
+	return fmt.Sprintf("127.0.0.1:%d", gatewayPort(index)+2)
+}
 
-	return client_cmd
+func (r *runner) newProcess(service string, index int, httpPort int, env []string) *process {
+	return &process{
+		service:  service,
+		name:     fmt.Sprintf("%s-%d", service, index),
+		path:     filepath.Join(r.distDir, service),
+		env:      append(env, fmt.Sprintf("HTTP_PORT=%d", httpPort)),
+		httpPort: httpPort,
+	}
 }
 
-func gateway() *exec.Cmd {
+func (r *runner) newAuth(index int) *process {
+	env := []string{
+		"GATEWAY_ADDRESS=" + proxyAddress(index),
+	}
+	return r.newProcess(soak.Service_Auth, index, AuthBasePort+index, append(env, r.keyEnv...))
+}
 
-	cmd := exec.Command(gatewayBin)
-	if cmd == nil {
-		panic("could not create gateway!\n")
-		return nil
+func (r *runner) newGateway(index int) *process {
+	port := gatewayPort(index)
+	env := []string{
+		fmt.Sprintf("UDP_PORT=%d", port),
+		"GATEWAY_ADDRESS=" + proxyAddress(index),
+		fmt.Sprintf("GATEWAY_INTERNAL_ADDRESS=127.0.0.1:%d", port+1),
+		fmt.Sprintf("SERVER_ADDRESS=127.0.0.1:%d", ServerBasePort+(index%r.scenario.Servers)*PortStride),
+		fmt.Sprintf("AUTH_URL=http://127.0.0.1:%d", AuthBasePort+index),
 	}
+	return r.newProcess(soak.Service_Gateway, index, port, append(env, r.keyEnv...))
+}
 
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, "HTTP_PORT=40000")
-	cmd.Env = append(cmd.Env, "UDP_PORT=40000")
-	cmd.Env = append(cmd.Env, "GATEWAY_ADDRESS=127.0.0.1:40000")
-	cmd.Env = append(cmd.Env, "GATEWAY_INTERNAL_ADDRESS=127.0.0.1:40001")
-	cmd.Env = append(cmd.Env, "GATEWAY_PRIVATE_KEY=qmnxBZs2UElVT4SXCdDuX4td+qtPkuXLL5VdOE0vvcA=")
-	cmd.Env = append(cmd.Env, "AUTH_PUBLIC_KEY=i9XuIDN5ePgWiRGZZoxNKjQv3ZC9JAfMjXGTIr4peQM=")
-	cmd.Env = append(cmd.Env, "SERVER_ADDRESS=127.0.0.1:50000")
+func (r *runner) newServer(index int) *process {
+	port := ServerBasePort + index*PortStride
+	env := []string{
+		fmt.Sprintf("UDP_PORT=%d", port),
+		"VALIDATE_TEST_MESSAGES=true",
+	}
+	return r.newProcess(soak.Service_Server, index, port, env)
+}
 
-	// cmd.Stdout = os.Stdout
-	// cmd.Stderr = os.Stderr
+func (r *runner) newClient(index int) *process {
+	port := ClientBasePort + index
+	env := []string{
+		fmt.Sprintf("UDP_PORT=%d", port),
+		fmt.Sprintf("CLIENT_ADDRESS=127.0.0.1:%d", soak.UpstreamPort(port, ClientBasePort, UpstreamBasePort)),
+		fmt.Sprintf("AUTH_URL=http://127.0.0.1:%d", AuthBasePort+index%r.scenario.Gateways),
+	}
+	return r.newProcess("client", index, port, env)
+}
 
-	cmd.Start()
+func (r *runner) startService(p *process) error {
+	if err := p.start(r.logDir); err != nil {
+		return err
+	}
+	return r.waitHealthy(p)
+}
 
-	return cmd
+func (r *runner) startClient(p *process) error {
+	if err := p.start(r.logDir); err != nil {
+		return err
+	}
+	r.stats.ClientSessions++
+	return nil
 }
 
-func server() *exec.Cmd {
-	cmd := exec.Command(serverBin)
-	if cmd == nil {
-		panic("could not create server!\n")
-		return nil
+// waitHealthy waits for a service to answer its health check, so clients aren't started before there is
+// anything to connect to
+func (r *runner) waitHealthy(p *process) error {
+	url := fmt.Sprintf("http://127.0.0.1:%d/health", p.httpPort)
+	deadline := time.Now().Add(StartTimeout)
+	for time.Now().Before(deadline) {
+		if p.hasExited() {
+			return fmt.Errorf("%s exited with code %d while starting", p.name, p.exitCode)
+		}
+		response, err := r.httpClient.Get(url)
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
 	}
-	cmd.Env = append(cmd.Env, "HTTP_PORT=50000")
-	cmd.Env = append(cmd.Env, "UDP_PORT=50000")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Start()
-	return cmd
+	return fmt.Errorf("%s is not healthy after %s", p.name, StartTimeout)
 }
 
-func auth() *exec.Cmd {
+// scrape reads /metrics from each running process. a process that doesn't answer keeps its last metrics
+func (r *runner) scrape(processes []*process) {
+	var wg sync.WaitGroup
+	for _, p := range processes {
+		if p.hasExited() {
+			continue
+		}
+		wg.Add(1)
+		go func(p *process) {
+			defer wg.Done()
+			response, err := r.httpClient.Get(fmt.Sprintf("http://127.0.0.1:%d/metrics", p.httpPort))
+			if err != nil {
+				return
+			}
+			defer response.Body.Close()
+			metrics := make(map[string]uint64)
+			if err := json.NewDecoder(response.Body).Decode(&metrics); err != nil {
+				core.Debug("could not decode metrics from %s: %v", p.name, err)
+				return
+			}
+			p.metrics = metrics
+		}(p)
+	}
+	wg.Wait()
+}
+
+// retire adds the last metrics of a process that has exited to the totals for its service
+func (r *runner) retire(p *process) {
+	totals := r.totals[p.service]
+	if totals == nil {
+		totals = make(map[string]uint64)
+		r.totals[p.service] = totals
+	}
+	for name, value := range p.metrics {
+		totals[name] += value
+	}
+	p.metrics = nil
+}
 
-	cmd := exec.Command(authBin)
+// restartService stops a service the way a deploy would, and starts it again on the same ports
+func (r *runner) restartService(p *process) error {
+	core.Info("restarting %s", p.name)
+	r.scrape([]*process{p})
+	p.signalStop()
+	if !p.waitStop(StopTimeout) {
+		core.Error("%s did not shut down cleanly (exit code %d)", p.name, p.exitCode)
+		r.stats.ShutdownFailures++
+	}
+	r.retire(p)
+	return r.startService(p)
+}
 
-	if cmd == nil {
-		panic("could not create auth!\n")
+// restartClient replaces a client that has exited, or has been churned, with a new session on the same port
+func (r *runner) restartClient(index int) error {
+	r.retire(r.clients[index])
+	r.clients[index] = r.newClient(index)
+	return r.startClient(r.clients[index])
+}
+
+// checkExits restarts anything that exited without being asked to, and counts why it exited
+func (r *runner) checkExits() error {
+
+	services := append(append(append([]*process{}, r.auths...), r.servers...), r.gateways...)
+
+	for _, p := range services {
+		if p.stopping || !p.hasExited() {
+			continue
+		}
+		core.Error("%s crashed with exit code %d", p.name, p.exitCode)
+		r.stats.Crashes++
+		r.retire(p)
+		if err := r.startService(p); err != nil {
+			return err
+		}
+	}
+
+	for i, p := range r.clients {
+		if p.stopping || !p.hasExited() {
+			continue
+		}
+		switch p.exitCode {
+		case ExitCode_Stopped:
+		case ExitCode_Disconnected:
+			r.stats.Reconnects++
+		case ExitCode_SessionTimeout:
+			core.Warn("%s session timed out", p.name)
+			r.stats.Disconnects++
+		default:
+			core.Warn("%s exited with code %d", p.name, p.exitCode)
+			r.stats.ClientErrors++
+		}
+		if err := r.restartClient(i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *runner) churn() error {
+	index := r.random.Intn(len(r.clients))
+	p := r.clients[index]
+	if p.hasExited() {
 		return nil
 	}
+	r.scrape([]*process{p})
+	p.signalStop()
+	p.waitStop(StopTimeout)
+	return r.restartClient(index)
+}
 
-	cmd.Env = append(cmd.Env, "HTTP_PORT=60000")
-	cmd.Env = append(cmd.Env, "GATEWAY_ADDRESS=127.0.0.1:40000")
-	cmd.Env = append(cmd.Env, "GATEWAY_PUBLIC_KEY=vnIjsJWZzgq+nS9t3KU7ch5BFhgDkm2U2bm7/2W6eRs=")
-	cmd.Env = append(cmd.Env, "GATEWAY_PRIVATE_KEY=qmnxBZs2UElVT4SXCdDuX4td+qtPkuXLL5VdOE0vvcA=")
-	cmd.Env = append(cmd.Env, "AUTH_PUBLIC_KEY=i9XuIDN5ePgWiRGZZoxNKjQv3ZC9JAfMjXGTIr4peQM=")
-	cmd.Env = append(cmd.Env, "AUTH_PRIVATE_KEY=VmmdIRwxUb7vmzupzHbBHqJF3WPpLrp0Y0EzepAzny0=")
+func (r *runner) restart(restart *soak.Restart) error {
+	switch restart.Service {
+	case soak.Service_Auth:
+		return r.restartService(r.auths[restart.Index])
+	case soak.Service_Gateway:
+		return r.restartService(r.gateways[restart.Index])
+	default:
+		return r.restartService(r.servers[restart.Index])
+	}
+}
 
-	// cmd.Stdout = os.Stdout
-	// cmd.Stderr = os.Stderr
+// stopAll signals every process first and then waits, so stopping a thousand clients doesn't take a thousand
+// times as long as stopping one
+func (r *runner) stopAll(processes []*process, countFailures bool) {
+	for _, p := range processes {
+		if !p.hasExited() {
+			p.signalStop()
+		}
+	}
+	for _, p := range processes {
+		if !p.waitStop(StopTimeout) && countFailures && p.stopping {
+			core.Error("%s did not shut down cleanly (exit code %d)", p.name, p.exitCode)
+			r.stats.ShutdownFailures++
+		}
+		r.retire(p)
+	}
+}
 
-	cmd.Start()
+func (r *runner) collectStats() {
+	clientTotals := r.totals["client"]
+	serverTotals := r.totals[soak.Service_Server]
+	gatewayTotals := r.totals[soak.Service_Gateway]
+	r.stats.PayloadsSent = clientTotals["PayloadsSent"]
+	r.stats.PayloadsAcked = clientTotals["PayloadsAcked"]
+	r.stats.PayloadMismatches = clientTotals["PayloadMismatches"] + serverTotals["PayloadMismatches"]
+	r.stats.SessionTokenUpdates = gatewayTotals["SessionTokenUpdates"]
+	r.stats.SessionTokenUpdateFailures = gatewayTotals["SessionTokenUpdateFailures"]
+}
 
-	return cmd
+func (r *runner) runningClients() int {
+	running := 0
+	for _, p := range r.clients {
+		if !p.hasExited() {
+			running++
+		}
+	}
+	return running
 }
 
-func soak() {
+func (r *runner) setup() error {
 
-	const NumClients = 10
+	// keys are generated for every run, so nothing secret is checked in
 
-	auth_cmd := auth()
-	server_cmd := server()
-	gateway_cmd := gateway()
-	client_cmd := make([]*exec.Cmd, NumClients)
-	for i := 0; i < NumClients; i++ {
-		client_cmd[i] = client(uint16(30000 + i))
+	gatewayPublicKey, gatewayPrivateKey := core.Keygen_Box()
+	authPublicKey, authPrivateKey := core.Keygen_Box()
+
+	r.keyEnv = []string{
+		"GATEWAY_PUBLIC_KEY=" + base64.StdEncoding.EncodeToString(gatewayPublicKey),
+		"GATEWAY_PRIVATE_KEY=" + base64.StdEncoding.EncodeToString(gatewayPrivateKey),
+		"AUTH_PUBLIC_KEY=" + base64.StdEncoding.EncodeToString(authPublicKey),
+		"AUTH_PRIVATE_KEY=" + base64.StdEncoding.EncodeToString(authPrivateKey),
 	}
 
-	server_cmd.Wait()
+	scenario := r.scenario
 
-	auth_cmd.Process.Signal(os.Interrupt)
-	auth_cmd.Wait()
+	for i := 0; i < scenario.Servers; i++ {
+		r.servers = append(r.servers, r.newServer(i))
+		if err := r.startService(r.servers[i]); err != nil {
+			return err
+		}
+	}
 
-	gateway_cmd.Process.Signal(os.Interrupt)
-	gateway_cmd.Wait()
+	for i := 0; i < scenario.Gateways; i++ {
+
+		r.auths = append(r.auths, r.newAuth(i))
+		if err := r.startService(r.auths[i]); err != nil {
+			return err
+		}
+
+		r.gateways = append(r.gateways, r.newGateway(i))
+		if err := r.startService(r.gateways[i]); err != nil {
+			return err
+		}
+
+		proxyAddress, _ := net.ResolveUDPAddr("udp", proxyAddress(i))
+		gatewayAddress := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: gatewayPort(i)}
+		proxy, err := soak.NewProxy(proxyAddress, gatewayAddress, ClientBasePort, UpstreamBasePort, scenario.Impairment.Conditions(), r.random.Int63())
+		if err != nil {
+			return err
+		}
+		r.proxies = append(r.proxies, proxy)
+	}
 
-	for i := 0; i < NumClients; i++ {
-		client_cmd[i].Process.Signal(os.Interrupt)
-		client_cmd[i].Wait()
+	for i := 0; i < scenario.Clients; i++ {
+		r.clients = append(r.clients, r.newClient(i))
+		if err := r.startClient(r.clients[i]); err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
 
-func main() {
-	soak()
+func (r *runner) shutdown() {
+	core.Info("stopping everything")
+	r.stopAll(r.clients, false)
+	r.stopAll(r.gateways, true)
+	r.stopAll(r.servers, true)
+	r.stopAll(r.auths, true)
+	for _, proxy := range r.proxies {
+		proxy.Close()
+	}
+}
+
+func (r *runner) run(termChan chan os.Signal) (bool, error) {
+
+	scenario := r.scenario
+
+	restarts := append([]soak.Restart{}, scenario.Restarts...)
+	sort.SliceStable(restarts, func(i, j int) bool { return restarts[i].At < restarts[j].At })
+
+	startTime := time.Now()
+	nextProgressTime := startTime.Add(ProgressTime)
+	churnDebt := 0.0
+
+	ticker := time.NewTicker(TickTime)
+	defer ticker.Stop()
+
+	for {
+
+		select {
+		case <-termChan:
+			return false, nil
+		case <-ticker.C:
+		}
+
+		elapsed := time.Since(startTime)
+
+		r.scrape(r.gateways)
+		r.scrape(r.servers)
+		r.scrape(r.clients)
+
+		if err := r.checkExits(); err != nil {
+			return false, err
+		}
+
+		if elapsed >= scenario.Duration {
+			return true, nil
+		}
+
+		// churn
+
+		churnDebt += scenario.Churn * TickTime.Minutes()
+		for churnDebt >= 1 {
+			churnDebt--
+			if err := r.churn(); err != nil {
+				return false, err
+			}
+		}
+
+		// scheduled restarts
+
+		for len(restarts) > 0 && restarts[0].At <= elapsed {
+			if err := r.restart(&restarts[0]); err != nil {
+				return false, err
+			}
+			restarts = restarts[1:]
+		}
+
+		if time.Now().After(nextProgressTime) {
+			nextProgressTime = nextProgressTime.Add(ProgressTime)
+			core.Info("%s/%s: %d clients running, %d sessions, %d reconnects, %d disconnects, %d client errors, %d crashes",
+				elapsed.Round(time.Second), scenario.Duration, r.runningClients(), r.stats.ClientSessions, r.stats.Reconnects, r.stats.Disconnects, r.stats.ClientErrors, r.stats.Crashes)
+		}
+	}
+}
+
+func (r *runner) report() {
+	stats := &r.stats
+	fmt.Printf("\nscenario %s: %d clients, %d gateways, %d servers for %s\n\n", r.scenario.Name, r.scenario.Clients, r.scenario.Gateways, r.scenario.Servers, r.scenario.Duration)
+	fmt.Printf("    client sessions:               %d\n", stats.ClientSessions)
+	fmt.Printf("    reconnects:                    %d\n", stats.Reconnects)
+	fmt.Printf("    disconnects:                   %d (%.4f)\n", stats.Disconnects, stats.DisconnectRate())
+	fmt.Printf("    client errors:                 %d\n", stats.ClientErrors)
+	fmt.Printf("    crashes:                       %d\n", stats.Crashes)
+	fmt.Printf("    shutdown failures:             %d\n", stats.ShutdownFailures)
+	fmt.Printf("    payloads sent:                 %d\n", stats.PayloadsSent)
+	fmt.Printf("    payloads acked:                %d (%.4f)\n", stats.PayloadsAcked, stats.PayloadAckRate())
+	fmt.Printf("    payload mismatches:            %d\n", stats.PayloadMismatches)
+	fmt.Printf("    session token updates:         %d\n", stats.SessionTokenUpdates)
+	fmt.Printf("    session token update failures: %d\n\n", stats.SessionTokenUpdateFailures)
+}
+
+func mainReturnWithCode() int {
+
+	core.SetLogService("soak")
+
+	config, done, err := envvar.Load(settings, os.Args[1:], os.Stdout)
+	if err != nil {
+		core.Error("invalid config: %v", err)
+		return 1
+	}
+
+	if done {
+		return 0
+	}
+
+	scenario, err := soak.LoadScenario(config.String("SCENARIO"))
+	if err != nil {
+		core.Error("%v", err)
+		return 1
+	}
+
+	// an absolute path, so exec doesn't look the binaries up in PATH
+
+	distDir, err := filepath.Abs(config.String("DIST_DIR"))
+	if err != nil {
+		core.Error("invalid dist dir: %v", err)
+		return 1
+	}
+
+	r := &runner{
+		scenario:   scenario,
+		distDir:    distDir,
+		logDir:     config.String("LOG_DIR"),
+		totals:     make(map[string]map[string]uint64),
+		random:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		httpClient: &http.Client{Timeout: time.Second},
+	}
+
+	if r.logDir != "" {
+		if err := os.MkdirAll(r.logDir, 0755); err != nil {
+			core.Error("could not create log dir: %v", err)
+			return 1
+		}
+	}
+
+	core.Info("running scenario %s", scenario.Name)
+
+	termChan := make(chan os.Signal, 1)
+	signal.Notify(termChan, os.Interrupt, syscall.SIGTERM)
+
+	completed := false
+	err = r.setup()
+	if err == nil {
+		completed, err = r.run(termChan)
+	}
+
+	if err != nil {
+		core.Error("%v", err)
+	}
+
+	r.scrape(r.gateways)
+	r.scrape(r.servers)
+	r.scrape(r.clients)
+	r.shutdown()
+	r.collectStats()
+	r.report()
+
+	if err != nil {
+		return 1
+	}
+
+	if !completed {
+		core.Error("interrupted before the scenario completed")
+		return 1
+	}
+
+	failures := scenario.Check(&r.stats)
+	for _, failure := range failures {
+		core.Error("failed: %s", failure)
+	}
+	if len(failures) > 0 {
+		return 1
+	}
+
+	core.Info("passed")
+
+	return 0
 }
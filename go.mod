@@ -4,8 +4,10 @@ go 1.13
 
 require (
 	github.com/gorilla/mux v1.7.3
-	github.com/pion/webrtc/v3 v3.1.21 // indirect
+	github.com/pion/webrtc/v3 v3.1.21
 	github.com/stretchr/testify v1.7.0
-	golang.org/x/crypto v0.0.0-20220112180741-5e0467b6c7ce // indirect
-	golang.org/x/sys v0.0.0-20220114195835-da31bd327af9 // indirect
+	golang.org/x/crypto v0.10.0
+	golang.org/x/net v0.11.0
+	golang.org/x/sys v0.9.0
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
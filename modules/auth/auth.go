@@ -0,0 +1,184 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/networknext/udpx/modules/core"
+
+	"github.com/gorilla/mux"
+)
+
+// ReloadableConfig holds the settings that are reloaded on SIGHUP. The keys from before the last reload
+// are kept in Previous, so session tokens issued before a key rotation can still be refreshed.
+type ReloadableConfig struct {
+	GatewayAddress    *net.UDPAddr
+	GatewayPublicKey  []byte
+	GatewayPrivateKey []byte
+	AuthPublicKey     []byte
+	AuthPrivateKey    []byte
+	Previous          *ReloadableConfig
+}
+
+// Auth issues connect tokens to clients, and refreshes session tokens for gateways.
+type Auth struct {
+	reloadableConfig atomic.Value
+	clock            core.Clock
+	logger           *core.Logger
+}
+
+func New(reloadable *ReloadableConfig, clock core.Clock) *Auth {
+	auth := &Auth{clock: clock, logger: core.Log}
+	auth.reloadableConfig.Store(reloadable)
+	return auth
+}
+
+// Reload swaps in new keys and a new gateway address. The previous keys are kept for refreshing session tokens.
+func (auth *Auth) Reload(reloadable *ReloadableConfig) {
+	previous := auth.reloadableConfig.Load().(*ReloadableConfig)
+	reloadable.Previous = &ReloadableConfig{GatewayPrivateKey: previous.GatewayPrivateKey, AuthPublicKey: previous.AuthPublicKey}
+	auth.reloadableConfig.Store(reloadable)
+}
+
+// Router serves the auth endpoints.
+func (auth *Auth) Router() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/health", auth.HealthHandler).Methods("GET")
+	router.HandleFunc("/status", auth.StatusHandler).Methods("GET")
+	router.HandleFunc("/connect_token", auth.ConnectTokenHandler).Methods("POST")
+	router.HandleFunc("/session_token", auth.SessionTokenHandler).Methods("POST")
+	return router
+}
+
+func (auth *Auth) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+func (auth *Auth) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "hello world\n")
+}
+
+// ConnectTokenHandler takes the client public key as the request body. The client generates its own keypair,
+// so auth never sees the client private key.
+func (auth *Auth) ConnectTokenHandler(w http.ResponseWriter, r *http.Request) {
+
+	requestData, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, core.PublicKeyBytes_Box))
+	if err != nil {
+		auth.logger.Debug("could not read request data: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if len(requestData) != core.PublicKeyBytes_Box {
+		auth.logger.Debug("bad client public key length (%d)", len(requestData))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var zeroKey [core.PublicKeyBytes_Box]byte
+	if core.IdEqual(requestData, zeroKey[:]) {
+		auth.logger.Debug("client public key is zero")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// todo: potentially may want to read in user id from POST binary request data
+	var userId [core.UserIdBytes]byte
+	envelopeUpKbps := uint32(2500)
+	envelopeDownKbps := uint32(10000)
+	packetsPerSecond := uint8(100)
+	reloadable := auth.reloadableConfig.Load().(*ReloadableConfig)
+	connectToken := core.GenerateConnectToken(requestData, userId[:], envelopeUpKbps, envelopeDownKbps, packetsPerSecond, reloadable.GatewayAddress, reloadable.GatewayPublicKey, reloadable.AuthPrivateKey, reloadable.GatewayPublicKey, auth.clock.Now())
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	w.Write(connectToken)
+}
+
+func (auth *Auth) SessionTokenHandler(w http.ResponseWriter, r *http.Request) {
+
+	requestData, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		auth.logger.Debug("could not read request data: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(requestData) != core.EncryptedSessionTokenBytes {
+		auth.logger.Debug("bad request length (%d)", len(requestData))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reloadable := auth.reloadableConfig.Load().(*ReloadableConfig)
+
+	index := 0
+	var sessionToken core.SessionToken
+	result := core.ReadEncryptedSessionToken(requestData, &index, &sessionToken, reloadable.AuthPublicKey, reloadable.GatewayPrivateKey)
+	if !result && reloadable.Previous != nil {
+		// the token may have been issued before the keys were reloaded. a failed decrypt leaves the data untouched
+		index = 0
+		result = core.ReadEncryptedSessionToken(requestData, &index, &sessionToken, reloadable.Previous.AuthPublicKey, reloadable.Previous.GatewayPrivateKey)
+	}
+	if !result {
+		auth.logger.Debug("invalid session token")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	logger := auth.logger.WithSession(sessionToken.SessionId[:])
+
+	currentTimestamp := uint64(auth.clock.Now().Unix())
+
+	if sessionToken.ExpireTimestamp > currentTimestamp+core.SessionTokenExtensionSeconds {
+		logger.Debug("session token is not due to be refreshed")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if sessionToken.ExpireTimestamp < currentTimestamp {
+		logger.Debug("session token has expired")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	sessionToken.ExpireTimestamp += core.SessionTokenExtensionSeconds
+
+	index = 0
+	responseData := [core.EncryptedSessionTokenBytes]byte{}
+	core.WriteEncryptedSessionToken(responseData[:], &index, &sessionToken, reloadable.AuthPrivateKey, reloadable.GatewayPublicKey)
+
+	logger.Info("updated session token")
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData[:])
+}
@@ -0,0 +1,942 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/testmessage"
+)
+
+const MaxPacketSize = 1500
+const SequenceBufferSize = 1024
+const QueueSize = 1024
+const ConnectTokenRetries = 10
+
+// TestMessagesPerFrame is how many test messages the client packs into each payload
+const TestMessagesPerFrame = 8
+
+// why the client is done
+const (
+	DoneReason_None = iota
+	DoneReason_Stopped
+	DoneReason_SessionTimeout
+	DoneReason_Disconnected
+)
+
+type Config struct {
+	BindAddress   string
+	ClientAddress *net.UDPAddr
+	AuthURL       string
+	ReadBuffer    int
+	WriteBuffer   int
+	HTTPClient    *http.Client
+	Logger        *core.Logger
+	Clock         core.Clock
+	// Idle clients send no messages, only keepalives, like a player sitting in a menu
+	Idle bool
+}
+
+type Counters struct {
+	PayloadsSent        uint64
+	PayloadsReceived    uint64
+	PayloadsAcked       uint64
+	PayloadMismatches   uint64
+	MessagesSent        uint64
+	MessagesReceived    uint64
+	SessionTokenUpdates uint64
+	KeepalivesSent      uint64
+	KeepalivesReceived  uint64
+}
+
+// Client gets a connect token from auth, then sends payload packets to a server through the gateway in the
+// connect token, at the rate the connect token allows. It runs until it is stopped, its session token expires,
+// or the gateway tells it to disconnect.
+type Client struct {
+	counters     Counters
+	connected    uint32
+	doneReason   int32
+	config       Config
+	transport    core.Transport
+	logger       *core.Logger
+	clock        core.Clock
+	httpClient   *http.Client
+	sendErrorLog *core.LogLimiter
+	socket       core.Socket
+	done         chan struct{}
+	doneOnce     sync.Once
+	wg           sync.WaitGroup
+}
+
+func New(config *Config, transport core.Transport) *Client {
+	client := &Client{config: *config, transport: transport}
+	client.logger = config.Logger
+	if client.logger == nil {
+		client.logger = core.Log
+	}
+	client.clock = config.Clock
+	if client.clock == nil {
+		client.clock = core.SystemClock
+	}
+	client.httpClient = config.HTTPClient
+	if client.httpClient == nil {
+		client.httpClient = &http.Client{Timeout: time.Second}
+	}
+	// write errors repeat for every packet until the socket recovers, so they are logged at most once per second
+	client.sendErrorLog = core.NewLogLimiter(time.Second)
+	client.done = make(chan struct{})
+	return client
+}
+
+// Connected is true once payload packets are getting through to a server and back.
+func (client *Client) Connected() bool {
+	return atomic.LoadUint32(&client.connected) != 0
+}
+
+func (client *Client) Counters() Counters {
+	counters := Counters{}
+	counters.PayloadsSent = atomic.LoadUint64(&client.counters.PayloadsSent)
+	counters.PayloadsReceived = atomic.LoadUint64(&client.counters.PayloadsReceived)
+	counters.PayloadsAcked = atomic.LoadUint64(&client.counters.PayloadsAcked)
+	counters.PayloadMismatches = atomic.LoadUint64(&client.counters.PayloadMismatches)
+	counters.MessagesSent = atomic.LoadUint64(&client.counters.MessagesSent)
+	counters.MessagesReceived = atomic.LoadUint64(&client.counters.MessagesReceived)
+	counters.SessionTokenUpdates = atomic.LoadUint64(&client.counters.SessionTokenUpdates)
+	counters.KeepalivesSent = atomic.LoadUint64(&client.counters.KeepalivesSent)
+	counters.KeepalivesReceived = atomic.LoadUint64(&client.counters.KeepalivesReceived)
+	return counters
+}
+
+// MetricsHandler writes the counters as JSON, for tools like soak that scrape them.
+func (client *Client) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(client.Counters())
+}
+
+// Done is closed when the client disconnects, or is stopped.
+func (client *Client) Done() <-chan struct{} {
+	return client.done
+}
+
+// DoneReason is why the client is done, or DoneReason_None while it is still running.
+func (client *Client) DoneReason() int {
+	return int(atomic.LoadInt32(&client.doneReason))
+}
+
+func (client *Client) disconnect(reason int) {
+	client.doneOnce.Do(func() {
+		atomic.StoreInt32(&client.doneReason, int32(reason))
+		close(client.done)
+	})
+}
+
+// Stop disconnects the client, closes its socket and waits for its goroutines to finish.
+func (client *Client) Stop() {
+	client.disconnect(DoneReason_Stopped)
+	if client.socket != nil {
+		client.socket.Close()
+	}
+	client.wg.Wait()
+}
+
+// Start gets a connect token, binds the client socket and starts sending packets.
+func (client *Client) Start() error {
+
+	clock := client.clock
+
+	clientAddress := client.config.ClientAddress
+
+	// generate our own keypair. only the public key is sent to auth, and it becomes the session id
+
+	clientPublicKey, clientPrivateKey := core.Keygen_Box()
+
+	connectToken, err := client.requestConnectToken(clientPublicKey)
+	if err != nil {
+		return fmt.Errorf("could not get connect token: %v", err)
+	}
+
+	index := 0
+	var connectData core.ConnectData
+	if !core.ReadObject(connectToken, &index, &connectData) {
+		return fmt.Errorf("invalid connect data")
+	}
+
+	if !core.IdEqual(connectData.ClientPublicKey[:], clientPublicKey) {
+		return fmt.Errorf("connect token is for a different client public key")
+	}
+
+	envelopeUpKbps := connectData.EnvelopeUpKbps
+	packetsPerSecond := int(connectData.PacketsPerSecond)
+
+	var bandwidthMutex sync.RWMutex
+	sendBandwidthBitsAccumulator := uint64(0)
+	sendBandwidthBitsPerSecondMax := uint64(envelopeUpKbps * 1000)
+	sendBandwidthBitsResetTime := clock.Now().Add(time.Second)
+
+	var sessionTokenMutex sync.RWMutex
+	sessionTokenData := make([]byte, core.EncryptedSessionTokenBytes)
+	copy(sessionTokenData[:], connectToken[core.ConnectDataBytes:])
+	sessionTokenSequence := uint64(0)
+	sessionTokenExpireTime := clock.Now().Add(time.Second * core.ConnectTokenExpireSeconds)
+
+	gatewayAddress := &connectData.GatewayAddress
+	gatewayPublicKey := connectData.GatewayPublicKey[:]
+	sessionId := clientPublicKey
+
+	// the key shared with the gateway is computed once, instead of doing the key exchange for every packet
+
+	var sharedKey [core.SharedKeyBytes_Box]byte
+	core.SharedKey_Box(gatewayPublicKey, clientPrivateKey, sharedKey[:])
+
+	var gatewayIdMutex sync.RWMutex
+	var gatewayId [core.GatewayIdBytes]byte
+
+	var serverIdMutex sync.RWMutex
+	var serverId [core.ServerIdBytes]byte
+
+	logger := client.logger.WithSession(sessionId)
+
+	logger.Info("starting client on %s", client.config.BindAddress)
+
+	logger.Info("connecting to %s", gatewayAddress)
+
+	// setup. the challenge token is set by the receive goroutine and sent by the send goroutine, and so are acks,
+	// so they each have a mutex
+
+	connectedToServer := false
+
+	var challengeTokenMutex sync.Mutex
+	hasChallengeToken := false
+	challengeTokenData := [core.EncryptedChallengeTokenBytes]byte{}
+	challengeTokenSequence := uint64(0)
+	challengeTokenExpireTimestamp := uint64(0)
+	challengeTokenGatewayId := [core.GatewayIdBytes]byte{}
+
+	sendSequence := uint64(10000) + uint64(rand.Intn(10000))
+
+	var ackMutex sync.Mutex
+	receiveSequence := uint64(0)
+
+	var replayProtection core.ReplayProtection
+
+	packetReceiveQueue := make(chan []byte, QueueSize)
+
+	ackBuffer := make([]uint64, SequenceBufferSize)
+	ackedPackets := make([]uint64, SequenceBufferSize)
+	receivedPackets := make([]uint64, SequenceBufferSize)
+
+	payloadAckQueue := make(chan uint64, QueueSize)
+	payloadSendQueue := make(chan []byte, QueueSize)
+	payloadSendPool := core.NewPacketPool(QueueSize, core.MaxPayloadBytes)
+	payloadReceiveQueue := make(chan []byte, QueueSize)
+
+	sequenceToPayloadId := make([]uint64, SequenceBufferSize)
+	for i := range sequenceToPayloadId {
+		sequenceToPayloadId[i] = ^uint64(0)
+	}
+
+	// create client socket
+
+	socket, err := client.transport.Listen(client.config.BindAddress, core.SocketOptions{ReadBuffer: client.config.ReadBuffer, WriteBuffer: client.config.WriteBuffer})
+	if err != nil {
+		return fmt.Errorf("could not bind socket: %v", err)
+	}
+
+	client.socket = socket
+
+	sendConn := client.transport.NewPacketConn(socket, 1, MaxPacketSize)
+	receiveConn := client.transport.NewPacketConn(socket, core.DefaultBatchSize, MaxPacketSize)
+
+	client.wg.Add(4)
+
+	// send packets
+
+	go func() {
+
+		defer client.wg.Done()
+
+		payloadId := uint64(0)
+
+		// per-goroutine buffers, so sending a packet doesn't allocate
+
+		var nonce [core.NonceBytes_Box]byte
+		var payloadWriter core.PayloadWriter
+		var packetChallengeTokenData [core.EncryptedChallengeTokenBytes]byte
+		var packetChallengeTokenGatewayId [core.GatewayIdBytes]byte
+
+		for {
+			select {
+			case <-client.done:
+				return
+			case payload := <-payloadSendQueue:
+
+				// take the challenge token for this packet, and time it out if it's too old
+
+				challengeTokenMutex.Lock()
+				if hasChallengeToken && challengeTokenExpireTimestamp <= uint64(clock.Now().Unix()) {
+					logger.Debug("timed out challenge token")
+					hasChallengeToken = false
+				}
+				packetHasChallengeToken := hasChallengeToken
+				if packetHasChallengeToken {
+					packetChallengeTokenData = challengeTokenData
+					packetChallengeTokenGatewayId = challengeTokenGatewayId
+				}
+				challengeTokenMutex.Unlock()
+
+				// an empty payload is sent as a keepalive. the gateway drops keepalives for sessions it doesn't
+				// know yet, so while answering a challenge it goes as a padded payload instead
+
+				keepalive := len(payload) == 0
+				if keepalive && packetHasChallengeToken {
+					payloadWriter.Reset(payload[:cap(payload)])
+					payload = payloadWriter.Finish()
+					keepalive = false
+				}
+
+				packetType := core.PacketType_Payload
+				if keepalive {
+					packetType = core.PacketType_Keepalive
+				}
+
+				ack_bits := [core.AckBitsBytes]byte{}
+
+				ackMutex.Lock()
+				ack := receiveSequence
+				core.GetAckBits(ack, receivedPackets[:], ack_bits[:])
+				ackMutex.Unlock()
+
+				if logger.DebugEnabled() {
+					logger.Debug("send packet sequence = %d ack = %d ack_bits = %x", sendSequence, ack, ack_bits[:])
+				}
+
+				prefix := core.PacketPrefix{}
+				prefix.PacketType = packetType
+				sessionTokenMutex.RLock()
+				copy(prefix.SessionTokenData[:], sessionTokenData)
+				prefix.SessionTokenSequence = sessionTokenSequence
+				sessionTokenMutex.RUnlock()
+
+				header := core.PayloadHeader{}
+				copy(header.SessionId[:], sessionId)
+				header.Sequence = sendSequence
+				header.Ack = ack
+				header.AckBits = ack_bits
+				if packetHasChallengeToken {
+					header.GatewayId = packetChallengeTokenGatewayId
+					header.Flags = core.Flags_ChallengeToken
+				} else {
+					gatewayIdMutex.RLock()
+					header.GatewayId = gatewayId
+					gatewayIdMutex.RUnlock()
+				}
+				serverIdMutex.RLock()
+				header.ServerId = serverId
+				serverIdMutex.RUnlock()
+				header.PacketType = packetType
+
+				packetData := sendConn.WritePacket()
+
+				index := 0
+
+				core.WriteObject(packetData, &index, &prefix)
+				core.WriteObject(packetData, &index, &header)
+				if packetHasChallengeToken {
+					core.WriteBytes(packetData, &index, packetChallengeTokenData[:], core.EncryptedChallengeTokenBytes)
+				}
+				core.WriteBytes(packetData, &index, payload, len(payload))
+				payloadSendPool.Put(payload)
+				encryptFinish := index
+				index += core.PostfixBytes
+
+				nonce = [core.NonceBytes_Box]byte{}
+				nonceIndex := 0
+				core.WriteUint64(nonce[:], &nonceIndex, sendSequence)
+
+				core.Encrypt_SharedBox(sharedKey[:], nonce[:], packetData[core.PayloadPacketEncryptIndex:encryptFinish+core.HMACBytes_Box], encryptFinish-core.PayloadPacketEncryptIndex)
+
+				packetBytes := index
+				packetData = packetData[:packetBytes]
+
+				core.WritePacketFilter(packetData, clientAddress, gatewayAddress)
+
+				// do we have enough bandwidth available to send this packet?
+
+				wireBits := uint64(core.WirePacketBits(len(packetData)))
+
+				canSendPacket := true
+
+				bandwidthMutex.Lock()
+				if sendBandwidthBitsAccumulator+wireBits <= sendBandwidthBitsPerSecondMax {
+					sendBandwidthBitsAccumulator += wireBits
+				} else {
+					canSendPacket = false
+				}
+				bandwidthMutex.Unlock()
+
+				if !canSendPacket {
+					logger.Debug("choke")
+					continue
+				}
+
+				// send the packet
+
+				sendConn.CommitPacket(packetBytes, gatewayAddress)
+
+				if err := sendConn.Flush(); err != nil {
+					logger.ErrorLimited(client.sendErrorLog, "failed to write udp packet: %v", err)
+				}
+
+				if logger.DebugEnabled() {
+					logger.Debug("sent %d byte packet to %s", len(packetData), gatewayAddress)
+				}
+
+				ackMutex.Lock()
+				if keepalive {
+					sequenceToPayloadId[sendSequence%SequenceBufferSize] = ^uint64(0)
+				} else {
+					sequenceToPayloadId[sendSequence%SequenceBufferSize] = payloadId
+				}
+				ackMutex.Unlock()
+
+				if keepalive {
+					atomic.AddUint64(&client.counters.KeepalivesSent, 1)
+				} else {
+					atomic.AddUint64(&client.counters.PayloadsSent, 1)
+					payloadId++
+				}
+				sendSequence++
+			}
+		}
+	}()
+
+	// receive packets (stateless)
+
+	go func() {
+
+		defer client.wg.Done()
+
+		for {
+
+			numPackets, err := receiveConn.ReadBatch()
+			if err != nil {
+				logger.Debug("failed to read udp packets: %v", err)
+				return
+			}
+
+			for packetIndex := 0; packetIndex < numPackets; packetIndex++ {
+
+				packetData, from := receiveConn.Packet(packetIndex)
+
+				packetBytes := len(packetData)
+
+				if !core.AddressEqual(from, gatewayAddress) {
+					logger.Debug("packet is not from gateway")
+					continue
+				}
+
+				if packetBytes < core.PrefixBytes {
+					logger.Debug("packet is too small")
+					continue
+				}
+
+				if packetData[0] != core.PacketVersion {
+					logger.Debug("unknown packet version: %d", packetData[0])
+					continue
+				}
+
+				if packetData[1] != core.PacketType_Payload && packetData[1] != core.PacketType_Keepalive && packetData[1] != core.PacketType_Challenge && packetData[1] != core.PacketType_Disconnect {
+					logger.Debug("unknown packet type %d", packetData[1])
+					continue
+				}
+
+				// packet filter
+
+				if !core.BasicPacketFilter(packetData, packetBytes) {
+					logger.Debug("basic packet filter failed")
+					continue
+				}
+
+				var magic [8]byte
+
+				var fromAddressData [4]byte
+				var fromAddressPort uint16
+
+				var toAddressData [4]byte
+				var toAddressPort uint16
+
+				core.GetAddressData(from, fromAddressData[:], &fromAddressPort)
+				core.GetAddressData(clientAddress, toAddressData[:], &toAddressPort)
+
+				if !core.AdvancedPacketFilter(packetData, magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, packetBytes) {
+					logger.Debug("advanced packet filter failed")
+					continue
+				}
+
+				// the read buffer is reused by the next batch, so the packet is copied before it is queued
+
+				packetCopy := make([]byte, packetBytes)
+				copy(packetCopy, packetData)
+
+				select {
+				case packetReceiveQueue <- packetCopy:
+				case <-client.done:
+					return
+				}
+			}
+		}
+	}()
+
+	// receive packets (stateful)
+
+	go func() {
+
+		defer client.wg.Done()
+
+		var messageBuffer [core.MaxPayloadMessages][]byte
+
+		for {
+			select {
+			case <-client.done:
+				return
+			case packetData := <-packetReceiveQueue:
+
+				packetType := packetData[core.VersionBytes]
+
+				packetBytes := len(packetData)
+
+				switch packetType {
+
+				case core.PacketType_Payload, core.PacketType_Keepalive:
+
+					logger.Debug("received %d byte packet from gateway", len(packetData))
+
+					index := 0
+					var prefix core.PacketPrefix
+					var header core.PayloadHeader
+					if packetBytes < core.PrefixBytes+core.HeaderBytes+core.PostfixBytes || !core.ReadObject(packetData, &index, &prefix) || !core.ReadObject(packetData, &index, &header) {
+						logger.Debug("payload packet is too small")
+						continue
+					}
+
+					// session id must match client public key
+
+					if !core.IdEqual(header.SessionId[:], clientPublicKey) {
+						logger.Debug("session id mismatch")
+						continue
+					}
+
+					// decrypt packet
+
+					encryptedData := packetData[core.PayloadPacketEncryptIndex : packetBytes-core.PittleBytes]
+
+					var nonce [core.NonceBytes_Box]byte
+					nonceIndex := 0
+					core.WriteUint64(nonce[:], &nonceIndex, header.Sequence)
+					nonce[9] |= (1 << 0)
+					nonce[9] &= 1 ^ (1 << 1)
+
+					err := core.Decrypt_SharedBox(sharedKey[:], nonce[:], encryptedData, len(encryptedData))
+					if err != nil {
+						logger.Debug("could not decrypt payload packet")
+						continue
+					}
+
+					// read the decrypted header. the payload follows it
+
+					index = core.PrefixBytes
+					core.ReadObject(packetData, &index, &header)
+
+					payload := packetData[index : packetBytes-core.PostfixBytes]
+
+					// check encrypted packet type matches
+
+					if header.PacketType != packetType {
+						logger.Debug("packet type mismatch: %d", header.PacketType)
+						continue
+					}
+
+					keepalive := packetType == core.PacketType_Keepalive
+
+					if keepalive && len(payload) != 0 {
+						logger.Debug("keepalive packet has a payload")
+						continue
+					}
+
+					// drop packets that are too old, too far ahead, or have already been received
+
+					sequence := header.Sequence
+
+					switch replayProtection.Check(sequence) {
+					case core.ReplayProtection_TooOld:
+						logger.Debug("packet sequence is too old: %d", sequence)
+						continue
+					case core.ReplayProtection_TooNew:
+						logger.Debug("packet sequence is too far ahead: %d", sequence)
+						continue
+					case core.ReplayProtection_Duplicate:
+						logger.Debug("packet %d has already been received", sequence)
+						continue
+					}
+
+					replayProtection.Advance(sequence)
+
+					ackMutex.Lock()
+					if sequence > receiveSequence {
+						receiveSequence = sequence
+					}
+					receivedPackets[sequence%SequenceBufferSize] = sequence
+					ackMutex.Unlock()
+
+					// update session token if the gateway has a newer one
+
+					sessionTokenMutex.Lock()
+
+					if prefix.SessionTokenSequence > sessionTokenSequence {
+						logger.Info("updated session token %d", prefix.SessionTokenSequence)
+						copy(sessionTokenData[:], prefix.SessionTokenData[:])
+						sessionTokenSequence = prefix.SessionTokenSequence
+						sessionTokenExpireTime = clock.Now().Add(time.Second * core.ConnectTokenExpireSeconds)
+						atomic.AddUint64(&client.counters.SessionTokenUpdates, 1)
+					}
+
+					sessionTokenMutex.Unlock()
+
+					if keepalive {
+
+						atomic.AddUint64(&client.counters.KeepalivesReceived, 1)
+
+					} else {
+
+						// split the payload into its messages. they alias the packet copy, which isn't reused
+
+						logger.Debug("payload is %d bytes", len(payload))
+
+						messages, ok := core.ReadPayloadMessages(payload, messageBuffer[:])
+						if ok {
+							atomic.AddUint64(&client.counters.PayloadsReceived, 1)
+						} else {
+							atomic.AddUint64(&client.counters.PayloadMismatches, 1)
+							logger.Error("malformed payload (%d bytes)", len(payload))
+						}
+
+						for i := range messages {
+							select {
+							case payloadReceiveQueue <- messages[i]:
+							case <-client.done:
+								return
+							}
+						}
+					}
+
+					// update reliability
+
+					logger.Debug("recv packet sequence = %d ack = %d ack_bits = %x", header.Sequence, header.Ack, header.AckBits[:])
+
+					// process acks
+
+					acks := core.ProcessAcks(header.Ack, header.AckBits[:], ackedPackets[:], ackBuffer[:])
+
+					for i := range acks {
+						logger.Debug("ack packet %d", acks[i])
+						ackedPackets[acks[i]%SequenceBufferSize] = acks[i]
+						ackMutex.Lock()
+						payloadAck := sequenceToPayloadId[acks[i]%SequenceBufferSize]
+						ackMutex.Unlock()
+						if payloadAck != ^uint64(0) {
+							select {
+							case payloadAckQueue <- payloadAck:
+							case <-client.done:
+								return
+							}
+						}
+					}
+
+					// check if we have a new gateway
+
+					packetGatewayId := header.GatewayId[:]
+
+					gatewayIdMutex.Lock()
+					if !core.IdEqual(packetGatewayId, gatewayId[:]) {
+						logger.Info("connected to gateway %s", core.IdString(packetGatewayId))
+						copy(gatewayId[:], packetGatewayId[:])
+					}
+					gatewayIdMutex.Unlock()
+
+					// check if we have a new server
+
+					packetServerId := header.ServerId[:]
+
+					serverIdMutex.Lock()
+					newServer := !core.IdEqual(packetServerId, serverId[:])
+					if newServer {
+						logger.Info("connected to server %s", core.IdString(packetServerId))
+						copy(serverId[:], packetServerId[:])
+					}
+					serverIdMutex.Unlock()
+
+					// clear challenge token
+
+					challengeTokenMutex.Lock()
+					if hasChallengeToken {
+						logger.Debug("cleared challenge token")
+						hasChallengeToken = false
+					}
+					challengeTokenMutex.Unlock()
+
+					if !connectedToServer {
+						connectedToServer = true
+						atomic.StoreUint32(&client.connected, 1)
+					}
+
+				case core.PacketType_Challenge:
+
+					logger.Debug("received %d byte challenge packet from gateway", len(packetData))
+
+					var challengePacket core.ChallengePacket
+					if !challengePacket.Read(packetData, sharedKey[:]) {
+						logger.Debug("could not read challenge packet")
+						continue
+					}
+
+					packetChallengeSequence := challengePacket.Sequence
+
+					challengeTokenMutex.Lock()
+					if !hasChallengeToken || challengeTokenSequence < packetChallengeSequence {
+						if connectedToServer {
+							logger.Info("reconnecting...")
+							connectedToServer = false
+							atomic.StoreUint32(&client.connected, 0)
+						}
+						hasChallengeToken = true
+						challengeTokenData = challengePacket.ChallengeTokenData
+						challengeTokenSequence = packetChallengeSequence
+						challengeTokenExpireTimestamp = uint64(clock.Now().Unix()) + 2
+						challengeTokenGatewayId = challengePacket.GatewayId
+						logger.Debug("updated challenge token: %d", packetChallengeSequence)
+					}
+					challengeTokenMutex.Unlock()
+
+				case core.PacketType_Disconnect:
+
+					logger.Debug("received %d byte disconnect packet from gateway", len(packetData))
+
+					var disconnectPacket core.DisconnectPacket
+					if !disconnectPacket.Read(packetData, sharedKey[:]) {
+						logger.Debug("could not read disconnect packet")
+						continue
+					}
+
+					// the gateway or server is shutting down. a new connect token will get a session somewhere else
+
+					logger.Info("disconnected by gateway %s: %s", core.IdString(disconnectPacket.GatewayId[:]), core.DisconnectReasonString(disconnectPacket.Reason))
+
+					client.disconnect(DoneReason_Disconnected)
+					return
+				}
+			}
+		}
+	}()
+
+	// main loop
+
+	go func() {
+
+		defer client.wg.Done()
+
+		ackBuffer := [QueueSize]uint64{}
+
+		var payloadWriter core.PayloadWriter
+		testMessageIndex := 0
+
+		var keepaliveTime time.Time
+
+		for {
+
+			// pack this frame's messages into one payload. messages that don't fit wait for the next frame
+
+			payload := payloadSendPool.Get()
+			payloadWriter.Reset(payload)
+			if !client.config.Idle {
+				for i := 0; i < TestMessagesPerFrame; i++ {
+					if !payloadWriter.AddMessage(testmessage.Message(testMessageIndex)) {
+						break
+					}
+					testMessageIndex++
+				}
+			}
+			atomic.AddUint64(&client.counters.MessagesSent, uint64(payloadWriter.NumMessages()))
+			payload = payloadWriter.Finish()
+
+			// with no messages to send, a connected client sends a keepalive instead, at most once per keepalive interval
+
+			sendPacket := true
+			if payloadWriter.NumMessages() == 0 && client.Connected() {
+				payload = payload[:0]
+				sendPacket = !clock.Now().Before(keepaliveTime)
+				if sendPacket {
+					keepaliveTime = clock.Now().Add(core.KeepaliveInterval)
+				}
+			}
+
+			if sendPacket {
+				select {
+				case payloadSendQueue <- payload:
+				case <-client.done:
+					return
+				}
+			} else {
+				payloadSendPool.Put(payload)
+			}
+
+			// process payload acks
+
+			acks := GetPayloadAcks(payloadAckQueue, ackBuffer[:])
+			for i := 0; i < len(acks); i++ {
+				logger.Debug("ack payload %d", acks[i])
+			}
+			atomic.AddUint64(&client.counters.PayloadsAcked, uint64(len(acks)))
+
+			// receive messages
+
+			for {
+				message := ReceivePayload(payloadReceiveQueue)
+				if message == nil {
+					break
+				}
+				if !testmessage.Valid(message) {
+					atomic.AddUint64(&client.counters.PayloadMismatches, 1)
+					logger.Error("message mismatch (%d bytes)", len(message))
+					continue
+				}
+				atomic.AddUint64(&client.counters.MessagesReceived, 1)
+			}
+
+			// have we timed out?
+
+			timedOut := false
+			sessionTokenMutex.RLock()
+			if sessionTokenExpireTime.Before(clock.Now()) {
+				timedOut = true
+			}
+			sessionTokenMutex.RUnlock()
+
+			if timedOut {
+				logger.Info("disconnected")
+				client.disconnect(DoneReason_SessionTimeout)
+				return
+			}
+
+			// update bandwidth usage
+
+			bandwidthMutex.Lock()
+			if sendBandwidthBitsResetTime.Before(clock.Now()) {
+				sendBandwidthMbps := float64(sendBandwidthBitsAccumulator) / 1000000.0
+				sendBandwidthBitsResetTime = clock.Now().Add(time.Second)
+				sendBandwidthBitsAccumulator = 0
+				logger.Debug("%.2f mbps", sendBandwidthMbps)
+			}
+			bandwidthMutex.Unlock()
+
+			// sleep till next frame
+
+			frameTime := time.Duration(1000000000 / packetsPerSecond)
+
+			frameTimer := clock.NewTimer(frameTime)
+
+			select {
+			case <-frameTimer.C():
+			case <-client.done:
+				frameTimer.Stop()
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// requestConnectToken posts the client public key to auth. It retries for a few seconds, since auth may still be starting up.
+func (client *Client) requestConnectToken(clientPublicKey []byte) ([]byte, error) {
+	var err error
+	for i := 0; i < ConnectTokenRetries; i++ {
+		if i > 0 {
+			time.Sleep(time.Second)
+		}
+		var connectToken []byte
+		connectToken, err = RequestConnectToken(client.httpClient, client.config.AuthURL, clientPublicKey)
+		if err == nil {
+			return connectToken, nil
+		}
+		client.logger.Debug("connect token request failed: %v", err)
+	}
+	return nil, err
+}
+
+// RequestConnectToken posts a client public key to auth once, and returns the connect token for it.
+func RequestConnectToken(httpClient *http.Client, authURL string, clientPublicKey []byte) ([]byte, error) {
+	response, err := httpClient.Post(authURL+"/connect_token", "application/octet-stream", bytes.NewReader(clientPublicKey))
+	if err != nil {
+		return nil, err
+	}
+	connectToken, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth returned %s", response.Status)
+	}
+	if len(connectToken) != core.ConnectTokenBytes {
+		return nil, fmt.Errorf("bad connect token size: %d", len(connectToken))
+	}
+	return connectToken, nil
+}
+
+// ReceivePayload returns the next message split from a received payload, or nil if there isn't one.
+func ReceivePayload(queue chan []byte) []byte {
+	select {
+	case payload := <-queue:
+		return payload
+	default:
+		return nil
+	}
+}
+
+func GetPayloadAcks(queue chan uint64, buffer []uint64) []uint64 {
+	index := 0
+	select {
+	case ack := <-queue:
+		buffer[index] = ack
+		index++
+	default:
+	}
+	return buffer[:index]
+}
@@ -0,0 +1,299 @@
+//go:build !race
+// +build !race
+
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cluster
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/networknext/udpx/modules/client"
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/testmessage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// allocations are counted for the whole process, and the race detector allocates, so these only run without it
+
+const rawClientAddress = "127.0.0.1:30000"
+
+// rawSession is a client session driven one packet at a time by the test, so nothing else is running while the
+// gateway and server forward its packets. It does the same handshake as the client, with the same packet layout.
+type rawSession struct {
+	conn             core.PacketConn
+	clientAddress    *net.UDPAddr
+	gatewayAddress   *net.UDPAddr
+	sessionId        []byte
+	sharedKey        [core.SharedKeyBytes_Box]byte
+	prefix           core.PacketPrefix
+	header           core.PayloadHeader
+	receiveHeader    core.PayloadHeader
+	sendSequence     uint64
+	receiveSequence  uint64
+	receivedPackets  [client.SequenceBufferSize]uint64
+	challenge        bool
+	challengeToken   core.ChallengePacket
+	payload          []byte
+	payloadsReceived int
+}
+
+func newRawSession(t testing.TB, cluster *Cluster) *rawSession {
+
+	session := &rawSession{}
+
+	clientPublicKey, clientPrivateKey := core.Keygen_Box()
+
+	connectToken, err := client.RequestConnectToken(cluster.HTTPClient, AuthURL, clientPublicKey)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	index := 0
+	var connectData core.ConnectData
+	assert.True(t, core.ReadObject(connectToken, &index, &connectData))
+
+	core.SharedKey_Box(connectData.GatewayPublicKey[:], clientPrivateKey, session.sharedKey[:])
+
+	socket, err := cluster.Network.Listen(rawClientAddress, core.SocketOptions{})
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	// a stuck read fails the test, instead of hanging it
+
+	socket.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	session.conn = cluster.Network.NewPacketConn(socket, core.DefaultBatchSize, client.MaxPacketSize)
+	session.clientAddress = core.ParseAddress(rawClientAddress)
+	session.gatewayAddress = core.ParseAddress(GatewayAddress)
+	session.sessionId = clientPublicKey
+	session.sendSequence = 10000
+	session.payload = testmessage.Payload(core.MinPayloadBytes)
+
+	copy(session.prefix.SessionTokenData[:], connectToken[core.ConnectDataBytes:])
+	copy(session.header.SessionId[:], clientPublicKey)
+
+	return session
+}
+
+// send sends a payload packet, with the challenge token if the gateway has sent one.
+func (session *rawSession) send() {
+
+	session.prefix.PacketType = core.PacketType_Payload
+
+	session.header.Sequence = session.sendSequence
+	session.header.Ack = session.receiveSequence
+	core.GetAckBits(session.receiveSequence, session.receivedPackets[:], session.header.AckBits[:])
+	session.header.PacketType = core.PacketType_Payload
+	session.header.Flags = 0
+	if session.challenge {
+		session.header.GatewayId = session.challengeToken.GatewayId
+		session.header.Flags = core.Flags_ChallengeToken
+	}
+
+	packetData := session.conn.WritePacket()
+
+	index := 0
+	core.WriteObject(packetData, &index, &session.prefix)
+	core.WriteObject(packetData, &index, &session.header)
+	if session.challenge {
+		core.WriteBytes(packetData, &index, session.challengeToken.ChallengeTokenData[:], core.EncryptedChallengeTokenBytes)
+	}
+	core.WriteBytes(packetData, &index, session.payload, len(session.payload))
+	encryptFinish := index
+	index += core.PostfixBytes
+
+	var nonce [core.NonceBytes_Box]byte
+	nonceIndex := 0
+	core.WriteUint64(nonce[:], &nonceIndex, session.sendSequence)
+
+	core.Encrypt_SharedBox(session.sharedKey[:], nonce[:], packetData[core.PayloadPacketEncryptIndex:encryptFinish+core.HMACBytes_Box], encryptFinish-core.PayloadPacketEncryptIndex)
+
+	core.WritePacketFilter(packetData[:index], session.clientAddress, session.gatewayAddress)
+
+	session.conn.CommitPacket(index, session.gatewayAddress)
+	session.conn.Flush()
+
+	session.sendSequence++
+}
+
+// receive reads packets until a payload packet arrives from the server. It returns false if a read fails.
+func (session *rawSession) receive() bool {
+
+	for {
+
+		numPackets, err := session.conn.ReadBatch()
+		if err != nil {
+			return false
+		}
+
+		payloadReceived := false
+
+		for i := 0; i < numPackets; i++ {
+
+			packetData, _ := session.conn.Packet(i)
+
+			if len(packetData) < core.PrefixBytes {
+				continue
+			}
+
+			switch packetData[core.VersionBytes] {
+
+			case core.PacketType_Challenge:
+
+				if session.challengeToken.Read(packetData, session.sharedKey[:]) {
+					session.challenge = true
+				}
+
+			case core.PacketType_Payload, core.PacketType_Keepalive:
+
+				header := &session.receiveHeader
+				index := core.PrefixBytes
+				if len(packetData) < core.PrefixBytes+core.HeaderBytes+core.PostfixBytes || !core.ReadObject(packetData, &index, header) {
+					continue
+				}
+
+				encryptedData := packetData[core.PayloadPacketEncryptIndex : len(packetData)-core.PittleBytes]
+
+				var nonce [core.NonceBytes_Box]byte
+				nonceIndex := 0
+				core.WriteUint64(nonce[:], &nonceIndex, header.Sequence)
+				nonce[9] |= (1 << 0)
+				nonce[9] &= 1 ^ (1 << 1)
+
+				if core.Decrypt_SharedBox(session.sharedKey[:], nonce[:], encryptedData, len(encryptedData)) != nil {
+					continue
+				}
+
+				index = core.PrefixBytes
+				core.ReadObject(packetData, &index, header)
+
+				if header.Sequence > session.receiveSequence {
+					session.receiveSequence = header.Sequence
+				}
+				session.receivedPackets[header.Sequence%client.SequenceBufferSize] = header.Sequence
+
+				// once connected, later packets don't need the challenge token
+
+				session.challenge = false
+				session.header.GatewayId = header.GatewayId
+				session.header.ServerId = header.ServerId
+
+				if header.PacketType == core.PacketType_Payload {
+					session.payloadsReceived++
+					payloadReceived = true
+				}
+			}
+		}
+
+		if payloadReceived {
+			return true
+		}
+	}
+}
+
+// connect answers the gateway's challenge, then waits for the server to echo the first payload back. The packet
+// with the challenge token only creates the session on the gateway, so the payload goes in the packet after it.
+func (session *rawSession) connect() bool {
+	for i := 0; i < 10 && !session.challenge; i++ {
+		session.send()
+		numPackets, err := session.conn.ReadBatch()
+		if err != nil {
+			return false
+		}
+		for j := 0; j < numPackets; j++ {
+			packetData, _ := session.conn.Packet(j)
+			if len(packetData) > core.VersionBytes && packetData[core.VersionBytes] == core.PacketType_Challenge && session.challengeToken.Read(packetData, session.sharedKey[:]) {
+				session.challenge = true
+			}
+		}
+	}
+	if !session.challenge {
+		return false
+	}
+	session.send()
+	session.send()
+	return session.receive()
+}
+
+func TestZeroAllocations(t *testing.T) {
+
+	// not parallel, since allocations in other tests would be counted
+
+	cluster, err := New(12, core.SystemClock)
+	assert.Nil(t, err)
+
+	session := newRawSession(t, cluster)
+
+	assert.True(t, session.connect())
+
+	// warm up, so maps and queues along the way have grown to size
+
+	for i := 0; i < 10; i++ {
+		session.send()
+		assert.True(t, session.receive())
+	}
+
+	// a payload goes through the gateway's public thread to the server, and the messages come back on the server's
+	// next send tick through the gateway's internal thread
+
+	payloadsReceived := session.payloadsReceived
+
+	assert.Equal(t, 0.0, testing.AllocsPerRun(100, func() {
+		session.send()
+		session.receive()
+	}))
+
+	assert.Equal(t, payloadsReceived+101, session.payloadsReceived)
+
+	assert.Equal(t, uint64(0), cluster.Server.Counters().PayloadMismatches)
+
+	assert.True(t, cluster.Close())
+}
+
+// BenchmarkRoundTrip forwards a payload from a client to the server and back. Each round trip waits for the
+// server's send tick, so the time per op is the tick rate. The point is the allocations per op.
+func BenchmarkRoundTrip(b *testing.B) {
+
+	cluster, err := New(13, core.SystemClock)
+	assert.Nil(b, err)
+
+	session := newRawSession(b, cluster)
+
+	assert.True(b, session.connect())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		session.send()
+		if !session.receive() {
+			b.Fatal("round trip failed")
+		}
+	}
+
+	b.StopTimer()
+
+	cluster.Close()
+}
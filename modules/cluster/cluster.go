@@ -0,0 +1,278 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/networknext/udpx/modules/auth"
+	"github.com/networknext/udpx/modules/client"
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/gateway"
+	"github.com/networknext/udpx/modules/server"
+)
+
+// Cluster runs auth, a gateway, a server and any number of clients in one process, on a virtual network.
+// Auth is called through an http.Client that serves requests with the auth handlers directly, so nothing
+// touches real sockets, and tests can run in parallel. Everything shares one clock, so with a FakeClock
+// a test can step through token expiry in milliseconds.
+type Cluster struct {
+	Clock         core.Clock
+	Network       *core.VirtualNetwork
+	Auth          *auth.Auth
+	Gateway       *gateway.Gateway
+	Server        *server.Server
+	Clients       []*client.Client
+	HTTPClient    *http.Client
+	authDown      *uint32
+	authConfig    auth.ReloadableConfig
+	gatewayConfig gateway.ReloadableConfig
+}
+
+const AuthURL = "http://auth"
+const GatewayAddress = "127.0.0.1:40000"
+const GatewayInternalAddress = "127.0.0.1:40001"
+const BrowserInternalAddress = "127.0.0.1:40002"
+const ServerAddress = "127.0.0.1:50000"
+const ClientBasePort = 30000
+const ShutdownTimeout = time.Second
+
+// FakeStepTime is how far Step moves a fake clock at a time. It is longer than a client frame, so each step
+// sends a packet from every client, but short enough that token timings are seen to the second.
+const FakeStepTime = 50 * time.Millisecond
+
+type handlerTransport struct {
+	handler http.Handler
+	down    *uint32
+}
+
+func (transport *handlerTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if atomic.LoadUint32(transport.down) != 0 {
+		return nil, fmt.Errorf("auth is down")
+	}
+	recorder := httptest.NewRecorder()
+	transport.handler.ServeHTTP(recorder, request)
+	return recorder.Result(), nil
+}
+
+// New creates the virtual network with the random seed, generates keys, and starts auth, the gateway and the server.
+func New(seed int64, clock core.Clock) (*Cluster, error) {
+
+	cluster := &Cluster{}
+
+	cluster.Clock = clock
+	cluster.authDown = new(uint32)
+
+	cluster.Network = core.NewVirtualNetwork(seed, clock)
+
+	gatewayAddress := core.ParseAddress(GatewayAddress)
+	gatewayInternalAddress := core.ParseAddress(GatewayInternalAddress)
+	serverAddress := core.ParseAddress(ServerAddress)
+
+	gatewayPublicKey, gatewayPrivateKey := core.Keygen_Box()
+	authPublicKey, authPrivateKey := core.Keygen_Box()
+
+	// auth
+
+	authConfig := &auth.ReloadableConfig{}
+	authConfig.GatewayAddress = gatewayAddress
+	authConfig.GatewayPublicKey = gatewayPublicKey
+	authConfig.GatewayPrivateKey = gatewayPrivateKey
+	authConfig.AuthPublicKey = authPublicKey
+	authConfig.AuthPrivateKey = authPrivateKey
+
+	cluster.authConfig = *authConfig
+
+	cluster.Auth = auth.New(authConfig, clock)
+
+	cluster.HTTPClient = &http.Client{Timeout: time.Second, Transport: &handlerTransport{handler: cluster.Auth.Router(), down: cluster.authDown}}
+
+	// server
+
+	serverConfig := &server.Config{}
+	serverConfig.BindAddress = fmt.Sprintf("0.0.0.0:%d", serverAddress.Port)
+	serverConfig.NumThreads = 1
+	serverConfig.BatchSize = core.DefaultBatchSize
+	serverConfig.ShutdownTimeout = ShutdownTimeout
+	serverConfig.Clock = clock
+	serverConfig.ValidateTestMessages = true
+
+	cluster.Server = server.New(serverConfig, cluster.Network)
+
+	if err := cluster.Server.Start(); err != nil {
+		cluster.Network.Close()
+		return nil, err
+	}
+
+	// gateway
+
+	gatewayConfig := &gateway.Config{}
+	gatewayConfig.BindAddress = fmt.Sprintf("0.0.0.0:%d", gatewayAddress.Port)
+	gatewayConfig.GatewayAddress = gatewayAddress
+	gatewayConfig.GatewayInternalAddress = gatewayInternalAddress
+	gatewayConfig.BrowserInternalAddress = core.ParseAddress(BrowserInternalAddress)
+	gatewayConfig.ServerAddress = serverAddress
+	gatewayConfig.AuthURL = AuthURL
+	gatewayConfig.NumThreads = 1
+	gatewayConfig.BatchSize = core.DefaultBatchSize
+	gatewayConfig.ShutdownTimeout = ShutdownTimeout
+	gatewayConfig.HTTPClient = cluster.HTTPClient
+	gatewayConfig.Clock = clock
+
+	gatewayReloadable := &gateway.ReloadableConfig{}
+	gatewayReloadable.GatewayPrivateKey = gatewayPrivateKey
+	gatewayReloadable.AuthPublicKey = authPublicKey
+	gatewayReloadable.ChallengeRatePerAddress = 10
+	gatewayReloadable.ChallengeRatePerSession = 10
+	gatewayReloadable.ChallengeRateGlobal = 10000
+
+	cluster.gatewayConfig = *gatewayReloadable
+
+	cluster.Gateway = gateway.New(gatewayConfig, gatewayReloadable, cluster.Network)
+
+	if err := cluster.Gateway.Start(); err != nil {
+		cluster.Server.Shutdown()
+		cluster.Network.Close()
+		return nil, err
+	}
+
+	return cluster, nil
+}
+
+// AddClient starts a client on the next free client port. It returns once the client has its connect token.
+func (cluster *Cluster) AddClient() (*client.Client, error) {
+	return cluster.addClient(false)
+}
+
+// AddIdleClient starts a client that sends no messages, only keepalives.
+func (cluster *Cluster) AddIdleClient() (*client.Client, error) {
+	return cluster.addClient(true)
+}
+
+func (cluster *Cluster) addClient(idle bool) (*client.Client, error) {
+
+	port := ClientBasePort + len(cluster.Clients)
+
+	clientConfig := &client.Config{}
+	clientConfig.BindAddress = fmt.Sprintf("0.0.0.0:%d", port)
+	clientConfig.ClientAddress = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	clientConfig.AuthURL = AuthURL
+	clientConfig.HTTPClient = cluster.HTTPClient
+	clientConfig.Clock = cluster.Clock
+	clientConfig.Idle = idle
+
+	c := client.New(clientConfig, cluster.Network)
+
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+
+	cluster.Clients = append(cluster.Clients, c)
+
+	return c, nil
+}
+
+// RotateGatewayKey reloads the gateway with a new key pair, like a SIGHUP does. Auth keeps issuing connect tokens
+// for the old key until ReloadAuth is called, like it would partway through a rollout.
+func (cluster *Cluster) RotateGatewayKey() {
+	gatewayPublicKey, gatewayPrivateKey := core.Keygen_Box()
+	cluster.authConfig.GatewayPublicKey = gatewayPublicKey
+	cluster.authConfig.GatewayPrivateKey = gatewayPrivateKey
+	cluster.gatewayConfig.GatewayPrivateKey = gatewayPrivateKey
+	gatewayConfig := cluster.gatewayConfig
+	cluster.Gateway.Reload(&gatewayConfig)
+}
+
+// ReloadAuth reloads auth with the gateway key from the last RotateGatewayKey.
+func (cluster *Cluster) ReloadAuth() {
+	authConfig := cluster.authConfig
+	cluster.Auth.Reload(&authConfig)
+}
+
+// SetAuthDown makes requests to auth fail, as if it couldn't be reached.
+func (cluster *Cluster) SetAuthDown(down bool) {
+	value := uint32(0)
+	if down {
+		value = 1
+	}
+	atomic.StoreUint32(cluster.authDown, value)
+}
+
+// Step lets time pass. A fake clock is advanced, then the goroutines get a moment of real time to handle
+// the timers and packets that released. Otherwise it sleeps.
+func (cluster *Cluster) Step(d time.Duration) {
+	fakeClock, ok := cluster.Clock.(*core.FakeClock)
+	if !ok {
+		time.Sleep(d)
+		return
+	}
+	fakeClock.Advance(d)
+	time.Sleep(2 * time.Millisecond)
+}
+
+func (cluster *Cluster) stepTime() time.Duration {
+	if _, ok := cluster.Clock.(*core.FakeClock); ok {
+		return FakeStepTime
+	}
+	return 10 * time.Millisecond
+}
+
+// Run steps time forward for the duration.
+func (cluster *Cluster) Run(duration time.Duration) {
+	step := cluster.stepTime()
+	for elapsed := time.Duration(0); elapsed < duration; elapsed += step {
+		cluster.Step(step)
+	}
+}
+
+// WaitConnected steps time until every client is connected to the server. It returns false if this takes longer than the timeout.
+func (cluster *Cluster) WaitConnected(timeout time.Duration) bool {
+	step := cluster.stepTime()
+	for elapsed := time.Duration(0); elapsed < timeout; elapsed += step {
+		connected := true
+		for i := range cluster.Clients {
+			if !cluster.Clients[i].Connected() {
+				connected = false
+				break
+			}
+		}
+		if connected {
+			return true
+		}
+		cluster.Step(step)
+	}
+	return false
+}
+
+// Close stops the clients, then shuts down the gateway and server. It returns false if they didn't shut down cleanly.
+func (cluster *Cluster) Close() bool {
+	for i := range cluster.Clients {
+		cluster.Clients[i].Stop()
+	}
+	completed := cluster.Gateway.Shutdown()
+	completed = cluster.Server.Shutdown() && completed
+	cluster.Network.Close()
+	return completed
+}
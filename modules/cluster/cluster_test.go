@@ -0,0 +1,860 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/networknext/udpx/modules/client"
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/gateway"
+	"github.com/networknext/udpx/modules/testmessage"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+func TestHandshake(t *testing.T) {
+
+	t.Parallel()
+
+	cluster, err := New(1, core.SystemClock)
+	assert.Nil(t, err)
+
+	for i := 0; i < 4; i++ {
+		_, err := cluster.AddClient()
+		assert.Nil(t, err)
+	}
+
+	assert.True(t, cluster.WaitConnected(5*time.Second))
+
+	assert.Equal(t, uint64(4), cluster.Gateway.Counters().SessionsCreated)
+	assert.Equal(t, uint64(4), cluster.Server.Counters().SessionsCreated)
+
+	assert.True(t, cluster.Close())
+}
+
+func TestReliability(t *testing.T) {
+
+	t.Parallel()
+
+	cluster, err := New(2, core.SystemClock)
+	assert.Nil(t, err)
+
+	cluster.Network.SetConditions(core.NetworkConditions{
+		Latency:   20 * time.Millisecond,
+		Jitter:    10 * time.Millisecond,
+		Loss:      0.1,
+		Duplicate: 0.05,
+		Reorder:   0.05,
+	})
+
+	c, err := cluster.AddClient()
+	assert.Nil(t, err)
+
+	assert.True(t, cluster.WaitConnected(5*time.Second))
+
+	time.Sleep(3 * time.Second)
+
+	assert.True(t, cluster.Close())
+
+	// duplicates are dropped, so each payload is received and acked at most once, and most get through both ways
+
+	clientCounters := c.Counters()
+	serverCounters := cluster.Server.Counters()
+
+	assert.True(t, clientCounters.PayloadsSent > 200)
+	assert.True(t, serverCounters.PayloadPacketsReceived <= clientCounters.PayloadsSent)
+	assert.True(t, serverCounters.PayloadPacketsReceived > clientCounters.PayloadsSent*7/10)
+	assert.True(t, clientCounters.PayloadsReceived <= serverCounters.PayloadPacketsSent)
+	assert.True(t, clientCounters.PayloadsReceived > serverCounters.PayloadPacketsSent*7/10)
+	assert.True(t, clientCounters.PayloadsAcked <= clientCounters.PayloadsSent)
+	assert.True(t, clientCounters.PayloadsAcked > clientCounters.PayloadsSent/2)
+
+	// each payload carries a frame of messages, which are split back out on the other side. the server
+	// queues them and echoes them back on its own send tick
+
+	assert.Equal(t, uint64(0), serverCounters.PayloadMismatches)
+	assert.Equal(t, uint64(0), clientCounters.PayloadMismatches)
+	assert.Equal(t, serverCounters.PayloadPacketsReceived*client.TestMessagesPerFrame, serverCounters.MessagesReceived)
+	assert.Equal(t, uint64(0), serverCounters.MessagesDropped)
+	assert.True(t, clientCounters.MessagesReceived <= serverCounters.MessagesReceived)
+	assert.True(t, clientCounters.MessagesReceived > serverCounters.MessagesReceived*7/10)
+
+	networkCounters := cluster.Network.Counters()
+
+	assert.True(t, networkCounters.PacketsLost > 0)
+	assert.True(t, networkCounters.PacketsDuplicated > 0)
+	assert.True(t, networkCounters.PacketsReordered > 0)
+}
+
+// the fake clock starts at a fixed time, so token timestamps are the same on every run
+
+var fakeClockStartTime = time.Unix(1700000000, 0)
+
+func isDone(c *client.Client) bool {
+	select {
+	case <-c.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestTokenRefresh(t *testing.T) {
+
+	t.Parallel()
+
+	cluster, err := New(3, core.NewFakeClock(fakeClockStartTime))
+	assert.Nil(t, err)
+
+	c, err := cluster.AddClient()
+	assert.Nil(t, err)
+
+	assert.True(t, cluster.WaitConnected(5*time.Second))
+
+	// the connect token expires after 20 seconds, so staying connected for a minute takes several refreshes
+
+	cluster.Run(60 * time.Second)
+
+	assert.True(t, cluster.Gateway.Counters().SessionTokenUpdates >= 4)
+	assert.Equal(t, uint64(0), cluster.Gateway.Counters().SessionTokenUpdateFailures)
+	assert.False(t, isDone(c))
+
+	payloadsReceived := c.Counters().PayloadsReceived
+
+	cluster.Run(time.Second)
+
+	assert.True(t, c.Counters().PayloadsReceived > payloadsReceived)
+
+	assert.True(t, cluster.Close())
+}
+
+func TestKeepalive(t *testing.T) {
+
+	t.Parallel()
+
+	cluster, err := New(6, core.NewFakeClock(fakeClockStartTime))
+	assert.Nil(t, err)
+
+	c, err := cluster.AddIdleClient()
+	assert.Nil(t, err)
+
+	assert.True(t, cluster.WaitConnected(5*time.Second))
+
+	// an idle client only sends keepalives, and they keep its session alive through token refreshes
+
+	cluster.Run(60 * time.Second)
+
+	assert.True(t, cluster.Gateway.Counters().SessionTokenUpdates >= 4)
+	assert.True(t, c.Counters().SessionTokenUpdates >= 4)
+	assert.False(t, isDone(c))
+	assert.True(t, c.Connected())
+
+	clientCounters := c.Counters()
+	serverCounters := cluster.Server.Counters()
+
+	assert.Equal(t, uint64(0), clientCounters.MessagesSent)
+	assert.True(t, clientCounters.PayloadsSent < 10)
+	assert.True(t, clientCounters.KeepalivesSent > 100)
+	assert.True(t, clientCounters.KeepalivesReceived > 100)
+	assert.True(t, serverCounters.KeepalivePacketsReceived > 100)
+
+	// keepalives are rate limited in both directions
+
+	assert.True(t, clientCounters.KeepalivesSent <= uint64(60*time.Second/core.KeepaliveInterval)+1)
+	assert.True(t, serverCounters.KeepalivePacketsSent <= uint64(60*time.Second/core.KeepaliveInterval)+10)
+
+	assert.True(t, cluster.Close())
+}
+
+func TestKeyRotation(t *testing.T) {
+
+	t.Parallel()
+
+	cluster, err := New(10, core.NewFakeClock(fakeClockStartTime))
+	assert.Nil(t, err)
+
+	before, err := cluster.AddClient()
+	assert.Nil(t, err)
+
+	assert.True(t, cluster.WaitConnected(5*time.Second))
+
+	// reload the gateway with a new key. a client that gets its connect token from auth before auth is reloaded
+	// connects with the key from before the reload
+
+	cluster.RotateGatewayKey()
+
+	during, err := cluster.AddClient()
+	assert.Nil(t, err)
+
+	assert.True(t, cluster.WaitConnected(5*time.Second))
+
+	cluster.ReloadAuth()
+
+	// both sessions keep the key they connected with, through token refreshes and past the session map swaps
+
+	cluster.Run(3 * gateway.SessionMapSwapTime * time.Second)
+
+	assert.True(t, before.Connected())
+	assert.True(t, during.Connected())
+
+	beforePayloadsReceived := before.Counters().PayloadsReceived
+	duringPayloadsReceived := during.Counters().PayloadsReceived
+
+	cluster.Run(time.Second)
+
+	assert.True(t, before.Counters().PayloadsReceived > beforePayloadsReceived)
+	assert.True(t, during.Counters().PayloadsReceived > duringPayloadsReceived)
+	assert.Equal(t, uint64(0), cluster.Gateway.Counters().SessionTokenUpdateFailures)
+
+	assert.True(t, cluster.Close())
+}
+
+func TestTokenRefreshRetry(t *testing.T) {
+
+	t.Parallel()
+
+	cluster, err := New(4, core.NewFakeClock(fakeClockStartTime))
+	assert.Nil(t, err)
+
+	c, err := cluster.AddClient()
+	assert.Nil(t, err)
+
+	assert.True(t, cluster.WaitConnected(5*time.Second))
+
+	// refreshes start 10 seconds before the token expires, and fail while auth is down
+
+	cluster.SetAuthDown(true)
+
+	cluster.Run(13 * time.Second)
+
+	assert.True(t, cluster.Gateway.Counters().SessionTokenUpdateFailures > 0)
+	assert.Equal(t, uint64(0), cluster.Gateway.Counters().SessionTokenUpdates)
+
+	// auth comes back before the token expires, so a retry gets a new token and the client stays connected
+
+	cluster.SetAuthDown(false)
+
+	cluster.Run(15 * time.Second)
+
+	assert.True(t, cluster.Gateway.Counters().SessionTokenUpdates > 0)
+	assert.False(t, isDone(c))
+
+	assert.True(t, cluster.Close())
+}
+
+func TestTokenExpiresDuringRefreshRetry(t *testing.T) {
+
+	t.Parallel()
+
+	cluster, err := New(5, core.NewFakeClock(fakeClockStartTime))
+	assert.Nil(t, err)
+
+	c, err := cluster.AddClient()
+	assert.Nil(t, err)
+
+	assert.True(t, cluster.WaitConnected(5*time.Second))
+
+	// auth stays down, so the gateway is still retrying when the session token expires, and the client gives up
+
+	cluster.SetAuthDown(true)
+
+	cluster.Run((core.ConnectTokenExpireSeconds - 1) * time.Second)
+
+	assert.True(t, cluster.Gateway.Counters().SessionTokenUpdateFailures > 0)
+	assert.False(t, isDone(c))
+
+	cluster.Run(2 * time.Second)
+
+	assert.Equal(t, uint64(0), cluster.Gateway.Counters().SessionTokenUpdates)
+	assert.True(t, isDone(c))
+
+	assert.True(t, cluster.Close())
+}
+
+// writeBrowserPacket builds a packet the way a browser client would, in the same format a UDP client sends.
+func writeBrowserPacket(sharedKey []byte, sessionId []byte, sessionTokenData []byte, sequence uint64, packetType byte, payload []byte) []byte {
+
+	prefix := core.PacketPrefix{}
+	prefix.PacketType = packetType
+	copy(prefix.SessionTokenData[:], sessionTokenData)
+
+	header := core.PayloadHeader{}
+	copy(header.SessionId[:], sessionId)
+	header.Sequence = sequence
+	header.PacketType = packetType
+
+	packetData := make([]byte, gateway.MaxPacketSize)
+
+	index := 0
+	core.WriteObject(packetData, &index, &prefix)
+	core.WriteObject(packetData, &index, &header)
+	core.WriteBytes(packetData, &index, payload, len(payload))
+	encryptFinish := index
+	index += core.PostfixBytes
+
+	var nonce [core.NonceBytes_Box]byte
+	nonceIndex := 0
+	core.WriteUint64(nonce[:], &nonceIndex, sequence)
+
+	core.Encrypt_SharedBox(sharedKey, nonce[:], packetData[core.PayloadPacketEncryptIndex:encryptFinish+core.HMACBytes_Box], encryptFinish-core.PayloadPacketEncryptIndex)
+
+	return packetData[:index]
+}
+
+// readBrowserPacket decrypts a payload or keepalive packet from the gateway, and returns its header and payload.
+func readBrowserPacket(sharedKey []byte, packetData []byte) (core.PayloadHeader, []byte, bool) {
+
+	var prefix core.PacketPrefix
+	var header core.PayloadHeader
+
+	index := 0
+	if len(packetData) < core.KeepalivePacketBytes || !core.ReadObject(packetData, &index, &prefix) || !core.ReadObject(packetData, &index, &header) {
+		return header, nil, false
+	}
+
+	var nonce [core.NonceBytes_Box]byte
+	nonceIndex := 0
+	core.WriteUint64(nonce[:], &nonceIndex, header.Sequence)
+	nonce[9] |= (1 << 0)
+	nonce[9] &= 1 ^ (1 << 1)
+
+	encryptedData := packetData[core.PayloadPacketEncryptIndex : len(packetData)-core.PittleBytes]
+
+	if core.Decrypt_SharedBox(sharedKey, nonce[:], encryptedData, len(encryptedData)) != nil {
+		return header, nil, false
+	}
+
+	index = core.PrefixBytes
+	core.ReadObject(packetData, &index, &header)
+
+	return header, packetData[index : len(packetData)-core.PostfixBytes], header.PacketType == prefix.PacketType
+}
+
+func TestWebSocket(t *testing.T) {
+
+	t.Parallel()
+
+	cluster, err := New(7, core.SystemClock)
+	assert.Nil(t, err)
+
+	httpServer := httptest.NewServer(http.HandlerFunc(cluster.Gateway.WebSocketHandler))
+	defer httpServer.Close()
+
+	// a browser client gets a connect token from auth like any other client
+
+	clientPublicKey, clientPrivateKey := core.Keygen_Box()
+
+	connectToken, err := client.RequestConnectToken(cluster.HTTPClient, AuthURL, clientPublicKey)
+	assert.Nil(t, err)
+
+	index := 0
+	var connectData core.ConnectData
+	assert.True(t, core.ReadObject(connectToken, &index, &connectData))
+
+	sharedKey := make([]byte, core.SharedKeyBytes_Box)
+	core.SharedKey_Box(connectData.GatewayPublicKey[:], clientPrivateKey, sharedKey)
+
+	sessionTokenData := connectToken[core.ConnectDataBytes:]
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), "", httpServer.URL)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// send frames of test messages. there is no challenge, so the first packet creates the session. the server
+	// echoes each frame's messages back through the gateway
+
+	const numFrames = 10
+
+	sequence := uint64(1000)
+
+	payloadBuffer := make([]byte, core.MaxPayloadBytes)
+	var payloadWriter core.PayloadWriter
+
+	var firstPacket []byte
+
+	messagesReceived := 0
+	var messageBuffer [core.MaxPayloadMessages][]byte
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for i := 0; i < numFrames; i++ {
+
+		payloadWriter.Reset(payloadBuffer)
+		for j := 0; j < client.TestMessagesPerFrame; j++ {
+			assert.True(t, payloadWriter.AddMessage(testmessage.Message(i*client.TestMessagesPerFrame+j)))
+		}
+		packetData := writeBrowserPacket(sharedKey, clientPublicKey, sessionTokenData, sequence, core.PacketType_Payload, payloadWriter.Finish())
+		if firstPacket == nil {
+			firstPacket = packetData
+		}
+		assert.Nil(t, websocket.Message.Send(conn, packetData))
+		sequence++
+
+		for messagesReceived < (i+1)*client.TestMessagesPerFrame {
+			var packetData []byte
+			if !assert.Nil(t, websocket.Message.Receive(conn, &packetData)) {
+				break
+			}
+			header, payload, ok := readBrowserPacket(sharedKey, packetData)
+			assert.True(t, ok)
+			assert.True(t, core.IdEqual(header.GatewayId[:], cluster.Gateway.Id()))
+			if header.PacketType != core.PacketType_Payload {
+				continue
+			}
+			messages, ok := core.ReadPayloadMessages(payload, messageBuffer[:])
+			assert.True(t, ok)
+			for j := range messages {
+				assert.True(t, testmessage.Valid(messages[j]))
+			}
+			messagesReceived += len(messages)
+		}
+	}
+
+	assert.Equal(t, numFrames*client.TestMessagesPerFrame, messagesReceived)
+
+	gatewayCounters := cluster.Gateway.Counters()
+	serverCounters := cluster.Server.Counters()
+
+	assert.Equal(t, uint64(1), gatewayCounters.WebSocketSessionsCreated)
+	assert.Equal(t, uint64(0), gatewayCounters.SessionsCreated)
+	assert.Equal(t, uint64(0), gatewayCounters.ChallengePacketsSent)
+	assert.Equal(t, uint64(numFrames), serverCounters.PayloadPacketsReceived)
+	assert.Equal(t, uint64(numFrames*client.TestMessagesPerFrame), serverCounters.MessagesReceived)
+
+	// replayed packets aren't forwarded
+
+	assert.Nil(t, websocket.Message.Send(conn, firstPacket))
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, uint64(numFrames), cluster.Server.Counters().PayloadPacketsReceived)
+
+	// when the gateway shuts down it sends a disconnect packet, then closes the connection
+
+	assert.True(t, cluster.Close())
+
+	disconnected := false
+	for {
+		var packetData []byte
+		if websocket.Message.Receive(conn, &packetData) != nil {
+			break
+		}
+		if packetData[core.VersionBytes] == core.PacketType_Disconnect {
+			var disconnectPacket core.DisconnectPacket
+			assert.True(t, disconnectPacket.Read(packetData, sharedKey))
+			assert.Equal(t, core.DisconnectReason_GatewayShutdown, disconnectPacket.Reason)
+			disconnected = true
+		}
+	}
+
+	assert.True(t, disconnected)
+}
+
+func TestWebSocketReplay(t *testing.T) {
+
+	t.Parallel()
+
+	cluster, err := New(11, core.SystemClock)
+	assert.Nil(t, err)
+
+	httpServer := httptest.NewServer(http.HandlerFunc(cluster.Gateway.WebSocketHandler))
+	defer httpServer.Close()
+
+	clientPublicKey, clientPrivateKey := core.Keygen_Box()
+
+	connectToken, err := client.RequestConnectToken(cluster.HTTPClient, AuthURL, clientPublicKey)
+	assert.Nil(t, err)
+
+	index := 0
+	var connectData core.ConnectData
+	assert.True(t, core.ReadObject(connectToken, &index, &connectData))
+
+	sharedKey := make([]byte, core.SharedKeyBytes_Box)
+	core.SharedKey_Box(connectData.GatewayPublicKey[:], clientPrivateKey, sharedKey)
+
+	sessionTokenData := connectToken[core.ConnectDataBytes:]
+
+	dial := func() *websocket.Conn {
+		conn, err := websocket.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), "", httpServer.URL)
+		assert.Nil(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+
+	// sendFrame sends a frame of test messages, and waits for the server to echo it back
+
+	payloadBuffer := make([]byte, core.MaxPayloadBytes)
+	var payloadWriter core.PayloadWriter
+	var messageBuffer [core.MaxPayloadMessages][]byte
+
+	sendFrame := func(conn *websocket.Conn, sequence uint64) []byte {
+		payloadWriter.Reset(payloadBuffer)
+		for j := 0; j < client.TestMessagesPerFrame; j++ {
+			assert.True(t, payloadWriter.AddMessage(testmessage.Message(j)))
+		}
+		packetData := writeBrowserPacket(sharedKey, clientPublicKey, sessionTokenData, sequence, core.PacketType_Payload, payloadWriter.Finish())
+		assert.Nil(t, websocket.Message.Send(conn, packetData))
+		messagesReceived := 0
+		for messagesReceived < client.TestMessagesPerFrame {
+			var responseData []byte
+			if !assert.Nil(t, websocket.Message.Receive(conn, &responseData)) {
+				break
+			}
+			header, payload, ok := readBrowserPacket(sharedKey, responseData)
+			assert.True(t, ok)
+			if header.PacketType != core.PacketType_Payload {
+				continue
+			}
+			messages, ok := core.ReadPayloadMessages(payload, messageBuffer[:])
+			assert.True(t, ok)
+			messagesReceived += len(messages)
+		}
+		return packetData
+	}
+
+	// closed waits for the gateway to close the connection
+
+	closed := func(conn *websocket.Conn) bool {
+		for {
+			var packetData []byte
+			if err := websocket.Message.Receive(conn, &packetData); err != nil {
+				return !core.IsTimeout(err)
+			}
+		}
+	}
+
+	first := dial()
+	defer first.Close()
+
+	capturedPacket := sendFrame(first, 1000)
+	sendFrame(first, 1001)
+
+	// a captured packet replayed on a new connection doesn't take over the session
+
+	attacker := dial()
+	defer attacker.Close()
+
+	assert.Nil(t, websocket.Message.Send(attacker, capturedPacket))
+	assert.True(t, closed(attacker))
+
+	sendFrame(first, 1002)
+
+	assert.Equal(t, uint64(1), cluster.Gateway.Counters().WebSocketSessionsCreated)
+	assert.Equal(t, uint64(3), cluster.Server.Counters().PayloadPacketsReceived)
+
+	// the client reconnecting with its next packet does, and the connection it left behind is closed
+
+	second := dial()
+	defer second.Close()
+
+	sendFrame(second, 1003)
+
+	assert.True(t, closed(first))
+
+	assert.Equal(t, uint64(2), cluster.Gateway.Counters().WebSocketSessionsCreated)
+	assert.Equal(t, uint64(4), cluster.Server.Counters().PayloadPacketsReceived)
+
+	// the replay protection moved to the new connection with the session
+
+	assert.Nil(t, websocket.Message.Send(second, capturedPacket))
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, uint64(4), cluster.Server.Counters().PayloadPacketsReceived)
+
+	assert.True(t, cluster.Close())
+}
+
+func TestWebRTC(t *testing.T) {
+
+	t.Parallel()
+
+	cluster, err := New(8, core.SystemClock)
+	assert.Nil(t, err)
+
+	httpServer := httptest.NewServer(http.HandlerFunc(cluster.Gateway.WebRTCHandler))
+	defer httpServer.Close()
+
+	clientPublicKey, clientPrivateKey := core.Keygen_Box()
+
+	connectToken, err := client.RequestConnectToken(cluster.HTTPClient, AuthURL, clientPublicKey)
+	assert.Nil(t, err)
+
+	index := 0
+	var connectData core.ConnectData
+	assert.True(t, core.ReadObject(connectToken, &index, &connectData))
+
+	sharedKey := make([]byte, core.SharedKeyBytes_Box)
+	core.SharedKey_Box(connectData.GatewayPublicKey[:], clientPrivateKey, sharedKey)
+
+	sessionTokenData := connectToken[core.ConnectDataBytes:]
+
+	// offer an unreliable, unordered data channel along with the connect token, like a browser would
+
+	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer peerConnection.Close()
+
+	ordered := false
+	maxRetransmits := uint16(0)
+	dataChannel, err := peerConnection.CreateDataChannel("udpx", &webrtc.DataChannelInit{Ordered: &ordered, MaxRetransmits: &maxRetransmits})
+	assert.Nil(t, err)
+
+	opened := make(chan struct{})
+	dataChannel.OnOpen(func() {
+		close(opened)
+	})
+
+	received := make(chan []byte, 1024)
+	dataChannel.OnMessage(func(message webrtc.DataChannelMessage) {
+		received <- message.Data
+	})
+
+	offer, err := peerConnection.CreateOffer(nil)
+	assert.Nil(t, err)
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	assert.Nil(t, peerConnection.SetLocalDescription(offer))
+	<-gatherComplete
+
+	requestData, err := json.Marshal(gateway.WebRTCOffer{ConnectToken: connectToken, Offer: *peerConnection.LocalDescription()})
+	assert.Nil(t, err)
+
+	response, err := http.Post(httpServer.URL, "application/json", bytes.NewReader(requestData))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	var answer webrtc.SessionDescription
+	assert.Nil(t, json.NewDecoder(response.Body).Decode(&answer))
+	assert.Nil(t, peerConnection.SetRemoteDescription(answer))
+
+	select {
+	case <-opened:
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "data channel did not open")
+		return
+	}
+
+	// send frames of test messages, and wait for the server to echo each one back through the gateway. nothing
+	// should be lost on loopback
+
+	const numFrames = 10
+
+	sequence := uint64(1000)
+
+	payloadBuffer := make([]byte, core.MaxPayloadBytes)
+	var payloadWriter core.PayloadWriter
+
+	messagesReceived := 0
+	var messageBuffer [core.MaxPayloadMessages][]byte
+
+	timeout := time.After(5 * time.Second)
+
+	for i := 0; i < numFrames; i++ {
+
+		payloadWriter.Reset(payloadBuffer)
+		for j := 0; j < client.TestMessagesPerFrame; j++ {
+			assert.True(t, payloadWriter.AddMessage(testmessage.Message(i*client.TestMessagesPerFrame+j)))
+		}
+		assert.Nil(t, dataChannel.Send(writeBrowserPacket(sharedKey, clientPublicKey, sessionTokenData, sequence, core.PacketType_Payload, payloadWriter.Finish())))
+		sequence++
+
+	receive:
+		for messagesReceived < (i+1)*client.TestMessagesPerFrame {
+			select {
+			case packetData := <-received:
+				header, payload, ok := readBrowserPacket(sharedKey, packetData)
+				assert.True(t, ok)
+				assert.True(t, core.IdEqual(header.GatewayId[:], cluster.Gateway.Id()))
+				if header.PacketType != core.PacketType_Payload {
+					continue
+				}
+				messages, ok := core.ReadPayloadMessages(payload, messageBuffer[:])
+				assert.True(t, ok)
+				for j := range messages {
+					assert.True(t, testmessage.Valid(messages[j]))
+				}
+				messagesReceived += len(messages)
+			case <-timeout:
+				break receive
+			}
+		}
+	}
+
+	assert.Equal(t, numFrames*client.TestMessagesPerFrame, messagesReceived)
+
+	gatewayCounters := cluster.Gateway.Counters()
+	serverCounters := cluster.Server.Counters()
+
+	assert.Equal(t, uint64(1), gatewayCounters.WebRTCSessionsCreated)
+	assert.Equal(t, uint64(0), gatewayCounters.WebSocketSessionsCreated)
+	assert.Equal(t, uint64(0), gatewayCounters.SessionsCreated)
+	assert.Equal(t, uint64(numFrames), serverCounters.PayloadPacketsReceived)
+	assert.Equal(t, uint64(numFrames*client.TestMessagesPerFrame), serverCounters.MessagesReceived)
+
+	// the peer can only send packets for the session in the connect token it offered
+
+	otherPublicKey, _ := core.Keygen_Box()
+	otherConnectToken, err := client.RequestConnectToken(cluster.HTTPClient, AuthURL, otherPublicKey)
+	assert.Nil(t, err)
+
+	assert.Nil(t, dataChannel.Send(writeBrowserPacket(sharedKey, otherPublicKey, otherConnectToken[core.ConnectDataBytes:], sequence, core.PacketType_Payload, nil)))
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, uint64(numFrames), cluster.Server.Counters().PayloadPacketsReceived)
+
+	// when the gateway shuts down it sends a disconnect packet
+
+	assert.True(t, cluster.Close())
+
+	disconnected := false
+	for !disconnected {
+		var packetData []byte
+		select {
+		case packetData = <-received:
+		case <-time.After(5 * time.Second):
+		}
+		if packetData == nil {
+			break
+		}
+		if packetData[core.VersionBytes] == core.PacketType_Disconnect {
+			var disconnectPacket core.DisconnectPacket
+			assert.True(t, disconnectPacket.Read(packetData, sharedKey))
+			assert.Equal(t, core.DisconnectReason_GatewayShutdown, disconnectPacket.Reason)
+			disconnected = true
+		}
+	}
+
+	assert.True(t, disconnected)
+}
+
+func TestWebRTCBadConnectToken(t *testing.T) {
+
+	t.Parallel()
+
+	cluster, err := New(9, core.SystemClock)
+	assert.Nil(t, err)
+	defer cluster.Close()
+
+	httpServer := httptest.NewServer(http.HandlerFunc(cluster.Gateway.WebRTCHandler))
+	defer httpServer.Close()
+
+	clientPublicKey, _ := core.Keygen_Box()
+
+	connectToken, err := client.RequestConnectToken(cluster.HTTPClient, AuthURL, clientPublicKey)
+	assert.Nil(t, err)
+
+	// the connect token is checked before the offer is looked at
+
+	connectToken[len(connectToken)-1] ^= 1
+
+	requestData, err := json.Marshal(gateway.WebRTCOffer{ConnectToken: connectToken, Offer: webrtc.SessionDescription{Type: webrtc.SDPTypeOffer}})
+	assert.Nil(t, err)
+
+	response, err := http.Post(httpServer.URL, "application/json", bytes.NewReader(requestData))
+	if !assert.Nil(t, err) {
+		return
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+
+	response, err = http.Post(httpServer.URL, "application/json", bytes.NewReader(requestData[:len(requestData)-1]))
+	if !assert.Nil(t, err) {
+		return
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+}
+
+func TestWebRTCPeerLimit(t *testing.T) {
+
+	t.Parallel()
+
+	cluster, err := New(14, core.SystemClock)
+	assert.Nil(t, err)
+	defer cluster.Close()
+
+	httpServer := httptest.NewServer(http.HandlerFunc(cluster.Gateway.WebRTCHandler))
+	defer httpServer.Close()
+
+	clientPublicKey, _ := core.Keygen_Box()
+
+	connectToken, err := client.RequestConnectToken(cluster.HTTPClient, AuthURL, clientPublicKey)
+	assert.Nil(t, err)
+
+	post := func(offer webrtc.SessionDescription) int {
+		requestData, err := json.Marshal(gateway.WebRTCOffer{ConnectToken: connectToken, Offer: offer})
+		assert.Nil(t, err)
+		response, err := http.Post(httpServer.URL, "application/json", bytes.NewReader(requestData))
+		if !assert.Nil(t, err) {
+			return 0
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	// peers for offers that are rejected don't count against the session
+
+	for i := 0; i < gateway.WebRTCMaxPeersPerSession+1; i++ {
+		assert.Equal(t, http.StatusBadRequest, post(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer}))
+	}
+
+	// peers that are answered do, until they close
+
+	for i := 0; i < gateway.WebRTCMaxPeersPerSession+1; i++ {
+
+		peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer peerConnection.Close()
+
+		ordered := false
+		maxRetransmits := uint16(0)
+		_, err = peerConnection.CreateDataChannel("udpx", &webrtc.DataChannelInit{Ordered: &ordered, MaxRetransmits: &maxRetransmits})
+		assert.Nil(t, err)
+
+		offer, err := peerConnection.CreateOffer(nil)
+		assert.Nil(t, err)
+		gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+		assert.Nil(t, peerConnection.SetLocalDescription(offer))
+		<-gatherComplete
+
+		if i < gateway.WebRTCMaxPeersPerSession {
+			assert.Equal(t, http.StatusOK, post(*peerConnection.LocalDescription()))
+		} else {
+			assert.Equal(t, http.StatusTooManyRequests, post(*peerConnection.LocalDescription()))
+		}
+	}
+}
@@ -0,0 +1,146 @@
+//go:build !race
+// +build !race
+
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// allocations are counted for the whole process, and the race detector allocates, so these only run without it
+
+func TestZeroAllocations(t *testing.T) {
+
+	// not parallel, since allocations in other tests would be counted
+
+	const PacketBytes = 1500
+
+	receivedPackets := make([]uint64, 1024)
+	ackedPackets := make([]uint64, 1024)
+	ackBuffer := make([]uint64, 1024)
+	var ack_bits [AckBitsBytes]byte
+
+	assert.Equal(t, 0.0, testing.AllocsPerRun(100, func() {
+		GetAckBits(100000, receivedPackets, ack_bits[:])
+		ProcessAcks(100000, ack_bits[:], ackedPackets, ackBuffer)
+	}))
+
+	packetData := make([]byte, PacketBytes)
+	address := ParseAddress("[::1]:40000")
+	var readAddress net.UDPAddr
+	readAddress.IP = make(net.IP, net.IPv6len)
+	var magic [MagicBytes]byte
+	var fromAddressData, toAddressData [4]byte
+	fromAddressPort, toAddressPort := uint16(40000), uint16(50000)
+
+	assert.Equal(t, 0.0, testing.AllocsPerRun(100, func() {
+		index := 0
+		WriteAddress(packetData, &index, address)
+		index = 0
+		ReadAddress(packetData, &index, &readAddress)
+		GenerateChonkle(packetData[2:2+ChonkleBytes], magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, PacketBytes)
+		GeneratePittle(packetData[PacketBytes-PittleBytes:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, PacketBytes)
+		AdvancedPacketFilter(packetData, magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, PacketBytes)
+	}))
+
+	var sharedKey [SharedKeyBytes_Box]byte
+	nonce := make([]byte, NonceBytes_Box)
+
+	assert.Equal(t, 0.0, testing.AllocsPerRun(100, func() {
+		Encrypt_SharedBox(sharedKey[:], nonce, packetData, PacketBytes-HMACBytes_Box)
+		Decrypt_SharedBox(sharedKey[:], nonce, packetData, PacketBytes)
+	}))
+
+	// streams are pooled, so packets and tokens are written and read without allocating
+
+	var prefix, readPrefix PacketPrefix
+	var header, readHeader PayloadHeader
+	var forwardPacket, readForwardPacket InternalForwardPacket
+	forwardPacket.GatewayAddress = *ParseAddress("127.0.0.1:40000")
+	forwardPacket.ClientAddress = *address
+	forwardPacket.Payload = packetData[:MinPayloadBytes]
+	readForwardPacket.GatewayAddress.IP = make(net.IP, net.IPv6len)
+	readForwardPacket.ClientAddress.IP = make(net.IP, net.IPv6len)
+	forwardPacketData := make([]byte, PacketBytes)
+
+	assert.Equal(t, 0.0, testing.AllocsPerRun(100, func() {
+		index := 0
+		WriteObject(packetData, &index, &prefix)
+		WriteObject(packetData, &index, &header)
+		index = 0
+		ReadObject(packetData, &index, &readPrefix)
+		ReadObject(packetData, &index, &readHeader)
+		index = 0
+		forwardPacket.Write(forwardPacketData, &index)
+		index = 0
+		readForwardPacket.Read(forwardPacketData[:forwardPacket.Size()], &index)
+	}))
+
+	pool := NewPacketPool(1, PacketBytes)
+	pool.Put(pool.Get())
+
+	assert.Equal(t, 0.0, testing.AllocsPerRun(100, func() {
+		pool.Put(pool.Get())
+	}))
+
+	// hot paths check the session logger before every debug log
+
+	logger := Log.WithSession(RandomBytes(SessionIdBytes))
+	SetSessionLogLevel("other session", LogLevel_Debug)
+	defer ClearSessionLogLevel("other session")
+
+	assert.Equal(t, 0.0, testing.AllocsPerRun(100, func() {
+		logger.DebugEnabled()
+	}))
+}
+
+func TestBatchConnZeroAllocations(t *testing.T) {
+
+	const PacketBytes = 1500
+
+	conn, err := net.ListenUDP("udp", ParseAddress("127.0.0.1:0"))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	batchConn := NewBatchConn(conn, 8, PacketBytes)
+
+	address := conn.LocalAddr().(*net.UDPAddr)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		packetData := batchConn.WritePacket()
+		packetData[0] = 1
+		batchConn.CommitPacket(100, address)
+		batchConn.Flush()
+		batchConn.ReadBatch()
+		batchConn.Packet(0)
+	})
+
+	if runtime.GOOS == "linux" {
+		assert.Equal(t, 0.0, allocs)
+	}
+}
@@ -0,0 +1,42 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"net"
+)
+
+const DefaultBatchSize = 64
+
+func (batchConn *BatchConn) Conn() *net.UDPConn {
+	return batchConn.conn
+}
+
+// IsTimeout reports whether a read failed because the read deadline passed, rather than because the socket failed or was closed.
+// Setting a deadline in the past is how another goroutine wakes up a thread blocked in ReadBatch.
+func IsTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// WriteTo copies a packet into the batch.
+func (batchConn *BatchConn) WriteTo(packetData []byte, to *net.UDPAddr) {
+	batchConn.CommitPacket(copy(batchConn.WritePacket(), packetData), to)
+}
@@ -0,0 +1,261 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmsghdr matches struct mmsghdr. Go pads it out to the alignment of msghdr, just like C.
+type mmsghdr struct {
+	Hdr unix.Msghdr
+	Len uint32
+}
+
+// BatchConn reads and writes batches of packets with one syscall per batch (recvmmsg/sendmmsg on linux).
+// Packets are built in place in a preallocated batch, and sent on Flush or when the batch is full.
+// A BatchConn must only be used from one goroutine, but several BatchConns may share the same socket.
+// On linux it calls recvmmsg and sendmmsg directly rather than going through x/net,
+// so reading a packet doesn't allocate a new source address for every packet.
+type BatchConn struct {
+	conn      *net.UDPConn
+	rawConn   syscall.RawConn
+	family    int
+	read      batchBuffers
+	write     batchBuffers
+	numRead   int
+	numWrite  int
+	readFunc  func(fileDescriptor uintptr) bool
+	readErr   error
+	writeFunc func(fileDescriptor uintptr) bool
+	sending   []mmsghdr
+	numSent   int
+	writeErr  syscall.Errno
+	flushErr  error
+}
+
+type batchBuffers struct {
+	buffers [][]byte
+	headers []mmsghdr
+	iovecs  []unix.Iovec
+	names   []unix.RawSockaddrInet6
+	address []net.UDPAddr
+	ip      [][net.IPv6len]byte
+}
+
+func newBatchBuffers(batchSize int, maxPacketSize int) batchBuffers {
+	b := batchBuffers{}
+	b.buffers = make([][]byte, batchSize)
+	b.headers = make([]mmsghdr, batchSize)
+	b.iovecs = make([]unix.Iovec, batchSize)
+	b.names = make([]unix.RawSockaddrInet6, batchSize)
+	b.address = make([]net.UDPAddr, batchSize)
+	b.ip = make([][net.IPv6len]byte, batchSize)
+	for i := 0; i < batchSize; i++ {
+		b.buffers[i] = make([]byte, maxPacketSize)
+		b.iovecs[i].Base = &b.buffers[i][0]
+		b.iovecs[i].SetLen(maxPacketSize)
+		b.headers[i].Hdr.Name = (*byte)(unsafe.Pointer(&b.names[i]))
+		b.headers[i].Hdr.Iov = &b.iovecs[i]
+		b.headers[i].Hdr.SetIovlen(1)
+	}
+	return b
+}
+
+// swap exchanges packets i and j. The headers keep pointing at their own iovec and name, so the contents move instead.
+func (b *batchBuffers) swap(i int, j int) {
+	b.buffers[i], b.buffers[j] = b.buffers[j], b.buffers[i]
+	b.iovecs[i], b.iovecs[j] = b.iovecs[j], b.iovecs[i]
+	b.names[i], b.names[j] = b.names[j], b.names[i]
+	b.headers[i].Len, b.headers[j].Len = b.headers[j].Len, b.headers[i].Len
+	b.headers[i].Hdr.Flags, b.headers[j].Hdr.Flags = b.headers[j].Hdr.Flags, b.headers[i].Hdr.Flags
+}
+
+func NewBatchConn(conn *net.UDPConn, batchSize int, maxPacketSize int) *BatchConn {
+	batchConn := &BatchConn{conn: conn}
+	batchConn.rawConn, _ = conn.SyscallConn()
+	batchConn.family = unix.AF_INET6
+	if localAddress, ok := conn.LocalAddr().(*net.UDPAddr); ok && localAddress.IP.To4() != nil {
+		batchConn.family = unix.AF_INET
+	}
+	batchConn.read = newBatchBuffers(batchSize, maxPacketSize)
+	batchConn.write = newBatchBuffers(batchSize, maxPacketSize)
+	batchConn.readFunc = func(fileDescriptor uintptr) bool {
+		for i := range batchConn.read.headers {
+			batchConn.read.headers[i].Hdr.Namelen = unix.SizeofSockaddrInet6
+		}
+		for {
+			n, _, errno := unix.Syscall6(unix.SYS_RECVMMSG, fileDescriptor, uintptr(unsafe.Pointer(&batchConn.read.headers[0])), uintptr(len(batchConn.read.headers)), 0, 0, 0)
+			switch errno {
+			case 0:
+				batchConn.numRead = int(n)
+				batchConn.readErr = nil
+				return true
+			case unix.EINTR:
+				continue
+			case unix.EAGAIN:
+				return false
+			default:
+				batchConn.readErr = errno
+				return true
+			}
+		}
+	}
+	batchConn.writeFunc = func(fileDescriptor uintptr) bool {
+		n, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, fileDescriptor, uintptr(unsafe.Pointer(&batchConn.sending[0])), uintptr(len(batchConn.sending)), 0, 0, 0)
+		if errno == unix.EAGAIN || errno == unix.EINTR {
+			return false
+		}
+		batchConn.numSent = int(n)
+		batchConn.writeErr = errno
+		return true
+	}
+	return batchConn
+}
+
+// ReadBatch blocks until at least one packet is available, then returns the number of packets read. Packets bigger
+// than the max packet size are dropped rather than returned truncated, so it can return zero packets.
+func (batchConn *BatchConn) ReadBatch() (int, error) {
+	batchConn.numRead = 0
+	if err := batchConn.rawConn.Read(batchConn.readFunc); err != nil {
+		return 0, err
+	}
+	if batchConn.readErr != nil {
+		return 0, batchConn.readErr
+	}
+	numRead := 0
+	for i := 0; i < batchConn.numRead; i++ {
+		if batchConn.read.headers[i].Hdr.Flags&unix.MSG_TRUNC != 0 {
+			continue
+		}
+		if i != numRead {
+			batchConn.read.swap(i, numRead)
+		}
+		parseSockaddr(&batchConn.read.names[numRead], &batchConn.read.address[numRead], &batchConn.read.ip[numRead])
+		numRead++
+	}
+	batchConn.numRead = numRead
+	return batchConn.numRead, nil
+}
+
+// Packet returns packet i from the last ReadBatch. The data and address are only valid until the next call to ReadBatch.
+func (batchConn *BatchConn) Packet(i int) ([]byte, *net.UDPAddr) {
+	return batchConn.read.buffers[i][:batchConn.read.headers[i].Len], &batchConn.read.address[i]
+}
+
+// WritePacket returns the buffer for the next packet to write. Fill it, then call CommitPacket.
+// If the batch is full it is sent first, and any error is returned by the next call to Flush.
+func (batchConn *BatchConn) WritePacket() []byte {
+	if batchConn.numWrite == len(batchConn.write.headers) {
+		if err := batchConn.flush(); err != nil {
+			batchConn.flushErr = err
+		}
+	}
+	return batchConn.write.buffers[batchConn.numWrite]
+}
+
+// CommitPacket queues the packet to send on the next flush. A packet to an address the socket can't send to, like an
+// IPv6 address on an IPv4 socket, is dropped, and the error is returned by the next call to Flush.
+func (batchConn *BatchConn) CommitPacket(packetBytes int, to *net.UDPAddr) {
+	i := batchConn.numWrite
+	namelen, ok := writeSockaddr(&batchConn.write.names[i], to, batchConn.family)
+	if !ok {
+		batchConn.flushErr = fmt.Errorf("cannot send to %s: address family does not match socket", to)
+		return
+	}
+	batchConn.write.iovecs[i].SetLen(packetBytes)
+	batchConn.write.headers[i].Hdr.Namelen = namelen
+	batchConn.numWrite++
+}
+
+// Flush sends all packets written since the last flush. If a packet fails to send, it is skipped
+// so the rest of the batch still goes out, and the last error is returned.
+func (batchConn *BatchConn) Flush() error {
+	err := batchConn.flush()
+	if err == nil {
+		err = batchConn.flushErr
+	}
+	batchConn.flushErr = nil
+	return err
+}
+
+func (batchConn *BatchConn) flush() error {
+	batchConn.sending = batchConn.write.headers[:batchConn.numWrite]
+	batchConn.numWrite = 0
+	var lastErr error
+	for len(batchConn.sending) > 0 {
+		if err := batchConn.rawConn.Write(batchConn.writeFunc); err != nil {
+			return err
+		}
+		if batchConn.writeErr != 0 {
+			lastErr = batchConn.writeErr
+			batchConn.numSent = 1
+		}
+		batchConn.sending = batchConn.sending[batchConn.numSent:]
+	}
+	return lastErr
+}
+
+func parseSockaddr(name *unix.RawSockaddrInet6, address *net.UDPAddr, ip *[net.IPv6len]byte) {
+	port := (*[2]byte)(unsafe.Pointer(&name.Port))
+	address.Port = int(port[0])<<8 | int(port[1])
+	address.Zone = ""
+	if name.Family == unix.AF_INET {
+		name4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(name))
+		address.IP = ip[:net.IPv4len]
+		copy(address.IP, name4.Addr[:])
+		return
+	}
+	address.IP = ip[:net.IPv6len]
+	copy(address.IP, name.Addr[:])
+}
+
+// writeSockaddr fills in the sockaddr for the address and returns its length. It returns false if the address isn't
+// in the socket's family, since an IPv4 socket can't send to an IPv6 address.
+func writeSockaddr(name *unix.RawSockaddrInet6, address *net.UDPAddr, family int) (uint32, bool) {
+	if family == unix.AF_INET {
+		ip := address.IP.To4()
+		if ip == nil {
+			return 0, false
+		}
+		name4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(name))
+		name4.Family = unix.AF_INET
+		port := (*[2]byte)(unsafe.Pointer(&name4.Port))
+		port[0] = byte(address.Port >> 8)
+		port[1] = byte(address.Port)
+		copy(name4.Addr[:], ip)
+		return unix.SizeofSockaddrInet4, true
+	}
+	ip := address.IP.To16()
+	if ip == nil {
+		return 0, false
+	}
+	name.Family = unix.AF_INET6
+	port := (*[2]byte)(unsafe.Pointer(&name.Port))
+	port[0] = byte(address.Port >> 8)
+	port[1] = byte(address.Port)
+	copy(name.Addr[:], ip)
+	return unix.SizeofSockaddrInet6, true
+}
@@ -0,0 +1,145 @@
+//go:build !linux
+// +build !linux
+
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// BatchConn reads and writes batches of packets with one syscall per batch (recvmmsg/sendmmsg on linux).
+// Packets are built in place in a preallocated batch, and sent on Flush or when the batch is full.
+// A BatchConn must only be used from one goroutine, but several BatchConns may share the same socket.
+type BatchConn struct {
+	conn          *net.UDPConn
+	packetConn    *ipv4.PacketConn
+	ipv4          bool
+	maxPacketSize int
+	readMessages  []ipv4.Message
+	writeMessages []ipv4.Message
+	writeBuffers  [][]byte
+	writeAddress  []net.UDPAddr
+	writeIP       [][net.IPv6len]byte
+	numWrite      int
+	flushErr      error
+}
+
+func NewBatchConn(conn *net.UDPConn, batchSize int, maxPacketSize int) *BatchConn {
+	batchConn := &BatchConn{conn: conn, packetConn: ipv4.NewPacketConn(conn), maxPacketSize: maxPacketSize}
+	if localAddress, ok := conn.LocalAddr().(*net.UDPAddr); ok && localAddress.IP.To4() != nil {
+		batchConn.ipv4 = true
+	}
+	batchConn.readMessages = make([]ipv4.Message, batchSize)
+	batchConn.writeMessages = make([]ipv4.Message, batchSize)
+	batchConn.writeBuffers = make([][]byte, batchSize)
+	batchConn.writeAddress = make([]net.UDPAddr, batchSize)
+	batchConn.writeIP = make([][net.IPv6len]byte, batchSize)
+	for i := 0; i < batchSize; i++ {
+		// one byte more than the max packet size, so a packet that doesn't fit shows up as too big
+		batchConn.readMessages[i].Buffers = [][]byte{make([]byte, maxPacketSize+1)}
+		batchConn.writeBuffers[i] = make([]byte, maxPacketSize)
+		batchConn.writeMessages[i].Buffers = make([][]byte, 1)
+	}
+	return batchConn
+}
+
+// ReadBatch blocks until at least one packet is available, then returns the number of packets read. Packets bigger
+// than the max packet size are dropped rather than returned truncated, so it can return zero packets.
+func (batchConn *BatchConn) ReadBatch() (int, error) {
+	n, err := batchConn.packetConn.ReadBatch(batchConn.readMessages, 0)
+	if err != nil {
+		return 0, err
+	}
+	numRead := 0
+	for i := 0; i < n; i++ {
+		if batchConn.readMessages[i].N > batchConn.maxPacketSize {
+			continue
+		}
+		batchConn.readMessages[i], batchConn.readMessages[numRead] = batchConn.readMessages[numRead], batchConn.readMessages[i]
+		numRead++
+	}
+	return numRead, nil
+}
+
+// Packet returns packet i from the last ReadBatch. The data is only valid until the next call to ReadBatch.
+func (batchConn *BatchConn) Packet(i int) ([]byte, *net.UDPAddr) {
+	message := &batchConn.readMessages[i]
+	from, _ := message.Addr.(*net.UDPAddr)
+	return message.Buffers[0][:message.N], from
+}
+
+// WritePacket returns the buffer for the next packet to write. Fill it, then call CommitPacket.
+// If the batch is full it is sent first, and any error is returned by the next call to Flush.
+func (batchConn *BatchConn) WritePacket() []byte {
+	if batchConn.numWrite == len(batchConn.writeMessages) {
+		if err := batchConn.flush(); err != nil {
+			batchConn.flushErr = err
+		}
+	}
+	return batchConn.writeBuffers[batchConn.numWrite]
+}
+
+// CommitPacket queues the packet to send on the next flush. A packet to an address the socket can't send to, like an
+// IPv6 address on an IPv4 socket, is dropped, and the error is returned by the next call to Flush.
+func (batchConn *BatchConn) CommitPacket(packetBytes int, to *net.UDPAddr) {
+	if (batchConn.ipv4 && to.IP.To4() == nil) || to.IP.To16() == nil {
+		batchConn.flushErr = fmt.Errorf("cannot send to %s: address family does not match socket", to)
+		return
+	}
+	i := batchConn.numWrite
+	ip := batchConn.writeIP[i][:copy(batchConn.writeIP[i][:], to.IP)]
+	batchConn.writeAddress[i] = net.UDPAddr{IP: ip, Port: to.Port, Zone: to.Zone}
+	batchConn.writeMessages[i].Buffers[0] = batchConn.writeBuffers[i][:packetBytes]
+	batchConn.writeMessages[i].Addr = &batchConn.writeAddress[i]
+	batchConn.numWrite++
+}
+
+// Flush sends all packets written since the last flush. If a packet fails to send, it is skipped
+// so the rest of the batch still goes out, and the last error is returned.
+func (batchConn *BatchConn) Flush() error {
+	err := batchConn.flush()
+	if err == nil {
+		err = batchConn.flushErr
+	}
+	batchConn.flushErr = nil
+	return err
+}
+
+func (batchConn *BatchConn) flush() error {
+	messages := batchConn.writeMessages[:batchConn.numWrite]
+	batchConn.numWrite = 0
+	var lastErr error
+	for len(messages) > 0 {
+		sent, err := batchConn.packetConn.WriteBatch(messages, 0)
+		if err != nil {
+			lastErr = err
+			if sent <= 0 {
+				sent = 1
+			}
+		}
+		messages = messages[sent:]
+	}
+	return lastErr
+}
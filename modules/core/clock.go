@@ -0,0 +1,164 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is where the client, gateway, server, auth and virtual network get the time for token expiry, challenge
+// expiry, session map swaps, bandwidth windows and the client frame loop. Tests use a FakeClock and move time
+// forward, instead of sleeping until a token expires. Shutdown deadlines and socket read deadlines are always
+// wall clock time, since they bound how long the process waits.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is like time.Timer. Reset lets a loop wait on the same timer every time around, instead of allocating
+// a new one. It must only be called on a timer that has fired and been received from, or has been stopped.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration)
+}
+
+type systemClock struct{}
+
+type systemTimer struct {
+	timer *time.Timer
+}
+
+// SystemClock is the real time.
+var SystemClock Clock = &systemClock{}
+
+func (clock *systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (clock *systemClock) NewTimer(d time.Duration) Timer {
+	return &systemTimer{timer: time.NewTimer(d)}
+}
+
+func (timer *systemTimer) C() <-chan time.Time {
+	return timer.timer.C
+}
+
+func (timer *systemTimer) Stop() bool {
+	return timer.timer.Stop()
+}
+
+func (timer *systemTimer) Reset(d time.Duration) {
+	timer.timer.Reset(d)
+}
+
+// FakeClock only moves when Advance is called. Timers fire in deadline order as the clock passes them.
+type FakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	deadline time.Time
+	channel  chan time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *FakeClock) NewTimer(d time.Duration) Timer {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	timer := &fakeTimer{clock: clock, channel: make(chan time.Time, 1)}
+	clock.start(timer, d)
+	return timer
+}
+
+// start must be called with the mutex held.
+func (clock *FakeClock) start(timer *fakeTimer, d time.Duration) {
+	timer.deadline = clock.now.Add(d)
+	if d <= 0 {
+		timer.channel <- clock.now
+		return
+	}
+	clock.timers = append(clock.timers, timer)
+}
+
+// Advance moves the clock forward and fires every timer with a deadline up to the new time.
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.now = clock.now.Add(d)
+	sort.SliceStable(clock.timers, func(i, j int) bool { return clock.timers[i].deadline.Before(clock.timers[j].deadline) })
+	fired := 0
+	for fired < len(clock.timers) && !clock.timers[fired].deadline.After(clock.now) {
+		clock.timers[fired].channel <- clock.now
+		fired++
+	}
+	clock.timers = append(clock.timers[:0], clock.timers[fired:]...)
+}
+
+// Timers is the number of timers waiting to fire.
+func (clock *FakeClock) Timers() int {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return len(clock.timers)
+}
+
+func (timer *fakeTimer) C() <-chan time.Time {
+	return timer.channel
+}
+
+func (timer *fakeTimer) Stop() bool {
+	clock := timer.clock
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.stop(timer)
+}
+
+func (timer *fakeTimer) Reset(d time.Duration) {
+	clock := timer.clock
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.stop(timer)
+	clock.start(timer, d)
+}
+
+// stop must be called with the mutex held.
+func (clock *FakeClock) stop(timer *fakeTimer) bool {
+	for i := range clock.timers {
+		if clock.timers[i] == timer {
+			clock.timers = append(clock.timers[:i], clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
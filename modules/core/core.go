@@ -19,21 +19,18 @@
 
 package core
 
-// #cgo pkg-config: libsodium
-// #include <sodium.h>
-import "C"
-
 import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
-	"hash/fnv"
 	"math"
 	"net"
-	"os"
 	"strconv"
+	"sync"
 	"time"
+
+	"golang.org/x/net/bpf"
 )
 
 const MagicBytes = 8
@@ -50,14 +47,23 @@ const PittleBytes = 2
 const AddressBytes = 19
 const PacketTypeBytes = 1
 const FlagsBytes = 1
+const ReasonBytes = 1
+
+const PacketVersion = byte(0)
 
-const PayloadPacket = byte(0)
-const ChallengePacket = byte(1)
+const PacketType_Payload = byte(0)
+const PacketType_Challenge = byte(1)
+const PacketType_Disconnect = byte(2)
+const PacketType_Keepalive = byte(3)
+
+const DisconnectReason_GatewayShutdown = byte(0)
+const DisconnectReason_ServerShutdown = byte(1)
 
 const PublicKeyBytes_Box = 32
 const PrivateKeyBytes_Box = 32
 const NonceBytes_Box = 24
 const HMACBytes_Box = 16
+const SharedKeyBytes_Box = 32
 
 const PrivateKeyBytes_SecretBox = 32
 const NonceBytes_SecretBox = 24
@@ -67,14 +73,35 @@ const PrefixBytes = VersionBytes + PacketTypeBytes + ChonkleBytes + EncryptedSes
 const HeaderBytes = SessionIdBytes + SequenceBytes + AckBytes + AckBitsBytes + GatewayIdBytes + ServerIdBytes + PacketTypeBytes + FlagsBytes
 const PostfixBytes = HMACBytes_Box + PittleBytes
 
+// PayloadPacketEncryptIndex is where encryption starts in a payload packet between a client and a gateway. The session id
+// and sequence at the start of the header are sent in the clear, so the gateway can find the session and build the nonce.
+const PayloadPacketEncryptIndex = PrefixBytes + SessionIdBytes + SequenceBytes
+
 const MinPayloadBytes = 1000
 
+const MaxPacketBytes = 1500
+
+// MaxPayloadBytes is the largest payload that fits in a packet on every hop. Client packets that carry a
+// challenge token have the most besides the payload.
+const MaxPayloadBytes = MaxPacketBytes - (PrefixBytes + HeaderBytes + EncryptedChallengeTokenBytes + PostfixBytes)
+
 const MinPacketSize = PrefixBytes + HeaderBytes + MinPayloadBytes + PostfixBytes
 
+// KeepalivePacketBytes is the size of a keepalive packet. It is a payload packet with no payload, sent while there is
+// nothing else to send, so the session stays open and acks and session tokens still get through.
+const KeepalivePacketBytes = PrefixBytes + HeaderBytes + PostfixBytes
+
+// KeepaliveInterval is the least time between keepalive packets, in each direction.
+const KeepaliveInterval = 100 * time.Millisecond
+
 const Flags_ChallengeToken = (1 << 0)
 
 const ChallengePacketBytes = PrefixBytes + NonceBytes_Box + EncryptedChallengeTokenBytes + SequenceBytes + GatewayIdBytes + PostfixBytes
 
+const DisconnectPacketBytes = PrefixBytes + NonceBytes_Box + GatewayIdBytes + ReasonBytes + PostfixBytes
+const InternalDisconnectPacketBytes = VersionBytes + PacketTypeBytes + AddressBytes + SessionIdBytes + ReasonBytes
+const InternalForwardPacketHeaderBytes = VersionBytes + PacketTypeBytes + AddressBytes + AddressBytes + EncryptedSessionTokenBytes + SequenceBytes + HeaderBytes
+
 const ConnectTokenExpireSeconds = 20
 const SessionTokenExtensionSeconds = 10
 
@@ -85,7 +112,7 @@ const PacketsPerSecondBytes = 1
 const SessionTokenBytes = 8 + SessionIdBytes + UserIdBytes + EnvelopeBytes + PacketsPerSecondBytes
 const EncryptedSessionTokenBytes = NonceBytes_SecretBox + SessionTokenBytes + HMACBytes_SecretBox
 
-const ConnectDataBytes = PublicKeyBytes_Box + PrivateKeyBytes_Box + AddressBytes + PublicKeyBytes_Box + EnvelopeBytes + PacketsPerSecondBytes
+const ConnectDataBytes = PublicKeyBytes_Box + AddressBytes + PublicKeyBytes_Box + EnvelopeBytes + PacketsPerSecondBytes
 
 const ConnectTokenBytes = ConnectDataBytes + EncryptedSessionTokenBytes
 
@@ -93,91 +120,6 @@ const EthernetHeaderBytes = 18
 const IPv4HeaderBytes = 18
 const UDPHeaderBytes = 8
 
-func Keygen_Box() ([]byte, []byte) {
-	var publicKey [PublicKeyBytes_Box]byte
-	var privateKey [PrivateKeyBytes_Box]byte
-	C.crypto_box_keypair((*C.uchar)(&publicKey[0]),
-		(*C.uchar)(&privateKey[0]))
-	return publicKey[:], privateKey[:]
-}
-
-func Encrypt_Box(senderPrivateKey []byte, receiverPublicKey []byte, nonce []byte, buffer []byte, bytes int) int {
-	C.crypto_box_easy((*C.uchar)(&buffer[0]),
-		(*C.uchar)(&buffer[0]),
-		C.ulonglong(bytes),
-		(*C.uchar)(&nonce[0]),
-		(*C.uchar)(&receiverPublicKey[0]),
-		(*C.uchar)(&senderPrivateKey[0]))
-	return bytes + HMACBytes_Box
-}
-
-func Decrypt_Box(senderPublicKey []byte, receiverPrivateKey []byte, nonce []byte, buffer []byte, bytes int) error {
-	result := C.crypto_box_open_easy(
-		(*C.uchar)(&buffer[0]),
-		(*C.uchar)(&buffer[0]),
-		C.ulonglong(bytes),
-		(*C.uchar)(&nonce[0]),
-		(*C.uchar)(&senderPublicKey[0]),
-		(*C.uchar)(&receiverPrivateKey[0]))
-	if result != 0 {
-		return fmt.Errorf("failed to decrypt: result = %d", result)
-	} else {
-		return nil
-	}
-}
-
-func Keygen_SecretBox() []byte {
-	key := make([]byte, PrivateKeyBytes_SecretBox)
-	C.crypto_secretbox_keygen((*C.uchar)(&key[0]))
-	return key
-}
-
-func Encrypt_SecretBox(privateKey []byte, nonce []byte, buffer []byte, bytes int) int {
-	C.crypto_secretbox_easy((*C.uchar)(&buffer[0]),
-		(*C.uchar)(&buffer[0]),
-		C.ulonglong(bytes),
-		(*C.uchar)(&nonce[0]),
-		(*C.uchar)(&privateKey[0]))
-	return bytes + HMACBytes_SecretBox
-}
-
-func Decrypt_SecretBox(privateKey []byte, nonce []byte, buffer []byte, bytes int) error {
-	result := C.crypto_secretbox_open_easy(
-		(*C.uchar)(&buffer[0]),
-		(*C.uchar)(&buffer[0]),
-		C.ulonglong(bytes),
-		(*C.uchar)(&nonce[0]),
-		(*C.uchar)(&privateKey[0]))
-	if result != 0 {
-		return fmt.Errorf("failed to decrypt: result = %d", result)
-	} else {
-		return nil
-	}
-}
-
-var debugLogs bool
-
-func init() {
-	value, ok := os.LookupEnv("UDPX_DEBUG_LOGS")
-	if ok && value == "1" {
-		debugLogs = true
-	}
-}
-
-func Error(s string, params ...interface{}) {
-	fmt.Printf("error: "+s+"\n", params...)
-}
-
-func Debug(s string, params ...interface{}) {
-	if debugLogs {
-		fmt.Printf(s+"\n", params...)
-	}
-}
-
-func Info(s string, params ...interface{}) {
-	fmt.Printf(s+"\n", params...)
-}
-
 const (
 	IPAddressNone = 0
 	IPAddressIPv4 = 1
@@ -259,7 +201,7 @@ func WriteBytes(data []byte, index *int, value []byte, numBytes int) {
 }
 
 func WriteAddress(buffer []byte, index *int, address *net.UDPAddr) {
-	if address == nil {
+	if address == nil || len(address.IP) == 0 {
 		buffer[*index] = IPAddressNone
 		*index += AddressBytes
 		return
@@ -383,20 +325,39 @@ func ReadBytes(data []byte, index *int, value []byte, bytes uint32) bool {
 	return true
 }
 
+// ReadAddress reuses the storage behind address.IP when it is big enough, so hot paths can read
+// addresses without allocating. Don't pass in an address whose IP is shared with something else.
+// A none address reads back as an address with an empty IP. Unknown address types are rejected.
 func ReadAddress(buffer []byte, index *int, address *net.UDPAddr) bool {
+	if *index < 0 || *index+AddressBytes > len(buffer) {
+		return false
+	}
 	addressType := buffer[*index]
+	ip := address.IP
+	if cap(ip) >= net.IPv6len {
+		ip = ip[:net.IPv6len]
+	} else {
+		ip = make(net.IP, net.IPv6len)
+	}
 	switch addressType {
+	case IPAddressNone:
+		*address = net.UDPAddr{IP: ip[:0]}
 	case IPAddressIPv4:
-		*address = net.UDPAddr{IP: net.IPv4(buffer[*index+1], buffer[*index+2], buffer[*index+3], buffer[*index+4]), Port: ((int)(binary.LittleEndian.Uint16(buffer[*index+5:])))}
-		break
+		copy(ip, v4InV6Prefix)
+		copy(ip[12:], buffer[*index+1:*index+5])
+		*address = net.UDPAddr{IP: ip, Port: ((int)(binary.LittleEndian.Uint16(buffer[*index+5:])))}
 	case IPAddressIPv6:
-		*address = net.UDPAddr{IP: buffer[*index+1:], Port: ((int)(binary.LittleEndian.Uint16(buffer[*index+17:])))}
-		break
+		copy(ip, buffer[*index+1:*index+17])
+		*address = net.UDPAddr{IP: ip, Port: ((int)(binary.LittleEndian.Uint16(buffer[*index+17:])))}
+	default:
+		return false
 	}
 	*index += AddressBytes
 	return true
 }
 
+var v4InV6Prefix = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
+
 func RandomBytes(bytes int) []byte {
 	buffer := make([]byte, bytes)
 	_, _ = rand.Read(buffer)
@@ -446,6 +407,17 @@ func GeneratePittle(output []byte, fromAddress []byte, fromPort uint16, toAddres
 	output[1] = 1 | ((255 - output[0]) ^ 113)
 }
 
+const fnvOffset64 = 14695981039346656037
+const fnvPrime64 = 1099511628211
+
+func fnvHash64a(hash uint64, data []byte) uint64 {
+	for _, c := range data {
+		hash ^= uint64(c)
+		hash *= fnvPrime64
+	}
+	return hash
+}
+
 func GenerateChonkle(output []byte, magic []byte, fromAddressData []byte, fromPort uint16, toAddressData []byte, toPort uint16, packetLength int) {
 
 	var fromPortData [2]byte
@@ -457,14 +429,15 @@ func GenerateChonkle(output []byte, magic []byte, fromAddressData []byte, fromPo
 	var packetLengthData [4]byte
 	binary.LittleEndian.PutUint32(packetLengthData[:], uint32(packetLength))
 
-	hash := fnv.New64a()
-	hash.Write(magic)
-	hash.Write(fromAddressData)
-	hash.Write(fromPortData[:])
-	hash.Write(toAddressData)
-	hash.Write(toPortData[:])
-	hash.Write(packetLengthData[:])
-	hashValue := hash.Sum64()
+	// fnv-1a, inlined so the packet filter doesn't allocate
+
+	hashValue := uint64(fnvOffset64)
+	hashValue = fnvHash64a(hashValue, magic)
+	hashValue = fnvHash64a(hashValue, fromAddressData)
+	hashValue = fnvHash64a(hashValue, fromPortData[:])
+	hashValue = fnvHash64a(hashValue, toAddressData)
+	hashValue = fnvHash64a(hashValue, toPortData[:])
+	hashValue = fnvHash64a(hashValue, packetLengthData[:])
 
 	var data [8]byte
 	binary.LittleEndian.PutUint64(data[:], uint64(hashValue))
@@ -505,6 +478,10 @@ func GenerateChonkle(output []byte, magic []byte, fromAddressData []byte, fromPo
 
 func BasicPacketFilter(packetData []byte, packetLength int) bool {
 
+	if packetLength < VersionBytes+PacketTypeBytes+ChonkleBytes || packetLength > len(packetData) {
+		return false
+	}
+
 	data := packetData[2:]
 
 	if data[0] < 0x2A || data[0] > 0x2D {
@@ -566,7 +543,89 @@ func BasicPacketFilter(packetData []byte, packetLength int) bool {
 	return true
 }
 
+type packetFilterByte struct {
+	Offset int
+	Min    byte
+	Max    byte
+	Values []byte
+}
+
+// packetFilterBytes mirrors the checks in BasicPacketFilter, relative to the start of the packet
+var packetFilterBytes = []packetFilterByte{
+	{Offset: 2, Min: 0x2A, Max: 0x2D},
+	{Offset: 3, Min: 0xC8, Max: 0xE7},
+	{Offset: 4, Min: 0x05, Max: 0x44},
+	{Offset: 6, Min: 0x4E, Max: 0x51},
+	{Offset: 7, Min: 0x60, Max: 0xDF},
+	{Offset: 8, Min: 0x64, Max: 0xE3},
+	{Offset: 9, Values: []byte{0x07, 0x4F}},
+	{Offset: 10, Values: []byte{0x25, 0x53}},
+	{Offset: 11, Min: 0x7C, Max: 0x83},
+	{Offset: 12, Min: 0xAF, Max: 0xB6},
+	{Offset: 13, Min: 0x21, Max: 0x60},
+	{Offset: 14, Values: []byte{0x61, 0x05, 0x2B, 0x0D}},
+	{Offset: 15, Min: 0xD2, Max: 0xF1},
+	{Offset: 16, Min: 0x11, Max: 0x90},
+}
+
+// BasicPacketFilterProgram compiles BasicPacketFilter, plus the packet version and minimum packet size checks,
+// into a classic BPF program so junk packets can be dropped in the kernel before they are copied to user space.
+// Socket filters on UDP sockets see the UDP header in front of the payload, so pass in UDPHeaderBytes for those.
+func BasicPacketFilterProgram(headerBytes int, minPacketBytes int) []bpf.Instruction {
+
+	var program []bpf.Instruction
+
+	// jumps to drop are patched once we know where the end of the program is
+
+	var dropJumps []int
+
+	dropIf := func(instruction bpf.JumpIf) {
+		dropJumps = append(dropJumps, len(program))
+		program = append(program, instruction)
+	}
+
+	program = append(program, bpf.LoadExtension{Num: bpf.ExtLen})
+	dropIf(bpf.JumpIf{Cond: bpf.JumpLessThan, Val: uint32(headerBytes + minPacketBytes)})
+
+	program = append(program, bpf.LoadAbsolute{Off: uint32(headerBytes), Size: 1})
+	dropIf(bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: uint32(PacketVersion)})
+
+	for _, check := range packetFilterBytes {
+		program = append(program, bpf.LoadAbsolute{Off: uint32(headerBytes + check.Offset), Size: 1})
+		if len(check.Values) == 0 {
+			dropIf(bpf.JumpIf{Cond: bpf.JumpLessThan, Val: uint32(check.Min)})
+			dropIf(bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: uint32(check.Max)})
+			continue
+		}
+		for i, value := range check.Values {
+			remaining := len(check.Values) - 1 - i
+			if remaining == 0 {
+				dropIf(bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: uint32(value)})
+			} else {
+				program = append(program, bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(value), SkipTrue: uint8(remaining)})
+			}
+		}
+	}
+
+	program = append(program, bpf.RetConstant{Val: 0xFFFFFFFF})
+
+	drop := len(program)
+
+	program = append(program, bpf.RetConstant{Val: 0})
+
+	for _, i := range dropJumps {
+		jump := program[i].(bpf.JumpIf)
+		jump.SkipTrue = uint8(drop - i - 1)
+		program[i] = jump
+	}
+
+	return program
+}
+
 func AdvancedPacketFilter(data []byte, magic []byte, fromAddress []byte, fromPort uint16, toAddress []byte, toPort uint16, packetLength int) bool {
+	if packetLength < VersionBytes+PacketTypeBytes+ChonkleBytes+PittleBytes || packetLength > len(data) {
+		return false
+	}
 	var a [15]byte
 	var b [2]byte
 	GenerateChonkle(a[:], magic, fromAddress, fromPort, toAddress, toPort, packetLength)
@@ -601,6 +660,29 @@ func AddressEqual(a *net.UDPAddr, b *net.UDPAddr) bool {
 	return net.IP.Equal(a.IP, b.IP) && a.Port == b.Port
 }
 
+// CopyAddress copies an address, including the IP, so it stays valid after the buffer it was read into is reused.
+// The IP in dst is reused, so this only allocates the first time.
+func CopyAddress(dst *net.UDPAddr, src *net.UDPAddr) {
+	dst.IP = append(dst.IP[:0], src.IP...)
+	dst.Port = src.Port
+	dst.Zone = src.Zone
+}
+
+// WaitDeadline waits for the wait group, or until the deadline passes. It returns false if the deadline passed first.
+func WaitDeadline(wg *sync.WaitGroup, deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+}
+
 func IdEqual(a []byte, b []byte) bool {
 	if len(a) != len(b) {
 		return false
@@ -623,20 +705,11 @@ type ChallengeToken struct {
 const ChallengeTokenBytes = 8 + AddressBytes + 8
 const EncryptedChallengeTokenBytes = NonceBytes_SecretBox + ChallengeTokenBytes + HMACBytes_SecretBox
 
-func WriteChallengeToken(buffer []byte, index *int, token *ChallengeToken) {
-	WriteUint64(buffer, index, token.ExpireTimestamp)
-	WriteAddress(buffer, index, &token.ClientAddress)
-	WriteUint64(buffer, index, token.Sequence)
-}
-
-func ReadChallengeToken(buffer []byte, index *int, token *ChallengeToken) bool {
-	if len(buffer)-*index < ChallengeTokenBytes {
-		return false
-	}
-	ReadUint64(buffer, index, &token.ExpireTimestamp)
-	ReadAddress(buffer, index, &token.ClientAddress)
-	ReadUint64(buffer, index, &token.Sequence)
-	return true
+func (token *ChallengeToken) Serialize(stream Stream) error {
+	stream.SerializeUint64(&token.ExpireTimestamp)
+	stream.SerializeAddress(&token.ClientAddress)
+	stream.SerializeUint64(&token.Sequence)
+	return stream.Error()
 }
 
 func WriteEncryptedChallengeToken(buffer []byte, index *int, token *ChallengeToken, privateKey []byte) {
@@ -644,7 +717,7 @@ func WriteEncryptedChallengeToken(buffer []byte, index *int, token *ChallengeTok
 	RandomBytes_InPlace(nonce)
 	*index += NonceBytes_SecretBox
 	tokenData := buffer[*index : *index+ChallengeTokenBytes+HMACBytes_SecretBox]
-	WriteChallengeToken(buffer, index, token)
+	WriteObject(buffer, index, token)
 	Encrypt_SecretBox(privateKey, nonce, tokenData, ChallengeTokenBytes)
 	*index += HMACBytes_SecretBox
 }
@@ -660,47 +733,32 @@ func ReadEncryptedChallengeToken(buffer []byte, index *int, token *ChallengeToke
 	if err != nil {
 		return false
 	}
-	result := ReadChallengeToken(buffer, index, token)
+	result := ReadObject(buffer, index, token)
 	*index += HMACBytes_SecretBox
 	return result
 }
 
 func GetAckBits(latestReceivedSequence uint64, receivedPackets []uint64, ack_bits []byte) {
 	totalBits := uint64(len(ack_bits) * 8)
-	ack := make([]byte, totalBits)
 	bufferSize := uint64(len(receivedPackets))
-	i := 0
-	minSequence := latestReceivedSequence - totalBits
-	for sequence := latestReceivedSequence; sequence > minSequence; sequence-- {
+	for i := uint64(0); i < totalBits && i <= latestReceivedSequence; i++ {
+		sequence := latestReceivedSequence - i
 		if receivedPackets[sequence%bufferSize] == sequence {
-			ack[i] = 1
-		}
-		i++
-	}
-	for i := uint64(0); i < totalBits; i++ {
-		if ack[i] == 1 {
-			byteIndex := i / 8
-			bitIndex := i % 8
-			ack_bits[byteIndex] |= (1 << bitIndex)
+			ack_bits[i/8] |= (1 << (i % 8))
 		}
 	}
 }
 
 func ProcessAcks(ackSequence uint64, ack_bits []byte, ackedPackets []uint64, ackBuffer []uint64) []uint64 {
 	totalBits := uint64(len(ack_bits) * 8)
-	ack := make([]byte, totalBits)
-	for i := uint64(0); i < totalBits; i++ {
-		byteIndex := i / 8
-		bitIndex := i % 8
-		if (ack_bits[byteIndex] & (1 << bitIndex)) != 0 {
-			ack[i] = 1
-		}
-	}
 	bufferSize := uint64(len(ackedPackets))
 	numAcks := 0
 	for i := uint64(0); i < totalBits; i++ {
+		if (ack_bits[i/8] & (1 << (i % 8))) == 0 {
+			continue
+		}
 		sequence := ackSequence - i
-		if ack[i] == 1 && ackedPackets[sequence%bufferSize] != sequence {
+		if ackedPackets[sequence%bufferSize] != sequence {
 			ackBuffer[numAcks] = sequence
 			numAcks++
 		}
@@ -708,6 +766,212 @@ func ProcessAcks(ackSequence uint64, ack_bits []byte, ackedPackets []uint64, ack
 	return ackBuffer[:numAcks]
 }
 
+const ReplayProtectionWindowSize = 1024
+const ReplayProtectionMaxForwardJump = 8192
+
+const (
+	ReplayProtection_Accept    = 0
+	ReplayProtection_Duplicate = 1
+	ReplayProtection_TooOld    = 2
+	ReplayProtection_TooNew    = 3
+)
+
+// ReplayProtection tracks which of the last ReplayProtectionWindowSize sequence numbers have been received,
+// so duplicated and replayed packets can be dropped. Sequence numbers are compared with wraparound.
+// Only call Advance once a packet has been authenticated, otherwise an attacker can move the window.
+type ReplayProtection struct {
+	Initialized        bool
+	MostRecentSequence uint64
+	ReceivedBits       [ReplayProtectionWindowSize / 64]uint64
+}
+
+func (replayProtection *ReplayProtection) Reset(sequence uint64) {
+	replayProtection.Initialized = true
+	replayProtection.MostRecentSequence = sequence
+	for i := range replayProtection.ReceivedBits {
+		replayProtection.ReceivedBits[i] = 0
+	}
+}
+
+func (replayProtection *ReplayProtection) Check(sequence uint64) int {
+	if !replayProtection.Initialized {
+		return ReplayProtection_Accept
+	}
+	delta := int64(sequence - replayProtection.MostRecentSequence)
+	if delta > ReplayProtectionMaxForwardJump {
+		return ReplayProtection_TooNew
+	}
+	if delta > 0 {
+		return ReplayProtection_Accept
+	}
+	if delta <= -ReplayProtectionWindowSize {
+		return ReplayProtection_TooOld
+	}
+	if replayProtection.received(sequence) {
+		return ReplayProtection_Duplicate
+	}
+	return ReplayProtection_Accept
+}
+
+func (replayProtection *ReplayProtection) Advance(sequence uint64) {
+	if !replayProtection.Initialized {
+		replayProtection.Reset(sequence)
+	}
+	delta := int64(sequence - replayProtection.MostRecentSequence)
+	if delta <= -ReplayProtectionWindowSize {
+		return
+	}
+	if delta > 0 {
+		if delta >= ReplayProtectionWindowSize {
+			for i := range replayProtection.ReceivedBits {
+				replayProtection.ReceivedBits[i] = 0
+			}
+		} else {
+			for s := replayProtection.MostRecentSequence + 1; s != sequence; s++ {
+				replayProtection.clear(s)
+			}
+		}
+		replayProtection.MostRecentSequence = sequence
+	}
+	index := sequence % ReplayProtectionWindowSize
+	replayProtection.ReceivedBits[index/64] |= 1 << (index % 64)
+}
+
+func (replayProtection *ReplayProtection) received(sequence uint64) bool {
+	index := sequence % ReplayProtectionWindowSize
+	return (replayProtection.ReceivedBits[index/64] & (1 << (index % 64))) != 0
+}
+
+func (replayProtection *ReplayProtection) clear(sequence uint64) {
+	index := sequence % ReplayProtectionWindowSize
+	replayProtection.ReceivedBits[index/64] &^= 1 << (index % 64)
+}
+
+// TokenBucket refills at a fixed rate up to a burst size. Each packet takes one token.
+type TokenBucket struct {
+	Tokens     float64
+	LastUpdate time.Time
+}
+
+func (bucket *TokenBucket) Take(currentTime time.Time, ratePerSecond float64, burst float64) bool {
+	if !bucket.Refill(currentTime, ratePerSecond, burst) {
+		return false
+	}
+	bucket.Tokens -= 1
+	return true
+}
+
+// Refill adds the tokens earned since the last update, and returns true if there is a token to take. It lets
+// several buckets be checked before a token is taken from any of them.
+func (bucket *TokenBucket) Refill(currentTime time.Time, ratePerSecond float64, burst float64) bool {
+	if bucket.LastUpdate.IsZero() {
+		bucket.Tokens = burst
+	} else if currentTime.After(bucket.LastUpdate) {
+		bucket.Tokens += currentTime.Sub(bucket.LastUpdate).Seconds() * ratePerSecond
+		if bucket.Tokens > burst {
+			bucket.Tokens = burst
+		}
+	}
+	bucket.LastUpdate = currentTime
+	return bucket.Tokens >= 1
+}
+
+const RateLimiterKeyBytes = 32
+const RateLimiterMaxKeys = 100000
+
+type RateLimiterKey [RateLimiterKeyBytes]byte
+
+// RateLimiter holds a token bucket per key. Like the session maps, buckets are timed out by swapping
+// maps, and the swap time is long enough for any idle bucket to have refilled completely.
+// Once RateLimiterMaxKeys buckets are live, new keys share one overflow bucket until the next swap. Spoofed
+// sources can't grow the maps without bound, and get one key's rate between them, while keys that already have
+// a bucket keep it.
+type RateLimiter struct {
+	RatePerSecond float64
+	Burst         float64
+	buckets_Old   map[RateLimiterKey]*TokenBucket
+	buckets_New   map[RateLimiterKey]*TokenBucket
+	overflow      TokenBucket
+	maxKeys       int
+	swapTime      time.Time
+	swapDuration  time.Duration
+}
+
+func NewRateLimiter(ratePerSecond float64, burst float64) *RateLimiter {
+	limiter := &RateLimiter{RatePerSecond: ratePerSecond, Burst: burst}
+	limiter.buckets_Old = make(map[RateLimiterKey]*TokenBucket)
+	limiter.buckets_New = make(map[RateLimiterKey]*TokenBucket)
+	limiter.maxKeys = RateLimiterMaxKeys
+	limiter.swapDuration = time.Second
+	if ratePerSecond > 0 && time.Duration(burst/ratePerSecond*float64(time.Second)) > limiter.swapDuration {
+		limiter.swapDuration = time.Duration(burst / ratePerSecond * float64(time.Second))
+	}
+	return limiter
+}
+
+func (limiter *RateLimiter) Take(key RateLimiterKey, currentTime time.Time) bool {
+	return limiter.Bucket(key, currentTime).Take(currentTime, limiter.RatePerSecond, limiter.Burst)
+}
+
+// Bucket returns the bucket for a key, which is the shared overflow bucket if the key is new and the maps are full.
+func (limiter *RateLimiter) Bucket(key RateLimiterKey, currentTime time.Time) *TokenBucket {
+	if currentTime.After(limiter.swapTime) {
+		limiter.swapTime = currentTime.Add(limiter.swapDuration)
+		limiter.buckets_Old = limiter.buckets_New
+		limiter.buckets_New = make(map[RateLimiterKey]*TokenBucket)
+	}
+	bucket := limiter.buckets_New[key]
+	if bucket == nil {
+		bucket = limiter.buckets_Old[key]
+		if bucket == nil {
+			if len(limiter.buckets_New) >= limiter.maxKeys {
+				return &limiter.overflow
+			}
+			bucket = &TokenBucket{}
+		}
+		limiter.buckets_New[key] = bucket
+	}
+	return bucket
+}
+
+func AddressKey(address *net.UDPAddr) RateLimiterKey {
+	var key RateLimiterKey
+	copy(key[:], address.IP.To16())
+	return key
+}
+
+// PacketPool recycles fixed size buffers that are handed between goroutines, eg. through a channel.
+// It is a bounded free list rather than a sync.Pool, because putting a slice into a sync.Pool allocates.
+type PacketPool struct {
+	free        chan []byte
+	packetBytes int
+}
+
+func NewPacketPool(size int, packetBytes int) *PacketPool {
+	return &PacketPool{free: make(chan []byte, size), packetBytes: packetBytes}
+}
+
+// Get returns a buffer of packetBytes, allocating a new one only if the pool is empty.
+func (pool *PacketPool) Get() []byte {
+	select {
+	case packetData := <-pool.free:
+		return packetData[:pool.packetBytes]
+	default:
+		return make([]byte, pool.packetBytes)
+	}
+}
+
+// Put returns a buffer from Get to the pool. If the pool is full, the buffer is left for the garbage collector.
+func (pool *PacketPool) Put(packetData []byte) {
+	if cap(packetData) < pool.packetBytes {
+		return
+	}
+	select {
+	case pool.free <- packetData:
+	default:
+	}
+}
+
 type SessionToken struct {
 	ExpireTimestamp  uint64
 	SessionId        [SessionIdBytes]byte
@@ -717,26 +981,14 @@ type SessionToken struct {
 	PacketsPerSecond uint8
 }
 
-func WriteSessionToken(buffer []byte, index *int, token *SessionToken) {
-	WriteUint64(buffer, index, token.ExpireTimestamp)
-	WriteBytes(buffer, index, token.SessionId[:], SessionIdBytes)
-	WriteBytes(buffer, index, token.UserId[:], UserIdBytes)
-	WriteUint32(buffer, index, token.EnvelopeUpKbps)
-	WriteUint32(buffer, index, token.EnvelopeDownKbps)
-	WriteUint8(buffer, index, token.PacketsPerSecond)
-}
-
-func ReadSessionToken(buffer []byte, index *int, token *SessionToken) bool {
-	if len(buffer)-*index < SessionTokenBytes {
-		return false
-	}
-	ReadUint64(buffer, index, &token.ExpireTimestamp)
-	ReadBytes(buffer, index, token.SessionId[:], SessionIdBytes)
-	ReadBytes(buffer, index, token.UserId[:], UserIdBytes)
-	ReadUint32(buffer, index, &token.EnvelopeUpKbps)
-	ReadUint32(buffer, index, &token.EnvelopeDownKbps)
-	ReadUint8(buffer, index, &token.PacketsPerSecond)
-	return true
+func (token *SessionToken) Serialize(stream Stream) error {
+	stream.SerializeUint64(&token.ExpireTimestamp)
+	stream.SerializeBytes(token.SessionId[:])
+	stream.SerializeBytes(token.UserId[:])
+	stream.SerializeUint32(&token.EnvelopeUpKbps)
+	stream.SerializeUint32(&token.EnvelopeDownKbps)
+	stream.SerializeUint8(&token.PacketsPerSecond)
+	return stream.Error()
 }
 
 func WriteEncryptedSessionToken(buffer []byte, index *int, token *SessionToken, senderPrivateKey []byte, receiverPublicKey []byte) {
@@ -744,7 +996,7 @@ func WriteEncryptedSessionToken(buffer []byte, index *int, token *SessionToken,
 	RandomBytes_InPlace(nonce)
 	*index += NonceBytes_Box
 	tokenData := buffer[*index : *index+SessionTokenBytes+HMACBytes_Box]
-	WriteSessionToken(buffer, index, token)
+	WriteObject(buffer, index, token)
 	Encrypt_Box(senderPrivateKey, receiverPublicKey, nonce, tokenData, SessionTokenBytes)
 	*index += HMACBytes_Box
 }
@@ -760,14 +1012,25 @@ func ReadEncryptedSessionToken(buffer []byte, index *int, token *SessionToken, s
 	if err != nil {
 		return false
 	}
-	result := ReadSessionToken(buffer, index, token)
+	result := ReadObject(buffer, index, token)
 	*index += HMACBytes_Box
 	return result
 }
 
+func DisconnectReasonString(reason byte) string {
+	switch reason {
+	case DisconnectReason_GatewayShutdown:
+		return "gateway shutdown"
+	case DisconnectReason_ServerShutdown:
+		return "server shutdown"
+	}
+	return fmt.Sprintf("unknown (%d)", reason)
+}
+
+// ConnectData is the public part of a connect token. The client generates its own keypair and only sends
+// the public key to auth, so the client private key never leaves the client.
 type ConnectData struct {
 	ClientPublicKey  [PublicKeyBytes_Box]byte
-	ClientPrivateKey [PrivateKeyBytes_Box]byte
 	GatewayAddress   net.UDPAddr
 	GatewayPublicKey [PublicKeyBytes_Box]byte
 	EnvelopeUpKbps   uint32
@@ -775,37 +1038,21 @@ type ConnectData struct {
 	PacketsPerSecond uint8
 }
 
-func WriteConnectData(buffer []byte, index *int, connectData *ConnectData) {
-	WriteBytes(buffer, index, connectData.ClientPublicKey[:], PublicKeyBytes_Box)
-	WriteBytes(buffer, index, connectData.ClientPrivateKey[:], PrivateKeyBytes_Box)
-	WriteAddress(buffer, index, &connectData.GatewayAddress)
-	WriteBytes(buffer, index, connectData.GatewayPublicKey[:], UserIdBytes)
-	WriteUint32(buffer, index, connectData.EnvelopeUpKbps)
-	WriteUint32(buffer, index, connectData.EnvelopeDownKbps)
-	WriteUint8(buffer, index, connectData.PacketsPerSecond)
-}
-
-func ReadConnectData(buffer []byte, index *int, connectData *ConnectData) bool {
-	if len(buffer)-*index < ConnectDataBytes {
-		return false
-	}
-	ReadBytes(buffer, index, connectData.ClientPublicKey[:], PublicKeyBytes_Box)
-	ReadBytes(buffer, index, connectData.ClientPrivateKey[:], PrivateKeyBytes_Box)
-	ReadAddress(buffer, index, &connectData.GatewayAddress)
-	ReadBytes(buffer, index, connectData.GatewayPublicKey[:], PublicKeyBytes_Box)
-	ReadUint32(buffer, index, &connectData.EnvelopeUpKbps)
-	ReadUint32(buffer, index, &connectData.EnvelopeDownKbps)
-	ReadUint8(buffer, index, &connectData.PacketsPerSecond)
-	return true
+func (connectData *ConnectData) Serialize(stream Stream) error {
+	stream.SerializeBytes(connectData.ClientPublicKey[:])
+	stream.SerializeAddress(&connectData.GatewayAddress)
+	stream.SerializeBytes(connectData.GatewayPublicKey[:])
+	stream.SerializeUint32(&connectData.EnvelopeUpKbps)
+	stream.SerializeUint32(&connectData.EnvelopeDownKbps)
+	stream.SerializeUint8(&connectData.PacketsPerSecond)
+	return stream.Error()
 }
 
-func GenerateConnectToken(userId []byte, envelopeUpKbps uint32, envelopeDownKbps uint32, packetsPerSecond uint8, gatewayAddress *net.UDPAddr, gatewayPublicKey []byte, senderPrivateKey []byte, receiverPublicKey []byte) []byte {
-
-	publicKey, privateKey := Keygen_Box()
+// GenerateConnectToken binds the client public key into the session token as the session id. The session token expires ConnectTokenExpireSeconds after the current time.
+func GenerateConnectToken(clientPublicKey []byte, userId []byte, envelopeUpKbps uint32, envelopeDownKbps uint32, packetsPerSecond uint8, gatewayAddress *net.UDPAddr, gatewayPublicKey []byte, senderPrivateKey []byte, receiverPublicKey []byte, currentTime time.Time) []byte {
 
 	connectData := ConnectData{}
-	copy(connectData.ClientPublicKey[:], publicKey[:])
-	copy(connectData.ClientPrivateKey[:], privateKey[:])
+	copy(connectData.ClientPublicKey[:], clientPublicKey[:])
 	connectData.GatewayAddress = *gatewayAddress
 	copy(connectData.GatewayPublicKey[:], gatewayPublicKey[:])
 	connectData.EnvelopeUpKbps = envelopeUpKbps
@@ -813,7 +1060,7 @@ func GenerateConnectToken(userId []byte, envelopeUpKbps uint32, envelopeDownKbps
 	connectData.PacketsPerSecond = packetsPerSecond
 
 	sessionToken := SessionToken{}
-	sessionToken.ExpireTimestamp = uint64(time.Now().Unix()) + ConnectTokenExpireSeconds
+	sessionToken.ExpireTimestamp = uint64(currentTime.Unix()) + ConnectTokenExpireSeconds
 	copy(sessionToken.SessionId[:], connectData.ClientPublicKey[:])
 	copy(sessionToken.UserId[:], userId[:])
 	sessionToken.EnvelopeUpKbps = envelopeUpKbps
@@ -824,7 +1071,7 @@ func GenerateConnectToken(userId []byte, envelopeUpKbps uint32, envelopeDownKbps
 
 	index := 0
 
-	WriteConnectData(buffer, &index, &connectData)
+	WriteObject(buffer, &index, &connectData)
 
 	WriteEncryptedSessionToken(buffer, &index, &sessionToken, senderPrivateKey, receiverPublicKey)
 
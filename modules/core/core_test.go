@@ -20,10 +20,22 @@
 package core
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/net/bpf"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -170,6 +182,49 @@ func TestAdvancedPacketFilter(t *testing.T) {
 	}
 }
 
+func TestBasicPacketFilterProgram(t *testing.T) {
+
+	t.Parallel()
+
+	vm, err := bpf.NewVM(BasicPacketFilterProgram(UDPHeaderBytes, MinPacketSize))
+	assert.NoError(t, err)
+
+	rand.Seed(42)
+
+	var packet [UDPHeaderBytes + 1500]byte
+
+	for i := 0; i < 100000; i++ {
+
+		packetBytes := MinPacketSize - 10 + rand.Intn(1500-MinPacketSize+10)
+		packetData := packet[UDPHeaderBytes : UDPHeaderBytes+packetBytes]
+
+		randomBytes(packetData)
+
+		// most packets should pass the filter, then mutate them to exercise every check
+
+		if i%4 != 0 {
+			var magic [8]byte
+			var fromAddress [4]byte
+			var toAddress [4]byte
+			randomBytes(magic[:])
+			randomBytes(fromAddress[:])
+			randomBytes(toAddress[:])
+			packetData[0] = PacketVersion
+			GenerateChonkle(packetData[2:], magic[:], fromAddress[:], uint16(i), toAddress[:], uint16(i+1), packetBytes)
+			if i%2 == 0 {
+				packetData[rand.Intn(VersionBytes+PacketTypeBytes+ChonkleBytes)] = byte(rand.Intn(256))
+			}
+		}
+
+		expected := packetBytes >= MinPacketSize && packetData[0] == PacketVersion && BasicPacketFilter(packetData, packetBytes)
+
+		result, err := vm.Run(packet[:UDPHeaderBytes+packetBytes])
+		assert.NoError(t, err)
+
+		assert.Equal(t, expected, result != 0)
+	}
+}
+
 func TestEncryptBox(t *testing.T) {
 
 	t.Parallel()
@@ -220,6 +275,238 @@ func TestEncryptBox(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestEncryptSharedBox(t *testing.T) {
+
+	t.Parallel()
+
+	senderPublicKey, senderPrivateKey := Keygen_Box()
+	receiverPublicKey, receiverPrivateKey := Keygen_Box()
+
+	// both sides compute the same shared key
+
+	var senderSharedKey [SharedKeyBytes_Box]byte
+	var receiverSharedKey [SharedKeyBytes_Box]byte
+
+	SharedKey_Box(receiverPublicKey, senderPrivateKey, senderSharedKey[:])
+	SharedKey_Box(senderPublicKey, receiverPrivateKey, receiverSharedKey[:])
+
+	assert.Equal(t, senderSharedKey, receiverSharedKey)
+
+	// data encrypted with the shared key decrypts with crypto box, and vice versa
+
+	nonce := RandomBytes(NonceBytes_Box)
+
+	data := RandomBytes(256)
+
+	encryptedData := make([]byte, 256+HMACBytes_Box)
+	copy(encryptedData, data)
+
+	encryptedBytes := Encrypt_SharedBox(senderSharedKey[:], nonce, encryptedData, len(data))
+
+	assert.Equal(t, 256+HMACBytes_Box, encryptedBytes)
+
+	err := Decrypt_Box(senderPublicKey, receiverPrivateKey, nonce, encryptedData, encryptedBytes)
+
+	assert.NoError(t, err)
+	assert.Equal(t, data, encryptedData[:len(data)])
+
+	encryptedData = make([]byte, 256+HMACBytes_Box)
+	copy(encryptedData, data)
+
+	Encrypt_Box(senderPrivateKey, receiverPublicKey, nonce, encryptedData, len(data))
+
+	err = Decrypt_SharedBox(receiverSharedKey[:], nonce, encryptedData, encryptedBytes)
+
+	assert.NoError(t, err)
+	assert.Equal(t, data, encryptedData[:len(data)])
+
+	// decryption should fail with garbage data
+
+	garbageData := RandomBytes(256 + HMACBytes_Box)
+
+	err = Decrypt_SharedBox(receiverSharedKey[:], nonce, garbageData, encryptedBytes)
+
+	assert.Error(t, err)
+
+	// decryption should fail with the wrong shared key
+
+	var wrongSharedKey [SharedKeyBytes_Box]byte
+	SharedKey_Box(senderPublicKey, senderPrivateKey, wrongSharedKey[:])
+
+	Encrypt_SharedBox(senderSharedKey[:], nonce, encryptedData, len(data))
+
+	err = Decrypt_SharedBox(wrongSharedKey[:], nonce, encryptedData, encryptedBytes)
+
+	assert.Error(t, err)
+}
+
+// These check the crypto functions against x/crypto/nacl and against known answers generated by the NaCl C
+// implementation, so ciphertexts from the libsodium and pure go builds (-tags nosodium) interoperate.
+
+func TestBoxKnownAnswer(t *testing.T) {
+
+	t.Parallel()
+
+	var privateKey1, privateKey2 [PrivateKeyBytes_Box]byte
+	for i := range privateKey1 {
+		privateKey1[i] = 1
+		privateKey2[i] = 2
+	}
+
+	publicKey1, err := curve25519.X25519(privateKey1[:], curve25519.Basepoint)
+	assert.NoError(t, err)
+
+	var nonce [NonceBytes_Box]byte
+	for i := range nonce {
+		nonce[i] = 4
+	}
+
+	buffer := make([]byte, 64+HMACBytes_Box)
+	for i := 0; i < 64; i++ {
+		buffer[i] = 3
+	}
+
+	expected, _ := hex.DecodeString("78ea30b19d2341ebbdba54180f821eec265cf86312549bea8a37652a8bb94f07b78a73ed1708085e6ddd0e943bbdeb8755079a37eb31d86163ce241164a47629c0539f330b4914cd135b3855bc2a2dfc")
+
+	Encrypt_Box(privateKey2[:], publicKey1, nonce[:], buffer, 64)
+
+	assert.Equal(t, expected, buffer)
+
+	// the same packet through the shared key
+
+	var sharedKey [SharedKeyBytes_Box]byte
+	SharedKey_Box(publicKey1, privateKey2[:], sharedKey[:])
+
+	for i := 0; i < 64; i++ {
+		buffer[i] = 3
+	}
+
+	Encrypt_SharedBox(sharedKey[:], nonce[:], buffer, 64)
+
+	assert.Equal(t, expected, buffer)
+}
+
+func TestSecretBoxKnownAnswer(t *testing.T) {
+
+	t.Parallel()
+
+	var key [PrivateKeyBytes_SecretBox]byte
+	for i := range key {
+		key[i] = 1
+	}
+
+	var nonce [NonceBytes_SecretBox]byte
+	for i := range nonce {
+		nonce[i] = 2
+	}
+
+	buffer := make([]byte, 64+HMACBytes_SecretBox)
+	for i := 0; i < 64; i++ {
+		buffer[i] = 3
+	}
+
+	expected, _ := hex.DecodeString("8442bc313f4626f1359e3b50122b6ce6fe66ddfe7d39d14e637eb4fd5b45beadab55198df6ab5368439792a23c87db70acb6156dc5ef957ac04f6276cf6093b84be77ff0849cc33e34b7254d5a8f65ad")
+
+	Encrypt_SecretBox(key[:], nonce[:], buffer, 64)
+
+	assert.Equal(t, expected, buffer)
+
+	assert.NoError(t, Decrypt_SecretBox(key[:], nonce[:], buffer, len(buffer)))
+
+	for i := 0; i < 64; i++ {
+		assert.Equal(t, byte(3), buffer[i])
+	}
+}
+
+func TestBoxInterop(t *testing.T) {
+
+	t.Parallel()
+
+	for i := 0; i < 100; i++ {
+
+		senderPublicKey, senderPrivateKey := Keygen_Box()
+		receiverPublicKey, receiverPrivateKey := Keygen_Box()
+
+		var senderPublicKeyArray, senderPrivateKeyArray, receiverPublicKeyArray, receiverPrivateKeyArray [32]byte
+		copy(senderPublicKeyArray[:], senderPublicKey)
+		copy(senderPrivateKeyArray[:], senderPrivateKey)
+		copy(receiverPublicKeyArray[:], receiverPublicKey)
+		copy(receiverPrivateKeyArray[:], receiverPrivateKey)
+
+		var nonce [NonceBytes_Box]byte
+		RandomBytes_InPlace(nonce[:])
+
+		message := RandomBytes(rand.Intn(1500))
+
+		// encrypt here, open with x/crypto
+
+		buffer := make([]byte, len(message)+HMACBytes_Box)
+		copy(buffer, message)
+
+		Encrypt_Box(senderPrivateKey, receiverPublicKey, nonce[:], buffer, len(message))
+
+		opened, ok := box.Open(nil, buffer, &nonce, &senderPublicKeyArray, &receiverPrivateKeyArray)
+		assert.True(t, ok)
+		assert.Equal(t, message, opened[:len(message)])
+
+		// seal with x/crypto, decrypt here
+
+		sealed := box.Seal(nil, message, &nonce, &receiverPublicKeyArray, &senderPrivateKeyArray)
+
+		assert.Equal(t, sealed, buffer)
+
+		assert.NoError(t, Decrypt_Box(senderPublicKey, receiverPrivateKey, nonce[:], sealed, len(sealed)))
+		assert.Equal(t, message, sealed[:len(message)])
+
+		// shared keys match
+
+		var sharedKey [SharedKeyBytes_Box]byte
+		var expectedSharedKey [32]byte
+		SharedKey_Box(receiverPublicKey, senderPrivateKey, sharedKey[:])
+		box.Precompute(&expectedSharedKey, &receiverPublicKeyArray, &senderPrivateKeyArray)
+
+		assert.Equal(t, expectedSharedKey, sharedKey)
+	}
+}
+
+func TestSecretBoxInterop(t *testing.T) {
+
+	t.Parallel()
+
+	for i := 0; i < 100; i++ {
+
+		key := Keygen_SecretBox()
+
+		var keyArray [32]byte
+		copy(keyArray[:], key)
+
+		var nonce [NonceBytes_SecretBox]byte
+		RandomBytes_InPlace(nonce[:])
+
+		message := RandomBytes(rand.Intn(1500))
+
+		// encrypt here, open with x/crypto
+
+		buffer := make([]byte, len(message)+HMACBytes_SecretBox)
+		copy(buffer, message)
+
+		Encrypt_SecretBox(key, nonce[:], buffer, len(message))
+
+		opened, ok := secretbox.Open(nil, buffer, &nonce, &keyArray)
+		assert.True(t, ok)
+		assert.Equal(t, message, opened[:len(message)])
+
+		// seal with x/crypto, decrypt here
+
+		sealed := secretbox.Seal(nil, message, &nonce, &keyArray)
+
+		assert.Equal(t, sealed, buffer)
+
+		assert.NoError(t, Decrypt_SecretBox(key, nonce[:], sealed, len(sealed)))
+		assert.Equal(t, message, sealed[:len(message)])
+	}
+}
+
 func TestEncryptSecretBox(t *testing.T) {
 
 	t.Parallel()
@@ -285,7 +572,7 @@ func TestChallengeToken(t *testing.T) {
 
 	index := 0
 
-	WriteChallengeToken(buffer, &index, &challengeToken)
+	WriteObject(buffer, &index, &challengeToken)
 
 	assert.Equal(t, index, ChallengeTokenBytes)
 
@@ -293,7 +580,7 @@ func TestChallengeToken(t *testing.T) {
 
 	index = 0
 
-	result := ReadChallengeToken(buffer, &index, &readChallengeToken)
+	result := ReadObject(buffer, &index, &readChallengeToken)
 
 	assert.True(t, result)
 	assert.Equal(t, challengeToken, readChallengeToken)
@@ -303,7 +590,7 @@ func TestChallengeToken(t *testing.T) {
 
 	index = 0
 
-	result = ReadChallengeToken(buffer[:5], &index, &readChallengeToken)
+	result = ReadObject(buffer[:5], &index, &readChallengeToken)
 
 	assert.False(t, result)
 
@@ -337,16 +624,255 @@ func TestAckBits(t *testing.T) {
 
 	t.Parallel()
 
-	// todo
+	const BufferSize = 1024
 
+	receivedPackets := make([]uint64, BufferSize)
+
+	latestSequence := uint64(100000)
+
+	// receive every third packet
+
+	for sequence := latestSequence - 1000; sequence <= latestSequence; sequence++ {
+		if sequence%3 == 0 {
+			receivedPackets[sequence%BufferSize] = sequence
+		}
+	}
+
+	var ack_bits [AckBitsBytes]byte
+
+	GetAckBits(latestSequence, receivedPackets, ack_bits[:])
+
+	for i := uint64(0); i < AckBitsBytes*8; i++ {
+		sequence := latestSequence - i
+		acked := (ack_bits[i/8] & (1 << (i % 8))) != 0
+		assert.Equal(t, sequence%3 == 0, acked)
+	}
 }
 
 func TestProcessAcks(t *testing.T) {
 
 	t.Parallel()
 
-	// todo
+	const BufferSize = 1024
+
+	ackedPackets := make([]uint64, BufferSize)
+	ackBuffer := make([]uint64, BufferSize)
+
+	ackSequence := uint64(100000)
+
+	var ack_bits [AckBitsBytes]byte
+	ack_bits[0] = 1 | (1 << 2)
+	ack_bits[1] = 1
+
+	acks := ProcessAcks(ackSequence, ack_bits[:], ackedPackets, ackBuffer)
+
+	assert.Equal(t, []uint64{ackSequence, ackSequence - 2, ackSequence - 8}, acks)
+
+	// packets that have already been acked are not returned again
+
+	for i := range acks {
+		ackedPackets[acks[i]%BufferSize] = acks[i]
+	}
+
+	acks = ProcessAcks(ackSequence, ack_bits[:], ackedPackets, ackBuffer)
+
+	assert.Equal(t, 0, len(acks))
+}
+
+func TestReplayProtection(t *testing.T) {
+
+	t.Parallel()
+
+	var replayProtection ReplayProtection
+
+	// first packet is always accepted
+
+	assert.Equal(t, ReplayProtection_Accept, replayProtection.Check(1000))
+	replayProtection.Advance(1000)
+
+	// duplicates are rejected
+
+	assert.Equal(t, ReplayProtection_Duplicate, replayProtection.Check(1000))
+
+	// packets that arrive out of order are accepted once
+
+	for sequence := uint64(1010); sequence > 1000; sequence-- {
+		assert.Equal(t, ReplayProtection_Accept, replayProtection.Check(sequence))
+		replayProtection.Advance(sequence)
+		assert.Equal(t, ReplayProtection_Duplicate, replayProtection.Check(sequence))
+	}
+
+	assert.Equal(t, uint64(1010), replayProtection.MostRecentSequence)
+
+	// packets older than the window are rejected
+
+	replayProtection.Advance(1000 + ReplayProtectionWindowSize)
+	assert.Equal(t, ReplayProtection_TooOld, replayProtection.Check(1000))
+	assert.Equal(t, ReplayProtection_Duplicate, replayProtection.Check(1001))
+	assert.Equal(t, ReplayProtection_Accept, replayProtection.Check(1011))
+
+	// packets too far ahead are rejected
+
+	mostRecentSequence := replayProtection.MostRecentSequence
+	assert.Equal(t, ReplayProtection_Accept, replayProtection.Check(mostRecentSequence+ReplayProtectionMaxForwardJump))
+	assert.Equal(t, ReplayProtection_TooNew, replayProtection.Check(mostRecentSequence+ReplayProtectionMaxForwardJump+1))
+	assert.Equal(t, ReplayProtection_TooNew, replayProtection.Check(mostRecentSequence+(1<<62)))
+
+	// moving the window forward clears bits for sequence numbers we skipped over
+
+	replayProtection.Advance(mostRecentSequence + ReplayProtectionWindowSize)
+	assert.Equal(t, ReplayProtection_Accept, replayProtection.Check(mostRecentSequence+1))
+	replayProtection.Advance(mostRecentSequence + ReplayProtectionWindowSize*3)
+	assert.Equal(t, ReplayProtection_Accept, replayProtection.Check(mostRecentSequence+ReplayProtectionWindowSize*3-1))
+	assert.Equal(t, ReplayProtection_Duplicate, replayProtection.Check(mostRecentSequence+ReplayProtectionWindowSize*3))
+}
+
+func TestReplayProtectionWraparound(t *testing.T) {
+
+	t.Parallel()
+
+	var replayProtection ReplayProtection
+
+	start := ^uint64(0) - 10
+
+	replayProtection.Reset(start)
+
+	for i := uint64(0); i < 20; i++ {
+		sequence := start + i
+		assert.Equal(t, ReplayProtection_Accept, replayProtection.Check(sequence))
+		replayProtection.Advance(sequence)
+	}
+
+	assert.Equal(t, uint64(8), replayProtection.MostRecentSequence)
+
+	for i := uint64(0); i < 20; i++ {
+		assert.Equal(t, ReplayProtection_Duplicate, replayProtection.Check(start+i))
+	}
+
+	mostRecentSequence := replayProtection.MostRecentSequence
+	assert.Equal(t, ReplayProtection_Accept, replayProtection.Check(mostRecentSequence+1))
+	assert.Equal(t, ReplayProtection_TooOld, replayProtection.Check(mostRecentSequence-ReplayProtectionWindowSize))
+}
+
+func TestReplayProtectionRandom(t *testing.T) {
+
+	t.Parallel()
+
+	rand.Seed(42)
+
+	var replayProtection ReplayProtection
+
+	received := make(map[uint64]bool)
+
+	sequence := uint64(1000000)
+
+	for i := 0; i < 10000; i++ {
+
+		// mostly increasing sequence numbers, with some reordering and duplicates
+
+		sequence += uint64(rand.Intn(4))
+		packetSequence := sequence - uint64(rand.Intn(64))
+
+		result := replayProtection.Check(packetSequence)
+
+		if received[packetSequence] {
+			assert.Equal(t, ReplayProtection_Duplicate, result)
+			continue
+		}
+
+		assert.Equal(t, ReplayProtection_Accept, result)
+
+		replayProtection.Advance(packetSequence)
+
+		received[packetSequence] = true
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+
+	t.Parallel()
+
+	var bucket TokenBucket
+
+	currentTime := time.Unix(1000, 0)
+
+	// a new bucket starts full
+
+	for i := 0; i < 5; i++ {
+		assert.True(t, bucket.Take(currentTime, 10, 5))
+	}
+
+	assert.False(t, bucket.Take(currentTime, 10, 5))
+
+	// tokens refill at the rate per-second
+
+	currentTime = currentTime.Add(100 * time.Millisecond)
+	assert.True(t, bucket.Take(currentTime, 10, 5))
+	assert.False(t, bucket.Take(currentTime, 10, 5))
+
+	// but never past the burst size
+
+	currentTime = currentTime.Add(time.Hour)
+	for i := 0; i < 5; i++ {
+		assert.True(t, bucket.Take(currentTime, 10, 5))
+	}
+	assert.False(t, bucket.Take(currentTime, 10, 5))
+}
+
+func TestRateLimiter(t *testing.T) {
+
+	t.Parallel()
+
+	limiter := NewRateLimiter(1, 2)
+
+	currentTime := time.Unix(1000, 0)
+
+	a := AddressKey(ParseAddress("127.0.0.1:30000"))
+	b := AddressKey(ParseAddress("127.0.0.2:30000"))
+
+	// keys are limited independently
+
+	assert.True(t, limiter.Take(a, currentTime))
+	assert.True(t, limiter.Take(a, currentTime))
+	assert.False(t, limiter.Take(a, currentTime))
+
+	assert.True(t, limiter.Take(b, currentTime))
+
+	// the same address on a different port shares a bucket
+
+	assert.Equal(t, a, AddressKey(ParseAddress("127.0.0.1:40000")))
+
+	// buckets survive a map swap, so a drained bucket isn't reset early
+
+	currentTime = currentTime.Add(limiter.swapDuration + time.Millisecond)
+	assert.True(t, limiter.Take(a, currentTime))
+	assert.True(t, limiter.Take(a, currentTime))
+	assert.False(t, limiter.Take(a, currentTime))
+
+	currentTime = currentTime.Add(limiter.swapDuration + time.Millisecond)
+	assert.True(t, limiter.Take(a, currentTime))
+	assert.True(t, limiter.Take(a, currentTime))
+	assert.False(t, limiter.Take(a, currentTime))
+
+	// once the maps are full, new keys share one overflow bucket, and keys with a bucket keep it
+
+	limiter.maxKeys = 2
+
+	assert.True(t, limiter.Take(b, currentTime))
+
+	c := AddressKey(ParseAddress("127.0.0.3:30000"))
+	d := AddressKey(ParseAddress("127.0.0.4:30000"))
+
+	assert.True(t, limiter.Take(c, currentTime))
+	assert.True(t, limiter.Take(d, currentTime))
+	assert.False(t, limiter.Take(c, currentTime))
+	assert.False(t, limiter.Take(d, currentTime))
 
+	assert.True(t, limiter.Take(b, currentTime))
+	assert.False(t, limiter.Take(b, currentTime))
+	assert.False(t, limiter.Take(a, currentTime))
+
+	assert.Equal(t, 2, len(limiter.buckets_New))
 }
 
 func TestSessionToken(t *testing.T) {
@@ -369,7 +895,7 @@ func TestSessionToken(t *testing.T) {
 
 	index := 0
 
-	WriteSessionToken(buffer, &index, &sessionToken)
+	WriteObject(buffer, &index, &sessionToken)
 
 	assert.Equal(t, index, SessionTokenBytes)
 
@@ -377,7 +903,7 @@ func TestSessionToken(t *testing.T) {
 
 	index = 0
 
-	result := ReadSessionToken(buffer, &index, &readSessionToken)
+	result := ReadObject(buffer, &index, &readSessionToken)
 
 	assert.True(t, result)
 	assert.Equal(t, sessionToken, readSessionToken)
@@ -387,7 +913,7 @@ func TestSessionToken(t *testing.T) {
 
 	index = 0
 
-	result = ReadSessionToken(buffer[:5], &index, &readSessionToken)
+	result = ReadObject(buffer[:5], &index, &readSessionToken)
 
 	assert.False(t, result)
 
@@ -421,11 +947,10 @@ func TestConnectData(t *testing.T) {
 
 	t.Parallel()
 
-	publicKey, privateKey := Keygen_Box()
+	publicKey, _ := Keygen_Box()
 
 	connectData := ConnectData{}
 	copy(connectData.ClientPublicKey[:], publicKey)
-	copy(connectData.ClientPrivateKey[:], privateKey)
 	connectData.GatewayAddress = *ParseAddress("127.0.0.1:40000")
 	RandomBytes_InPlace(connectData.GatewayPublicKey[:])
 
@@ -435,7 +960,7 @@ func TestConnectData(t *testing.T) {
 
 	index := 0
 
-	WriteConnectData(buffer, &index, &connectData)
+	WriteObject(buffer, &index, &connectData)
 
 	assert.Equal(t, index, ConnectDataBytes)
 
@@ -443,7 +968,7 @@ func TestConnectData(t *testing.T) {
 
 	index = 0
 
-	result := ReadConnectData(buffer, &index, &readConnectData)
+	result := ReadObject(buffer, &index, &readConnectData)
 
 	assert.True(t, result)
 	assert.Equal(t, connectData, readConnectData)
@@ -453,7 +978,1600 @@ func TestConnectData(t *testing.T) {
 
 	index = 0
 
-	result = ReadConnectData(buffer[:5], &index, &readConnectData)
+	result = ReadObject(buffer[:5], &index, &readConnectData)
 
 	assert.False(t, result)
 }
+
+func TestConnectToken(t *testing.T) {
+
+	t.Parallel()
+
+	clientPublicKey, _ := Keygen_Box()
+	gatewayPublicKey, gatewayPrivateKey := Keygen_Box()
+	authPublicKey, authPrivateKey := Keygen_Box()
+
+	var userId [UserIdBytes]byte
+	RandomBytes_InPlace(userId[:])
+
+	gatewayAddress := ParseAddress("127.0.0.1:40000")
+
+	connectToken := GenerateConnectToken(clientPublicKey, userId[:], 256, 512, 100, gatewayAddress, gatewayPublicKey, authPrivateKey, gatewayPublicKey, time.Unix(1000, 0))
+
+	assert.Equal(t, ConnectTokenBytes, len(connectToken))
+
+	// the connect data holds the client public key, and nothing secret
+
+	index := 0
+	var connectData ConnectData
+	assert.True(t, ReadObject(connectToken, &index, &connectData))
+	assert.Equal(t, clientPublicKey, connectData.ClientPublicKey[:])
+	assert.Equal(t, gatewayPublicKey, connectData.GatewayPublicKey[:])
+	assert.True(t, AddressEqual(gatewayAddress, &connectData.GatewayAddress))
+
+	// the gateway sees the client public key as the session id
+
+	var sessionToken SessionToken
+	assert.True(t, ReadEncryptedSessionToken(connectToken, &index, &sessionToken, authPublicKey, gatewayPrivateKey))
+	assert.Equal(t, clientPublicKey, sessionToken.SessionId[:])
+	assert.Equal(t, userId, sessionToken.UserId)
+	assert.Equal(t, uint32(256), sessionToken.EnvelopeUpKbps)
+	assert.Equal(t, uint32(512), sessionToken.EnvelopeDownKbps)
+	assert.Equal(t, uint8(100), sessionToken.PacketsPerSecond)
+	assert.Equal(t, uint64(1000+ConnectTokenExpireSeconds), sessionToken.ExpireTimestamp)
+}
+
+func TestDisconnectPacket(t *testing.T) {
+
+	t.Parallel()
+
+	clientPublicKey, clientPrivateKey := Keygen_Box()
+	gatewayPublicKey, gatewayPrivateKey := Keygen_Box()
+
+	var clientSharedKey [SharedKeyBytes_Box]byte
+	var gatewaySharedKey [SharedKeyBytes_Box]byte
+
+	SharedKey_Box(gatewayPublicKey, clientPrivateKey, clientSharedKey[:])
+	SharedKey_Box(clientPublicKey, gatewayPrivateKey, gatewaySharedKey[:])
+
+	gatewayId := RandomBytes(GatewayIdBytes)
+
+	gatewayAddress := ParseAddress("127.0.0.1:40000")
+	clientAddress := ParseAddress("127.0.0.1:30000")
+
+	// write a disconnect packet and read it back on the client
+
+	packetData := make([]byte, 1500)
+
+	disconnectPacket := DisconnectPacket{Reason: DisconnectReason_ServerShutdown}
+	copy(disconnectPacket.GatewayId[:], gatewayId)
+
+	packetBytes := disconnectPacket.Write(packetData, gatewaySharedKey[:], gatewayAddress, clientAddress)
+
+	assert.Equal(t, DisconnectPacketBytes, packetBytes)
+	assert.Equal(t, disconnectPacket.Size(), packetBytes)
+
+	packetData = packetData[:packetBytes]
+
+	var magic [MagicBytes]byte
+
+	var fromAddressData [4]byte
+	var fromAddressPort uint16
+
+	var toAddressData [4]byte
+	var toAddressPort uint16
+
+	GetAddressData(gatewayAddress, fromAddressData[:], &fromAddressPort)
+	GetAddressData(clientAddress, toAddressData[:], &toAddressPort)
+
+	assert.True(t, BasicPacketFilter(packetData, packetBytes))
+	assert.True(t, AdvancedPacketFilter(packetData, magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, packetBytes))
+
+	packetCopy := make([]byte, packetBytes)
+	copy(packetCopy, packetData)
+
+	var readPacket DisconnectPacket
+
+	assert.True(t, readPacket.Read(packetData, clientSharedKey[:]))
+	assert.Equal(t, disconnectPacket, readPacket)
+
+	// a disconnect packet for another session doesn't decrypt
+
+	var otherSharedKey [SharedKeyBytes_Box]byte
+	RandomBytes_InPlace(otherSharedKey[:])
+
+	copy(packetData, packetCopy)
+	assert.False(t, readPacket.Read(packetData, otherSharedKey[:]))
+
+	// a modified disconnect packet doesn't decrypt
+
+	copy(packetData, packetCopy)
+	packetData[packetBytes-PostfixBytes-1] ^= 1
+	assert.False(t, readPacket.Read(packetData, clientSharedKey[:]))
+
+	// wrong size packets are rejected
+
+	copy(packetData, packetCopy)
+	assert.False(t, readPacket.Read(packetData[:packetBytes-1], clientSharedKey[:]))
+}
+
+func TestChallengePacket(t *testing.T) {
+
+	t.Parallel()
+
+	clientPublicKey, clientPrivateKey := Keygen_Box()
+	gatewayPublicKey, gatewayPrivateKey := Keygen_Box()
+
+	var clientSharedKey [SharedKeyBytes_Box]byte
+	var gatewaySharedKey [SharedKeyBytes_Box]byte
+
+	SharedKey_Box(gatewayPublicKey, clientPrivateKey, clientSharedKey[:])
+	SharedKey_Box(clientPublicKey, gatewayPrivateKey, gatewaySharedKey[:])
+
+	gatewayAddress := ParseAddress("127.0.0.1:40000")
+	clientAddress := ParseAddress("127.0.0.1:30000")
+
+	challengePacket := ChallengePacket{Sequence: 1234}
+	RandomBytes_InPlace(challengePacket.ChallengeTokenData[:])
+	RandomBytes_InPlace(challengePacket.GatewayId[:])
+
+	packetData := make([]byte, 1500)
+
+	packetBytes := challengePacket.Write(packetData, gatewaySharedKey[:], gatewayAddress, clientAddress)
+
+	assert.Equal(t, ChallengePacketBytes, packetBytes)
+	assert.Equal(t, challengePacket.Size(), packetBytes)
+
+	packetData = packetData[:packetBytes]
+
+	assert.True(t, BasicPacketFilter(packetData, packetBytes))
+	assert.Equal(t, PacketType_Challenge, packetData[1])
+
+	packetCopy := make([]byte, packetBytes)
+	copy(packetCopy, packetData)
+
+	// only the client can read it
+
+	var otherSharedKey [SharedKeyBytes_Box]byte
+	RandomBytes_InPlace(otherSharedKey[:])
+
+	var readPacket ChallengePacket
+
+	assert.False(t, readPacket.Read(packetData, otherSharedKey[:]))
+	assert.Equal(t, packetCopy, packetData)
+
+	assert.True(t, readPacket.Read(packetData, clientSharedKey[:]))
+	assert.Equal(t, challengePacket, readPacket)
+
+	// a disconnect packet is not a challenge packet, even though it is laid out the same way
+
+	disconnectPacket := DisconnectPacket{}
+	packetBytes = disconnectPacket.Write(packetData[:cap(packetData)], gatewaySharedKey[:], gatewayAddress, clientAddress)
+	assert.False(t, readPacket.Read(packetData[:packetBytes], clientSharedKey[:]))
+}
+
+func TestPayloadPacket(t *testing.T) {
+
+	t.Parallel()
+
+	clientAddress := ParseAddress("127.0.0.1:30000")
+	gatewayAddress := ParseAddress("127.0.0.1:40000")
+
+	prefix := PacketPrefix{PacketType: PacketType_Payload, SessionTokenSequence: 5}
+	RandomBytes_InPlace(prefix.SessionTokenData[:])
+
+	header := PayloadHeader{
+		Sequence:   100,
+		Ack:        99,
+		PacketType: PacketType_Payload,
+		Flags:      Flags_ChallengeToken,
+	}
+	RandomBytes_InPlace(header.SessionId[:])
+	RandomBytes_InPlace(header.AckBits[:])
+	RandomBytes_InPlace(header.GatewayId[:])
+	RandomBytes_InPlace(header.ServerId[:])
+
+	payload := RandomBytes(MinPayloadBytes)
+
+	packetData := make([]byte, 1500)
+
+	index := 0
+	WriteObject(packetData, &index, &prefix)
+	assert.Equal(t, prefix.Size(), index)
+	WriteObject(packetData, &index, &header)
+	assert.Equal(t, prefix.Size()+header.Size(), index)
+	WriteBytes(packetData, &index, payload, len(payload))
+	index += PostfixBytes
+
+	packetData = packetData[:index]
+
+	WritePacketFilter(packetData, clientAddress, gatewayAddress)
+
+	var magic [MagicBytes]byte
+
+	var fromAddressData [4]byte
+	var fromAddressPort uint16
+
+	var toAddressData [4]byte
+	var toAddressPort uint16
+
+	GetAddressData(clientAddress, fromAddressData[:], &fromAddressPort)
+	GetAddressData(gatewayAddress, toAddressData[:], &toAddressPort)
+
+	assert.True(t, BasicPacketFilter(packetData, len(packetData)))
+	assert.True(t, AdvancedPacketFilter(packetData, magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, len(packetData)))
+
+	// the filter goes in the chonkle and pittle, so the rest of the packet reads back the same
+
+	index = 0
+
+	var readPrefix PacketPrefix
+	var readHeader PayloadHeader
+
+	assert.True(t, ReadObject(packetData, &index, &readPrefix))
+	assert.True(t, ReadObject(packetData, &index, &readHeader))
+	assert.Equal(t, prefix, readPrefix)
+	assert.Equal(t, header, readHeader)
+	assert.Equal(t, payload, packetData[index:len(packetData)-PostfixBytes])
+
+	// the session id and sequence are in the clear, and the rest of the header is encrypted
+
+	assert.Equal(t, PrefixBytes+SessionIdBytes+SequenceBytes, PayloadPacketEncryptIndex)
+
+	// unknown versions and short packets are rejected
+
+	index = 0
+	assert.False(t, ReadObject(packetData[:PrefixBytes-1], &index, &readPrefix))
+
+	packetData[0] = PacketVersion + 1
+	index = 0
+	assert.False(t, ReadObject(packetData, &index, &readPrefix))
+
+	index = PrefixBytes
+	assert.False(t, ReadObject(packetData[:PrefixBytes+HeaderBytes-1], &index, &readHeader))
+}
+
+func TestInternalForwardPacket(t *testing.T) {
+
+	t.Parallel()
+
+	packet := InternalForwardPacket{
+		GatewayAddress:       *ParseAddress("127.0.0.1:40001"),
+		ClientAddress:        *ParseAddress("[::1]:30000"),
+		SessionTokenSequence: 10,
+		Payload:              RandomBytes(100),
+	}
+	RandomBytes_InPlace(packet.SessionTokenData[:])
+	RandomBytes_InPlace(packet.Header.SessionId[:])
+	packet.Header.Sequence = 1000
+	packet.Header.PacketType = PacketType_Payload
+
+	packetData := make([]byte, 1500)
+
+	index := 0
+	packet.Write(packetData, &index)
+	assert.Equal(t, packet.Size(), index)
+
+	packetData = packetData[:index]
+
+	var readPacket InternalForwardPacket
+
+	index = 0
+	assert.True(t, readPacket.Read(packetData, &index))
+	assert.Equal(t, len(packetData), index)
+	assert.True(t, AddressEqual(&packet.GatewayAddress, &readPacket.GatewayAddress))
+	assert.True(t, AddressEqual(&packet.ClientAddress, &readPacket.ClientAddress))
+	assert.Equal(t, packet.SessionTokenData, readPacket.SessionTokenData)
+	assert.Equal(t, packet.SessionTokenSequence, readPacket.SessionTokenSequence)
+	assert.Equal(t, packet.Header, readPacket.Header)
+	assert.Equal(t, packet.Payload, readPacket.Payload)
+
+	// packets that are too small or too large are rejected
+
+	index = 0
+	assert.False(t, readPacket.Read(packetData[:InternalForwardPacketHeaderBytes-1], &index))
+
+	largePacket := packet
+	largePacket.Payload = make([]byte, MaxPayloadBytes+1)
+	largePacketData := make([]byte, largePacket.Size())
+	index = 0
+	largePacket.Write(largePacketData, &index)
+	index = 0
+	assert.False(t, readPacket.Read(largePacketData, &index))
+
+	// so are packets without a client address
+
+	noAddressPacket := packet
+	noAddressPacket.ClientAddress = net.UDPAddr{}
+	index = 0
+	noAddressPacket.Write(packetData, &index)
+	index = 0
+	assert.False(t, readPacket.Read(packetData[:noAddressPacket.Size()], &index))
+}
+
+func TestInternalDisconnectPacket(t *testing.T) {
+
+	t.Parallel()
+
+	packet := InternalDisconnectPacket{
+		ClientAddress: *ParseAddress("127.0.0.1:30000"),
+		Reason:        DisconnectReason_ServerShutdown,
+	}
+	RandomBytes_InPlace(packet.SessionId[:])
+
+	packetData := make([]byte, 1500)
+
+	index := 0
+	WriteObject(packetData, &index, &packet)
+	assert.Equal(t, packet.Size(), index)
+
+	packetData = packetData[:index]
+
+	var readPacket InternalDisconnectPacket
+
+	index = 0
+	assert.True(t, readPacket.Read(packetData, &index))
+	assert.True(t, AddressEqual(&packet.ClientAddress, &readPacket.ClientAddress))
+	assert.Equal(t, packet.SessionId, readPacket.SessionId)
+	assert.Equal(t, packet.Reason, readPacket.Reason)
+
+	// a forward packet is not a disconnect packet
+
+	index = 0
+	assert.False(t, readPacket.Read(packetData[:len(packetData)-1], &index))
+
+	packetData[1] = PacketType_Payload
+	index = 0
+	assert.False(t, readPacket.Read(packetData, &index))
+}
+
+// testMessage returns the i'th of a set of messages of different sizes, for packing into payloads.
+func testMessage(i int) []byte {
+	message := make([]byte, 16+i%8*40)
+	for j := range message {
+		message[j] = byte(i)
+	}
+	return message
+}
+
+// testPayload returns a payload packed with test messages, zero padded to exactly payloadBytes.
+func testPayload(payloadBytes int) []byte {
+	payload := make([]byte, payloadBytes)
+	var writer PayloadWriter
+	writer.Reset(payload)
+	for i := 0; writer.AddMessage(testMessage(i)); i++ {
+	}
+	writer.Finish()
+	return payload
+}
+
+func TestPayloadMessages(t *testing.T) {
+
+	t.Parallel()
+
+	var writer PayloadWriter
+	writer.Reset(make([]byte, MaxPayloadBytes))
+
+	// messages are packed until the payload is full
+
+	numMessages := 0
+	for writer.AddMessage(testMessage(numMessages)) {
+		numMessages++
+	}
+	assert.Equal(t, numMessages, writer.NumMessages())
+	assert.False(t, writer.Fits(len(testMessage(numMessages))))
+	assert.False(t, writer.AddMessage(nil))
+
+	payload := writer.Finish()
+	assert.True(t, len(payload) >= MinPayloadBytes)
+	assert.True(t, len(payload) <= MaxPayloadBytes)
+
+	var messageBuffer [MaxPayloadMessages][]byte
+	messages, ok := ReadPayloadMessages(payload, messageBuffer[:])
+	assert.True(t, ok)
+	assert.Equal(t, numMessages, len(messages))
+	for i := range messages {
+		assert.Equal(t, testMessage(i), messages[i])
+	}
+
+	// small payloads are padded to the minimum size, and the padding isn't read as messages
+
+	writer.Reset(make([]byte, MaxPayloadBytes))
+	assert.True(t, writer.AddMessage([]byte{1, 2, 3}))
+	payload = writer.Finish()
+	assert.Equal(t, MinPayloadBytes, len(payload))
+
+	messages, ok = ReadPayloadMessages(payload, messageBuffer[:])
+	assert.True(t, ok)
+	assert.Equal(t, [][]byte{{1, 2, 3}}, messages)
+
+	// the largest message fits on its own
+
+	writer.Reset(make([]byte, MaxPayloadBytes))
+	assert.True(t, writer.AddMessage(make([]byte, MaxMessageBytes)))
+	assert.False(t, writer.AddMessage([]byte{1}))
+	assert.Equal(t, MaxPayloadBytes, len(writer.Finish()))
+
+	// a length that runs past the end is malformed
+
+	payload = make([]byte, MinPayloadBytes)
+	index := 0
+	WriteUint16(payload, &index, MinPayloadBytes)
+	_, ok = ReadPayloadMessages(payload, messageBuffer[:])
+	assert.False(t, ok)
+
+	// so are more messages than fit in the buffer
+
+	writer.Reset(make([]byte, MinPayloadBytes))
+	for writer.AddMessage([]byte{1}) {
+	}
+	_, ok = ReadPayloadMessages(writer.Finish(), messageBuffer[:10:10])
+	assert.False(t, ok)
+
+}
+
+type testStreamObject struct {
+	Bits       uint32
+	Bool       bool
+	Integer    int32
+	Uint8      uint8
+	Uint16     uint16
+	Uint32     uint32
+	Uint64     uint64
+	Float32    float32
+	Float64    float64
+	Compressed float32
+	Bytes      [5]byte
+	String     string
+	Address    net.UDPAddr
+}
+
+func (object *testStreamObject) Serialize(stream Stream) error {
+	stream.SerializeBits(&object.Bits, 3)
+	stream.SerializeBool(&object.Bool)
+	stream.SerializeInteger(&object.Integer, -100, 100)
+	stream.SerializeUint8(&object.Uint8)
+	stream.SerializeUint16(&object.Uint16)
+	stream.SerializeUint32(&object.Uint32)
+	stream.SerializeUint64(&object.Uint64)
+	stream.SerializeFloat32(&object.Float32)
+	stream.SerializeFloat64(&object.Float64)
+	stream.SerializeCompressedFloat(&object.Compressed, -10, 10, 0.01)
+	stream.SerializeBytes(object.Bytes[:])
+	stream.SerializeString(&object.String, 16)
+	stream.SerializeAddress(&object.Address)
+	stream.SerializeAlign()
+	stream.SerializeCheck(0xAB)
+	return stream.Error()
+}
+
+func TestStream(t *testing.T) {
+
+	t.Parallel()
+
+	object := testStreamObject{
+		Bits:       5,
+		Bool:       true,
+		Integer:    -42,
+		Uint8:      200,
+		Uint16:     60000,
+		Uint32:     4000000000,
+		Uint64:     0x0123456789ABCDEF,
+		Float32:    3.25,
+		Float64:    -1234.5,
+		Compressed: 1.2345,
+		Bytes:      [5]byte{1, 2, 3, 4, 5},
+		String:     "hello",
+		Address:    *ParseAddress("127.0.0.1:40000"),
+	}
+
+	// values are bit-packed, so most of the object isn't byte aligned
+
+	buffer := make([]byte, 1024)
+
+	index := 0
+	WriteObject(buffer, &index, &object)
+	assert.Equal(t, MeasureObject(&object), index)
+
+	var readObject testStreamObject
+
+	readIndex := 0
+	assert.True(t, ReadObject(buffer[:index], &readIndex, &readObject))
+	assert.Equal(t, index, readIndex)
+
+	assert.InDelta(t, object.Compressed, readObject.Compressed, 0.01)
+	readObject.Compressed = object.Compressed
+	assert.True(t, AddressEqual(&object.Address, &readObject.Address))
+	readObject.Address = object.Address
+	assert.Equal(t, object, readObject)
+
+	// every value that fits in fewer bytes than written is rejected, and leaves the index alone
+
+	for bytes := 0; bytes < index; bytes++ {
+		readIndex = 0
+		assert.False(t, ReadObject(buffer[:bytes], &readIndex, &readObject))
+		assert.Equal(t, 0, readIndex)
+	}
+
+	// as are values that are out of bounds or don't match
+
+	buffer[index-1] = 0
+	readIndex = 0
+	assert.False(t, ReadObject(buffer[:index], &readIndex, &readObject))
+
+	badObject := object
+	badObject.Integer = 101
+	assert.Panics(t, func() {
+		index := 0
+		WriteObject(buffer, &index, &badObject)
+	})
+
+	badObject = object
+	badObject.String = "this string is too long"
+	assert.Panics(t, func() {
+		index := 0
+		WriteObject(buffer, &index, &badObject)
+	})
+
+	assert.Panics(t, func() {
+		index := 0
+		WriteObject(buffer[:10], &index, &object)
+	})
+}
+
+func TestStreamLayout(t *testing.T) {
+
+	t.Parallel()
+
+	// byte aligned values are laid out the same as WriteUint32 and friends, so tokens and packets keep their format
+
+	expected := make([]byte, 64)
+	index := 0
+	WriteUint8(expected, &index, 7)
+	WriteUint16(expected, &index, 1000)
+	WriteUint32(expected, &index, 123456789)
+	WriteUint64(expected, &index, 987654321987654321)
+	WriteAddress(expected, &index, ParseAddress("[::1]:50000"))
+	expected = expected[:index]
+
+	actual := make([]byte, len(expected))
+	stream := NewWriteStream(actual)
+	uint8Value := uint8(7)
+	uint16Value := uint16(1000)
+	uint32Value := uint32(123456789)
+	uint64Value := uint64(987654321987654321)
+	stream.SerializeUint8(&uint8Value)
+	stream.SerializeUint16(&uint16Value)
+	stream.SerializeUint32(&uint32Value)
+	stream.SerializeUint64(&uint64Value)
+	stream.SerializeAddress(ParseAddress("[::1]:50000"))
+	assert.NoError(t, stream.Error())
+	assert.Equal(t, len(expected), stream.BytesProcessed())
+	assert.Equal(t, expected, actual)
+
+	// each type measures the same as its size constant
+
+	assert.Equal(t, ChallengeTokenBytes, MeasureObject(&ChallengeToken{}))
+	assert.Equal(t, SessionTokenBytes, MeasureObject(&SessionToken{}))
+	assert.Equal(t, ConnectDataBytes, MeasureObject(&ConnectData{}))
+	assert.Equal(t, PrefixBytes, MeasureObject(&PacketPrefix{}))
+	assert.Equal(t, HeaderBytes, MeasureObject(&PayloadHeader{}))
+	assert.Equal(t, InternalForwardPacketHeaderBytes, MeasureObject(&InternalForwardPacket{}))
+	assert.Equal(t, InternalDisconnectPacketBytes, MeasureObject(&InternalDisconnectPacket{}))
+	assert.Equal(t, ChallengePacketBytes, PrefixBytes+NonceBytes_Box+MeasureObject(&ChallengePacket{})+PostfixBytes)
+	assert.Equal(t, DisconnectPacketBytes, PrefixBytes+NonceBytes_Box+MeasureObject(&DisconnectPacket{})+PostfixBytes)
+}
+
+func TestStreamBits(t *testing.T) {
+
+	t.Parallel()
+
+	// write random values with random bit counts, then read them back
+
+	const NumValues = 1000
+
+	bits := make([]int, NumValues)
+	values := make([]uint32, NumValues)
+	totalBits := 0
+	for i := range values {
+		bits[i] = 1 + rand.Intn(32)
+		values[i] = rand.Uint32()
+		if bits[i] < 32 {
+			values[i] &= (1 << uint(bits[i])) - 1
+		}
+		totalBits += bits[i]
+	}
+
+	buffer := make([]byte, (totalBits+7)/8)
+
+	writeStream := NewWriteStream(buffer)
+	measureStream := NewMeasureStream()
+	for i := range values {
+		writeStream.SerializeBits(&values[i], bits[i])
+		measureStream.SerializeBits(&values[i], bits[i])
+	}
+	assert.NoError(t, writeStream.Error())
+	assert.Equal(t, totalBits, writeStream.BitsProcessed())
+	assert.Equal(t, totalBits, measureStream.BitsProcessed())
+
+	readStream := NewReadStream(buffer)
+	for i := range values {
+		var value uint32
+		readStream.SerializeBits(&value, bits[i])
+		assert.Equal(t, values[i], value)
+	}
+	assert.NoError(t, readStream.Error())
+
+	// reading past the padding to the end of the last byte overflows, and the error sticks
+
+	var value uint32
+	readStream.SerializeBits(&value, 8)
+	assert.Equal(t, ErrStreamOverflow, readStream.Error())
+	readStream.SetError(ErrStreamInvalid)
+	assert.Equal(t, ErrStreamOverflow, readStream.Error())
+
+	// values that don't fit in their bits are rejected on write
+
+	writeStream.Reset(buffer)
+	value = 8
+	writeStream.SerializeBits(&value, 3)
+	assert.Equal(t, ErrStreamInvalid, writeStream.Error())
+
+	assert.Equal(t, 0, BitsRequired(0))
+	assert.Equal(t, 1, BitsRequired(1))
+	assert.Equal(t, 8, BitsRequired(255))
+	assert.Equal(t, 9, BitsRequired(256))
+	assert.Equal(t, 32, BitsRequired(0xFFFFFFFF))
+}
+
+func TestBatchConn(t *testing.T) {
+
+	t.Parallel()
+
+	senderConn, err := net.ListenUDP("udp", ParseAddress("127.0.0.1:0"))
+	assert.NoError(t, err)
+	defer senderConn.Close()
+
+	receiverConn, err := net.ListenUDP("udp", ParseAddress("127.0.0.1:0"))
+	assert.NoError(t, err)
+	defer receiverConn.Close()
+
+	receiverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	sender := NewBatchConn(senderConn, 8, 1500)
+	receiver := NewBatchConn(receiverConn, 8, 1500)
+
+	receiverAddress := receiverConn.LocalAddr().(*net.UDPAddr)
+	senderAddress := senderConn.LocalAddr().(*net.UDPAddr)
+
+	// write more packets than fit in one batch, so WriteTo has to flush along the way
+
+	const NumPackets = 20
+
+	for i := 0; i < NumPackets; i++ {
+		packetData := make([]byte, 100+i)
+		for j := range packetData {
+			packetData[j] = byte(i)
+		}
+		sender.WriteTo(packetData, receiverAddress)
+	}
+
+	assert.NoError(t, sender.Flush())
+
+	received := 0
+	for received < NumPackets {
+		numPackets, err := receiver.ReadBatch()
+		assert.NoError(t, err)
+		if err != nil {
+			break
+		}
+		for i := 0; i < numPackets; i++ {
+			packetData, from := receiver.Packet(i)
+			assert.Equal(t, 100+received, len(packetData))
+			assert.Equal(t, byte(received), packetData[0])
+			assert.True(t, AddressEqual(from, senderAddress))
+			received++
+		}
+	}
+}
+
+func TestBatchConnTruncated(t *testing.T) {
+
+	t.Parallel()
+
+	senderConn, err := net.ListenUDP("udp", ParseAddress("127.0.0.1:0"))
+	assert.NoError(t, err)
+	defer senderConn.Close()
+
+	receiverConn, err := net.ListenUDP("udp", ParseAddress("127.0.0.1:0"))
+	assert.NoError(t, err)
+	defer receiverConn.Close()
+
+	receiverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	sender := NewBatchConn(senderConn, 8, 1500)
+	receiver := NewBatchConn(receiverConn, 8, 100)
+
+	receiverAddress := receiverConn.LocalAddr().(*net.UDPAddr)
+
+	// packets bigger than the max packet size are dropped, instead of being read truncated
+
+	for _, packetBytes := range []int{50, 200, 100, 101, 60} {
+		packetData := make([]byte, packetBytes)
+		packetData[0] = byte(packetBytes)
+		sender.WriteTo(packetData, receiverAddress)
+	}
+
+	assert.NoError(t, sender.Flush())
+
+	var received []int
+	for len(received) < 3 {
+		numPackets, err := receiver.ReadBatch()
+		assert.NoError(t, err)
+		if err != nil {
+			break
+		}
+		for i := 0; i < numPackets; i++ {
+			packetData, _ := receiver.Packet(i)
+			assert.Equal(t, int(packetData[0]), len(packetData))
+			received = append(received, len(packetData))
+		}
+	}
+
+	assert.Equal(t, []int{50, 100, 60}, received)
+}
+
+func TestBatchConnAddressFamily(t *testing.T) {
+
+	t.Parallel()
+
+	senderConn, err := net.ListenUDP("udp", ParseAddress("127.0.0.1:0"))
+	assert.NoError(t, err)
+	defer senderConn.Close()
+
+	receiverConn, err := net.ListenUDP("udp", ParseAddress("127.0.0.1:0"))
+	assert.NoError(t, err)
+	defer receiverConn.Close()
+
+	receiverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	sender := NewBatchConn(senderConn, 8, 1500)
+	receiver := NewBatchConn(receiverConn, 8, 1500)
+
+	receiverAddress := receiverConn.LocalAddr().(*net.UDPAddr)
+
+	// an ipv4 socket can't send to an ipv6 address. that packet is dropped with an error, and the rest still go
+
+	sender.WriteTo([]byte{1}, ParseAddress("[::1]:40000"))
+	sender.WriteTo([]byte{2}, receiverAddress)
+
+	assert.Error(t, sender.Flush())
+
+	numPackets, err := receiver.ReadBatch()
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, numPackets) {
+		packetData, _ := receiver.Packet(0)
+		assert.Equal(t, []byte{2}, packetData)
+	}
+
+	// the error is only reported once
+
+	sender.WriteTo([]byte{3}, receiverAddress)
+
+	assert.NoError(t, sender.Flush())
+}
+
+func TestBatchConnWake(t *testing.T) {
+
+	t.Parallel()
+
+	conn, err := net.ListenUDP("udp", ParseAddress("127.0.0.1:0"))
+	assert.NoError(t, err)
+
+	batchConn := NewBatchConn(conn, 8, 1500)
+
+	// setting a read deadline wakes up a blocked read with a timeout, and the socket still works afterwards
+
+	result := make(chan error, 1)
+
+	go func() {
+		_, err := batchConn.ReadBatch()
+		result <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	conn.SetReadDeadline(time.Now())
+
+	err = <-result
+	assert.Error(t, err)
+	assert.True(t, IsTimeout(err))
+
+	conn.SetReadDeadline(time.Time{})
+
+	// closing the socket ends a blocked read with an error that isn't a timeout
+
+	go func() {
+		_, err := batchConn.ReadBatch()
+		result <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	conn.Close()
+
+	err = <-result
+	assert.Error(t, err)
+	assert.False(t, IsTimeout(err))
+}
+
+func TestVirtualNetwork(t *testing.T) {
+
+	t.Parallel()
+
+	network := NewVirtualNetwork(0, SystemClock)
+	defer network.Close()
+
+	var transport Transport = network
+
+	receiverSocket, err := transport.Listen("0.0.0.0:40000", SocketOptions{})
+	assert.NoError(t, err)
+
+	senderSocket, err := transport.Listen("127.0.0.1:0", SocketOptions{})
+	assert.NoError(t, err)
+
+	senderAddress := senderSocket.LocalAddr().(*net.UDPAddr)
+	assert.NotEqual(t, 0, senderAddress.Port)
+
+	// can't bind the same address twice without reuse port
+
+	_, err = transport.Listen("0.0.0.0:40000", SocketOptions{})
+	assert.Error(t, err)
+
+	sender := transport.NewPacketConn(senderSocket, 8, 1500)
+	receiver := transport.NewPacketConn(receiverSocket, 8, 1500)
+
+	// packets sent to any address with the port arrive at the wildcard socket, and a full batch is flushed as it goes
+
+	const NumPackets = 20
+
+	for i := 0; i < NumPackets; i++ {
+		packetData := make([]byte, 100+i)
+		for j := range packetData {
+			packetData[j] = byte(i)
+		}
+		sender.WriteTo(packetData, ParseAddress("127.0.0.1:40000"))
+	}
+
+	assert.NoError(t, sender.Flush())
+
+	received := 0
+	for received < NumPackets {
+		numPackets, err := receiver.ReadBatch()
+		assert.NoError(t, err)
+		if err != nil {
+			break
+		}
+		for i := 0; i < numPackets; i++ {
+			packetData, from := receiver.Packet(i)
+			assert.Equal(t, 100+received, len(packetData))
+			assert.Equal(t, byte(received), packetData[0])
+			assert.True(t, AddressEqual(from, senderAddress))
+			received++
+		}
+	}
+
+	// replies from the wildcard socket come from 127.0.0.1
+
+	receiver.WriteTo([]byte("reply"), senderAddress)
+	assert.NoError(t, receiver.Flush())
+
+	numPackets, err := sender.ReadBatch()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numPackets)
+	packetData, from := sender.Packet(0)
+	assert.Equal(t, "reply", string(packetData))
+	assert.Equal(t, "127.0.0.1:40000", from.String())
+
+	// packets bigger than the max packet size are dropped, like a BatchConn does
+
+	small := transport.NewPacketConn(senderSocket, 8, 100)
+
+	receiver.WriteTo(make([]byte, 200), senderAddress)
+	receiver.WriteTo([]byte("small"), senderAddress)
+	assert.NoError(t, receiver.Flush())
+
+	numPackets, err = small.ReadBatch()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numPackets)
+	packetData, _ = small.Packet(0)
+	assert.Equal(t, "small", string(packetData))
+
+	// a read deadline wakes up a blocked read with a timeout
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		receiverSocket.SetReadDeadline(time.Now())
+	}()
+
+	_, err = receiver.ReadBatch()
+	assert.True(t, IsTimeout(err))
+
+	receiverSocket.SetReadDeadline(time.Time{})
+
+	// closing the socket ends a blocked read, and packets sent to it afterwards are dropped
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		receiverSocket.Close()
+	}()
+
+	_, err = receiver.ReadBatch()
+	assert.Error(t, err)
+	assert.False(t, IsTimeout(err))
+
+	sender.WriteTo([]byte("dropped"), ParseAddress("127.0.0.1:40000"))
+	assert.NoError(t, sender.Flush())
+
+	assert.Equal(t, uint64(1), network.Counters().PacketsDropped)
+
+	// the address can be bound again once it's closed
+
+	socket, err := transport.Listen("0.0.0.0:40000", SocketOptions{})
+	assert.NoError(t, err)
+	socket.Close()
+}
+
+func TestVirtualNetworkReusePort(t *testing.T) {
+
+	t.Parallel()
+
+	network := NewVirtualNetwork(0, SystemClock)
+	defer network.Close()
+
+	// packets are spread across sockets bound with reuse port, and each sender always goes to the same socket
+
+	const NumSockets = 4
+	const NumSenders = 32
+
+	receivers := make([]PacketConn, NumSockets)
+	for i := range receivers {
+		socket, err := network.Listen("127.0.0.1:50000", SocketOptions{ReusePort: true})
+		assert.NoError(t, err)
+		defer socket.Close()
+		receivers[i] = network.NewPacketConn(socket, 64, 1500)
+	}
+
+	for i := 0; i < NumSenders; i++ {
+		socket, err := network.Listen("127.0.0.1:0", SocketOptions{})
+		assert.NoError(t, err)
+		defer socket.Close()
+		sender := network.NewPacketConn(socket, 8, 1500)
+		for j := 0; j < 2; j++ {
+			sender.WriteTo([]byte{byte(i)}, ParseAddress("127.0.0.1:50000"))
+		}
+		assert.NoError(t, sender.Flush())
+	}
+
+	// packets are delivered as they are sent when there is no latency, so everything is queued by now
+
+	received := 0
+	used := 0
+	for i := range receivers {
+		senders := make(map[string]int)
+		for len(receivers[i].(*virtualPacketConn).socket.receive) > 0 {
+			numPackets, err := receivers[i].ReadBatch()
+			assert.NoError(t, err)
+			for j := 0; j < numPackets; j++ {
+				_, from := receivers[i].Packet(j)
+				senders[from.String()]++
+				received++
+			}
+		}
+		for _, count := range senders {
+			assert.Equal(t, 2, count)
+		}
+		if len(senders) > 0 {
+			used++
+		}
+	}
+
+	assert.Equal(t, NumSenders*2, received)
+	assert.True(t, used > 1)
+}
+
+func TestVirtualNetworkConditions(t *testing.T) {
+
+	t.Parallel()
+
+	const NumPackets = 1000
+
+	run := func(seed int64, conditions NetworkConditions) ([]int, VirtualNetworkCounters, time.Duration) {
+
+		network := NewVirtualNetwork(seed, SystemClock)
+		defer network.Close()
+
+		network.SetConditions(conditions)
+
+		senderSocket, _ := network.Listen("127.0.0.1:0", SocketOptions{})
+		receiverSocket, _ := network.Listen("127.0.0.1:40000", SocketOptions{})
+
+		sender := network.NewPacketConn(senderSocket, 64, 1500)
+		receiver := network.NewPacketConn(receiverSocket, 64, 1500)
+
+		startTime := time.Now()
+
+		for i := 0; i < NumPackets; i++ {
+			var packetData [2]byte
+			packetData[0] = byte(i)
+			packetData[1] = byte(i >> 8)
+			sender.WriteTo(packetData[:], receiverSocket.LocalAddr().(*net.UDPAddr))
+		}
+		sender.Flush()
+
+		// wait for everything in flight to arrive
+
+		var order []int
+		for {
+			counters := network.Counters()
+			if counters.PacketsDelivered+counters.PacketsDropped == uint64(len(order)) && counters.PacketsDelivered+counters.PacketsLost-counters.PacketsDuplicated == NumPackets {
+				break
+			}
+			receiverSocket.SetReadDeadline(time.Now().Add(time.Second))
+			numPackets, err := receiver.ReadBatch()
+			if err != nil {
+				break
+			}
+			for i := 0; i < numPackets; i++ {
+				packetData, _ := receiver.Packet(i)
+				order = append(order, int(packetData[0])|int(packetData[1])<<8)
+			}
+		}
+
+		return order, network.Counters(), time.Since(startTime)
+	}
+
+	// a perfect network delivers everything in order
+
+	order, counters, _ := run(0, NetworkConditions{})
+	assert.Equal(t, NumPackets, len(order))
+	for i := range order {
+		assert.Equal(t, i, order[i])
+	}
+	assert.Equal(t, uint64(NumPackets), counters.PacketsDelivered)
+
+	// loss and duplication happen at roughly the configured rate
+
+	order, counters, _ = run(1, NetworkConditions{Loss: 0.1, Duplicate: 0.1})
+	assert.InDelta(t, NumPackets*0.1, float64(counters.PacketsLost), NumPackets*0.05)
+	assert.InDelta(t, NumPackets*0.1*0.9, float64(counters.PacketsDuplicated), NumPackets*0.05)
+	assert.Equal(t, NumPackets-int(counters.PacketsLost)+int(counters.PacketsDuplicated), len(order))
+
+	// the same seed gives the same losses and duplicates
+
+	repeatOrder, repeatCounters, _ := run(1, NetworkConditions{Loss: 0.1, Duplicate: 0.1})
+	assert.Equal(t, order, repeatOrder)
+	assert.Equal(t, counters, repeatCounters)
+
+	// latency delays packets, and reordered packets arrive after packets sent after them
+
+	order, counters, elapsed := run(2, NetworkConditions{Latency: 20 * time.Millisecond, Jitter: 5 * time.Millisecond, Reorder: 0.1})
+	assert.Equal(t, NumPackets, len(order))
+	assert.True(t, elapsed >= 20*time.Millisecond)
+	assert.True(t, counters.PacketsReordered > 0)
+	outOfOrder := 0
+	for i := 1; i < len(order); i++ {
+		if order[i] < order[i-1] {
+			outOfOrder++
+		}
+	}
+	assert.True(t, outOfOrder > 0)
+}
+
+func TestCopyAddress(t *testing.T) {
+
+	t.Parallel()
+
+	source := ParseAddress("127.0.0.1:40000")
+
+	var address net.UDPAddr
+	CopyAddress(&address, source)
+
+	assert.True(t, AddressEqual(&address, source))
+
+	// the copy doesn't share the IP with the source
+
+	source.IP[0] = 10
+	source.Port = 50000
+
+	assert.Equal(t, "127.0.0.1:40000", address.String())
+}
+
+func TestWaitDeadline(t *testing.T) {
+
+	t.Parallel()
+
+	var wg sync.WaitGroup
+
+	assert.True(t, WaitDeadline(&wg, time.Now().Add(time.Second)))
+
+	wg.Add(1)
+
+	assert.False(t, WaitDeadline(&wg, time.Now().Add(10*time.Millisecond)))
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		wg.Done()
+	}()
+
+	assert.True(t, WaitDeadline(&wg, time.Now().Add(5*time.Second)))
+}
+
+func TestPacketPool(t *testing.T) {
+
+	t.Parallel()
+
+	pool := NewPacketPool(2, 100)
+
+	a := pool.Get()
+	assert.Equal(t, 100, len(a))
+
+	a[0] = 1
+	pool.Put(a[:10])
+
+	b := pool.Get()
+	assert.Equal(t, 100, len(b))
+	assert.Equal(t, &a[0], &b[0])
+
+	// the pool doesn't grow past its size
+
+	pool.Put(make([]byte, 100))
+	pool.Put(make([]byte, 100))
+	pool.Put(make([]byte, 100))
+
+	assert.Equal(t, 2, len(pool.free))
+
+	// buffers that are too small are not pooled
+
+	pool = NewPacketPool(2, 100)
+	pool.Put(make([]byte, 10))
+	assert.Equal(t, 0, len(pool.free))
+}
+
+func TestLogger(t *testing.T) {
+
+	// not parallel, since log level, format and output are global
+
+	var output bytes.Buffer
+	SetLogOutput(&output)
+	defer SetLogOutput(os.Stdout)
+	defer SetLogLevel(GetLogLevel())
+	defer SetLogFormat(LogFormat_Logfmt)
+
+	logger := (&Logger{}).With("service", "gateway").With("thread", 3).With("client", ParseAddress("127.0.0.1:30000"))
+
+	SetLogLevel(LogLevel_Info)
+	SetLogFormat(LogFormat_Logfmt)
+
+	logger.Debug("not written")
+	assert.Equal(t, 0, output.Len())
+
+	logger.Info("hello %s", "world")
+	line := output.String()
+	assert.True(t, strings.HasPrefix(line, "time="))
+	assert.True(t, strings.HasSuffix(line, ` level=info service=gateway thread=3 client=127.0.0.1:30000 msg="hello world"`+"\n"))
+
+	output.Reset()
+	SetLogFormat(LogFormat_JSON)
+	logger.Error("failed: %v", fmt.Errorf("bad \"thing\""))
+
+	var fields map[string]interface{}
+	assert.Nil(t, json.Unmarshal(output.Bytes(), &fields))
+	assert.Equal(t, "error", fields["level"])
+	assert.Equal(t, "gateway", fields["service"])
+	assert.Equal(t, 3.0, fields["thread"])
+	assert.Equal(t, "127.0.0.1:30000", fields["client"])
+	assert.Equal(t, `failed: bad "thing"`, fields["msg"])
+
+	// deriving a logger doesn't change its parent
+
+	child := logger.With("extra", "value")
+	assert.Equal(t, 3, len(logger.fields))
+	assert.Equal(t, 4, len(child.fields))
+
+	SetLogLevel(LogLevel_None)
+	output.Reset()
+	logger.Error("not written")
+	assert.Equal(t, 0, output.Len())
+}
+
+func TestLogLevel(t *testing.T) {
+
+	t.Parallel()
+
+	for level := int32(LogLevel_Debug); level <= LogLevel_None; level++ {
+		parsed, err := ParseLogLevel(LogLevelString(level))
+		assert.Nil(t, err)
+		assert.Equal(t, level, parsed)
+	}
+
+	_, err := ParseLogLevel("verbose")
+	assert.NotNil(t, err)
+
+	_, err = ParseLogFormat("xml")
+	assert.NotNil(t, err)
+}
+
+func TestSessionLogLevel(t *testing.T) {
+
+	// not parallel, since log level and session overrides are global
+
+	defer SetLogLevel(GetLogLevel())
+
+	SetLogLevel(LogLevel_Info)
+
+	sessionId := RandomBytes(SessionIdBytes)
+	otherSessionId := RandomBytes(SessionIdBytes)
+
+	logger := Log.WithSession(sessionId)
+	otherLogger := Log.WithSession(otherSessionId)
+
+	assert.False(t, logger.DebugEnabled())
+	assert.False(t, otherLogger.DebugEnabled())
+
+	SetSessionLogLevel(IdString(sessionId), LogLevel_Debug)
+
+	assert.True(t, logger.DebugEnabled())
+	assert.False(t, otherLogger.DebugEnabled())
+	assert.False(t, Log.DebugEnabled())
+
+	// session overrides can also make a session quieter
+
+	SetSessionLogLevel(IdString(otherSessionId), LogLevel_Error)
+	assert.False(t, otherLogger.Enabled(LogLevel_Warn))
+	assert.True(t, otherLogger.Enabled(LogLevel_Error))
+
+	ClearSessionLogLevel(IdString(sessionId))
+	ClearSessionLogLevel(IdString(otherSessionId))
+
+	assert.False(t, logger.DebugEnabled())
+	assert.True(t, otherLogger.Enabled(LogLevel_Warn))
+}
+
+func TestLogLevelHandler(t *testing.T) {
+
+	// not parallel, since log level and session overrides are global
+
+	defer SetLogLevel(GetLogLevel())
+
+	SetLogLevel(LogLevel_Info)
+
+	handler := LogLevelHandler("secret")
+
+	request := func(method string, query string, secret string) int {
+		r := httptest.NewRequest(method, "/log_level?"+query, nil)
+		if secret != "" {
+			r.Header.Set("Authorization", "Bearer "+secret)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	// requests without the secret are refused, and change nothing
+
+	assert.Equal(t, http.StatusUnauthorized, request("POST", "level=debug", ""))
+	assert.Equal(t, http.StatusUnauthorized, request("POST", "level=debug", "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "", ""))
+	assert.Equal(t, int32(LogLevel_Info), GetLogLevel())
+
+	w := httptest.NewRecorder()
+	LogLevelHandler("")(w, httptest.NewRequest("GET", "/log_level", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	assert.Equal(t, http.StatusOK, request("POST", "level=warn", "secret"))
+	assert.Equal(t, int32(LogLevel_Warn), GetLogLevel())
+	assert.Equal(t, http.StatusBadRequest, request("POST", "level=verbose", "secret"))
+
+	// session overrides must be for a session id, and there can only be so many
+
+	assert.Equal(t, http.StatusBadRequest, request("POST", "level=debug&session=other", "secret"))
+
+	sessionIds := make([]string, MaxSessionLogLevels+1)
+	for i := range sessionIds {
+		sessionIds[i] = IdString(RandomBytes(SessionIdBytes))
+	}
+	defer func() {
+		for i := range sessionIds {
+			ClearSessionLogLevel(sessionIds[i])
+		}
+	}()
+
+	for i := 0; i < MaxSessionLogLevels; i++ {
+		assert.Equal(t, http.StatusOK, request("POST", "level=debug&session="+sessionIds[i], "secret"))
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, request("POST", "level=debug&session="+sessionIds[MaxSessionLogLevels], "secret"))
+	assert.Equal(t, http.StatusOK, request("POST", "level=error&session="+sessionIds[0], "secret"))
+
+	assert.Equal(t, http.StatusOK, request("POST", "level=default&session="+strings.ToUpper(sessionIds[0]), "secret"))
+	assert.Equal(t, http.StatusOK, request("POST", "level=debug&session="+sessionIds[MaxSessionLogLevels], "secret"))
+}
+
+func TestLogLimiter(t *testing.T) {
+
+	t.Parallel()
+
+	limiter := NewLogLimiter(time.Hour)
+
+	ok, suppressed := limiter.Allow()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(0), suppressed)
+
+	for i := 0; i < 10; i++ {
+		ok, _ = limiter.Allow()
+		assert.False(t, ok)
+	}
+
+	// the next line to get through reports how many were dropped
+
+	limiter.next = 0
+
+	ok, suppressed = limiter.Allow()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(10), suppressed)
+}
+
+func BenchmarkGetAckBits(b *testing.B) {
+	receivedPackets := make([]uint64, 1024)
+	var ack_bits [AckBitsBytes]byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		GetAckBits(uint64(100000+i), receivedPackets, ack_bits[:])
+	}
+}
+
+func BenchmarkProcessAcks(b *testing.B) {
+	ackedPackets := make([]uint64, 1024)
+	ackBuffer := make([]uint64, 1024)
+	var ack_bits [AckBitsBytes]byte
+	RandomBytes_InPlace(ack_bits[:])
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ProcessAcks(uint64(100000+i), ack_bits[:], ackedPackets, ackBuffer)
+	}
+}
+
+func BenchmarkAdvancedPacketFilter(b *testing.B) {
+	packetData := make([]byte, 100)
+	var magic [MagicBytes]byte
+	var fromAddressData, toAddressData [4]byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		AdvancedPacketFilter(packetData, magic[:], fromAddressData[:], 40000, toAddressData[:], 50000, len(packetData))
+	}
+}
+
+// BenchmarkBatchConn forwards packets over loopback the way the gateway does: build each packet in place, flush, read.
+func BenchmarkBatchConn(b *testing.B) {
+
+	const PacketBytes = 1500
+
+	senderConn, err := net.ListenUDP("udp", ParseAddress("127.0.0.1:0"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer senderConn.Close()
+
+	receiverConn, err := net.ListenUDP("udp", ParseAddress("127.0.0.1:0"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer receiverConn.Close()
+
+	const BatchSize = 32
+
+	sender := NewBatchConn(senderConn, BatchSize, PacketBytes)
+	receiver := NewBatchConn(receiverConn, BatchSize, PacketBytes)
+
+	receiverAddress := receiverConn.LocalAddr().(*net.UDPAddr)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i += BatchSize {
+		for j := 0; j < BatchSize; j++ {
+			packetData := sender.WritePacket()
+			packetData[0] = byte(j)
+			sender.CommitPacket(100, receiverAddress)
+		}
+		if err := sender.Flush(); err != nil {
+			b.Fatal(err)
+		}
+		for received := 0; received < BatchSize; {
+			numPackets, err := receiver.ReadBatch()
+			if err != nil {
+				b.Fatal(err)
+			}
+			received += numPackets
+		}
+	}
+}
+
+// BenchmarkEncryptBox and BenchmarkEncryptSharedBox compare the per-packet crypto cost of crypto box
+// with and without a precomputed shared key, for a minimum size payload packet.
+
+func BenchmarkEncryptBox(b *testing.B) {
+	_, senderPrivateKey := Keygen_Box()
+	receiverPublicKey, _ := Keygen_Box()
+	nonce := RandomBytes(NonceBytes_Box)
+	buffer := make([]byte, HeaderBytes+MinPayloadBytes+HMACBytes_Box)
+	b.SetBytes(int64(len(buffer) - HMACBytes_Box))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Encrypt_Box(senderPrivateKey, receiverPublicKey, nonce, buffer, len(buffer)-HMACBytes_Box)
+	}
+}
+
+func BenchmarkEncryptSharedBox(b *testing.B) {
+	_, senderPrivateKey := Keygen_Box()
+	receiverPublicKey, _ := Keygen_Box()
+	var sharedKey [SharedKeyBytes_Box]byte
+	SharedKey_Box(receiverPublicKey, senderPrivateKey, sharedKey[:])
+	nonce := RandomBytes(NonceBytes_Box)
+	buffer := make([]byte, HeaderBytes+MinPayloadBytes+HMACBytes_Box)
+	b.SetBytes(int64(len(buffer) - HMACBytes_Box))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Encrypt_SharedBox(sharedKey[:], nonce, buffer, len(buffer)-HMACBytes_Box)
+	}
+}
+
+func BenchmarkDecryptBox(b *testing.B) {
+	senderPublicKey, senderPrivateKey := Keygen_Box()
+	receiverPublicKey, receiverPrivateKey := Keygen_Box()
+	nonce := RandomBytes(NonceBytes_Box)
+	packetData := make([]byte, HeaderBytes+MinPayloadBytes+HMACBytes_Box)
+	Encrypt_Box(senderPrivateKey, receiverPublicKey, nonce, packetData, len(packetData)-HMACBytes_Box)
+	buffer := make([]byte, len(packetData))
+	b.SetBytes(int64(len(buffer) - HMACBytes_Box))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		copy(buffer, packetData)
+		if err := Decrypt_Box(senderPublicKey, receiverPrivateKey, nonce, buffer, len(buffer)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecryptSharedBox(b *testing.B) {
+	senderPublicKey, senderPrivateKey := Keygen_Box()
+	receiverPublicKey, receiverPrivateKey := Keygen_Box()
+	var sharedKey [SharedKeyBytes_Box]byte
+	SharedKey_Box(senderPublicKey, receiverPrivateKey, sharedKey[:])
+	nonce := RandomBytes(NonceBytes_Box)
+	packetData := make([]byte, HeaderBytes+MinPayloadBytes+HMACBytes_Box)
+	Encrypt_Box(senderPrivateKey, receiverPublicKey, nonce, packetData, len(packetData)-HMACBytes_Box)
+	buffer := make([]byte, len(packetData))
+	b.SetBytes(int64(len(buffer) - HMACBytes_Box))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		copy(buffer, packetData)
+		if err := Decrypt_SharedBox(sharedKey[:], nonce, buffer, len(buffer)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+
+	t.Parallel()
+
+	clock := NewFakeClock(time.Unix(1000, 0))
+
+	assert.Equal(t, time.Unix(1000, 0), clock.Now())
+
+	first := clock.NewTimer(time.Second)
+	second := clock.NewTimer(2 * time.Second)
+	stopped := clock.NewTimer(time.Second)
+
+	assert.Equal(t, 3, clock.Timers())
+	assert.True(t, stopped.Stop())
+	assert.False(t, stopped.Stop())
+
+	// timers only fire once the clock passes their deadline
+
+	clock.Advance(999 * time.Millisecond)
+
+	select {
+	case <-first.C():
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	clock.Advance(time.Millisecond)
+
+	assert.Equal(t, time.Unix(1001, 0), <-first.C())
+	assert.False(t, first.Stop())
+	assert.Equal(t, 1, clock.Timers())
+
+	clock.Advance(10 * time.Second)
+
+	assert.Equal(t, time.Unix(1011, 0), <-second.C())
+	assert.Equal(t, 0, clock.Timers())
+
+	select {
+	case <-stopped.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+
+	// a timer with no duration fires straight away
+
+	now := clock.NewTimer(0)
+	assert.Equal(t, time.Unix(1011, 0), <-now.C())
+
+	// a reset timer fires again, from the time it was reset
+
+	first.Reset(time.Second)
+	assert.Equal(t, 1, clock.Timers())
+
+	clock.Advance(time.Second)
+
+	assert.Equal(t, time.Unix(1012, 0), <-first.C())
+	assert.Equal(t, 0, clock.Timers())
+
+	stopped.Reset(time.Second)
+	stopped.Reset(2 * time.Second)
+	assert.Equal(t, 1, clock.Timers())
+
+	clock.Advance(time.Second)
+
+	select {
+	case <-stopped.C():
+		t.Fatal("timer fired before its reset deadline")
+	default:
+	}
+
+	clock.Advance(time.Second)
+
+	assert.Equal(t, time.Unix(1014, 0), <-stopped.C())
+}
+
+func TestVirtualNetworkFakeClock(t *testing.T) {
+
+	t.Parallel()
+
+	clock := NewFakeClock(time.Unix(1000, 0))
+
+	network := NewVirtualNetwork(0, clock)
+	defer network.Close()
+
+	network.SetConditions(NetworkConditions{Latency: 100 * time.Millisecond})
+
+	sender, err := network.Listen("127.0.0.1:20000", SocketOptions{})
+	assert.Nil(t, err)
+	receiver, err := network.Listen("127.0.0.1:20001", SocketOptions{})
+	assert.Nil(t, err)
+
+	senderConn := network.NewPacketConn(sender, 1, 1500)
+	receiverConn := network.NewPacketConn(receiver, 1, 1500)
+
+	senderConn.WriteTo([]byte("hello"), ParseAddress("127.0.0.1:20001"))
+	assert.Nil(t, senderConn.Flush())
+
+	// the packet is in flight until the clock reaches its delivery time, however long we wait
+
+	receiver.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = receiverConn.ReadBatch()
+	assert.True(t, IsTimeout(err))
+
+	clock.Advance(100 * time.Millisecond)
+
+	receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	numPackets, err := receiverConn.ReadBatch()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, numPackets)
+	packetData, from := receiverConn.Packet(0)
+	assert.Equal(t, []byte("hello"), packetData)
+	assert.Equal(t, "127.0.0.1:20000", from.String())
+}
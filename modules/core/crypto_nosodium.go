@@ -0,0 +1,136 @@
+//go:build !cgo || nosodium
+// +build !cgo nosodium
+
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+// crypto box and secretbox in pure go, on top of golang.org/x/crypto/nacl. This is used when building
+// with -tags nosodium or CGO_ENABLED=0, so static builds and cross compiles don't need libsodium.
+// The output is byte for byte the same as libsodium's _easy functions: the MAC followed by the ciphertext.
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// x/crypto can't encrypt in place, so the input is copied to a scratch buffer on the stack first.
+// This is large enough for any packet, so the hot paths don't allocate. Anything larger goes on the heap.
+const cryptoScratchBytes = 2048
+
+func cryptoScratch(scratch []byte, data []byte) []byte {
+	if len(data) > len(scratch) {
+		scratch = make([]byte, len(data))
+	}
+	scratch = scratch[:len(data)]
+	copy(scratch, data)
+	return scratch
+}
+
+func Keygen_Box() ([]byte, []byte) {
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("failed to generate box keypair: %v", err))
+	}
+	return publicKey[:], privateKey[:]
+}
+
+func Encrypt_Box(senderPrivateKey []byte, receiverPublicKey []byte, nonce []byte, buffer []byte, bytes int) int {
+	var sharedKey [SharedKeyBytes_Box]byte
+	SharedKey_Box(receiverPublicKey, senderPrivateKey, sharedKey[:])
+	return Encrypt_SharedBox(sharedKey[:], nonce, buffer, bytes)
+}
+
+func Decrypt_Box(senderPublicKey []byte, receiverPrivateKey []byte, nonce []byte, buffer []byte, bytes int) error {
+	var sharedKey [SharedKeyBytes_Box]byte
+	SharedKey_Box(senderPublicKey, receiverPrivateKey, sharedKey[:])
+	return Decrypt_SharedBox(sharedKey[:], nonce, buffer, bytes)
+}
+
+func SharedKey_Box(publicKey []byte, privateKey []byte, sharedKey []byte) {
+	var publicKeyArray [PublicKeyBytes_Box]byte
+	var privateKeyArray [PrivateKeyBytes_Box]byte
+	var sharedKeyArray [SharedKeyBytes_Box]byte
+	copy(publicKeyArray[:], publicKey)
+	copy(privateKeyArray[:], privateKey)
+	box.Precompute(&sharedKeyArray, &publicKeyArray, &privateKeyArray)
+	copy(sharedKey, sharedKeyArray[:])
+}
+
+func Encrypt_SharedBox(sharedKey []byte, nonce []byte, buffer []byte, bytes int) int {
+	var nonceArray [NonceBytes_Box]byte
+	var sharedKeyArray [SharedKeyBytes_Box]byte
+	var scratch [cryptoScratchBytes]byte
+	copy(nonceArray[:], nonce)
+	copy(sharedKeyArray[:], sharedKey)
+	message := cryptoScratch(scratch[:], buffer[:bytes])
+	box.SealAfterPrecomputation(buffer[:0:bytes+HMACBytes_Box], message, &nonceArray, &sharedKeyArray)
+	return bytes + HMACBytes_Box
+}
+
+func Decrypt_SharedBox(sharedKey []byte, nonce []byte, buffer []byte, bytes int) error {
+	if bytes < HMACBytes_Box {
+		return fmt.Errorf("failed to decrypt: %d bytes is too small", bytes)
+	}
+	var nonceArray [NonceBytes_Box]byte
+	var sharedKeyArray [SharedKeyBytes_Box]byte
+	var scratch [cryptoScratchBytes]byte
+	copy(nonceArray[:], nonce)
+	copy(sharedKeyArray[:], sharedKey)
+	ciphertext := cryptoScratch(scratch[:], buffer[:bytes])
+	if _, ok := box.OpenAfterPrecomputation(buffer[:0], ciphertext, &nonceArray, &sharedKeyArray); !ok {
+		return fmt.Errorf("failed to decrypt")
+	}
+	return nil
+}
+
+func Keygen_SecretBox() []byte {
+	return RandomBytes(PrivateKeyBytes_SecretBox)
+}
+
+func Encrypt_SecretBox(privateKey []byte, nonce []byte, buffer []byte, bytes int) int {
+	var nonceArray [NonceBytes_SecretBox]byte
+	var privateKeyArray [PrivateKeyBytes_SecretBox]byte
+	var scratch [cryptoScratchBytes]byte
+	copy(nonceArray[:], nonce)
+	copy(privateKeyArray[:], privateKey)
+	message := cryptoScratch(scratch[:], buffer[:bytes])
+	secretbox.Seal(buffer[:0:bytes+HMACBytes_SecretBox], message, &nonceArray, &privateKeyArray)
+	return bytes + HMACBytes_SecretBox
+}
+
+func Decrypt_SecretBox(privateKey []byte, nonce []byte, buffer []byte, bytes int) error {
+	if bytes < HMACBytes_SecretBox {
+		return fmt.Errorf("failed to decrypt: %d bytes is too small", bytes)
+	}
+	var nonceArray [NonceBytes_SecretBox]byte
+	var privateKeyArray [PrivateKeyBytes_SecretBox]byte
+	var scratch [cryptoScratchBytes]byte
+	copy(nonceArray[:], nonce)
+	copy(privateKeyArray[:], privateKey)
+	ciphertext := cryptoScratch(scratch[:], buffer[:bytes])
+	if _, ok := secretbox.Open(buffer[:0], ciphertext, &nonceArray, &privateKeyArray); !ok {
+		return fmt.Errorf("failed to decrypt")
+	}
+	return nil
+}
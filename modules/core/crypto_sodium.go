@@ -0,0 +1,127 @@
+//go:build cgo && !nosodium
+// +build cgo,!nosodium
+
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+// crypto box and secretbox through libsodium. This is the default when cgo is available.
+// Build with -tags nosodium, or with CGO_ENABLED=0, for the pure go implementation in crypto_nosodium.go.
+
+// #cgo pkg-config: libsodium
+// #include <sodium.h>
+import "C"
+
+import (
+	"fmt"
+)
+
+func Keygen_Box() ([]byte, []byte) {
+	var publicKey [PublicKeyBytes_Box]byte
+	var privateKey [PrivateKeyBytes_Box]byte
+	C.crypto_box_keypair((*C.uchar)(&publicKey[0]),
+		(*C.uchar)(&privateKey[0]))
+	return publicKey[:], privateKey[:]
+}
+
+func Encrypt_Box(senderPrivateKey []byte, receiverPublicKey []byte, nonce []byte, buffer []byte, bytes int) int {
+	C.crypto_box_easy((*C.uchar)(&buffer[0]),
+		(*C.uchar)(&buffer[0]),
+		C.ulonglong(bytes),
+		(*C.uchar)(&nonce[0]),
+		(*C.uchar)(&receiverPublicKey[0]),
+		(*C.uchar)(&senderPrivateKey[0]))
+	return bytes + HMACBytes_Box
+}
+
+func Decrypt_Box(senderPublicKey []byte, receiverPrivateKey []byte, nonce []byte, buffer []byte, bytes int) error {
+	result := C.crypto_box_open_easy(
+		(*C.uchar)(&buffer[0]),
+		(*C.uchar)(&buffer[0]),
+		C.ulonglong(bytes),
+		(*C.uchar)(&nonce[0]),
+		(*C.uchar)(&senderPublicKey[0]),
+		(*C.uchar)(&receiverPrivateKey[0]))
+	if result != 0 {
+		return fmt.Errorf("failed to decrypt: result = %d", result)
+	} else {
+		return nil
+	}
+}
+
+// SharedKey_Box precomputes the key shared between a public key and a private key (crypto_box_beforenm).
+// Encrypting with the shared key skips the X25519 scalar multiplication that Encrypt_Box does for every packet.
+func SharedKey_Box(publicKey []byte, privateKey []byte, sharedKey []byte) {
+	C.crypto_box_beforenm((*C.uchar)(&sharedKey[0]),
+		(*C.uchar)(&publicKey[0]),
+		(*C.uchar)(&privateKey[0]))
+}
+
+func Encrypt_SharedBox(sharedKey []byte, nonce []byte, buffer []byte, bytes int) int {
+	C.crypto_box_easy_afternm((*C.uchar)(&buffer[0]),
+		(*C.uchar)(&buffer[0]),
+		C.ulonglong(bytes),
+		(*C.uchar)(&nonce[0]),
+		(*C.uchar)(&sharedKey[0]))
+	return bytes + HMACBytes_Box
+}
+
+func Decrypt_SharedBox(sharedKey []byte, nonce []byte, buffer []byte, bytes int) error {
+	result := C.crypto_box_open_easy_afternm(
+		(*C.uchar)(&buffer[0]),
+		(*C.uchar)(&buffer[0]),
+		C.ulonglong(bytes),
+		(*C.uchar)(&nonce[0]),
+		(*C.uchar)(&sharedKey[0]))
+	if result != 0 {
+		return fmt.Errorf("failed to decrypt: result = %d", result)
+	} else {
+		return nil
+	}
+}
+
+func Keygen_SecretBox() []byte {
+	key := make([]byte, PrivateKeyBytes_SecretBox)
+	C.crypto_secretbox_keygen((*C.uchar)(&key[0]))
+	return key
+}
+
+func Encrypt_SecretBox(privateKey []byte, nonce []byte, buffer []byte, bytes int) int {
+	C.crypto_secretbox_easy((*C.uchar)(&buffer[0]),
+		(*C.uchar)(&buffer[0]),
+		C.ulonglong(bytes),
+		(*C.uchar)(&nonce[0]),
+		(*C.uchar)(&privateKey[0]))
+	return bytes + HMACBytes_SecretBox
+}
+
+func Decrypt_SecretBox(privateKey []byte, nonce []byte, buffer []byte, bytes int) error {
+	result := C.crypto_secretbox_open_easy(
+		(*C.uchar)(&buffer[0]),
+		(*C.uchar)(&buffer[0]),
+		C.ulonglong(bytes),
+		(*C.uchar)(&nonce[0]),
+		(*C.uchar)(&privateKey[0]))
+	if result != 0 {
+		return fmt.Errorf("failed to decrypt: result = %d", result)
+	} else {
+		return nil
+	}
+}
@@ -0,0 +1,386 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Fuzz targets for the parsers that read bytes from the network. go test runs them over the seed corpus,
+// and go test -fuzz=FuzzReadAddress ./modules/core fuzzes one of them. Any input must be rejected cleanly, not panic.
+
+func FuzzBasicPacketFilter(f *testing.F) {
+
+	var magic [MagicBytes]byte
+	var fromAddress, toAddress [4]byte
+
+	for _, packetBytes := range []int{0, 1, 16, 17, 18, MinPacketSize, 1500} {
+		packetData := make([]byte, packetBytes)
+		if packetBytes >= VersionBytes+PacketTypeBytes+ChonkleBytes {
+			GenerateChonkle(packetData[2:], magic[:], fromAddress[:], 40000, toAddress[:], 50000, packetBytes)
+		}
+		f.Add(packetData, packetBytes)
+		f.Add(packetData, packetBytes+1)
+	}
+
+	f.Fuzz(func(t *testing.T, packetData []byte, packetBytes int) {
+		if BasicPacketFilter(packetData, packetBytes) {
+			assert.True(t, packetBytes <= len(packetData))
+		}
+	})
+}
+
+func FuzzAdvancedPacketFilter(f *testing.F) {
+
+	var magic [MagicBytes]byte
+	var fromAddress, toAddress [4]byte
+	fromPort, toPort := uint16(40000), uint16(50000)
+
+	for _, packetBytes := range []int{0, 18, 19, MinPacketSize, 1500} {
+		packetData := make([]byte, packetBytes)
+		if packetBytes >= VersionBytes+PacketTypeBytes+ChonkleBytes+PittleBytes {
+			GenerateChonkle(packetData[2:], magic[:], fromAddress[:], fromPort, toAddress[:], toPort, packetBytes)
+			GeneratePittle(packetData[packetBytes-PittleBytes:], fromAddress[:], fromPort, toAddress[:], toPort, packetBytes)
+		}
+		f.Add(packetData, packetBytes)
+		f.Add(packetData, packetBytes-1)
+	}
+
+	f.Fuzz(func(t *testing.T, packetData []byte, packetBytes int) {
+		if AdvancedPacketFilter(packetData, magic[:], fromAddress[:], fromPort, toAddress[:], toPort, packetBytes) {
+			assert.True(t, packetBytes <= len(packetData))
+		}
+	})
+}
+
+func FuzzReadAddress(f *testing.F) {
+
+	for _, address := range []*net.UDPAddr{nil, ParseAddress("127.0.0.1:40000"), ParseAddress("[::1]:50000")} {
+		buffer := make([]byte, AddressBytes)
+		index := 0
+		WriteAddress(buffer, &index, address)
+		f.Add(buffer)
+		f.Add(buffer[:AddressBytes-1])
+	}
+	f.Add([]byte{})
+	f.Add([]byte{IPAddressIPv6 + 1})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		var address net.UDPAddr
+		index := 0
+		if !ReadAddress(data, &index, &address) {
+			assert.Equal(t, 0, index)
+			return
+		}
+		assert.Equal(t, AddressBytes, index)
+
+		// whatever was read writes back out and reads back in the same
+
+		buffer := make([]byte, AddressBytes)
+		index = 0
+		WriteAddress(buffer, &index, &address)
+
+		var readAddress net.UDPAddr
+		index = 0
+		assert.True(t, ReadAddress(buffer, &index, &readAddress))
+		assert.True(t, AddressEqual(&address, &readAddress))
+	})
+}
+
+func FuzzReadChallengeToken(f *testing.F) {
+
+	privateKey := Keygen_SecretBox()
+
+	challengeToken := ChallengeToken{}
+	challengeToken.ExpireTimestamp = uint64(time.Now().Unix() + 10)
+	challengeToken.ClientAddress = *ParseAddress("127.0.0.1:30000")
+	challengeToken.Sequence = 10000
+
+	buffer := make([]byte, EncryptedChallengeTokenBytes)
+	index := 0
+	WriteObject(buffer, &index, &challengeToken)
+	f.Add(buffer[:ChallengeTokenBytes])
+
+	index = 0
+	WriteEncryptedChallengeToken(buffer, &index, &challengeToken, privateKey)
+	f.Add(buffer)
+	f.Add(buffer[:EncryptedChallengeTokenBytes-1])
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		var token ChallengeToken
+		index := 0
+		if ReadObject(data, &index, &token) {
+			assert.Equal(t, ChallengeTokenBytes, index)
+		}
+
+		// decrypting happens in place, so work on a copy
+
+		buffer := append([]byte(nil), data...)
+		index = 0
+		if ReadEncryptedChallengeToken(buffer, &index, &token, privateKey) {
+			assert.Equal(t, EncryptedChallengeTokenBytes, index)
+		}
+	})
+}
+
+func FuzzReadSessionToken(f *testing.F) {
+
+	authPublicKey, authPrivateKey := Keygen_Box()
+	gatewayPublicKey, gatewayPrivateKey := Keygen_Box()
+
+	sessionToken := SessionToken{}
+	sessionToken.ExpireTimestamp = uint64(time.Now().Unix() + 10)
+	RandomBytes_InPlace(sessionToken.SessionId[:])
+	RandomBytes_InPlace(sessionToken.UserId[:])
+
+	buffer := make([]byte, EncryptedSessionTokenBytes)
+	index := 0
+	WriteObject(buffer, &index, &sessionToken)
+	f.Add(buffer[:SessionTokenBytes])
+
+	index = 0
+	WriteEncryptedSessionToken(buffer, &index, &sessionToken, authPrivateKey, gatewayPublicKey)
+	f.Add(buffer)
+	f.Add(buffer[:EncryptedSessionTokenBytes-1])
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		var token SessionToken
+		index := 0
+		if ReadObject(data, &index, &token) {
+			assert.Equal(t, SessionTokenBytes, index)
+		}
+
+		buffer := append([]byte(nil), data...)
+		index = 0
+		if ReadEncryptedSessionToken(buffer, &index, &token, authPublicKey, gatewayPrivateKey) {
+			assert.Equal(t, EncryptedSessionTokenBytes, index)
+		}
+	})
+}
+
+func FuzzReadConnectData(f *testing.F) {
+
+	publicKey, _ := Keygen_Box()
+
+	for _, gatewayAddress := range []string{"127.0.0.1:40000", "[::1]:40000"} {
+		connectData := ConnectData{}
+		copy(connectData.ClientPublicKey[:], publicKey)
+		connectData.GatewayAddress = *ParseAddress(gatewayAddress)
+		RandomBytes_InPlace(connectData.GatewayPublicKey[:])
+		buffer := make([]byte, ConnectDataBytes)
+		index := 0
+		WriteObject(buffer, &index, &connectData)
+		f.Add(buffer)
+		f.Add(buffer[:ConnectDataBytes-1])
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var connectData ConnectData
+		index := 0
+		if ReadObject(data, &index, &connectData) {
+			assert.Equal(t, ConnectDataBytes, index)
+		}
+	})
+}
+
+func FuzzReadPayloadPacket(f *testing.F) {
+
+	for _, packetBytes := range []int{PrefixBytes - 1, PrefixBytes, PrefixBytes + HeaderBytes - 1, PrefixBytes + HeaderBytes} {
+		packetData := make([]byte, packetBytes)
+		if packetBytes > 1 {
+			packetData[1] = PacketType_Payload
+		}
+		f.Add(packetData)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var prefix PacketPrefix
+		var header PayloadHeader
+		index := 0
+		if ReadObject(data, &index, &prefix) && ReadObject(data, &index, &header) {
+			assert.Equal(t, PrefixBytes+HeaderBytes, index)
+		}
+	})
+}
+
+func FuzzReadChallengePacket(f *testing.F) {
+
+	_, clientPrivateKey := Keygen_Box()
+	gatewayPublicKey, _ := Keygen_Box()
+
+	var sharedKey [SharedKeyBytes_Box]byte
+	SharedKey_Box(gatewayPublicKey, clientPrivateKey, sharedKey[:])
+
+	challengePacket := ChallengePacket{Sequence: 1}
+	packetData := make([]byte, 1500)
+	packetBytes := challengePacket.Write(packetData, sharedKey[:], ParseAddress("127.0.0.1:40000"), ParseAddress("127.0.0.1:30000"))
+	f.Add(packetData[:packetBytes])
+	f.Add(packetData[:packetBytes-1])
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var packet ChallengePacket
+		packetData := append([]byte(nil), data...)
+		packet.Read(packetData, sharedKey[:])
+	})
+}
+
+func FuzzReadDisconnectPacket(f *testing.F) {
+
+	_, clientPrivateKey := Keygen_Box()
+	gatewayPublicKey, _ := Keygen_Box()
+
+	var sharedKey [SharedKeyBytes_Box]byte
+	SharedKey_Box(gatewayPublicKey, clientPrivateKey, sharedKey[:])
+
+	disconnectPacket := DisconnectPacket{Reason: DisconnectReason_GatewayShutdown}
+	packetData := make([]byte, 1500)
+	packetBytes := disconnectPacket.Write(packetData, sharedKey[:], ParseAddress("127.0.0.1:40000"), ParseAddress("127.0.0.1:30000"))
+	f.Add(packetData[:packetBytes])
+	f.Add(packetData[:packetBytes-1])
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var packet DisconnectPacket
+		packetData := append([]byte(nil), data...)
+		packet.Read(packetData, sharedKey[:])
+	})
+}
+
+func FuzzReadInternalForwardPacket(f *testing.F) {
+
+	for _, payloadBytes := range []int{0, MinPayloadBytes, MaxPayloadBytes, MaxPayloadBytes + 1} {
+		packet := InternalForwardPacket{
+			GatewayAddress: *ParseAddress("127.0.0.1:40001"),
+			ClientAddress:  *ParseAddress("[::1]:30000"),
+			Payload:        make([]byte, payloadBytes),
+		}
+		packetData := make([]byte, packet.Size())
+		index := 0
+		packet.Write(packetData, &index)
+		f.Add(packetData)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		var packet InternalForwardPacket
+		index := 0
+		if !packet.Read(data, &index) {
+			return
+		}
+		assert.Equal(t, len(data), index)
+		assert.Equal(t, len(data), packet.Size())
+		assert.NotEqual(t, 0, len(packet.GatewayAddress.IP))
+		assert.NotEqual(t, 0, len(packet.ClientAddress.IP))
+
+		// the packet forwarded to the client has to fit
+
+		assert.True(t, PrefixBytes+HeaderBytes+len(packet.Payload)+PostfixBytes <= MaxPacketBytes)
+	})
+}
+
+func FuzzReadInternalDisconnectPacket(f *testing.F) {
+
+	for _, clientAddress := range []string{"127.0.0.1:30000", "[::1]:30000"} {
+		packet := InternalDisconnectPacket{ClientAddress: *ParseAddress(clientAddress), Reason: DisconnectReason_ServerShutdown}
+		packetData := make([]byte, packet.Size())
+		index := 0
+		WriteObject(packetData, &index, &packet)
+		f.Add(packetData)
+		f.Add(packetData[:index-1])
+	}
+	f.Add(make([]byte, InternalDisconnectPacketBytes))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var packet InternalDisconnectPacket
+		index := 0
+		if packet.Read(data, &index) {
+			assert.Equal(t, InternalDisconnectPacketBytes, index)
+			assert.NotEqual(t, 0, len(packet.ClientAddress.IP))
+		}
+	})
+}
+
+func FuzzReadStream(f *testing.F) {
+
+	object := testStreamObject{Integer: 10, String: "hello", Address: *ParseAddress("127.0.0.1:40000")}
+	buffer := make([]byte, 1024)
+	index := 0
+	WriteObject(buffer, &index, &object)
+	f.Add(buffer[:index])
+	f.Add(buffer[:index-1])
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		var object testStreamObject
+		index := 0
+		if !ReadObject(data, &index, &object) {
+			return
+		}
+		assert.Equal(t, MeasureObject(&object), index)
+
+		// anything that reads must write and read back
+
+		buffer := make([]byte, index)
+		writeIndex := 0
+		WriteObject(buffer, &writeIndex, &object)
+		assert.Equal(t, index, writeIndex)
+
+		readIndex := 0
+		assert.True(t, ReadObject(buffer, &readIndex, &object))
+	})
+}
+
+func FuzzReadPayloadMessages(f *testing.F) {
+
+	f.Add(testPayload(MinPayloadBytes))
+	f.Add(testPayload(MaxPayloadBytes))
+	f.Add([]byte{3, 0, 1, 2})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+
+		var messageBuffer [MaxPayloadMessages][]byte
+		messages, ok := ReadPayloadMessages(payload, messageBuffer[:])
+		if !ok {
+			return
+		}
+
+		// anything that reads must pack back into a payload with the same messages
+
+		var writer PayloadWriter
+		writer.Reset(make([]byte, len(payload)+MinPayloadBytes))
+		for i := range messages {
+			assert.True(t, len(messages[i]) > 0)
+			assert.True(t, writer.AddMessage(messages[i]))
+		}
+
+		readMessages, ok := ReadPayloadMessages(writer.Finish(), make([][]byte, 0, len(messages)))
+		assert.True(t, ok)
+		assert.Equal(t, len(messages), len(readMessages))
+	})
+}
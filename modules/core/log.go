@@ -0,0 +1,440 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+// structured, leveled logging. Each line carries a level, a message and any fields attached to the
+// logger with With, such as service, thread, session and client address. Output is logfmt by default,
+// or one JSON object per line with UDPX_LOG_FORMAT=json. The level comes from UDPX_LOG_LEVEL, and can
+// be overridden per-session at runtime, so one session can be debugged on a busy gateway.
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	LogLevel_Debug = 0
+	LogLevel_Info  = 1
+	LogLevel_Warn  = 2
+	LogLevel_Error = 3
+	LogLevel_None  = 4
+)
+
+const (
+	LogFormat_Logfmt = 0
+	LogFormat_JSON   = 1
+)
+
+var logLevelNames = [...]string{"debug", "info", "warn", "error", "none"}
+
+var logLevel int32 = LogLevel_Info
+var logFormat int32 = LogFormat_Logfmt
+
+var logMutex sync.Mutex
+var logOutput io.Writer = os.Stdout
+var logBuffer bytes.Buffer
+
+// MaxSessionLogLevels caps the session overrides, so they can't grow without bound.
+const MaxSessionLogLevels = 64
+
+var sessionLogMutex sync.RWMutex
+var sessionLogLevels = make(map[string]int32)
+var numSessionLogLevels int32
+
+func init() {
+	if value, ok := os.LookupEnv("UDPX_DEBUG_LOGS"); ok && value == "1" {
+		logLevel = LogLevel_Debug
+	}
+	if value, ok := os.LookupEnv("UDPX_LOG_LEVEL"); ok {
+		level, err := ParseLogLevel(value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid UDPX_LOG_LEVEL: %v\n", err)
+		} else {
+			logLevel = level
+		}
+	}
+	if value, ok := os.LookupEnv("UDPX_LOG_FORMAT"); ok {
+		format, err := ParseLogFormat(value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid UDPX_LOG_FORMAT: %v\n", err)
+		} else {
+			logFormat = format
+		}
+	}
+}
+
+func ParseLogLevel(value string) (int32, error) {
+	for i := range logLevelNames {
+		if value == logLevelNames[i] {
+			return int32(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level '%s'", value)
+}
+
+func LogLevelString(level int32) string {
+	if level < 0 || int(level) >= len(logLevelNames) {
+		return strconv.Itoa(int(level))
+	}
+	return logLevelNames[level]
+}
+
+func ParseLogFormat(value string) (int32, error) {
+	switch value {
+	case "logfmt":
+		return LogFormat_Logfmt, nil
+	case "json":
+		return LogFormat_JSON, nil
+	}
+	return 0, fmt.Errorf("unknown log format '%s'", value)
+}
+
+func SetLogLevel(level int32) {
+	atomic.StoreInt32(&logLevel, level)
+}
+
+func GetLogLevel() int32 {
+	return atomic.LoadInt32(&logLevel)
+}
+
+func SetLogFormat(format int32) {
+	atomic.StoreInt32(&logFormat, format)
+}
+
+func SetLogOutput(output io.Writer) {
+	logMutex.Lock()
+	logOutput = output
+	logMutex.Unlock()
+}
+
+// SetLogService adds a service field to every line. Call it at startup, before any other loggers are derived from Log.
+func SetLogService(service string) {
+	Log.fields = append(Log.fields[:0:0], logField{key: "service", value: service})
+}
+
+// SetSessionLogLevel overrides the log level for one session, by its hex session id. It applies to
+// loggers created with WithSession, and takes effect immediately. It fails once there are
+// MaxSessionLogLevels overrides, until one is cleared.
+func SetSessionLogLevel(sessionId string, level int32) error {
+	sessionLogMutex.Lock()
+	defer sessionLogMutex.Unlock()
+	if _, ok := sessionLogLevels[sessionId]; !ok && len(sessionLogLevels) >= MaxSessionLogLevels {
+		return fmt.Errorf("there are already %d session log levels", MaxSessionLogLevels)
+	}
+	sessionLogLevels[sessionId] = level
+	atomic.StoreInt32(&numSessionLogLevels, int32(len(sessionLogLevels)))
+	return nil
+}
+
+func ClearSessionLogLevel(sessionId string) {
+	sessionLogMutex.Lock()
+	delete(sessionLogLevels, sessionId)
+	atomic.StoreInt32(&numSessionLogLevels, int32(len(sessionLogLevels)))
+	sessionLogMutex.Unlock()
+}
+
+func getSessionLogLevel(sessionId string) (int32, bool) {
+	sessionLogMutex.RLock()
+	level, ok := sessionLogLevels[sessionId]
+	sessionLogMutex.RUnlock()
+	return level, ok
+}
+
+// ---------------------------------------------------
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// Logger writes log lines with a fixed set of fields. Loggers are immutable and safe to share between
+// goroutines. Derive them once per thread or session with With, not per packet.
+type Logger struct {
+	fields    []logField
+	sessionId string
+}
+
+// Log is the root logger used by Debug, Info, Warn and Error.
+var Log = &Logger{}
+
+func (logger *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]logField, len(logger.fields), len(logger.fields)+1)
+	copy(fields, logger.fields)
+	fields = append(fields, logField{key: key, value: value})
+	return &Logger{fields: fields, sessionId: logger.sessionId}
+}
+
+// WithSession adds the session id field, and makes the logger follow any log level set for the session with SetSessionLogLevel.
+func (logger *Logger) WithSession(sessionId []byte) *Logger {
+	id := IdString(sessionId)
+	child := logger.With("session", id)
+	child.sessionId = id
+	return child
+}
+
+func (logger *Logger) Enabled(level int32) bool {
+	threshold := atomic.LoadInt32(&logLevel)
+	if logger.sessionId != "" && atomic.LoadInt32(&numSessionLogLevels) > 0 {
+		if sessionLevel, ok := getSessionLogLevel(logger.sessionId); ok {
+			threshold = sessionLevel
+		}
+	}
+	return level >= threshold
+}
+
+// DebugEnabled is checked by hot paths before calling Debug, so arguments aren't boxed and formatted
+// for every packet when debug logs are off.
+func (logger *Logger) DebugEnabled() bool {
+	return logger.Enabled(LogLevel_Debug)
+}
+
+func (logger *Logger) Debug(s string, params ...interface{}) {
+	if logger.Enabled(LogLevel_Debug) {
+		logger.write(LogLevel_Debug, 0, s, params)
+	}
+}
+
+func (logger *Logger) Info(s string, params ...interface{}) {
+	if logger.Enabled(LogLevel_Info) {
+		logger.write(LogLevel_Info, 0, s, params)
+	}
+}
+
+func (logger *Logger) Warn(s string, params ...interface{}) {
+	if logger.Enabled(LogLevel_Warn) {
+		logger.write(LogLevel_Warn, 0, s, params)
+	}
+}
+
+func (logger *Logger) Error(s string, params ...interface{}) {
+	if logger.Enabled(LogLevel_Error) {
+		logger.write(LogLevel_Error, 0, s, params)
+	}
+}
+
+// ErrorLimited logs an error at most once per limiter interval. Use it on hot error paths, where
+// a failure is likely to repeat for every packet. The number of lines dropped since the last one
+// written is added as the suppressed field.
+func (logger *Logger) ErrorLimited(limiter *LogLimiter, s string, params ...interface{}) {
+	if !logger.Enabled(LogLevel_Error) {
+		return
+	}
+	ok, suppressed := limiter.Allow()
+	if ok {
+		logger.write(LogLevel_Error, suppressed, s, params)
+	}
+}
+
+func (logger *Logger) write(level int32, suppressed uint64, s string, params []interface{}) {
+	message := s
+	if len(params) > 0 {
+		message = fmt.Sprintf(s, params...)
+	}
+	timestamp := time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	buffer := &logBuffer
+	buffer.Reset()
+	if atomic.LoadInt32(&logFormat) == LogFormat_JSON {
+		buffer.WriteString(`{"time":`)
+		writeJSONValue(buffer, timestamp)
+		buffer.WriteString(`,"level":`)
+		writeJSONValue(buffer, logLevelNames[level])
+		for i := range logger.fields {
+			buffer.WriteByte(',')
+			writeJSONValue(buffer, logger.fields[i].key)
+			buffer.WriteByte(':')
+			writeJSONValue(buffer, logger.fields[i].value)
+		}
+		if suppressed > 0 {
+			buffer.WriteString(`,"suppressed":`)
+			writeJSONValue(buffer, suppressed)
+		}
+		buffer.WriteString(`,"msg":`)
+		writeJSONValue(buffer, message)
+		buffer.WriteString("}\n")
+	} else {
+		buffer.WriteString("time=")
+		buffer.WriteString(timestamp)
+		buffer.WriteString(" level=")
+		buffer.WriteString(logLevelNames[level])
+		for i := range logger.fields {
+			buffer.WriteByte(' ')
+			buffer.WriteString(logger.fields[i].key)
+			buffer.WriteByte('=')
+			writeLogfmtValue(buffer, logger.fields[i].value)
+		}
+		if suppressed > 0 {
+			buffer.WriteString(" suppressed=")
+			buffer.WriteString(strconv.FormatUint(suppressed, 10))
+		}
+		buffer.WriteString(" msg=")
+		writeLogfmtValue(buffer, message)
+		buffer.WriteByte('\n')
+	}
+	logOutput.Write(buffer.Bytes())
+}
+
+func writeJSONValue(buffer *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		fmt.Fprint(buffer, v)
+		return
+	case string:
+		data, _ := json.Marshal(v)
+		buffer.Write(data)
+		return
+	}
+	data, _ := json.Marshal(fmt.Sprint(value))
+	buffer.Write(data)
+}
+
+func writeLogfmtValue(buffer *bytes.Buffer, value interface{}) {
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	default:
+		s = fmt.Sprint(v)
+	}
+	quote := s == ""
+	for i := 0; i < len(s) && !quote; i++ {
+		if s[i] <= ' ' || s[i] == '=' || s[i] == '"' || s[i] >= utf8.RuneSelf {
+			quote = true
+		}
+	}
+	if quote {
+		buffer.WriteString(strconv.Quote(s))
+	} else {
+		buffer.WriteString(s)
+	}
+}
+
+// ---------------------------------------------------
+
+// LogLimiter lets at most one log line through per interval, and counts the lines it drops.
+// It is safe to share one limiter between threads.
+type LogLimiter struct {
+	interval   int64
+	next       int64
+	suppressed uint64
+}
+
+func NewLogLimiter(interval time.Duration) *LogLimiter {
+	return &LogLimiter{interval: int64(interval)}
+}
+
+// Allow reports whether a line should be written now, and if so, how many were dropped since the last one.
+func (limiter *LogLimiter) Allow() (bool, uint64) {
+	now := time.Now().UnixNano()
+	next := atomic.LoadInt64(&limiter.next)
+	if now < next || !atomic.CompareAndSwapInt64(&limiter.next, next, now+limiter.interval) {
+		atomic.AddUint64(&limiter.suppressed, 1)
+		return false, 0
+	}
+	return true, atomic.SwapUint64(&limiter.suppressed, 0)
+}
+
+// ---------------------------------------------------
+
+func Debug(s string, params ...interface{}) {
+	Log.Debug(s, params...)
+}
+
+func Info(s string, params ...interface{}) {
+	Log.Info(s, params...)
+}
+
+func Warn(s string, params ...interface{}) {
+	Log.Warn(s, params...)
+}
+
+func Error(s string, params ...interface{}) {
+	Log.Error(s, params...)
+}
+
+func DebugEnabled() bool {
+	return Log.DebugEnabled()
+}
+
+// LogLevelHandler changes log levels at runtime. POST /log_level?level=debug sets the global level,
+// and adding session=<session id> sets it for just that session. level=default removes a session override.
+// GET returns the global level and any session overrides. Requests must have the secret as a bearer token,
+// since turning on debug logs is expensive. An empty secret refuses every request.
+func LogLevelHandler(secret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if secret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+secret)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		if r.Method == http.MethodGet {
+			fmt.Fprintf(w, "level %s\n", LogLevelString(GetLogLevel()))
+			sessionLogMutex.RLock()
+			for sessionId, level := range sessionLogLevels {
+				fmt.Fprintf(w, "session %s %s\n", sessionId, LogLevelString(level))
+			}
+			sessionLogMutex.RUnlock()
+			return
+		}
+		value := r.URL.Query().Get("level")
+		sessionId := r.URL.Query().Get("session")
+		if sessionId != "" {
+			id, err := hex.DecodeString(sessionId)
+			if err != nil || len(id) != SessionIdBytes {
+				http.Error(w, "session must be a hex session id", http.StatusBadRequest)
+				return
+			}
+			sessionId = IdString(id)
+		}
+		if sessionId != "" && value == "default" {
+			ClearSessionLogLevel(sessionId)
+			Info("cleared log level for session %s", sessionId)
+			return
+		}
+		level, err := ParseLogLevel(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if sessionId != "" {
+			if err := SetSessionLogLevel(sessionId, level); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			Info("set log level for session %s to %s", sessionId, value)
+		} else {
+			SetLogLevel(level)
+			Info("set log level to %s", value)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"net"
+)
+
+// PacketPrefix starts every packet between a client and a gateway. The chonkle after the packet type is skipped,
+// since it depends on the size of the whole packet. WritePacketFilter fills it in once the packet is written.
+// Challenge and disconnect packets don't carry a session token, so theirs is left zero.
+type PacketPrefix struct {
+	PacketType           byte
+	SessionTokenData     [EncryptedSessionTokenBytes]byte
+	SessionTokenSequence uint64
+}
+
+func (prefix *PacketPrefix) Size() int {
+	return PrefixBytes
+}
+
+func (prefix *PacketPrefix) Serialize(stream Stream) error {
+	stream.SerializeCheck(PacketVersion)
+	stream.SerializeUint8(&prefix.PacketType)
+	stream.SerializeSkip(ChonkleBytes)
+	stream.SerializeBytes(prefix.SessionTokenData[:])
+	stream.SerializeUint64(&prefix.SessionTokenSequence)
+	return stream.Error()
+}
+
+// PayloadHeader follows the prefix in payload packets between clients and gateways, and is passed through to the server.
+// Only the session id and sequence are sent in the clear, see PayloadPacketEncryptIndex.
+type PayloadHeader struct {
+	SessionId  [SessionIdBytes]byte
+	Sequence   uint64
+	Ack        uint64
+	AckBits    [AckBitsBytes]byte
+	GatewayId  [GatewayIdBytes]byte
+	ServerId   [ServerIdBytes]byte
+	PacketType byte
+	Flags      byte
+}
+
+func (header *PayloadHeader) Size() int {
+	return HeaderBytes
+}
+
+func (header *PayloadHeader) Serialize(stream Stream) error {
+	stream.SerializeBytes(header.SessionId[:])
+	stream.SerializeUint64(&header.Sequence)
+	stream.SerializeUint64(&header.Ack)
+	stream.SerializeBytes(header.AckBits[:])
+	stream.SerializeBytes(header.GatewayId[:])
+	stream.SerializeBytes(header.ServerId[:])
+	stream.SerializeUint8(&header.PacketType)
+	stream.SerializeUint8(&header.Flags)
+	return stream.Error()
+}
+
+// InternalForwardPacket carries a payload between a gateway and a server. It is the same in both directions: the server
+// responds to the gateway address, and the gateway forwards the response to the client address. The session token is
+// passed through the server, so the gateway can hand an updated one to the client.
+type InternalForwardPacket struct {
+	GatewayAddress       net.UDPAddr
+	ClientAddress        net.UDPAddr
+	SessionTokenData     [EncryptedSessionTokenBytes]byte
+	SessionTokenSequence uint64
+	Header               PayloadHeader
+	Payload              []byte
+}
+
+func (packet *InternalForwardPacket) Size() int {
+	return InternalForwardPacketHeaderBytes + len(packet.Payload)
+}
+
+// Serialize covers everything up to the payload, which is the rest of the packet. Read and Write handle the payload.
+func (packet *InternalForwardPacket) Serialize(stream Stream) error {
+	stream.SerializeCheck(PacketVersion)
+	stream.SerializeCheck(PacketType_Payload)
+	stream.SerializeAddress(&packet.GatewayAddress)
+	stream.SerializeAddress(&packet.ClientAddress)
+	stream.SerializeBytes(packet.SessionTokenData[:])
+	stream.SerializeUint64(&packet.SessionTokenSequence)
+	packet.Header.Serialize(stream)
+	if stream.IsReading() && (len(packet.GatewayAddress.IP) == 0 || len(packet.ClientAddress.IP) == 0) {
+		stream.SetError(ErrStreamInvalid)
+	}
+	return stream.Error()
+}
+
+func (packet *InternalForwardPacket) Write(buffer []byte, index *int) {
+	WriteObject(buffer, index, packet)
+	WriteBytes(buffer, index, packet.Payload, len(packet.Payload))
+}
+
+// Read reads the rest of the buffer as the payload, which points into the buffer. The address IPs are reused like ReadAddress,
+// so reading doesn't allocate. It returns false if this isn't a payload packet, either address is missing or can't be read,
+// or the payload is larger than MaxPayloadBytes.
+func (packet *InternalForwardPacket) Read(buffer []byte, index *int) bool {
+	packetBytes := len(buffer) - *index
+	if packetBytes < InternalForwardPacketHeaderBytes || packetBytes > InternalForwardPacketHeaderBytes+MaxPayloadBytes {
+		return false
+	}
+	if !ReadObject(buffer, index, packet) {
+		return false
+	}
+	packet.Payload = buffer[*index:]
+	*index = len(buffer)
+	return true
+}
+
+// InternalDisconnectPacket is sent by a server to the gateway for each of its sessions when it shuts down.
+// The gateway passes it on to the client as a DisconnectPacket.
+type InternalDisconnectPacket struct {
+	ClientAddress net.UDPAddr
+	SessionId     [SessionIdBytes]byte
+	Reason        byte
+}
+
+func (packet *InternalDisconnectPacket) Size() int {
+	return InternalDisconnectPacketBytes
+}
+
+func (packet *InternalDisconnectPacket) Serialize(stream Stream) error {
+	stream.SerializeCheck(PacketVersion)
+	stream.SerializeCheck(PacketType_Disconnect)
+	stream.SerializeAddress(&packet.ClientAddress)
+	stream.SerializeBytes(packet.SessionId[:])
+	stream.SerializeUint8(&packet.Reason)
+	if stream.IsReading() && len(packet.ClientAddress.IP) == 0 {
+		stream.SetError(ErrStreamInvalid)
+	}
+	return stream.Error()
+}
+
+// Read returns false if the rest of the buffer is the wrong size, this isn't a disconnect packet, or the client address is missing or can't be read.
+func (packet *InternalDisconnectPacket) Read(buffer []byte, index *int) bool {
+	if len(buffer)-*index != InternalDisconnectPacketBytes {
+		return false
+	}
+	return ReadObject(buffer, index, packet)
+}
+
+// ChallengePacket is sent by a gateway to a client that doesn't have a session yet. The client sends the challenge token
+// back to show it can receive packets at its address. Everything after the nonce is encrypted with the key shared with
+// the client, so only that client can read it.
+type ChallengePacket struct {
+	ChallengeTokenData [EncryptedChallengeTokenBytes]byte
+	Sequence           uint64
+	GatewayId          [GatewayIdBytes]byte
+}
+
+func (packet *ChallengePacket) Size() int {
+	return ChallengePacketBytes
+}
+
+// Serialize covers the encrypted part of the packet. Read and Write handle the prefix, nonce and encryption.
+func (packet *ChallengePacket) Serialize(stream Stream) error {
+	stream.SerializeBytes(packet.ChallengeTokenData[:])
+	stream.SerializeUint64(&packet.Sequence)
+	stream.SerializeBytes(packet.GatewayId[:])
+	return stream.Error()
+}
+
+// Write writes the whole challenge packet from the gateway to the client, and returns its size.
+func (packet *ChallengePacket) Write(packetData []byte, sharedKey []byte, from *net.UDPAddr, to *net.UDPAddr) int {
+
+	var nonce [NonceBytes_Box]byte
+	RandomBytes_InPlace(nonce[:])
+	nonce[9] &= 1 ^ (1 << 0)
+	nonce[9] |= (1 << 1)
+
+	index := 0
+
+	prefix := PacketPrefix{PacketType: PacketType_Challenge}
+	WriteObject(packetData, &index, &prefix)
+	WriteBytes(packetData, &index, nonce[:], NonceBytes_Box)
+	encryptStart := index
+	WriteObject(packetData, &index, packet)
+	encryptFinish := index
+	index += HMACBytes_Box + PittleBytes
+
+	Encrypt_SharedBox(sharedKey, nonce[:], packetData[encryptStart:encryptFinish+HMACBytes_Box], encryptFinish-encryptStart)
+
+	WritePacketFilter(packetData[:index], from, to)
+
+	return index
+}
+
+// Read decrypts a challenge packet in place and reads it. It returns false if the packet is the wrong size, or wasn't
+// encrypted with the shared key. A failed decrypt leaves the packet untouched.
+func (packet *ChallengePacket) Read(packetData []byte, sharedKey []byte) bool {
+	index := 0
+	var prefix PacketPrefix
+	if len(packetData) != ChallengePacketBytes || !ReadObject(packetData, &index, &prefix) || prefix.PacketType != PacketType_Challenge {
+		return false
+	}
+	nonce := packetData[index : index+NonceBytes_Box]
+	index += NonceBytes_Box
+	encryptedData := packetData[index : len(packetData)-PittleBytes]
+	if err := Decrypt_SharedBox(sharedKey, nonce, encryptedData, len(encryptedData)); err != nil {
+		return false
+	}
+	return ReadObject(packetData, &index, packet)
+}
+
+// DisconnectPacket is sent by a gateway to tell a client its session is over. It is laid out like a challenge packet,
+// and the gateway id and reason are encrypted with the key shared with the client, so only the gateway the client
+// is connected to can end its session.
+type DisconnectPacket struct {
+	GatewayId [GatewayIdBytes]byte
+	Reason    byte
+}
+
+func (packet *DisconnectPacket) Size() int {
+	return DisconnectPacketBytes
+}
+
+// Serialize covers the encrypted part of the packet. Read and Write handle the prefix, nonce and encryption.
+func (packet *DisconnectPacket) Serialize(stream Stream) error {
+	stream.SerializeBytes(packet.GatewayId[:])
+	stream.SerializeUint8(&packet.Reason)
+	return stream.Error()
+}
+
+// Write writes the whole disconnect packet from the gateway to the client, and returns its size.
+func (packet *DisconnectPacket) Write(packetData []byte, sharedKey []byte, from *net.UDPAddr, to *net.UDPAddr) int {
+
+	var nonce [NonceBytes_Box]byte
+	RandomBytes_InPlace(nonce[:])
+	nonce[9] |= (1 << 0)
+	nonce[9] |= (1 << 1)
+
+	index := 0
+
+	prefix := PacketPrefix{PacketType: PacketType_Disconnect}
+	WriteObject(packetData, &index, &prefix)
+	WriteBytes(packetData, &index, nonce[:], NonceBytes_Box)
+	encryptStart := index
+	WriteObject(packetData, &index, packet)
+	encryptFinish := index
+	index += HMACBytes_Box + PittleBytes
+
+	Encrypt_SharedBox(sharedKey, nonce[:], packetData[encryptStart:encryptFinish+HMACBytes_Box], encryptFinish-encryptStart)
+
+	WritePacketFilter(packetData[:index], from, to)
+
+	return index
+}
+
+// Read decrypts a disconnect packet in place and reads it. It returns false if the packet is the wrong size, or wasn't
+// encrypted with the shared key.
+func (packet *DisconnectPacket) Read(packetData []byte, sharedKey []byte) bool {
+	index := 0
+	var prefix PacketPrefix
+	if len(packetData) != DisconnectPacketBytes || !ReadObject(packetData, &index, &prefix) || prefix.PacketType != PacketType_Disconnect {
+		return false
+	}
+	nonce := packetData[index : index+NonceBytes_Box]
+	index += NonceBytes_Box
+	encryptedData := packetData[index : len(packetData)-PittleBytes]
+	if err := Decrypt_SharedBox(sharedKey, nonce, encryptedData, len(encryptedData)); err != nil {
+		return false
+	}
+	return ReadObject(packetData, &index, packet)
+}
+
+// WritePacketFilter generates the chonkle and pittle of a packet between a client and a gateway, once the rest of the
+// packet is written, so it passes the packet filters at the other end. Both depend on the addresses and the packet size.
+func WritePacketFilter(packetData []byte, from *net.UDPAddr, to *net.UDPAddr) {
+
+	var magic [MagicBytes]byte
+
+	var fromAddressData [4]byte
+	var fromAddressPort uint16
+
+	var toAddressData [4]byte
+	var toAddressPort uint16
+
+	GetAddressData(from, fromAddressData[:], &fromAddressPort)
+	GetAddressData(to, toAddressData[:], &toAddressPort)
+
+	packetBytes := len(packetData)
+
+	GenerateChonkle(packetData[VersionBytes+PacketTypeBytes:], magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, packetBytes)
+
+	GeneratePittle(packetData[packetBytes-PittleBytes:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, packetBytes)
+}
@@ -0,0 +1,103 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+// Payloads carry several application messages, so small messages don't each pay for a packet. Each message is
+// prefixed with its length, and the payload is zero padded to MinPayloadBytes. A zero length ends the messages,
+// so empty messages can't be sent.
+
+const MessageLengthBytes = 2
+
+// MaxMessageBytes is the largest message that fits in a payload on its own.
+const MaxMessageBytes = MaxPayloadBytes - MessageLengthBytes
+
+// MaxPayloadMessages is the most messages a payload can hold, when every message is one byte.
+const MaxPayloadMessages = MaxPayloadBytes / (MessageLengthBytes + 1)
+
+// PayloadWriter packs messages into a payload until the buffer is full.
+type PayloadWriter struct {
+	buffer      []byte
+	index       int
+	numMessages int
+}
+
+// Reset starts a new payload in the buffer, which must be at least MinPayloadBytes. The payload can grow to the
+// length of the buffer, so pass a buffer of MaxPayloadBytes to fill the packet.
+func (writer *PayloadWriter) Reset(buffer []byte) {
+	if len(buffer) < MinPayloadBytes {
+		panic("payload buffer is smaller than MinPayloadBytes")
+	}
+	writer.buffer = buffer
+	writer.index = 0
+	writer.numMessages = 0
+}
+
+// Fits is true if a message of this size can be added to the payload.
+func (writer *PayloadWriter) Fits(messageBytes int) bool {
+	return messageBytes > 0 && writer.index+MessageLengthBytes+messageBytes <= len(writer.buffer)
+}
+
+// AddMessage appends a message to the payload. It returns false if the message is empty or doesn't fit.
+func (writer *PayloadWriter) AddMessage(message []byte) bool {
+	if !writer.Fits(len(message)) {
+		return false
+	}
+	WriteUint16(writer.buffer, &writer.index, uint16(len(message)))
+	WriteBytes(writer.buffer, &writer.index, message, len(message))
+	writer.numMessages++
+	return true
+}
+
+func (writer *PayloadWriter) NumMessages() int {
+	return writer.numMessages
+}
+
+// Finish zero pads the payload to MinPayloadBytes and returns it.
+func (writer *PayloadWriter) Finish() []byte {
+	payloadBytes := writer.index
+	if payloadBytes < MinPayloadBytes {
+		payloadBytes = MinPayloadBytes
+	}
+	for i := writer.index; i < payloadBytes; i++ {
+		writer.buffer[i] = 0
+	}
+	return writer.buffer[:payloadBytes]
+}
+
+// ReadPayloadMessages splits a payload back into its messages, appending them to messages[:0]. The messages
+// alias the payload. It returns false if a length runs past the end of the payload, or there are more
+// messages than fit in the buffer.
+func ReadPayloadMessages(payload []byte, messages [][]byte) ([][]byte, bool) {
+	messages = messages[:0]
+	index := 0
+	for index+MessageLengthBytes <= len(payload) {
+		var messageBytes uint16
+		ReadUint16(payload, &index, &messageBytes)
+		if messageBytes == 0 {
+			break
+		}
+		if index+int(messageBytes) > len(payload) || len(messages) == cap(messages) {
+			return messages, false
+		}
+		messages = append(messages, payload[index:index+int(messageBytes)])
+		index += int(messageBytes)
+	}
+	return messages, true
+}
@@ -0,0 +1,82 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+func AttachSocketFilter(conn *net.UDPConn, program []bpf.Instruction) error {
+
+	rawInstructions, err := bpf.Assemble(program)
+	if err != nil {
+		return fmt.Errorf("failed to assemble socket filter: %v", err)
+	}
+
+	filter := make([]unix.SockFilter, len(rawInstructions))
+	for i := range rawInstructions {
+		filter[i] = unix.SockFilter{Code: rawInstructions[i].Op, Jt: rawInstructions[i].Jt, Jf: rawInstructions[i].Jf, K: rawInstructions[i].K}
+	}
+
+	fprog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var setsockoptErr error
+	err = rawConn.Control(func(fileDescriptor uintptr) {
+		setsockoptErr = unix.SetsockoptSockFprog(int(fileDescriptor), unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &fprog)
+	})
+	if err != nil {
+		return err
+	}
+	if setsockoptErr != nil {
+		return fmt.Errorf("failed to attach socket filter: %v", setsockoptErr)
+	}
+
+	return nil
+}
+
+// reusePortControl lets several sockets bind the same address, so the kernel spreads packets across them by source address.
+func reusePortControl(network string, address string, c syscall.RawConn) error {
+	var setsockoptErr error
+	err := c.Control(func(fileDescriptor uintptr) {
+		setsockoptErr = unix.SetsockoptInt(int(fileDescriptor), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		if setsockoptErr != nil {
+			setsockoptErr = fmt.Errorf("failed to set reuse address socket option: %v", setsockoptErr)
+			return
+		}
+		setsockoptErr = unix.SetsockoptInt(int(fileDescriptor), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		if setsockoptErr != nil {
+			setsockoptErr = fmt.Errorf("failed to set reuse port socket option: %v", setsockoptErr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return setsockoptErr
+}
@@ -0,0 +1,40 @@
+//go:build !linux
+// +build !linux
+
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/bpf"
+)
+
+func AttachSocketFilter(conn *net.UDPConn, program []bpf.Instruction) error {
+	return fmt.Errorf("socket filters are only supported on linux")
+}
+
+// reusePortControl is a no-op off linux, so only one socket can bind each address there.
+func reusePortControl(network string, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,680 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+)
+
+var ErrStreamOverflow = errors.New("stream overflow")
+var ErrStreamInvalid = errors.New("invalid value in stream")
+
+// Stream writes, reads or measures a value with the same code, so each type declares a single Serialize method
+// instead of a writer and reader that can drift apart. Values are bit-packed in order, lowest bits first, so
+// whole bytes, integers and addresses that start on a byte boundary come out in the same little endian layout
+// as WriteUint32 and friends. The first error sticks: serializing after an error does nothing.
+type Stream interface {
+	IsWriting() bool
+	IsReading() bool
+
+	SerializeBits(value *uint32, bits int)
+	SerializeBool(value *bool)
+	SerializeInteger(value *int32, min int32, max int32)
+	SerializeUint8(value *uint8)
+	SerializeUint16(value *uint16)
+	SerializeUint32(value *uint32)
+	SerializeUint64(value *uint64)
+	SerializeFloat32(value *float32)
+	SerializeFloat64(value *float64)
+	SerializeCompressedFloat(value *float32, min float32, max float32, resolution float32)
+	SerializeBytes(value []byte)
+	SerializeString(value *string, maxStringLength int)
+	SerializeAddress(address *net.UDPAddr)
+
+	// SerializeCheck writes a constant, such as a packet version, and fails the read if it doesn't match
+	SerializeCheck(value uint8)
+
+	// SerializeSkip leaves bytes that are filled in later, such as the chonkle, as they are
+	SerializeSkip(bytes int)
+
+	// SerializeAlign pads with zero bits to the next byte boundary
+	SerializeAlign()
+
+	SetError(err error)
+	Error() error
+	BitsProcessed() int
+	BytesProcessed() int
+}
+
+// Serializable is implemented by each type that is written, read and measured with a stream.
+type Serializable interface {
+	Serialize(stream Stream) error
+}
+
+// BitsRequired returns the number of bits needed to hold values from 0 to max.
+func BitsRequired(max uint32) int {
+	bits := 0
+	for max > 0 {
+		bits++
+		max >>= 1
+	}
+	return bits
+}
+
+func compressedFloatBits(min float32, max float32, resolution float32) (uint32, int) {
+	maxIntegerValue := uint32(math.Ceil(float64((max - min) / resolution)))
+	return maxIntegerValue, BitsRequired(maxIntegerValue)
+}
+
+// ------------------------------------------------------------
+
+// WriteStream bit-packs values into a buffer. The bits of a partial byte are written as they go, so nothing needs flushing.
+type WriteStream struct {
+	buffer    []byte
+	bitsTotal int
+	bits      int
+	err       error
+}
+
+func NewWriteStream(buffer []byte) *WriteStream {
+	stream := &WriteStream{}
+	stream.Reset(buffer)
+	return stream
+}
+
+// Reset lets a stream be reused for another buffer without allocating.
+func (stream *WriteStream) Reset(buffer []byte) {
+	stream.buffer = buffer
+	stream.bitsTotal = len(buffer) * 8
+	stream.bits = 0
+	stream.err = nil
+}
+
+func (stream *WriteStream) IsWriting() bool {
+	return true
+}
+
+func (stream *WriteStream) IsReading() bool {
+	return false
+}
+
+func (stream *WriteStream) writeBits(value uint32, bits int) {
+	if stream.err != nil {
+		return
+	}
+	if stream.bits+bits > stream.bitsTotal {
+		stream.err = ErrStreamOverflow
+		return
+	}
+	for bits > 0 {
+		byteIndex := stream.bits >> 3
+		bitOffset := uint(stream.bits & 7)
+		count := 8 - int(bitOffset)
+		if count > bits {
+			count = bits
+		}
+		mask := byte((1<<uint(count))-1) << bitOffset
+		stream.buffer[byteIndex] = (stream.buffer[byteIndex] &^ mask) | (byte(value<<bitOffset) & mask)
+		value >>= uint(count)
+		bits -= count
+		stream.bits += count
+	}
+}
+
+func (stream *WriteStream) SerializeBits(value *uint32, bits int) {
+	if bits < 32 && *value >= 1<<uint(bits) {
+		stream.SetError(ErrStreamInvalid)
+		return
+	}
+	stream.writeBits(*value, bits)
+}
+
+func (stream *WriteStream) SerializeBool(value *bool) {
+	if *value {
+		stream.writeBits(1, 1)
+	} else {
+		stream.writeBits(0, 1)
+	}
+}
+
+func (stream *WriteStream) SerializeInteger(value *int32, min int32, max int32) {
+	if *value < min || *value > max {
+		stream.SetError(ErrStreamInvalid)
+		return
+	}
+	stream.writeBits(uint32(*value-min), BitsRequired(uint32(max-min)))
+}
+
+func (stream *WriteStream) SerializeUint8(value *uint8) {
+	stream.writeBits(uint32(*value), 8)
+}
+
+func (stream *WriteStream) SerializeUint16(value *uint16) {
+	stream.writeBits(uint32(*value), 16)
+}
+
+func (stream *WriteStream) SerializeUint32(value *uint32) {
+	stream.writeBits(*value, 32)
+}
+
+func (stream *WriteStream) SerializeUint64(value *uint64) {
+	stream.writeBits(uint32(*value), 32)
+	stream.writeBits(uint32(*value>>32), 32)
+}
+
+func (stream *WriteStream) SerializeFloat32(value *float32) {
+	stream.writeBits(math.Float32bits(*value), 32)
+}
+
+func (stream *WriteStream) SerializeFloat64(value *float64) {
+	uintValue := math.Float64bits(*value)
+	stream.SerializeUint64(&uintValue)
+}
+
+// SerializeCompressedFloat quantizes the value to resolution within [min,max], and writes it with only as many bits as that needs.
+// Values outside the range are clamped.
+func (stream *WriteStream) SerializeCompressedFloat(value *float32, min float32, max float32, resolution float32) {
+	maxIntegerValue, bits := compressedFloatBits(min, max, resolution)
+	normalizedValue := (*value - min) / (max - min)
+	if normalizedValue < 0 {
+		normalizedValue = 0
+	}
+	if normalizedValue > 1 {
+		normalizedValue = 1
+	}
+	stream.writeBits(uint32(math.Floor(float64(normalizedValue)*float64(maxIntegerValue)+0.5)), bits)
+}
+
+func (stream *WriteStream) SerializeBytes(value []byte) {
+	if stream.err != nil {
+		return
+	}
+	if stream.bits&7 != 0 {
+		for i := range value {
+			stream.writeBits(uint32(value[i]), 8)
+		}
+		return
+	}
+	if stream.bits+len(value)*8 > stream.bitsTotal {
+		stream.err = ErrStreamOverflow
+		return
+	}
+	copy(stream.buffer[stream.bits>>3:], value)
+	stream.bits += len(value) * 8
+}
+
+func (stream *WriteStream) SerializeString(value *string, maxStringLength int) {
+	if len(*value) > maxStringLength {
+		stream.SetError(ErrStreamInvalid)
+		return
+	}
+	stream.writeBits(uint32(len(*value)), 32)
+	for i := 0; i < len(*value); i++ {
+		stream.writeBits(uint32((*value)[i]), 8)
+	}
+}
+
+// SerializeAddress writes the same AddressBytes layout as WriteAddress, with unused bytes zeroed. An address with no IP is written as none.
+func (stream *WriteStream) SerializeAddress(address *net.UDPAddr) {
+	if stream.err != nil {
+		return
+	}
+	if stream.bits+AddressBytes*8 > stream.bitsTotal {
+		stream.err = ErrStreamOverflow
+		return
+	}
+	var data [AddressBytes]byte
+	index := 0
+	WriteAddress(data[:], &index, address)
+	stream.SerializeBytes(data[:])
+}
+
+func (stream *WriteStream) SerializeCheck(value uint8) {
+	stream.writeBits(uint32(value), 8)
+}
+
+func (stream *WriteStream) SerializeSkip(bytes int) {
+	if stream.err != nil {
+		return
+	}
+	if stream.bits+bytes*8 > stream.bitsTotal {
+		stream.err = ErrStreamOverflow
+		return
+	}
+	stream.bits += bytes * 8
+}
+
+func (stream *WriteStream) SerializeAlign() {
+	if stream.bits&7 != 0 {
+		stream.writeBits(0, 8-stream.bits&7)
+	}
+}
+
+func (stream *WriteStream) SetError(err error) {
+	if stream.err == nil {
+		stream.err = err
+	}
+}
+
+func (stream *WriteStream) Error() error {
+	return stream.err
+}
+
+func (stream *WriteStream) BitsProcessed() int {
+	return stream.bits
+}
+
+func (stream *WriteStream) BytesProcessed() int {
+	return (stream.bits + 7) / 8
+}
+
+// ------------------------------------------------------------
+
+// ReadStream reads values bit-packed by a WriteStream. Reading past the end of the buffer fails with ErrStreamOverflow,
+// and values outside of their bounds fail with ErrStreamInvalid, so a malformed packet can't panic.
+type ReadStream struct {
+	buffer    []byte
+	bitsTotal int
+	bits      int
+	err       error
+}
+
+func NewReadStream(buffer []byte) *ReadStream {
+	stream := &ReadStream{}
+	stream.Reset(buffer)
+	return stream
+}
+
+// Reset lets a stream be reused for another buffer without allocating.
+func (stream *ReadStream) Reset(buffer []byte) {
+	stream.buffer = buffer
+	stream.bitsTotal = len(buffer) * 8
+	stream.bits = 0
+	stream.err = nil
+}
+
+func (stream *ReadStream) IsWriting() bool {
+	return false
+}
+
+func (stream *ReadStream) IsReading() bool {
+	return true
+}
+
+func (stream *ReadStream) readBits(bits int) uint32 {
+	if stream.err != nil {
+		return 0
+	}
+	if stream.bits+bits > stream.bitsTotal {
+		stream.err = ErrStreamOverflow
+		return 0
+	}
+	value := uint32(0)
+	shift := uint(0)
+	for bits > 0 {
+		byteIndex := stream.bits >> 3
+		bitOffset := uint(stream.bits & 7)
+		count := 8 - int(bitOffset)
+		if count > bits {
+			count = bits
+		}
+		chunk := (uint32(stream.buffer[byteIndex]) >> bitOffset) & ((1 << uint(count)) - 1)
+		value |= chunk << shift
+		shift += uint(count)
+		bits -= count
+		stream.bits += count
+	}
+	return value
+}
+
+func (stream *ReadStream) SerializeBits(value *uint32, bits int) {
+	*value = stream.readBits(bits)
+}
+
+func (stream *ReadStream) SerializeBool(value *bool) {
+	*value = stream.readBits(1) != 0
+}
+
+func (stream *ReadStream) SerializeInteger(value *int32, min int32, max int32) {
+	integerValue := stream.readBits(BitsRequired(uint32(max - min)))
+	if integerValue > uint32(max-min) {
+		stream.SetError(ErrStreamInvalid)
+		return
+	}
+	*value = min + int32(integerValue)
+}
+
+func (stream *ReadStream) SerializeUint8(value *uint8) {
+	*value = uint8(stream.readBits(8))
+}
+
+func (stream *ReadStream) SerializeUint16(value *uint16) {
+	*value = uint16(stream.readBits(16))
+}
+
+func (stream *ReadStream) SerializeUint32(value *uint32) {
+	*value = stream.readBits(32)
+}
+
+func (stream *ReadStream) SerializeUint64(value *uint64) {
+	low := stream.readBits(32)
+	high := stream.readBits(32)
+	*value = uint64(low) | uint64(high)<<32
+}
+
+func (stream *ReadStream) SerializeFloat32(value *float32) {
+	*value = math.Float32frombits(stream.readBits(32))
+}
+
+func (stream *ReadStream) SerializeFloat64(value *float64) {
+	var uintValue uint64
+	stream.SerializeUint64(&uintValue)
+	*value = math.Float64frombits(uintValue)
+}
+
+func (stream *ReadStream) SerializeCompressedFloat(value *float32, min float32, max float32, resolution float32) {
+	maxIntegerValue, bits := compressedFloatBits(min, max, resolution)
+	integerValue := stream.readBits(bits)
+	if integerValue > maxIntegerValue {
+		stream.SetError(ErrStreamInvalid)
+		return
+	}
+	if maxIntegerValue == 0 {
+		*value = min
+		return
+	}
+	*value = min + float32(float64(integerValue)/float64(maxIntegerValue)*float64(max-min))
+}
+
+func (stream *ReadStream) SerializeBytes(value []byte) {
+	if stream.err != nil {
+		return
+	}
+	if stream.bits&7 != 0 {
+		for i := range value {
+			value[i] = byte(stream.readBits(8))
+		}
+		return
+	}
+	if stream.bits+len(value)*8 > stream.bitsTotal {
+		stream.err = ErrStreamOverflow
+		return
+	}
+	copy(value, stream.buffer[stream.bits>>3:])
+	stream.bits += len(value) * 8
+}
+
+func (stream *ReadStream) SerializeString(value *string, maxStringLength int) {
+	stringLength := stream.readBits(32)
+	if stream.err != nil {
+		return
+	}
+	if stringLength > uint32(maxStringLength) {
+		stream.err = ErrStreamInvalid
+		return
+	}
+	if stream.bits+int(stringLength)*8 > stream.bitsTotal {
+		stream.err = ErrStreamOverflow
+		return
+	}
+	stringData := make([]byte, stringLength)
+	stream.SerializeBytes(stringData)
+	*value = string(stringData)
+}
+
+// SerializeAddress reuses the storage behind address.IP like ReadAddress, so hot paths can read addresses without allocating.
+func (stream *ReadStream) SerializeAddress(address *net.UDPAddr) {
+	if stream.err != nil {
+		return
+	}
+	if stream.bits+AddressBytes*8 > stream.bitsTotal {
+		stream.err = ErrStreamOverflow
+		return
+	}
+	if stream.bits&7 == 0 {
+		index := stream.bits >> 3
+		if !ReadAddress(stream.buffer, &index, address) {
+			stream.err = ErrStreamInvalid
+			return
+		}
+		stream.bits += AddressBytes * 8
+		return
+	}
+	var data [AddressBytes]byte
+	for i := range data {
+		data[i] = byte(stream.readBits(8))
+	}
+	index := 0
+	if !ReadAddress(data[:], &index, address) {
+		stream.err = ErrStreamInvalid
+	}
+}
+
+func (stream *ReadStream) SerializeCheck(value uint8) {
+	if uint8(stream.readBits(8)) != value {
+		stream.SetError(ErrStreamInvalid)
+	}
+}
+
+func (stream *ReadStream) SerializeSkip(bytes int) {
+	if stream.err != nil {
+		return
+	}
+	if stream.bits+bytes*8 > stream.bitsTotal {
+		stream.err = ErrStreamOverflow
+		return
+	}
+	stream.bits += bytes * 8
+}
+
+func (stream *ReadStream) SerializeAlign() {
+	if stream.bits&7 != 0 {
+		if stream.readBits(8-stream.bits&7) != 0 {
+			stream.SetError(ErrStreamInvalid)
+		}
+	}
+}
+
+func (stream *ReadStream) SetError(err error) {
+	if stream.err == nil {
+		stream.err = err
+	}
+}
+
+func (stream *ReadStream) Error() error {
+	return stream.err
+}
+
+func (stream *ReadStream) BitsProcessed() int {
+	return stream.bits
+}
+
+func (stream *ReadStream) BytesProcessed() int {
+	return (stream.bits + 7) / 8
+}
+
+// ------------------------------------------------------------
+
+// MeasureStream counts the bits a WriteStream would write, without writing anything.
+type MeasureStream struct {
+	bits int
+	err  error
+}
+
+func NewMeasureStream() *MeasureStream {
+	return &MeasureStream{}
+}
+
+func (stream *MeasureStream) Reset() {
+	stream.bits = 0
+	stream.err = nil
+}
+
+func (stream *MeasureStream) IsWriting() bool {
+	return true
+}
+
+func (stream *MeasureStream) IsReading() bool {
+	return false
+}
+
+func (stream *MeasureStream) SerializeBits(value *uint32, bits int) {
+	stream.bits += bits
+}
+
+func (stream *MeasureStream) SerializeBool(value *bool) {
+	stream.bits++
+}
+
+func (stream *MeasureStream) SerializeInteger(value *int32, min int32, max int32) {
+	if *value < min || *value > max {
+		stream.SetError(ErrStreamInvalid)
+	}
+	stream.bits += BitsRequired(uint32(max - min))
+}
+
+func (stream *MeasureStream) SerializeUint8(value *uint8) {
+	stream.bits += 8
+}
+
+func (stream *MeasureStream) SerializeUint16(value *uint16) {
+	stream.bits += 16
+}
+
+func (stream *MeasureStream) SerializeUint32(value *uint32) {
+	stream.bits += 32
+}
+
+func (stream *MeasureStream) SerializeUint64(value *uint64) {
+	stream.bits += 64
+}
+
+func (stream *MeasureStream) SerializeFloat32(value *float32) {
+	stream.bits += 32
+}
+
+func (stream *MeasureStream) SerializeFloat64(value *float64) {
+	stream.bits += 64
+}
+
+func (stream *MeasureStream) SerializeCompressedFloat(value *float32, min float32, max float32, resolution float32) {
+	_, bits := compressedFloatBits(min, max, resolution)
+	stream.bits += bits
+}
+
+func (stream *MeasureStream) SerializeBytes(value []byte) {
+	stream.bits += len(value) * 8
+}
+
+func (stream *MeasureStream) SerializeString(value *string, maxStringLength int) {
+	if len(*value) > maxStringLength {
+		stream.SetError(ErrStreamInvalid)
+	}
+	stream.bits += 32 + len(*value)*8
+}
+
+func (stream *MeasureStream) SerializeAddress(address *net.UDPAddr) {
+	stream.bits += AddressBytes * 8
+}
+
+func (stream *MeasureStream) SerializeCheck(value uint8) {
+	stream.bits += 8
+}
+
+func (stream *MeasureStream) SerializeSkip(bytes int) {
+	stream.bits += bytes * 8
+}
+
+func (stream *MeasureStream) SerializeAlign() {
+	stream.bits += (8 - stream.bits&7) & 7
+}
+
+func (stream *MeasureStream) SetError(err error) {
+	if stream.err == nil {
+		stream.err = err
+	}
+}
+
+func (stream *MeasureStream) Error() error {
+	return stream.err
+}
+
+func (stream *MeasureStream) BitsProcessed() int {
+	return stream.bits
+}
+
+func (stream *MeasureStream) BytesProcessed() int {
+	return (stream.bits + 7) / 8
+}
+
+// ------------------------------------------------------------
+
+// streams are pooled, because a stream passed to Serialize through the interface escapes to the heap
+
+var writeStreamPool = sync.Pool{New: func() interface{} { return &WriteStream{} }}
+var readStreamPool = sync.Pool{New: func() interface{} { return &ReadStream{} }}
+var measureStreamPool = sync.Pool{New: func() interface{} { return &MeasureStream{} }}
+
+// WriteObject writes the object at the index and moves the index past it. It panics if the object doesn't fit,
+// or has a value that can't be serialized, since that's a bug in the caller.
+func WriteObject(buffer []byte, index *int, object Serializable) {
+	stream := writeStreamPool.Get().(*WriteStream)
+	stream.Reset(buffer[*index:])
+	err := object.Serialize(stream)
+	bytes := stream.BytesProcessed()
+	stream.Reset(nil)
+	writeStreamPool.Put(stream)
+	if err != nil {
+		panic(err)
+	}
+	*index += bytes
+}
+
+// ReadObject reads the object at the index and moves the index past it. It returns false, and leaves the index
+// where it was, if the buffer is too small or holds a value the object doesn't accept.
+func ReadObject(buffer []byte, index *int, object Serializable) bool {
+	if *index < 0 || *index > len(buffer) {
+		return false
+	}
+	stream := readStreamPool.Get().(*ReadStream)
+	stream.Reset(buffer[*index:])
+	err := object.Serialize(stream)
+	bytes := stream.BytesProcessed()
+	stream.Reset(nil)
+	readStreamPool.Put(stream)
+	if err != nil {
+		return false
+	}
+	*index += bytes
+	return true
+}
+
+// MeasureObject returns the number of bytes WriteObject would write.
+func MeasureObject(object Serializable) int {
+	stream := measureStreamPool.Get().(*MeasureStream)
+	stream.Reset()
+	object.Serialize(stream)
+	bytes := stream.BytesProcessed()
+	measureStreamPool.Put(stream)
+	return bytes
+}
@@ -0,0 +1,112 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/bpf"
+)
+
+// Socket is a bound datagram socket. Several goroutines may each have their own PacketConn on the same socket.
+// SetReadDeadline and Close may be called from any goroutine, to wake up or end reads blocked on the socket.
+type Socket interface {
+	LocalAddr() net.Addr
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// PacketConn reads and writes batches of packets on a socket. It must only be used from one goroutine.
+// *BatchConn is the implementation for UDP sockets. Packets bigger than the max packet size are dropped, so
+// ReadBatch can return zero packets.
+type PacketConn interface {
+	ReadBatch() (int, error)
+	Packet(i int) ([]byte, *net.UDPAddr)
+	WritePacket() []byte
+	CommitPacket(packetBytes int, to *net.UDPAddr)
+	WriteTo(packetData []byte, to *net.UDPAddr)
+	Flush() error
+}
+
+type SocketOptions struct {
+	ReadBuffer   int
+	WriteBuffer  int
+	ReusePort    bool
+	PacketFilter []bpf.Instruction
+}
+
+// Transport binds sockets. The client, gateway and server only send and receive packets through a transport,
+// so they run the same way over real UDP sockets and over a VirtualNetwork in tests.
+type Transport interface {
+	Listen(address string, options SocketOptions) (Socket, error)
+	NewPacketConn(socket Socket, batchSize int, maxPacketSize int) PacketConn
+}
+
+type UDPTransport struct{}
+
+// UDP is the transport for real UDP sockets.
+var UDP Transport = &UDPTransport{}
+
+func (transport *UDPTransport) Listen(address string, options SocketOptions) (Socket, error) {
+
+	lc := net.ListenConfig{}
+	if options.ReusePort {
+		lc.Control = reusePortControl
+	}
+
+	lp, err := lc.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := lp.(*net.UDPConn)
+
+	if options.ReadBuffer > 0 {
+		if err := conn.SetReadBuffer(options.ReadBuffer); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not set read buffer size: %v", err)
+		}
+	}
+
+	if options.WriteBuffer > 0 {
+		if err := conn.SetWriteBuffer(options.WriteBuffer); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not set write buffer size: %v", err)
+		}
+	}
+
+	// drop junk packets in the kernel before they are copied to user space
+
+	if options.PacketFilter != nil {
+		if err := AttachSocketFilter(conn, options.PacketFilter); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not attach kernel packet filter: %v", err)
+		}
+	}
+
+	return conn, nil
+}
+
+func (transport *UDPTransport) NewPacketConn(socket Socket, batchSize int, maxPacketSize int) PacketConn {
+	return NewBatchConn(socket.(*net.UDPConn), batchSize, maxPacketSize)
+}
@@ -0,0 +1,619 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package core
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// NetworkConditions impair packets sent on a virtual network. Latency is one way. Each packet gets a random
+// extra delay of up to Jitter, and with probability Reorder it is held back long enough to arrive after the
+// packets sent after it. Loss and Duplicate are the probability a packet is dropped or delivered twice.
+type NetworkConditions struct {
+	Latency   time.Duration
+	Jitter    time.Duration
+	Loss      float64
+	Duplicate float64
+	Reorder   float64
+}
+
+type VirtualNetworkCounters struct {
+	PacketsSent       uint64
+	PacketsDelivered  uint64
+	PacketsLost       uint64
+	PacketsDuplicated uint64
+	PacketsReordered  uint64
+	PacketsDropped    uint64
+}
+
+// VirtualQueueSize is the number of packets each virtual socket queues before it drops packets, like a full socket buffer.
+const VirtualQueueSize = 1024
+
+const virtualEphemeralPort = 49152
+
+var errVirtualSocketClosed = errors.New("use of closed virtual socket")
+
+type virtualTimeoutError struct{}
+
+func (err virtualTimeoutError) Error() string   { return "i/o timeout" }
+func (err virtualTimeoutError) Timeout() bool   { return true }
+func (err virtualTimeoutError) Temporary() bool { return true }
+
+// virtualAddress is an address as a map key, so looking up the socket a packet goes to doesn't allocate a string.
+type virtualAddress struct {
+	ip   [net.IPv6len]byte
+	port int
+}
+
+func virtualAddressOf(address *net.UDPAddr) virtualAddress {
+	var key virtualAddress
+	if ip := address.IP.To4(); ip != nil {
+		key.ip[10] = 0xff
+		key.ip[11] = 0xff
+		copy(key.ip[12:], ip)
+	} else {
+		copy(key.ip[:], address.IP)
+	}
+	key.port = address.Port
+	return key
+}
+
+// virtualAnyAddress is 0.0.0.0 on the port.
+func virtualAnyAddress(port int) virtualAddress {
+	var key virtualAddress
+	key.ip[10] = 0xff
+	key.ip[11] = 0xff
+	key.port = port
+	return key
+}
+
+type virtualPacket struct {
+	data        []byte
+	from        net.UDPAddr
+	to          net.UDPAddr
+	deliverTime time.Time
+	sequence    uint64
+}
+
+type virtualPacketQueue []*virtualPacket
+
+func (queue virtualPacketQueue) Len() int { return len(queue) }
+
+func (queue virtualPacketQueue) Less(i, j int) bool {
+	if queue[i].deliverTime.Equal(queue[j].deliverTime) {
+		return queue[i].sequence < queue[j].sequence
+	}
+	return queue[i].deliverTime.Before(queue[j].deliverTime)
+}
+
+func (queue virtualPacketQueue) Swap(i, j int) { queue[i], queue[j] = queue[j], queue[i] }
+
+func (queue *virtualPacketQueue) Push(x interface{}) { *queue = append(*queue, x.(*virtualPacket)) }
+
+func (queue *virtualPacketQueue) Pop() interface{} {
+	old := *queue
+	packet := old[len(old)-1]
+	old[len(old)-1] = nil
+	*queue = old[:len(old)-1]
+	return packet
+}
+
+// VirtualNetwork is an in-memory Transport, so the client, gateway and server can run together in one process
+// without binding real ports. Random impairments come from the seed, so a test that sends the same packets
+// in the same order sees the same losses, duplicates and delays on every run. Delays are measured on the clock,
+// so with a FakeClock packets in flight are only delivered as the clock is advanced. Packets are reused once they
+// have been read, like the buffers of a real PacketConn, so sending and receiving don't allocate.
+type VirtualNetwork struct {
+	mutex      sync.Mutex
+	clock      Clock
+	random     *rand.Rand
+	conditions NetworkConditions
+	counters   VirtualNetworkCounters
+	sockets    map[virtualAddress][]*VirtualSocket
+	nextPort   int
+	pending    virtualPacketQueue
+	free       []*virtualPacket
+	sequence   uint64
+	wake       chan struct{}
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+func NewVirtualNetwork(seed int64, clock Clock) *VirtualNetwork {
+	network := &VirtualNetwork{}
+	network.clock = clock
+	network.random = rand.New(rand.NewSource(seed))
+	network.sockets = make(map[virtualAddress][]*VirtualSocket)
+	network.nextPort = virtualEphemeralPort
+	network.wake = make(chan struct{}, 1)
+	network.closed = make(chan struct{})
+	go network.run()
+	return network
+}
+
+// SetConditions changes the impairments for packets sent from now on. Packets already in flight keep their delay.
+func (network *VirtualNetwork) SetConditions(conditions NetworkConditions) {
+	network.mutex.Lock()
+	network.conditions = conditions
+	network.mutex.Unlock()
+}
+
+func (network *VirtualNetwork) Counters() VirtualNetworkCounters {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	return network.counters
+}
+
+// Close stops delivering packets. Packets still in flight are dropped.
+func (network *VirtualNetwork) Close() {
+	network.closeOnce.Do(func() {
+		close(network.closed)
+	})
+}
+
+// Listen binds a virtual socket. Port 0 picks a free port. Sockets bound to 0.0.0.0 receive packets sent to
+// any address with their port, and send from 127.0.0.1. Several sockets can bind the same address with
+// ReusePort, and packets are spread across them by source address, like SO_REUSEPORT.
+func (network *VirtualNetwork) Listen(address string, options SocketOptions) (Socket, error) {
+
+	udpAddress, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+
+	socket := &VirtualSocket{network: network, reusePort: options.ReusePort}
+
+	socket.address.IP = udpAddress.IP
+	if socket.address.IP == nil || socket.address.IP.IsUnspecified() {
+		socket.address.IP = net.IPv4zero
+		socket.sendAddress.IP = net.IPv4(127, 0, 0, 1)
+	} else {
+		socket.sendAddress.IP = socket.address.IP
+	}
+
+	socket.address.Port = udpAddress.Port
+	if socket.address.Port == 0 {
+		for {
+			socket.address.Port = network.nextPort
+			network.nextPort++
+			if len(network.sockets[virtualAddressOf(&socket.address)]) == 0 {
+				break
+			}
+		}
+	}
+	socket.sendAddress.Port = socket.address.Port
+
+	socket.key = virtualAddressOf(&socket.address)
+
+	existing := network.sockets[socket.key]
+	if len(existing) > 0 && !(options.ReusePort && existing[0].reusePort) {
+		return nil, fmt.Errorf("listen udp %s: address already in use", socket.address.String())
+	}
+
+	socket.receive = make(chan *virtualPacket, VirtualQueueSize)
+	socket.deadlineChanged = make(chan struct{})
+	socket.closed = make(chan struct{})
+
+	network.sockets[socket.key] = append(existing, socket)
+
+	return socket, nil
+}
+
+func (network *VirtualNetwork) NewPacketConn(socket Socket, batchSize int, maxPacketSize int) PacketConn {
+	conn := &virtualPacketConn{socket: socket.(*VirtualSocket), maxPacketSize: maxPacketSize}
+	conn.read = make([]*virtualPacket, batchSize)
+	conn.write = make([][]byte, batchSize)
+	conn.writeBytes = make([]int, batchSize)
+	conn.writeTo = make([]net.UDPAddr, batchSize)
+	for i := range conn.write {
+		conn.write[i] = make([]byte, maxPacketSize)
+	}
+	return conn
+}
+
+// ImpairPacket decides what the conditions do to one packet. It returns how many copies arrive, which is 0 if the
+// packet is lost and 2 if it is duplicated, and sets the delay of each copy. Reordered copies are held back long
+// enough to arrive after packets sent after them. The same random numbers are always drawn for each packet, so
+// changing one condition doesn't change what the others do.
+func ImpairPacket(random *rand.Rand, conditions *NetworkConditions, delays *[2]time.Duration, reordered *[2]bool) int {
+
+	lost := random.Float64() < conditions.Loss
+	duplicated := random.Float64() < conditions.Duplicate
+
+	if lost {
+		return 0
+	}
+
+	copies := 1
+	if duplicated {
+		copies = 2
+	}
+
+	for i := 0; i < copies; i++ {
+		jitter := random.Float64()
+		reordered[i] = random.Float64() < conditions.Reorder
+		delays[i] = conditions.Latency + time.Duration(jitter*float64(conditions.Jitter))
+		if reordered[i] {
+			delays[i] += conditions.Latency + conditions.Jitter + time.Millisecond
+		}
+	}
+
+	return copies
+}
+
+func (network *VirtualNetwork) send(from *net.UDPAddr, to *net.UDPAddr, packetData []byte) {
+
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+
+	network.counters.PacketsSent++
+
+	var delays [2]time.Duration
+	var reordered [2]bool
+
+	copies := ImpairPacket(network.random, &network.conditions, &delays, &reordered)
+
+	if copies == 0 {
+		network.counters.PacketsLost++
+		return
+	}
+
+	if copies == 2 {
+		network.counters.PacketsDuplicated++
+	}
+
+	currentTime := network.clock.Now()
+
+	for i := 0; i < copies; i++ {
+
+		delay := delays[i]
+		if reordered[i] {
+			network.counters.PacketsReordered++
+		}
+
+		packet := network.newPacket()
+		packet.data = append(packet.data[:0], packetData...)
+		CopyAddress(&packet.from, from)
+		CopyAddress(&packet.to, to)
+
+		if delay == 0 {
+			network.deliver(packet)
+			continue
+		}
+
+		packet.deliverTime = currentTime.Add(delay)
+		packet.sequence = network.sequence
+		network.sequence++
+		heap.Push(&network.pending, packet)
+	}
+
+	if len(network.pending) > 0 {
+		select {
+		case network.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// newPacket must be called with the mutex held.
+func (network *VirtualNetwork) newPacket() *virtualPacket {
+	if len(network.free) == 0 {
+		return &virtualPacket{}
+	}
+	packet := network.free[len(network.free)-1]
+	network.free[len(network.free)-1] = nil
+	network.free = network.free[:len(network.free)-1]
+	return packet
+}
+
+// freePackets returns packets that have been read, to be sent again.
+func (network *VirtualNetwork) freePackets(packets []*virtualPacket) {
+	network.mutex.Lock()
+	network.free = append(network.free, packets...)
+	network.mutex.Unlock()
+}
+
+// deliver must be called with the mutex held.
+func (network *VirtualNetwork) deliver(packet *virtualPacket) {
+	sockets := network.sockets[virtualAddressOf(&packet.to)]
+	if len(sockets) == 0 {
+		sockets = network.sockets[virtualAnyAddress(packet.to.Port)]
+	}
+	if len(sockets) == 0 {
+		network.counters.PacketsDropped++
+		network.free = append(network.free, packet)
+		return
+	}
+	socket := sockets[0]
+	if len(sockets) > 1 {
+		// fnv-1a of the source address
+		from := virtualAddressOf(&packet.from)
+		hash := uint32(2166136261)
+		for _, b := range from.ip {
+			hash = (hash ^ uint32(b)) * 16777619
+		}
+		hash = (hash ^ uint32(from.port>>8)) * 16777619
+		hash = (hash ^ uint32(from.port&0xff)) * 16777619
+		socket = sockets[int(hash%uint32(len(sockets)))]
+	}
+	select {
+	case socket.receive <- packet:
+		network.counters.PacketsDelivered++
+	default:
+		network.counters.PacketsDropped++
+		network.free = append(network.free, packet)
+	}
+}
+
+func (network *VirtualNetwork) run() {
+	timer := network.clock.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		network.mutex.Lock()
+		currentTime := network.clock.Now()
+		for len(network.pending) > 0 && !network.pending[0].deliverTime.After(currentTime) {
+			network.deliver(heap.Pop(&network.pending).(*virtualPacket))
+		}
+		wait := time.Hour
+		if len(network.pending) > 0 {
+			wait = network.pending[0].deliverTime.Sub(currentTime)
+		}
+		network.mutex.Unlock()
+
+		stopTimer(timer)
+		timer.Reset(wait)
+		select {
+		case <-timer.C():
+		case <-network.wake:
+		case <-network.closed:
+			return
+		}
+	}
+}
+
+// stopTimer stops a timer and empties its channel if it fired without being received from, so it can be reset.
+func stopTimer(timer Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C():
+		default:
+		}
+	}
+}
+
+func (network *VirtualNetwork) remove(socket *VirtualSocket) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	sockets := network.sockets[socket.key]
+	for i := range sockets {
+		if sockets[i] == socket {
+			sockets = append(sockets[:i:i], sockets[i+1:]...)
+			break
+		}
+	}
+	if len(sockets) == 0 {
+		delete(network.sockets, socket.key)
+	} else {
+		network.sockets[socket.key] = sockets
+	}
+}
+
+type VirtualSocket struct {
+	network         *VirtualNetwork
+	address         net.UDPAddr
+	sendAddress     net.UDPAddr
+	key             virtualAddress
+	reusePort       bool
+	receive         chan *virtualPacket
+	mutex           sync.Mutex
+	deadline        time.Time
+	deadlineChanged chan struct{}
+	closed          chan struct{}
+	closeOnce       sync.Once
+}
+
+func (socket *VirtualSocket) LocalAddr() net.Addr {
+	return &socket.address
+}
+
+func (socket *VirtualSocket) SetReadDeadline(t time.Time) error {
+	socket.mutex.Lock()
+	socket.deadline = t
+	close(socket.deadlineChanged)
+	socket.deadlineChanged = make(chan struct{})
+	socket.mutex.Unlock()
+	return nil
+}
+
+func (socket *VirtualSocket) Close() error {
+	err := errVirtualSocketClosed
+	socket.closeOnce.Do(func() {
+		close(socket.closed)
+		socket.network.remove(socket)
+		err = nil
+	})
+	return err
+}
+
+type virtualPacketConn struct {
+	socket        *VirtualSocket
+	maxPacketSize int
+	read          []*virtualPacket
+	numRead       int
+	timer         *time.Timer
+	write         [][]byte
+	writeBytes    []int
+	writeTo       []net.UDPAddr
+	numWrite      int
+	flushErr      error
+}
+
+func (conn *virtualPacketConn) ReadBatch() (int, error) {
+
+	// the packets from the last batch are done with
+
+	socket := conn.socket
+
+	socket.network.freePackets(conn.read[:conn.numRead])
+	for i := 0; i < conn.numRead; i++ {
+		conn.read[i] = nil
+	}
+	conn.numRead = 0
+
+	for {
+		select {
+		case <-socket.closed:
+			return 0, errVirtualSocketClosed
+		default:
+		}
+
+		socket.mutex.Lock()
+		deadline := socket.deadline
+		deadlineChanged := socket.deadlineChanged
+		socket.mutex.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, virtualTimeoutError{}
+			}
+			if conn.timer == nil {
+				conn.timer = time.NewTimer(wait)
+			} else {
+				conn.timer.Reset(wait)
+			}
+			timeout = conn.timer.C
+		}
+
+		select {
+		case packet := <-socket.receive:
+			conn.stopTimer(timeout)
+			conn.read[0] = packet
+			conn.numRead = 1
+		more:
+			for conn.numRead < len(conn.read) {
+				select {
+				case packet := <-socket.receive:
+					conn.read[conn.numRead] = packet
+					conn.numRead++
+				default:
+					break more
+				}
+			}
+			conn.dropOversized()
+			return conn.numRead, nil
+		case <-timeout:
+			return 0, virtualTimeoutError{}
+		case <-deadlineChanged:
+			conn.stopTimer(timeout)
+		case <-socket.closed:
+			conn.stopTimer(timeout)
+			return 0, errVirtualSocketClosed
+		}
+	}
+}
+
+// stopTimer stops the deadline timer, if it was started for this read, so it can be reset for the next one.
+func (conn *virtualPacketConn) stopTimer(timeout <-chan time.Time) {
+	if timeout != nil && !conn.timer.Stop() {
+		select {
+		case <-conn.timer.C:
+		default:
+		}
+	}
+}
+
+// dropOversized drops packets bigger than the max packet size from the batch, like a BatchConn drops the datagrams
+// the kernel had to truncate. They are rare, so they are left for the garbage collector instead of being reused.
+func (conn *virtualPacketConn) dropOversized() {
+	numRead := 0
+	for i := 0; i < conn.numRead; i++ {
+		packet := conn.read[i]
+		conn.read[i] = nil
+		if len(packet.data) > conn.maxPacketSize {
+			continue
+		}
+		conn.read[numRead] = packet
+		numRead++
+	}
+	conn.numRead = numRead
+}
+
+// Packet returns packet i from the last ReadBatch.
+func (conn *virtualPacketConn) Packet(i int) ([]byte, *net.UDPAddr) {
+	packet := conn.read[i]
+	return packet.data, &packet.from
+}
+
+func (conn *virtualPacketConn) WritePacket() []byte {
+	if conn.numWrite == len(conn.write) {
+		if err := conn.flush(); err != nil {
+			conn.flushErr = err
+		}
+	}
+	return conn.write[conn.numWrite]
+}
+
+func (conn *virtualPacketConn) CommitPacket(packetBytes int, to *net.UDPAddr) {
+	i := conn.numWrite
+	conn.writeBytes[i] = packetBytes
+	CopyAddress(&conn.writeTo[i], to)
+	conn.numWrite++
+}
+
+func (conn *virtualPacketConn) WriteTo(packetData []byte, to *net.UDPAddr) {
+	conn.CommitPacket(copy(conn.WritePacket(), packetData), to)
+}
+
+func (conn *virtualPacketConn) Flush() error {
+	err := conn.flush()
+	if err == nil {
+		err = conn.flushErr
+	}
+	conn.flushErr = nil
+	return err
+}
+
+func (conn *virtualPacketConn) flush() error {
+	numWrite := conn.numWrite
+	conn.numWrite = 0
+	select {
+	case <-conn.socket.closed:
+		if numWrite > 0 {
+			return errVirtualSocketClosed
+		}
+		return nil
+	default:
+	}
+	for i := 0; i < numWrite; i++ {
+		conn.socket.network.send(&conn.socket.sendAddress, &conn.writeTo[i], conn.write[i][:conn.writeBytes[i]])
+	}
+	return nil
+}
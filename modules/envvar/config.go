@@ -0,0 +1,484 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package envvar
+
+// config is the layer on top of env vars. Each command declares its settings in one place. Values come
+// from the setting defaults, then an optional YAML config file, then env vars, which override the file.
+// Everything is parsed and validated up front, so misconfiguration is caught at startup, or before
+// deploying with --check-config.
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	Type_String   = 0
+	Type_Int      = 1
+	Type_Float    = 2
+	Type_Bool     = 3
+	Type_Duration = 4
+	Type_Base64   = 5
+	Type_Address  = 6
+	Type_Port     = 7
+)
+
+var typeNames = [...]string{"string", "integer", "float", "bool", "duration", "base64 encoded value", "address", "port"}
+
+// Setting declares one config value. Name is the env var, and the config file key is the same name in lower case.
+// Any setting can also be read from a file named by the env var with a _FILE suffix, or the config file key with a
+// _file suffix, eg. GATEWAY_PRIVATE_KEY_FILE=/run/secrets/gateway_private_key. Reloadable settings take new values
+// when the config is reloaded.
+type Setting struct {
+	Name        string
+	Type        int
+	Default     string
+	Description string
+	Required    bool
+	Secret      bool
+	Positive    bool
+	Reloadable  bool
+	Bytes       int
+}
+
+func (setting *Setting) Key() string {
+	return strings.ToLower(setting.Name)
+}
+
+type Config struct {
+	File     string
+	settings []Setting
+	raw      map[string]string
+	sources  map[string]string
+	values   map[string]interface{}
+}
+
+// Load builds the config for a command from its settings and command line arguments. The config file is
+// given with --config or CONFIG_FILE. With --print-config, the effective config is written to output with
+// secrets redacted, and with --check-config the config is only validated. In both cases done is true
+// and the command should exit instead of running.
+func Load(settings []Setting, args []string, output io.Writer) (config *Config, done bool, err error) {
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flags.SetOutput(output)
+	configFile := flags.String("config", Get("CONFIG_FILE", ""), "path to a YAML config file")
+	printConfig := flags.Bool("print-config", false, "print the effective config with secrets redacted, then exit")
+	checkConfig := flags.Bool("check-config", false, "validate the config, then exit")
+	flags.Usage = func() {
+		fmt.Fprintf(output, "usage: %s [--config file] [--print-config] [--check-config]\n\n", flags.Name())
+		flags.PrintDefaults()
+		fmt.Fprintf(output, "\nsettings (env var, or lower case key in the config file. add _FILE to read the value from a file):\n\n")
+		for i := range settings {
+			fmt.Fprintf(output, "  %s (%s, default '%s')\n    \t%s\n", settings[i].Name, typeNames[settings[i].Type], settings[i].Default, settings[i].Description)
+		}
+	}
+
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil, true, nil
+		}
+		return nil, false, err
+	}
+
+	if flags.NArg() > 0 {
+		return nil, false, fmt.Errorf("unexpected argument '%s'", flags.Arg(0))
+	}
+
+	config = &Config{File: *configFile, settings: settings}
+
+	if err := config.load(); err != nil {
+		return nil, false, err
+	}
+
+	if *printConfig {
+		config.Print(output)
+		return config, true, nil
+	}
+
+	if *checkConfig {
+		fmt.Fprintf(output, "config is valid\n")
+		return config, true, nil
+	}
+
+	return config, false, nil
+}
+
+// Reload reads the config file, env vars and value files again, for example when a key file has been
+// replaced. Reloadable settings take their new values. Other settings keep their current values, and the
+// names of any that changed are returned, since those only take effect on restart.
+func (config *Config) Reload() (*Config, []string, error) {
+
+	reloaded := &Config{File: config.File, settings: config.settings}
+
+	if err := reloaded.load(); err != nil {
+		return nil, nil, err
+	}
+
+	var restart []string
+
+	for i := range config.settings {
+		setting := &config.settings[i]
+		if setting.Reloadable {
+			continue
+		}
+		value, ok := config.raw[setting.Name]
+		reloadedValue, reloadedOk := reloaded.raw[setting.Name]
+		if ok != reloadedOk || value != reloadedValue {
+			restart = append(restart, setting.Name)
+		}
+		if ok {
+			reloaded.raw[setting.Name] = value
+			reloaded.sources[setting.Name] = config.sources[setting.Name]
+			reloaded.values[setting.Name] = config.values[setting.Name]
+		} else {
+			delete(reloaded.raw, setting.Name)
+			delete(reloaded.sources, setting.Name)
+			delete(reloaded.values, setting.Name)
+		}
+	}
+
+	return reloaded, restart, nil
+}
+
+func (config *Config) load() error {
+
+	config.raw = make(map[string]string)
+	config.sources = make(map[string]string)
+	config.values = make(map[string]interface{})
+
+	for i := range config.settings {
+		if config.settings[i].Default != "" {
+			config.raw[config.settings[i].Name] = config.settings[i].Default
+			config.sources[config.settings[i].Name] = "default"
+		}
+	}
+
+	if config.File != "" {
+		if err := config.loadFile(config.File); err != nil {
+			return err
+		}
+	}
+
+	for i := range config.settings {
+		setting := &config.settings[i]
+		value, ok := os.LookupEnv(setting.Name)
+		filename, fileOk := os.LookupEnv(setting.Name + "_FILE")
+		if ok && fileOk {
+			return fmt.Errorf("set only one of %s and %s_FILE", setting.Name, setting.Name)
+		}
+		if ok {
+			config.raw[setting.Name] = value
+			config.sources[setting.Name] = "env"
+		}
+		if fileOk {
+			value, err := readValueFile(setting, filename)
+			if err != nil {
+				return fmt.Errorf("%s_FILE: %v", setting.Name, err)
+			}
+			config.raw[setting.Name] = value
+			config.sources[setting.Name] = "env file " + filename
+		}
+	}
+
+	return config.validate()
+}
+
+func (config *Config) loadFile(filename string) error {
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %v", err)
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("could not parse config file %s: %v", filename, err)
+	}
+
+	keys := make(map[string]*Setting)
+	for i := range config.settings {
+		keys[config.settings[i].Key()] = &config.settings[i]
+	}
+
+	for key, value := range values {
+		setting := keys[key]
+		fromFile := false
+		if setting == nil && strings.HasSuffix(key, "_file") {
+			setting = keys[strings.TrimSuffix(key, "_file")]
+			fromFile = true
+		}
+		if setting == nil {
+			return fmt.Errorf("unknown key '%s' in config file %s", key, filename)
+		}
+		if _, ok := values[setting.Key()]; ok && fromFile {
+			return fmt.Errorf("set only one of '%s' and '%s_file' in config file %s", setting.Key(), setting.Key(), filename)
+		}
+		switch value.(type) {
+		case nil:
+			continue
+		case string, int, int64, uint64, float64, bool:
+		default:
+			return fmt.Errorf("key '%s' in config file %s must be a single value", key, filename)
+		}
+		if fromFile {
+			valueFilename := fmt.Sprint(value)
+			value, err := readValueFile(setting, valueFilename)
+			if err != nil {
+				return fmt.Errorf("key '%s' in config file %s: %v", key, filename, err)
+			}
+			config.raw[setting.Name] = value
+			config.sources[setting.Name] = "file " + valueFilename
+		} else {
+			config.raw[setting.Name] = fmt.Sprint(value)
+			config.sources[setting.Name] = "file"
+		}
+	}
+
+	return nil
+}
+
+// readValueFile reads a setting from a file, such as a key in a Kubernetes secret mount. The file must not
+// be writable by other users, and files holding secrets must not be readable by them either. Group read is
+// allowed for secrets, since Kubernetes adds it when fsGroup is set.
+func readValueFile(setting *Setting, filename string) (string, error) {
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return "", err
+	}
+
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", filename)
+	}
+
+	if runtime.GOOS != "windows" {
+		perm := info.Mode().Perm()
+		if perm&0022 != 0 {
+			return "", fmt.Errorf("%s must not be writable by group or other users (mode %04o)", filename, perm)
+		}
+		if setting.Secret && perm&0007 != 0 {
+			return "", fmt.Errorf("%s holds a secret and must not be accessible by other users (mode %04o). chmod 600 it, or set defaultMode 0400 on the secret volume", filename, perm)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (config *Config) validate() error {
+
+	var problems []string
+
+	for i := range config.settings {
+
+		setting := &config.settings[i]
+
+		valueString, ok := config.raw[setting.Name]
+		if !ok {
+			if setting.Required {
+				problems = append(problems, fmt.Sprintf("%s is required", setting.Name))
+			}
+			continue
+		}
+
+		value, err := parseValue(setting, valueString)
+		if err != nil {
+			if setting.Secret {
+				problems = append(problems, fmt.Sprintf("%s: %v", setting.Name, err))
+			} else {
+				problems = append(problems, fmt.Sprintf("%s: %v. Value: %s", setting.Name, err, valueString))
+			}
+			continue
+		}
+
+		config.values[setting.Name] = value
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+func parseValue(setting *Setting, valueString string) (interface{}, error) {
+
+	switch setting.Type {
+
+	case Type_String:
+		return valueString, nil
+
+	case Type_Int:
+		value, err := strconv.ParseInt(valueString, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse as an integer")
+		}
+		if setting.Positive && value <= 0 {
+			return nil, fmt.Errorf("must be greater than zero")
+		}
+		return int(value), nil
+
+	case Type_Float:
+		value, err := strconv.ParseFloat(valueString, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse as a float")
+		}
+		if setting.Positive && value <= 0 {
+			return nil, fmt.Errorf("must be greater than zero")
+		}
+		return value, nil
+
+	case Type_Bool:
+		value, err := strconv.ParseBool(valueString)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse as a bool")
+		}
+		return value, nil
+
+	case Type_Duration:
+		value, err := time.ParseDuration(valueString)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse as a duration")
+		}
+		if setting.Positive && value <= 0 {
+			return nil, fmt.Errorf("must be greater than zero")
+		}
+		return value, nil
+
+	case Type_Base64:
+		value, err := base64.StdEncoding.DecodeString(valueString)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse as a base64 encoded value")
+		}
+		if setting.Bytes != 0 && len(value) != setting.Bytes {
+			return nil, fmt.Errorf("must be %d bytes, got %d", setting.Bytes, len(value))
+		}
+		return value, nil
+
+	case Type_Address:
+		value, err := net.ResolveUDPAddr("udp", valueString)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse as an address")
+		}
+		return value, nil
+
+	case Type_Port:
+		value, err := strconv.ParseUint(valueString, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse as a port")
+		}
+		return strconv.Itoa(int(value)), nil
+	}
+
+	panic(fmt.Sprintf("setting %s has unknown type %d", setting.Name, setting.Type))
+}
+
+// Print writes the effective config as YAML, with where each value came from. Secrets are redacted.
+func (config *Config) Print(output io.Writer) {
+	if config.File != "" {
+		fmt.Fprintf(output, "# config file: %s\n", config.File)
+	}
+	for i := range config.settings {
+		setting := &config.settings[i]
+		valueString, ok := config.raw[setting.Name]
+		if !ok {
+			fmt.Fprintf(output, "# %s: (not set)\n", setting.Key())
+			continue
+		}
+		if setting.Secret {
+			valueString = "<redacted>"
+		}
+		fmt.Fprintf(output, "%s: %s # %s\n", setting.Key(), strconv.Quote(valueString), config.sources[setting.Name])
+	}
+}
+
+// ---------------------------------------------------
+
+func (config *Config) value(name string, settingType int) interface{} {
+	for i := range config.settings {
+		if config.settings[i].Name == name {
+			if config.settings[i].Type != settingType {
+				panic(fmt.Sprintf("setting %s is not of type %s", name, typeNames[settingType]))
+			}
+			return config.values[name]
+		}
+	}
+	panic(fmt.Sprintf("setting %s is not declared", name))
+}
+
+func (config *Config) Exists(name string) bool {
+	_, ok := config.raw[name]
+	return ok
+}
+
+func (config *Config) String(name string) string {
+	value, _ := config.value(name, Type_String).(string)
+	return value
+}
+
+func (config *Config) Port(name string) string {
+	value, _ := config.value(name, Type_Port).(string)
+	return value
+}
+
+func (config *Config) Int(name string) int {
+	value, _ := config.value(name, Type_Int).(int)
+	return value
+}
+
+func (config *Config) Float(name string) float64 {
+	value, _ := config.value(name, Type_Float).(float64)
+	return value
+}
+
+func (config *Config) Bool(name string) bool {
+	value, _ := config.value(name, Type_Bool).(bool)
+	return value
+}
+
+func (config *Config) Duration(name string) time.Duration {
+	value, _ := config.value(name, Type_Duration).(time.Duration)
+	return value
+}
+
+func (config *Config) Base64(name string) []byte {
+	value, _ := config.value(name, Type_Base64).([]byte)
+	return value
+}
+
+func (config *Config) Address(name string) *net.UDPAddr {
+	value, _ := config.value(name, Type_Address).(*net.UDPAddr)
+	return value
+}
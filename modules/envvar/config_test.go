@@ -0,0 +1,273 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package envvar
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testSettings = []Setting{
+	{Name: "TEST_CONFIG_PORT", Type: Type_Port, Default: "40000"},
+	{Name: "TEST_CONFIG_ADDRESS", Type: Type_Address, Default: "127.0.0.1:40000"},
+	{Name: "TEST_CONFIG_THREADS", Type: Type_Int, Default: "1", Positive: true},
+	{Name: "TEST_CONFIG_RATE", Type: Type_Float, Default: "10"},
+	{Name: "TEST_CONFIG_FILTER", Type: Type_Bool, Default: "false"},
+	{Name: "TEST_CONFIG_TIMEOUT", Type: Type_Duration, Default: "1s"},
+	{Name: "TEST_CONFIG_KEY", Type: Type_Base64, Bytes: 4, Required: true, Secret: true},
+	{Name: "TEST_CONFIG_URL", Type: Type_String},
+}
+
+func writeConfigFile(t *testing.T, data string) string {
+	dir, err := ioutil.TempDir("", "envvar")
+	assert.NoError(t, err)
+	filename := filepath.Join(dir, "config.yaml")
+	assert.NoError(t, ioutil.WriteFile(filename, []byte(data), 0600))
+	return filename
+}
+
+func TestConfigDefaults(t *testing.T) {
+
+	os.Setenv("TEST_CONFIG_KEY", "AQIDBA==")
+	defer os.Unsetenv("TEST_CONFIG_KEY")
+
+	var output bytes.Buffer
+	config, done, err := Load(testSettings, nil, &output)
+	assert.NoError(t, err)
+	assert.False(t, done)
+
+	assert.Equal(t, "40000", config.Port("TEST_CONFIG_PORT"))
+	assert.Equal(t, "127.0.0.1:40000", config.Address("TEST_CONFIG_ADDRESS").String())
+	assert.Equal(t, 1, config.Int("TEST_CONFIG_THREADS"))
+	assert.Equal(t, 10.0, config.Float("TEST_CONFIG_RATE"))
+	assert.Equal(t, false, config.Bool("TEST_CONFIG_FILTER"))
+	assert.Equal(t, time.Second, config.Duration("TEST_CONFIG_TIMEOUT"))
+	assert.Equal(t, []byte{1, 2, 3, 4}, config.Base64("TEST_CONFIG_KEY"))
+	assert.Equal(t, "", config.String("TEST_CONFIG_URL"))
+	assert.False(t, config.Exists("TEST_CONFIG_URL"))
+
+	assert.Panics(t, func() { config.Int("TEST_CONFIG_RATE") })
+	assert.Panics(t, func() { config.Int("NOT_DECLARED") })
+}
+
+func TestConfigFile(t *testing.T) {
+
+	filename := writeConfigFile(t, "test_config_threads: 4\ntest_config_rate: 2.5\ntest_config_filter: true\ntest_config_url: http://localhost\ntest_config_key: AQIDBA==\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	// env vars override the config file
+
+	os.Setenv("TEST_CONFIG_THREADS", "8")
+	defer os.Unsetenv("TEST_CONFIG_THREADS")
+
+	var output bytes.Buffer
+	config, done, err := Load(testSettings, []string{"--config", filename}, &output)
+	assert.NoError(t, err)
+	assert.False(t, done)
+
+	assert.Equal(t, 8, config.Int("TEST_CONFIG_THREADS"))
+	assert.Equal(t, 2.5, config.Float("TEST_CONFIG_RATE"))
+	assert.Equal(t, true, config.Bool("TEST_CONFIG_FILTER"))
+	assert.Equal(t, "http://localhost", config.String("TEST_CONFIG_URL"))
+
+	// --print-config shows where values came from, and redacts secrets
+
+	output.Reset()
+	_, done, err = Load(testSettings, []string{"--config", filename, "--print-config"}, &output)
+	assert.NoError(t, err)
+	assert.True(t, done)
+
+	printed := output.String()
+	assert.Contains(t, printed, `test_config_threads: "8" # env`)
+	assert.Contains(t, printed, `test_config_rate: "2.5" # file`)
+	assert.Contains(t, printed, `test_config_port: "40000" # default`)
+	assert.Contains(t, printed, `test_config_key: "<redacted>" # file`)
+	assert.NotContains(t, printed, "AQIDBA==")
+
+	// the printed config can be loaded again
+
+	reloaded := writeConfigFile(t, strings.Replace(printed, "<redacted>", "AQIDBA==", 1))
+	defer os.RemoveAll(filepath.Dir(reloaded))
+
+	config, _, err = Load(testSettings, []string{"--config", reloaded}, &output)
+	assert.NoError(t, err)
+	assert.Equal(t, 2.5, config.Float("TEST_CONFIG_RATE"))
+}
+
+func TestConfigErrors(t *testing.T) {
+
+	var output bytes.Buffer
+
+	// required settings
+
+	_, _, err := Load(testSettings, []string{"--check-config"}, &output)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "TEST_CONFIG_KEY is required")
+
+	// every bad value is reported, and secret values are not
+
+	os.Setenv("TEST_CONFIG_KEY", "AQID")
+	os.Setenv("TEST_CONFIG_THREADS", "0")
+	os.Setenv("TEST_CONFIG_PORT", "70000")
+	os.Setenv("TEST_CONFIG_ADDRESS", "not an address")
+	defer os.Unsetenv("TEST_CONFIG_KEY")
+	defer os.Unsetenv("TEST_CONFIG_THREADS")
+	defer os.Unsetenv("TEST_CONFIG_PORT")
+	defer os.Unsetenv("TEST_CONFIG_ADDRESS")
+
+	_, _, err = Load(testSettings, []string{"--check-config"}, &output)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "TEST_CONFIG_KEY: must be 4 bytes, got 3")
+	assert.Contains(t, err.Error(), "TEST_CONFIG_THREADS: must be greater than zero")
+	assert.Contains(t, err.Error(), "TEST_CONFIG_PORT: could not parse as a port")
+	assert.Contains(t, err.Error(), "TEST_CONFIG_ADDRESS: could not parse as an address")
+	assert.NotContains(t, err.Error(), "AQID")
+
+	// unknown keys in the config file are typos
+
+	filename := writeConfigFile(t, "test_config_thread: 4\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	_, _, err = Load(testSettings, []string{"--config", filename}, &output)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown key 'test_config_thread'")
+
+	_, _, err = Load(testSettings, []string{"--config", filename + ".missing"}, &output)
+	assert.Error(t, err)
+
+	_, _, err = Load(testSettings, []string{"extra"}, &output)
+	assert.Error(t, err)
+}
+
+func TestConfigValueFiles(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "envvar")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key")
+	assert.NoError(t, ioutil.WriteFile(keyFile, []byte("AQIDBA==\n"), 0600))
+
+	os.Setenv("TEST_CONFIG_KEY_FILE", keyFile)
+	defer os.Unsetenv("TEST_CONFIG_KEY_FILE")
+
+	var output bytes.Buffer
+	config, _, err := Load(testSettings, nil, &output)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3, 4}, config.Base64("TEST_CONFIG_KEY"))
+
+	// secrets must not be readable by other users
+
+	assert.NoError(t, os.Chmod(keyFile, 0644))
+	_, _, err = Load(testSettings, nil, &output)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "must not be accessible by other users")
+
+	// nothing may be writable by other users
+
+	assert.NoError(t, os.Chmod(keyFile, 0640))
+	_, _, err = Load(testSettings, nil, &output)
+	assert.NoError(t, err)
+
+	urlFile := filepath.Join(dir, "url")
+	assert.NoError(t, ioutil.WriteFile(urlFile, []byte("http://localhost"), 0666))
+	assert.NoError(t, os.Chmod(urlFile, 0666))
+
+	os.Setenv("TEST_CONFIG_URL_FILE", urlFile)
+	defer os.Unsetenv("TEST_CONFIG_URL_FILE")
+
+	_, _, err = Load(testSettings, nil, &output)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "must not be writable")
+
+	assert.NoError(t, os.Chmod(urlFile, 0644))
+	config, _, err = Load(testSettings, nil, &output)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost", config.String("TEST_CONFIG_URL"))
+
+	// a setting and its _FILE variant can't both be set
+
+	os.Setenv("TEST_CONFIG_KEY", "AQIDBA==")
+	defer os.Unsetenv("TEST_CONFIG_KEY")
+
+	_, _, err = Load(testSettings, nil, &output)
+	assert.Error(t, err)
+
+	os.Unsetenv("TEST_CONFIG_KEY")
+
+	// files can also be named in the config file
+
+	os.Unsetenv("TEST_CONFIG_KEY_FILE")
+
+	filename := writeConfigFile(t, "test_config_key_file: "+keyFile+"\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	config, _, err = Load(testSettings, []string{"--config", filename}, &output)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3, 4}, config.Base64("TEST_CONFIG_KEY"))
+}
+
+func TestConfigReload(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "envvar")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key")
+	assert.NoError(t, ioutil.WriteFile(keyFile, []byte("AQIDBA=="), 0600))
+
+	settings := []Setting{
+		{Name: "TEST_RELOAD_KEY", Type: Type_Base64, Bytes: 4, Required: true, Secret: true, Reloadable: true},
+		{Name: "TEST_RELOAD_THREADS", Type: Type_Int, Default: "1"},
+	}
+
+	filename := writeConfigFile(t, "test_reload_key_file: "+keyFile+"\ntest_reload_threads: 2\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	var output bytes.Buffer
+	config, _, err := Load(settings, []string{"--config", filename}, &output)
+	assert.NoError(t, err)
+
+	// reloadable settings change, and others keep their value until restart
+
+	assert.NoError(t, ioutil.WriteFile(keyFile, []byte("BQYHCA=="), 0600))
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("test_reload_key_file: "+keyFile+"\ntest_reload_threads: 4\n"), 0600))
+
+	reloaded, restart, err := config.Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{5, 6, 7, 8}, reloaded.Base64("TEST_RELOAD_KEY"))
+	assert.Equal(t, 2, reloaded.Int("TEST_RELOAD_THREADS"))
+	assert.Equal(t, []string{"TEST_RELOAD_THREADS"}, restart)
+
+	// a bad reload is reported, and the current config is unchanged
+
+	assert.NoError(t, ioutil.WriteFile(keyFile, []byte("AQID"), 0600))
+
+	_, _, err = reloaded.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, []byte{5, 6, 7, 8}, reloaded.Base64("TEST_RELOAD_KEY"))
+}
@@ -0,0 +1,563 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gateway
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+)
+
+// BrowserSendQueueSize is how many packets can wait to be written to a browser client. Packets for a client that
+// can't keep up are dropped, like they would be on a congested UDP path.
+const BrowserSendQueueSize = 64
+
+// browserSession is a session for a browser client, connected over WebSocket or WebRTC. The session entry belongs
+// to the goroutine reading from the connection. The browser thread only uses the shared key, client address and
+// logger, which don't change once the session is created, and the send queue. A new connection for the same session
+// takes over its replay protection, so the mutex guards that and replaced.
+type browserSession struct {
+	entry     SessionEntry
+	sessionId [core.SessionIdBytes]byte
+	sendQueue chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	mutex     sync.Mutex
+	replaced  bool
+}
+
+// send queues a packet to be written to the client. The packet data comes from the browser packet pool.
+func (session *browserSession) send(pool *core.PacketPool, packetData []byte) {
+	select {
+	case session.sendQueue <- packetData:
+	default:
+		pool.Put(packetData)
+		session.entry.Logger.Debug("browser send queue is full")
+	}
+}
+
+// close makes the writer goroutine write whatever is queued, then close the connection.
+func (session *browserSession) close() {
+	session.closeOnce.Do(func() {
+		close(session.done)
+	})
+}
+
+// browserConnection handles the packets from one browser client. Packets get the same checks as packets from UDP
+// clients, apart from the challenge and the packet filter: the connection is already established from the client's
+// address, and delivers packets intact. So the first packet with a valid session token creates the session. Packets
+// are forwarded to the server from the browser internal address, so a server can't tell a browser client from a UDP
+// client. Its methods must be called from one goroutine.
+type browserConnection struct {
+	gateway         *Gateway
+	logger          *core.Logger
+	clientAddress   *net.UDPAddr
+	sessionId       *[core.SessionIdBytes]byte
+	sessionsCreated *uint64
+	write           func(packetData []byte) error
+	closeConn       func()
+	batchConn       core.PacketConn
+	session         *browserSession
+
+	// per-connection buffers, so forwarding a packet doesn't allocate
+
+	nonce            [core.NonceBytes_Box]byte
+	sharedKey        [core.SharedKeyBytes_Box]byte
+	packet           clientPacket
+	sessionTokenData [core.EncryptedSessionTokenBytes]byte
+	sessionToken     core.SessionToken
+	forwardPacket    core.InternalForwardPacket
+}
+
+// newBrowserConnection starts handling packets from a browser client. If sessionId is set, only packets for that
+// session are accepted. Write sends a packet to the client, and closeConn closes the connection to it.
+func (gateway *Gateway) newBrowserConnection(logger *core.Logger, clientAddress *net.UDPAddr, sessionId *[core.SessionIdBytes]byte, sessionsCreated *uint64, write func(packetData []byte) error, closeConn func()) *browserConnection {
+	connection := &browserConnection{}
+	connection.gateway = gateway
+	connection.logger = logger
+	connection.clientAddress = clientAddress
+	connection.sessionId = sessionId
+	connection.sessionsCreated = sessionsCreated
+	connection.write = write
+	connection.closeConn = closeConn
+	connection.batchConn = gateway.transport.NewPacketConn(gateway.browserSocket, 1, MaxPacketSize)
+	return connection
+}
+
+// close ends the session once the connection has closed.
+func (connection *browserConnection) close() {
+	if connection.session != nil {
+		connection.gateway.removeBrowserSession(connection.session)
+		connection.session.close()
+	}
+}
+
+// receivePacket checks a packet from the client and forwards it to the server. It returns false if the connection
+// should be closed.
+func (connection *browserConnection) receivePacket(packetData []byte) bool {
+
+	gateway := connection.gateway
+	config := &gateway.config
+	clock := gateway.clock
+	logger := connection.logger
+
+	packet := &connection.packet
+	sessionToken := &connection.sessionToken
+
+	packetBytes := len(packetData)
+
+	if !readClientPacket(packetData, packet) {
+		logger.Debug("bad packet size: %d", packetBytes)
+		return true
+	}
+
+	if packetData[0] != core.PacketVersion {
+		logger.Debug("unknown packet version: %d", packetData[0])
+		return true
+	}
+
+	// the packet filter isn't checked. the connection has already delivered the packet intact, from the client's address
+
+	sessionId := packet.Header.SessionId
+
+	if connection.sessionId != nil && sessionId != *connection.sessionId {
+		logger.Debug("wrong session id")
+		return true
+	}
+
+	if connection.session != nil && sessionId != connection.session.sessionId {
+		logger.Debug("session id changed")
+		return true
+	}
+
+	reloadable := gateway.reloadableConfig.Load().(*ReloadableConfig)
+
+	// verify session token
+
+	connection.sessionTokenData = packet.Prefix.SessionTokenData
+
+	if !readSessionToken(reloadable, connection.sessionTokenData[:], sessionToken) {
+		logger.Debug("could not decrypt session token")
+		return true
+	}
+
+	if sessionToken.ExpireTimestamp < uint64(clock.Now().Unix()) {
+		logger.Debug("session token has expired")
+		return true
+	}
+
+	if !core.IdEqual(sessionToken.SessionId[:], sessionId[:]) {
+		logger.Debug("session id mismatch")
+		return true
+	}
+
+	// decrypt packet
+
+	sharedKey := connection.sharedKey[:]
+
+	if connection.session != nil {
+		connection.sharedKey = connection.session.entry.SharedKey
+	} else {
+		core.SharedKey_Box(sessionId[:], reloadable.GatewayPrivateKey, sharedKey)
+	}
+
+	encryptedData := packet.EncryptedData
+
+	connection.nonce = [core.NonceBytes_Box]byte{}
+	index := 0
+	core.WriteUint64(connection.nonce[:], &index, packet.Header.Sequence)
+
+	err := core.Decrypt_SharedBox(sharedKey, connection.nonce[:], encryptedData, len(encryptedData))
+	if err != nil && connection.session == nil && reloadable.Previous != nil {
+		// the client may have a connect token for the gateway key from before the last reload
+		core.SharedKey_Box(sessionId[:], reloadable.Previous.GatewayPrivateKey, sharedKey)
+		err = core.Decrypt_SharedBox(sharedKey, connection.nonce[:], encryptedData, len(encryptedData))
+	}
+	if err != nil {
+		logger.Debug("could not decrypt payload packet")
+		return true
+	}
+
+	if !readClientHeader(packetData, packet) {
+		logger.Debug("bad payload size: %d", len(packet.Payload))
+		return true
+	}
+
+	if packet.Header.PacketType != core.PacketType_Payload && packet.Header.PacketType != core.PacketType_Keepalive || packet.Header.PacketType != packet.Prefix.PacketType {
+		logger.Debug("invalid packet type: %d", packet.Header.PacketType)
+		return true
+	}
+
+	if packet.ChallengeTokenData != nil {
+		logger.Debug("browser clients don't get challenges")
+		return true
+	}
+
+	sequence := packet.Header.Sequence
+
+	// the first packet creates the session
+
+	if connection.session == nil {
+		if gateway.isDraining() {
+			logger.Debug("draining, ignoring packet for new session")
+			return false
+		}
+		if !connection.newSession(sessionId, sequence, packet.Prefix.SessionTokenSequence, &packet.Prefix.SessionTokenData) {
+			return false
+		}
+	}
+
+	session := connection.session
+	sessionEntry := &session.entry
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.replaced {
+		sessionEntry.Logger.Debug("session was taken over by a new connection")
+		return false
+	}
+
+	// drop packets that are too old, too far ahead, or have already been forwarded to the server
+
+	switch sessionEntry.ReplayProtection.Check(sequence) {
+	case core.ReplayProtection_TooOld:
+		sessionEntry.Logger.Debug("sequence number is too old: %d", sequence)
+		return true
+	case core.ReplayProtection_TooNew:
+		sessionEntry.Logger.Debug("sequence number is too far ahead: %d", sequence)
+		return true
+	case core.ReplayProtection_Duplicate:
+		sessionEntry.Logger.Debug("packet %d has already been forwarded to the server", sequence)
+		return true
+	}
+
+	// does this packet fit in the session's bandwidth and packets per-second envelope?
+
+	if !sessionEntry.allowPacket(packetBytes, clock.Now()) {
+		return true
+	}
+
+	// update session token
+
+	gateway.updateSessionEntry(sessionEntry, reloadable, &packet.Prefix.SessionTokenData)
+
+	// forward packet to server. the client never saw a challenge, so it doesn't know the gateway id yet
+
+	packet.Header.Flags = 0
+	copy(packet.Header.GatewayId[:], gateway.gatewayId)
+
+	forwardPacket := &connection.forwardPacket
+	forwardPacket.GatewayAddress = *config.BrowserInternalAddress
+	forwardPacket.ClientAddress = *connection.clientAddress
+	forwardPacket.SessionTokenData = sessionEntry.SessionTokenData
+	forwardPacket.SessionTokenSequence = sessionEntry.SessionTokenSequence
+	forwardPacket.Header = packet.Header
+	forwardPacket.Payload = packet.Payload
+
+	batchConn := connection.batchConn
+
+	forwardPacketData := batchConn.WritePacket()
+
+	index = 0
+	forwardPacket.Write(forwardPacketData, &index)
+
+	forwardPacketBytes := index
+
+	batchConn.CommitPacket(forwardPacketBytes, config.ServerAddress)
+
+	if err := batchConn.Flush(); err != nil {
+		logger.ErrorLimited(gateway.forwardErrorLog, "failed to forward payload to server: %v", err)
+	}
+
+	if sessionEntry.Logger.DebugEnabled() {
+		sessionEntry.Logger.Debug("send %d byte packet to %s", forwardPacketBytes, config.ServerAddress.String())
+	}
+
+	// mark packet as received
+
+	sessionEntry.ReplayProtection.Advance(sequence)
+
+	return true
+}
+
+// newSession creates the session for the client from its first packet, and starts the goroutine that writes packets
+// to it. A session left behind by an earlier connection from the same client is taken over, and closed. The packet
+// must be newer than any the earlier connection forwarded, otherwise a replayed packet could take over a live session.
+// It returns false if the session can't be created.
+func (connection *browserConnection) newSession(sessionId [core.SessionIdBytes]byte, sequence uint64, sessionTokenSequence uint64, sessionTokenData *[core.EncryptedSessionTokenBytes]byte) bool {
+
+	gateway := connection.gateway
+	sessionToken := &connection.sessionToken
+
+	session := &browserSession{}
+	session.sessionId = sessionId
+	session.sendQueue = make(chan []byte, BrowserSendQueueSize)
+	session.done = make(chan struct{})
+
+	sessionEntry := &session.entry
+	sessionEntry.Logger = connection.logger.WithSession(sessionId[:])
+	core.CopyAddress(&sessionEntry.ClientAddress, connection.clientAddress)
+	sessionEntry.SharedKey = connection.sharedKey
+	sessionEntry.SessionTokenChannel = make(chan SessionTokenUpdate, 1)
+	sessionEntry.SessionTokenData = *sessionTokenData
+	sessionEntry.SessionTokenExpireTimestamp = sessionToken.ExpireTimestamp
+	sessionEntry.SessionTokenSequence = sessionTokenSequence
+	sessionEntry.ReceiveBandwidthBitsPerSecondMax = uint64(sessionToken.EnvelopeUpKbps * 1000.0)
+	sessionEntry.PacketsPerSecondMax = uint64(float32(sessionToken.PacketsPerSecond) * 1.1)
+	sessionEntry.ReceiveBandwidthBitsResetTime = gateway.clock.Now().Add(time.Second)
+
+	gateway.browserMutex.Lock()
+	previous := gateway.browserSessions[sessionId]
+	if previous != nil {
+		previous.mutex.Lock()
+		replayProtection := &previous.entry.ReplayProtection
+		if replayProtection.Initialized && int64(sequence-replayProtection.MostRecentSequence) <= 0 {
+			mostRecentSequence := replayProtection.MostRecentSequence
+			previous.mutex.Unlock()
+			gateway.browserMutex.Unlock()
+			connection.logger.Debug("packet %d is not newer than the live session's last packet %d", sequence, mostRecentSequence)
+			return false
+		}
+		sessionEntry.ReplayProtection = *replayProtection
+		previous.replaced = true
+		previous.mutex.Unlock()
+	}
+	gateway.browserSessions[sessionId] = session
+	gateway.browserMutex.Unlock()
+
+	if previous != nil {
+		previous.close()
+	}
+
+	connection.session = session
+
+	go connection.writer(session)
+
+	atomic.AddUint64(connection.sessionsCreated, 1)
+
+	sessionEntry.Logger.Info("new browser session")
+
+	return true
+}
+
+// writer writes queued packets to the client. Once the session is closed it writes what is left in the queue, so a
+// disconnect packet gets out, then closes the connection.
+func (connection *browserConnection) writer(session *browserSession) {
+
+	defer connection.closeConn()
+
+	pool := connection.gateway.browserPool
+
+	write := func(packetData []byte) bool {
+		err := connection.write(packetData)
+		pool.Put(packetData)
+		if err != nil {
+			session.entry.Logger.Debug("failed to write to browser: %v", err)
+			return false
+		}
+		return true
+	}
+
+	for {
+		select {
+		case packetData := <-session.sendQueue:
+			if !write(packetData) {
+				return
+			}
+		case <-session.done:
+			for {
+				select {
+				case packetData := <-session.sendQueue:
+					if !write(packetData) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (gateway *Gateway) removeBrowserSession(session *browserSession) {
+	gateway.browserMutex.Lock()
+	if gateway.browserSessions[session.sessionId] == session {
+		delete(gateway.browserSessions, session.sessionId)
+	}
+	gateway.browserMutex.Unlock()
+}
+
+func (gateway *Gateway) getBrowserSession(sessionId [core.SessionIdBytes]byte) *browserSession {
+	gateway.browserMutex.Lock()
+	session := gateway.browserSessions[sessionId]
+	gateway.browserMutex.Unlock()
+	return session
+}
+
+// browserThread reads packets from servers for browser clients, and queues them to be written to the client.
+func (gateway *Gateway) browserThread() {
+
+	defer gateway.internalWg.Done()
+
+	config := &gateway.config
+
+	gatewayId := gateway.gatewayId
+	gatewayAddress := config.GatewayAddress
+
+	logger := gateway.logger.With("socket", "browser")
+
+	batchConn := gateway.transport.NewPacketConn(gateway.browserSocket, config.BatchSize, MaxPacketSize)
+
+	pool := gateway.browserPool
+
+	// per-thread buffers, so forwarding a packet doesn't allocate
+
+	var disconnectPacket core.InternalDisconnectPacket
+	var payloadPacket core.InternalForwardPacket
+	var prefix core.PacketPrefix
+	disconnectPacket.ClientAddress.IP = make(net.IP, net.IPv6len)
+	payloadPacket.GatewayAddress.IP = make(net.IP, net.IPv6len)
+	payloadPacket.ClientAddress.IP = make(net.IP, net.IPv6len)
+
+	for {
+
+		numPackets, err := batchConn.ReadBatch()
+		if err != nil {
+			if gateway.isDraining() {
+				logger.Debug("browser internal socket closed")
+			} else {
+				logger.Error("failed to read browser internal udp packets: %v", err)
+			}
+			break
+		}
+
+		atomic.StoreInt64(&gateway.lastInternalPacketTime, time.Now().UnixNano())
+
+		for packetIndex := 0; packetIndex < numPackets; packetIndex++ {
+
+			packetData, from := batchConn.Packet(packetIndex)
+
+			packetBytes := len(packetData)
+
+			if logger.DebugEnabled() {
+				logger.Debug("recv internal %d byte packet from %s", packetBytes, from.String())
+			}
+
+			if packetBytes < core.VersionBytes+core.PacketTypeBytes {
+				logger.Debug("internal packet is too small")
+				continue
+			}
+
+			if packetData[0] != core.PacketVersion {
+				logger.Debug("unknown internal packet version: %d", packetData[0])
+				continue
+			}
+
+			// servers send a disconnect packet for each of their sessions when they shut down. pass it on to the client
+
+			if packetData[1] == core.PacketType_Disconnect {
+
+				index := 0
+				if !disconnectPacket.Read(packetData, &index) {
+					logger.Debug("bad internal disconnect packet (%d bytes)", packetBytes)
+					continue
+				}
+
+				session := gateway.getBrowserSession(disconnectPacket.SessionId)
+				if session == nil {
+					logger.Debug("disconnect for unknown browser session")
+					continue
+				}
+
+				clientDisconnectPacket := core.DisconnectPacket{Reason: disconnectPacket.Reason}
+				copy(clientDisconnectPacket.GatewayId[:], gatewayId)
+
+				disconnectPacketData := pool.Get()
+
+				disconnectPacketBytes := clientDisconnectPacket.Write(disconnectPacketData, session.entry.SharedKey[:], gatewayAddress, &session.entry.ClientAddress)
+
+				session.send(pool, disconnectPacketData[:disconnectPacketBytes])
+
+				session.entry.Logger.Debug("send %d byte disconnect packet (%s)", disconnectPacketBytes, core.DisconnectReasonString(disconnectPacket.Reason))
+
+				continue
+			}
+
+			if packetData[1] != core.PacketType_Payload {
+				logger.Debug("unknown internal packet type: %d", packetData[1])
+				continue
+			}
+
+			if !readInternalPayloadPacket(packetData, &payloadPacket) {
+				logger.Debug("bad internal payload packet (%d bytes)", packetBytes)
+				continue
+			}
+
+			session := gateway.getBrowserSession(payloadPacket.Header.SessionId)
+			if session == nil {
+				logger.Debug("payload for unknown browser session")
+				continue
+			}
+
+			// build the packet to send to the client. the packet filter is written like it is for UDP clients, so
+			// the packet format is the same, but the client doesn't need to check it
+
+			forwardPacketData := pool.Get()
+
+			forwardPacketBytes := writeClientPacket(forwardPacketData, &prefix, &payloadPacket, session.entry.SharedKey[:])
+			forwardPacketData = forwardPacketData[:forwardPacketBytes]
+
+			core.WritePacketFilter(forwardPacketData, gatewayAddress, &session.entry.ClientAddress)
+
+			session.send(pool, forwardPacketData)
+
+			if session.entry.Logger.DebugEnabled() {
+				session.entry.Logger.Debug("send %d byte packet to browser", forwardPacketBytes)
+			}
+		}
+	}
+}
+
+// disconnectBrowsers tells each browser client the gateway is shutting down, then closes its connection.
+func (gateway *Gateway) disconnectBrowsers() {
+
+	if gateway.browserSocket == nil {
+		return
+	}
+
+	pool := gateway.browserPool
+
+	disconnectPacket := core.DisconnectPacket{Reason: core.DisconnectReason_GatewayShutdown}
+	copy(disconnectPacket.GatewayId[:], gateway.gatewayId)
+
+	gateway.browserMutex.Lock()
+	for _, session := range gateway.browserSessions {
+		disconnectPacketData := pool.Get()
+		disconnectPacketBytes := disconnectPacket.Write(disconnectPacketData, session.entry.SharedKey[:], gateway.config.GatewayAddress, &session.entry.ClientAddress)
+		session.send(pool, disconnectPacketData[:disconnectPacketBytes])
+		session.close()
+	}
+	gateway.logger.Info("sent disconnect packets to %d browser sessions", len(gateway.browserSessions))
+	gateway.browserMutex.Unlock()
+}
@@ -0,0 +1,76 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gateway
+
+import (
+	"testing"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/stretchr/testify/assert"
+)
+
+// Fuzz targets for the packets the gateway parses. go test runs them over the seed corpus,
+// and go test -fuzz=FuzzReadClientPacket ./modules/gateway fuzzes one of them.
+
+func FuzzReadClientPacket(f *testing.F) {
+
+	for _, packetBytes := range []int{core.KeepalivePacketBytes - 1, core.KeepalivePacketBytes, core.MinPacketSize - 1, core.MinPacketSize, MaxPacketSize, MaxPacketSize + 1} {
+		for _, packetType := range []byte{core.PacketType_Payload, core.PacketType_Keepalive} {
+			for _, flags := range []byte{0, core.Flags_ChallengeToken} {
+				packetData := make([]byte, packetBytes)
+				if packetBytes > core.PrefixBytes+core.HeaderBytes {
+					packetData[1] = packetType
+					packetData[core.PrefixBytes+core.HeaderBytes-2] = packetType
+					packetData[core.PrefixBytes+core.HeaderBytes-1] = flags
+				}
+				f.Add(packetData)
+			}
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, packetData []byte) {
+
+		var packet clientPacket
+		if !readClientPacket(packetData, &packet) {
+			return
+		}
+		assert.Equal(t, len(packetData)-core.PayloadPacketEncryptIndex-core.PittleBytes, len(packet.EncryptedData))
+
+		if !readClientHeader(packetData, &packet) {
+			return
+		}
+		if packet.ChallengeTokenData != nil {
+			assert.Equal(t, core.EncryptedChallengeTokenBytes, len(packet.ChallengeTokenData))
+		}
+		if packet.Header.PacketType == core.PacketType_Keepalive {
+			assert.Equal(t, 0, len(packet.Payload))
+		} else {
+			assert.True(t, len(packet.Payload) >= core.MinPayloadBytes)
+		}
+
+		// the packet forwarded to the server has to fit
+
+		forwardPacket := core.InternalForwardPacket{Payload: packet.Payload}
+		assert.True(t, forwardPacket.Size() <= MaxPacketSize)
+	})
+}
@@ -0,0 +1,1342 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const MaxPacketSize = 1500
+const SessionMapSwapTime = 60
+const ChallengeTokenTimeout = 10
+const DisconnectResendTime = 100 * time.Millisecond
+const DrainQuietTime = 250 * time.Millisecond
+const QueueSize = 1024
+
+// Config is the gateway configuration that is fixed for the life of the gateway. Settings that can be
+// changed while it runs are in ReloadableConfig.
+type Config struct {
+	BindAddress            string
+	GatewayAddress         *net.UDPAddr
+	GatewayInternalAddress *net.UDPAddr
+	ServerAddress          *net.UDPAddr
+	AuthURL                string
+	NumThreads             int
+	ReadBuffer             int
+	WriteBuffer            int
+	BatchSize              int
+	KernelPacketFilter     bool
+	ShutdownTimeout        time.Duration
+	HTTPClient             *http.Client
+	Logger                 *core.Logger
+	Clock                  core.Clock
+	// BrowserInternalAddress is where servers send packets for browser clients, connected over WebSocket or
+	// WebRTC. Nil disables browser clients.
+	BrowserInternalAddress *net.UDPAddr
+	// WebRTCPublicIP replaces the local address in the gateway's WebRTC candidates, for gateways behind a 1:1 NAT.
+	WebRTCPublicIP string
+	// WebRTCPortMin and WebRTCPortMax limit the UDP ports WebRTC peers are given. Zero allows any port.
+	WebRTCPortMin uint16
+	WebRTCPortMax uint16
+}
+
+type SessionTokenUpdate struct {
+	SessionTokenData []byte
+	ExpireTimestamp  uint64
+}
+
+type SessionEntry struct {
+	Logger                           *core.Logger
+	ClientAddress                    net.UDPAddr
+	SharedKey                        [core.SharedKeyBytes_Box]byte
+	ReplayProtection                 core.ReplayProtection
+	UpdatingSessionToken             bool
+	SessionTokenChannel              chan SessionTokenUpdate
+	SessionTokenData                 [core.EncryptedSessionTokenBytes]byte
+	SessionTokenExpireTimestamp      uint64
+	SessionTokenSequence             uint64
+	SessionTokenCooldown             time.Time
+	SessionTokenRetryCount           int
+	ReceiveBandwidthBitsAccumulator  uint64
+	ReceiveBandwidthBitsPerSecondMax uint64
+	ReceiveBandwidthBitsResetTime    time.Time
+	PacketsReceivedInLastSecond      uint64
+	PacketsPerSecondMax              uint64
+	DisconnectSendTime               time.Time
+}
+
+type Counters struct {
+	ChallengePacketsSent       uint64
+	PrefilterShedPerAddress    uint64
+	PrefilterShedPerSession    uint64
+	PrefilterShedGlobal        uint64
+	SessionsCreated            uint64
+	SessionTokenUpdates        uint64
+	SessionTokenUpdateFailures uint64
+	WebSocketSessionsCreated   uint64
+	WebRTCSessionsCreated      uint64
+}
+
+// Prefilter rate limits packets for sessions that don't have a session entry yet. These cost crypto work
+// and may trigger a challenge packet, so they are limited per-source address, per-session id and globally.
+type Prefilter struct {
+	PerAddress          *core.RateLimiter
+	PerSession          *core.RateLimiter
+	Global              core.TokenBucket
+	GlobalRatePerSecond float64
+	counters            *Counters
+}
+
+func NewPrefilter(perAddressRate float64, perSessionRate float64, globalRate float64, counters *Counters) *Prefilter {
+	prefilter := &Prefilter{}
+	prefilter.PerAddress = core.NewRateLimiter(perAddressRate, perAddressRate)
+	prefilter.PerSession = core.NewRateLimiter(perSessionRate, perSessionRate)
+	prefilter.GlobalRatePerSecond = globalRate
+	prefilter.counters = counters
+	return prefilter
+}
+
+// SetRates changes the rates without resetting any buckets, so reloading the config doesn't let a burst through.
+func (prefilter *Prefilter) SetRates(perAddressRate float64, perSessionRate float64, globalRate float64) {
+	prefilter.PerAddress.RatePerSecond = perAddressRate
+	prefilter.PerAddress.Burst = perAddressRate
+	prefilter.PerSession.RatePerSecond = perSessionRate
+	prefilter.PerSession.Burst = perSessionRate
+	prefilter.GlobalRatePerSecond = globalRate
+}
+
+// Allow returns true if a packet can go through, and takes a token from each bucket for it. Every bucket is checked
+// before any token is taken, so a packet shed for its session or globally doesn't spend its address's budget, and a
+// flood for one session id can't starve the addresses it spoofs.
+func (prefilter *Prefilter) Allow(from *net.UDPAddr, sessionId [core.SessionIdBytes]byte, currentTime time.Time) bool {
+	perAddress := prefilter.PerAddress.Bucket(core.AddressKey(from), currentTime)
+	if !perAddress.Refill(currentTime, prefilter.PerAddress.RatePerSecond, prefilter.PerAddress.Burst) {
+		atomic.AddUint64(&prefilter.counters.PrefilterShedPerAddress, 1)
+		core.Debug("prefilter shed packet from %s", from.String())
+		return false
+	}
+	perSession := prefilter.PerSession.Bucket(core.RateLimiterKey(sessionId), currentTime)
+	if !perSession.Refill(currentTime, prefilter.PerSession.RatePerSecond, prefilter.PerSession.Burst) {
+		atomic.AddUint64(&prefilter.counters.PrefilterShedPerSession, 1)
+		core.Debug("prefilter shed packet for session %s", core.IdString(sessionId[:]))
+		return false
+	}
+	if !prefilter.Global.Refill(currentTime, prefilter.GlobalRatePerSecond, prefilter.GlobalRatePerSecond) {
+		atomic.AddUint64(&prefilter.counters.PrefilterShedGlobal, 1)
+		core.Debug("prefilter shed packet (global)")
+		return false
+	}
+	perAddress.Tokens -= 1
+	perSession.Tokens -= 1
+	prefilter.Global.Tokens -= 1
+	return true
+}
+
+// sharedKeyCache holds the key each session shares with its client, as the public threads decrypted it. Packets
+// from servers can arrive on any internal thread, and must be encrypted with the key the client has, which is
+// from before the last reload for sessions that connected with an older connect token. Entries time out the same
+// way as sessions, and the public threads store them again as their sessions move to a new session map.
+type sharedKeyCache struct {
+	mutex      sync.Mutex
+	keyMap_Old map[[core.SessionIdBytes]byte][core.SharedKeyBytes_Box]byte
+	keyMap_New map[[core.SessionIdBytes]byte][core.SharedKeyBytes_Box]byte
+	swapTime   int64
+}
+
+func newSharedKeyCache(currentTime int64) *sharedKeyCache {
+	cache := &sharedKeyCache{}
+	cache.keyMap_Old = make(map[[core.SessionIdBytes]byte][core.SharedKeyBytes_Box]byte)
+	cache.keyMap_New = make(map[[core.SessionIdBytes]byte][core.SharedKeyBytes_Box]byte)
+	cache.swapTime = currentTime + SessionMapSwapTime
+	return cache
+}
+
+// swap times out the keys that haven't been stored since the last swap. Call with the mutex held.
+func (cache *sharedKeyCache) swap(currentTime int64) {
+	if currentTime >= cache.swapTime {
+		cache.swapTime = currentTime + SessionMapSwapTime
+		cache.keyMap_Old = cache.keyMap_New
+		cache.keyMap_New = make(map[[core.SessionIdBytes]byte][core.SharedKeyBytes_Box]byte)
+	}
+}
+
+func (cache *sharedKeyCache) store(sessionId [core.SessionIdBytes]byte, sharedKey *[core.SharedKeyBytes_Box]byte, currentTime int64) {
+	cache.mutex.Lock()
+	cache.swap(currentTime)
+	cache.keyMap_New[sessionId] = *sharedKey
+	cache.mutex.Unlock()
+}
+
+func (cache *sharedKeyCache) load(sessionId [core.SessionIdBytes]byte, currentTime int64) ([core.SharedKeyBytes_Box]byte, bool) {
+	cache.mutex.Lock()
+	cache.swap(currentTime)
+	sharedKey, ok := cache.keyMap_New[sessionId]
+	if !ok {
+		sharedKey, ok = cache.keyMap_Old[sessionId]
+	}
+	cache.mutex.Unlock()
+	return sharedKey, ok
+}
+
+// ReloadableConfig holds the settings that are reloaded on SIGHUP. Threads pick up a new one at the start
+// of each batch. The keys from before the last reload are kept in Previous, so session tokens and connect
+// tokens issued before a key rotation are still accepted, and existing sessions aren't dropped.
+type ReloadableConfig struct {
+	GatewayPrivateKey       []byte
+	AuthPublicKey           []byte
+	ChallengeRatePerAddress float64
+	ChallengeRatePerSession float64
+	ChallengeRateGlobal     float64
+	Previous                *ReloadableConfig
+}
+
+// Gateway forwards packets between clients and servers. Each thread has a public socket that clients send
+// to, and an internal socket that servers send to. Packets for clients go out through the public socket.
+type Gateway struct {
+	counters               Counters
+	lastInternalPacketTime int64
+	draining               uint32
+	drainedThreads         int32
+	config                 Config
+	transport              core.Transport
+	logger                 *core.Logger
+	clock                  core.Clock
+	httpClient             *http.Client
+	reloadableConfig       atomic.Value
+	gatewayId              []byte
+	challengePrivateKey    []byte
+	forwardErrorLog        *core.LogLimiter
+	sharedKeys             *sharedKeyCache
+	publicSocket           []core.Socket
+	internalSocket         []core.Socket
+	browserStarted         uint32
+	browserSocket          core.Socket
+	browserPool            *core.PacketPool
+	browserMutex           sync.Mutex
+	browserSessions        map[[core.SessionIdBytes]byte]*browserSession
+	webRTCPeers            map[[core.SessionIdBytes]byte]int
+	webRTC                 *webrtc.API
+	wg                     sync.WaitGroup
+	internalWg             sync.WaitGroup
+}
+
+func New(config *Config, reloadable *ReloadableConfig, transport core.Transport) *Gateway {
+	gateway := &Gateway{config: *config, transport: transport}
+	gateway.logger = config.Logger
+	if gateway.logger == nil {
+		gateway.logger = core.Log
+	}
+	gateway.clock = config.Clock
+	if gateway.clock == nil {
+		gateway.clock = core.SystemClock
+	}
+	gateway.httpClient = config.HTTPClient
+	if gateway.httpClient == nil {
+		gateway.httpClient = &http.Client{
+			Timeout: time.Second,
+			Transport: &http.Transport{
+				Dial:                (&net.Dialer{Timeout: time.Second}).Dial,
+				TLSHandshakeTimeout: time.Second,
+			},
+		}
+	}
+	gateway.reloadableConfig.Store(reloadable)
+	gateway.gatewayId = core.RandomBytes(core.GatewayIdBytes)
+	gateway.challengePrivateKey = core.Keygen_SecretBox()
+	// errors sending packets repeat for every batch until the socket recovers, so they are logged at most once per second
+	gateway.forwardErrorLog = core.NewLogLimiter(time.Second)
+	gateway.sharedKeys = newSharedKeyCache(gateway.clock.Now().Unix())
+	return gateway
+}
+
+func (gateway *Gateway) Id() []byte {
+	return gateway.gatewayId
+}
+
+func (gateway *Gateway) Counters() Counters {
+	counters := Counters{}
+	counters.ChallengePacketsSent = atomic.LoadUint64(&gateway.counters.ChallengePacketsSent)
+	counters.PrefilterShedPerAddress = atomic.LoadUint64(&gateway.counters.PrefilterShedPerAddress)
+	counters.PrefilterShedPerSession = atomic.LoadUint64(&gateway.counters.PrefilterShedPerSession)
+	counters.PrefilterShedGlobal = atomic.LoadUint64(&gateway.counters.PrefilterShedGlobal)
+	counters.SessionsCreated = atomic.LoadUint64(&gateway.counters.SessionsCreated)
+	counters.SessionTokenUpdates = atomic.LoadUint64(&gateway.counters.SessionTokenUpdates)
+	counters.SessionTokenUpdateFailures = atomic.LoadUint64(&gateway.counters.SessionTokenUpdateFailures)
+	counters.WebSocketSessionsCreated = atomic.LoadUint64(&gateway.counters.WebSocketSessionsCreated)
+	counters.WebRTCSessionsCreated = atomic.LoadUint64(&gateway.counters.WebRTCSessionsCreated)
+	return counters
+}
+
+// Reload swaps in new keys and rates. Sessions are kept, and keep the shared keys they connected with.
+func (gateway *Gateway) Reload(reloadable *ReloadableConfig) {
+	previous := gateway.reloadableConfig.Load().(*ReloadableConfig)
+	reloadable.Previous = &ReloadableConfig{GatewayPrivateKey: previous.GatewayPrivateKey, AuthPublicKey: previous.AuthPublicKey}
+	gateway.reloadableConfig.Store(reloadable)
+}
+
+func (gateway *Gateway) isDraining() bool {
+	return atomic.LoadUint32(&gateway.draining) != 0
+}
+
+// Start binds the public and internal sockets and starts the threads.
+func (gateway *Gateway) Start() error {
+
+	config := &gateway.config
+
+	gateway.logger.Info("starting gateway on %s", config.BindAddress)
+
+	gateway.logger.Info("gateway id is %s", core.IdString(gateway.gatewayId))
+
+	// listen on public address
+
+	publicOptions := core.SocketOptions{ReadBuffer: config.ReadBuffer, WriteBuffer: config.WriteBuffer, ReusePort: true}
+
+	if config.KernelPacketFilter {
+		gateway.logger.Info("kernel packet filter is enabled")
+		publicOptions.PacketFilter = core.BasicPacketFilterProgram(core.UDPHeaderBytes, core.KeepalivePacketBytes)
+	}
+
+	gateway.publicSocket = make([]core.Socket, config.NumThreads)
+
+	for i := 0; i < config.NumThreads; i++ {
+		socket, err := gateway.transport.Listen(config.BindAddress, publicOptions)
+		if err != nil {
+			gateway.closeSockets()
+			return fmt.Errorf("could not bind socket: %v", err)
+		}
+		gateway.publicSocket[i] = socket
+	}
+
+	// listen on internal address
+
+	internalOptions := core.SocketOptions{ReadBuffer: config.ReadBuffer, WriteBuffer: config.WriteBuffer, ReusePort: true}
+
+	gateway.internalSocket = make([]core.Socket, config.NumThreads)
+
+	for i := 0; i < config.NumThreads; i++ {
+		socket, err := gateway.transport.Listen(config.GatewayInternalAddress.String(), internalOptions)
+		if err != nil {
+			gateway.closeSockets()
+			return fmt.Errorf("could not bind internal socket: %v", err)
+		}
+		gateway.internalSocket[i] = socket
+	}
+
+	// listen on browser internal address
+
+	if config.BrowserInternalAddress != nil {
+		webRTC, err := gateway.newWebRTCAPI()
+		if err != nil {
+			gateway.closeSockets()
+			return fmt.Errorf("could not configure webrtc: %v", err)
+		}
+		socket, err := gateway.transport.Listen(config.BrowserInternalAddress.String(), internalOptions)
+		if err != nil {
+			gateway.closeSockets()
+			return fmt.Errorf("could not bind browser internal socket: %v", err)
+		}
+		gateway.browserSocket = socket
+		gateway.browserPool = core.NewPacketPool(QueueSize, MaxPacketSize)
+		gateway.browserSessions = make(map[[core.SessionIdBytes]byte]*browserSession)
+		gateway.webRTCPeers = make(map[[core.SessionIdBytes]byte]int)
+		gateway.webRTC = webRTC
+		gateway.logger.Info("accepting browser clients, internal address is %s", config.BrowserInternalAddress)
+	}
+
+	gateway.wg.Add(config.NumThreads)
+	gateway.internalWg.Add(config.NumThreads)
+
+	for i := 0; i < config.NumThreads; i++ {
+		go gateway.publicThread(i)
+		go gateway.internalThread(i)
+	}
+
+	if gateway.browserSocket != nil {
+		gateway.internalWg.Add(1)
+		go gateway.browserThread()
+		atomic.StoreUint32(&gateway.browserStarted, 1)
+	}
+
+	return nil
+}
+
+func (gateway *Gateway) closeSockets() {
+	for i := range gateway.publicSocket {
+		if gateway.publicSocket[i] != nil {
+			gateway.publicSocket[i].Close()
+		}
+	}
+	for i := range gateway.internalSocket {
+		if gateway.internalSocket[i] != nil {
+			gateway.internalSocket[i].Close()
+		}
+	}
+	if gateway.browserSocket != nil {
+		gateway.browserSocket.Close()
+	}
+}
+
+// clientPacket is a payload or keepalive packet from a client. Only the prefix, and the session id and sequence at the start of the
+// header, can be read before the packet is decrypted. The rest of the header is read by readClientHeader once it is.
+type clientPacket struct {
+	Prefix             core.PacketPrefix
+	Header             core.PayloadHeader
+	EncryptedData      []byte
+	ChallengeTokenData []byte
+	Payload            []byte
+}
+
+// readClientPacket splits up a payload or keepalive packet from a client. The encrypted data and payload point into the
+// packet data. The packet filters are checked by the caller. It returns false if the packet is too small or too large.
+func readClientPacket(packetData []byte, packet *clientPacket) bool {
+	packetBytes := len(packetData)
+	if packetBytes < core.KeepalivePacketBytes || packetBytes > MaxPacketSize {
+		return false
+	}
+	index := 0
+	if !core.ReadObject(packetData, &index, &packet.Prefix) || !core.ReadObject(packetData, &index, &packet.Header) {
+		return false
+	}
+	packet.EncryptedData = packetData[core.PayloadPacketEncryptIndex : packetBytes-core.PittleBytes]
+	packet.ChallengeTokenData = nil
+	packet.Payload = packetData[index : packetBytes-core.PostfixBytes]
+	return true
+}
+
+// readClientHeader reads the header of a client packet once it has been decrypted, and splits the challenge token off
+// the front of the payload if the client sent one. It returns false if the payload is too small to hold the challenge
+// token, or the wrong size for the packet type: payloads are padded to MinPayloadBytes, so responses to them are never
+// larger, and keepalives have no payload.
+func readClientHeader(packetData []byte, packet *clientPacket) bool {
+	index := core.PrefixBytes
+	core.ReadObject(packetData, &index, &packet.Header)
+	if packet.Header.Flags&core.Flags_ChallengeToken != 0 {
+		if len(packet.Payload) < core.EncryptedChallengeTokenBytes {
+			return false
+		}
+		packet.ChallengeTokenData = packet.Payload[:core.EncryptedChallengeTokenBytes]
+		packet.Payload = packet.Payload[core.EncryptedChallengeTokenBytes:]
+	}
+	if packet.Header.PacketType == core.PacketType_Keepalive {
+		return len(packet.Payload) == 0
+	}
+	return len(packet.Payload) >= core.MinPayloadBytes && len(packet.Payload) <= core.MaxPayloadBytes
+}
+
+func (gateway *Gateway) publicThread(thread int) {
+	config := &gateway.config
+	clock := gateway.clock
+
+	gatewayId := gateway.gatewayId
+	gatewayAddress := config.GatewayAddress
+	gatewayInternalAddress := config.GatewayInternalAddress
+	serverAddress := config.ServerAddress
+	numThreads := config.NumThreads
+	challengePrivateKey := gateway.challengePrivateKey
+
+	socket := gateway.publicSocket[thread]
+
+	defer socket.Close()
+
+	logger := gateway.logger.With("thread", thread)
+
+	batchConn := gateway.transport.NewPacketConn(socket, config.BatchSize, MaxPacketSize)
+
+	sessionMap_Old := make(map[[core.SessionIdBytes]byte]*SessionEntry)
+	sessionMap_New := make(map[[core.SessionIdBytes]byte]*SessionEntry)
+
+	swapTime := clock.Now().Unix() + SessionMapSwapTime
+	swapCount := 0
+
+	// each thread gets its own prefilter, so the global rate is split across threads
+
+	reloadable := gateway.reloadableConfig.Load().(*ReloadableConfig)
+
+	prefilter := NewPrefilter(reloadable.ChallengeRatePerAddress, reloadable.ChallengeRatePerSession, reloadable.ChallengeRateGlobal/float64(numThreads), &gateway.counters)
+
+	// per-thread buffers, so forwarding a packet doesn't allocate
+
+	var nonce [core.NonceBytes_Box]byte
+	var sharedKey [core.SharedKeyBytes_Box]byte
+	var packet clientPacket
+	var sessionTokenData [core.EncryptedSessionTokenBytes]byte
+	var sessionToken core.SessionToken
+	var challengeToken core.ChallengeToken
+	var challengePacket core.ChallengePacket
+	var forwardPacket core.InternalForwardPacket
+	challengeToken.ClientAddress.IP = make(net.IP, net.IPv6len)
+
+	sentDisconnectPackets := false
+
+	for {
+
+		numPackets, err := batchConn.ReadBatch()
+		if err != nil {
+			if !core.IsTimeout(err) {
+				logger.Debug("failed to read udp packets: %v", err)
+				break
+			}
+			// woken up to start draining
+			socket.SetReadDeadline(time.Time{})
+			numPackets = 0
+		}
+
+		// once draining, tell every session on this thread to reconnect through another gateway
+
+		if !sentDisconnectPackets && gateway.isDraining() {
+			for sessionId, sessionEntry := range sessionMap_Old {
+				if sessionMap_New[sessionId] == nil {
+					sessionMap_New[sessionId] = sessionEntry
+				}
+			}
+			currentTime := clock.Now()
+			for _, sessionEntry := range sessionMap_New {
+				gateway.sendDisconnectPacket(batchConn, sessionEntry, currentTime)
+			}
+			if err := batchConn.Flush(); err != nil {
+				logger.Error("failed to send disconnect packets: %v", err)
+			}
+			logger.Info("sent disconnect packets to %d sessions", len(sessionMap_New))
+			sentDisconnectPackets = true
+			atomic.AddInt32(&gateway.drainedThreads, 1)
+		}
+
+		// pick up settings reloaded on SIGHUP
+
+		if current := gateway.reloadableConfig.Load().(*ReloadableConfig); current != reloadable {
+			reloadable = current
+			prefilter.SetRates(reloadable.ChallengeRatePerAddress, reloadable.ChallengeRatePerSession, reloadable.ChallengeRateGlobal/float64(numThreads))
+		}
+
+		for packetIndex := 0; packetIndex < numPackets; packetIndex++ {
+
+			packetData, from := batchConn.Packet(packetIndex)
+
+			packetBytes := len(packetData)
+
+			swapCount++
+			if swapCount > 100 {
+				currentTime := clock.Now().Unix()
+				if currentTime >= swapTime {
+					swapCount = 0
+					swapTime = currentTime + SessionMapSwapTime
+					sessionMap_Old = sessionMap_New
+					sessionMap_New = make(map[[core.SessionIdBytes]byte]*SessionEntry)
+				}
+			}
+
+			if !readClientPacket(packetData, &packet) {
+				logger.Debug("bad packet size: %d", packetBytes)
+				continue
+			}
+
+			if logger.DebugEnabled() {
+				logger.Debug("recv %d byte packet from %s", packetBytes, from)
+			}
+
+			// drop unknown packet versions
+
+			if packetData[0] != core.PacketVersion {
+				logger.Debug("unknown packet version: %d", packetData[0])
+				continue
+			}
+
+			// packet filter
+
+			if !core.BasicPacketFilter(packetData, packetBytes) {
+				logger.Debug("basic packet filter failed")
+				continue
+			}
+
+			var magic [8]byte
+
+			var fromAddressData [4]byte
+			var fromAddressPort uint16
+
+			var toAddressData [4]byte
+			var toAddressPort uint16
+
+			core.GetAddressData(from, fromAddressData[:], &fromAddressPort)
+			core.GetAddressData(gatewayAddress, toAddressData[:], &toAddressPort)
+
+			if !core.AdvancedPacketFilter(packetData, magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, packetBytes) {
+				logger.Debug("advanced packet filter failed")
+				continue
+			}
+
+			// prefilter packets for sessions we don't know about before doing any crypto work
+
+			sessionId := packet.Header.SessionId
+			senderPublicKey := sessionId[:]
+
+			if sessionMap_New[sessionId] == nil && sessionMap_Old[sessionId] == nil {
+				if gateway.isDraining() {
+					logger.Debug("draining, ignoring packet for new session")
+					continue
+				}
+				if !prefilter.Allow(from, sessionId, clock.Now()) {
+					continue
+				}
+			}
+
+			sessionEntry := sessionMap_New[sessionId]
+			if sessionEntry == nil {
+				sessionEntry = sessionMap_Old[sessionId]
+			}
+
+			// verify session token. a session entry keeps the token it was verified with, so packets carrying that token
+			// don't pay to decrypt it again. other tokens are decrypted in place, so decrypt a copy and keep the encrypted
+			// data for the session entry
+
+			sessionTokenSequence := packet.Prefix.SessionTokenSequence
+
+			if sessionEntry != nil && packet.Prefix.SessionTokenData == sessionEntry.SessionTokenData {
+
+				if sessionEntry.SessionTokenExpireTimestamp < uint64(clock.Now().Unix()) {
+					logger.Debug("session token has expired")
+					continue
+				}
+
+			} else {
+
+				sessionTokenData = packet.Prefix.SessionTokenData
+
+				if !readSessionToken(reloadable, sessionTokenData[:], &sessionToken) {
+					logger.Debug("could not decrypt session token")
+					continue
+				}
+
+				if sessionToken.ExpireTimestamp < uint64(clock.Now().Unix()) {
+					logger.Debug("session token has expired")
+					continue
+				}
+
+				if !core.IdEqual(sessionToken.SessionId[:], sessionId[:]) {
+					logger.Debug("session id mismatch")
+					continue
+				}
+			}
+
+			// decrypt packet. the key shared with the client is cached in the session entry, so only new sessions pay for the key exchange
+
+			if sessionEntry != nil {
+				sharedKey = sessionEntry.SharedKey
+			} else {
+				core.SharedKey_Box(senderPublicKey, reloadable.GatewayPrivateKey, sharedKey[:])
+			}
+
+			encryptedData := packet.EncryptedData
+
+			nonce = [core.NonceBytes_Box]byte{}
+			index := 0
+			core.WriteUint64(nonce[:], &index, packet.Header.Sequence)
+
+			err = core.Decrypt_SharedBox(sharedKey[:], nonce[:], encryptedData, len(encryptedData))
+			if err != nil && sessionEntry == nil && reloadable.Previous != nil {
+				// the client may have a connect token for the gateway key from before the last reload
+				core.SharedKey_Box(senderPublicKey, reloadable.Previous.GatewayPrivateKey, sharedKey[:])
+				err = core.Decrypt_SharedBox(sharedKey[:], nonce[:], encryptedData, len(encryptedData))
+			}
+			if err != nil {
+				logger.Debug("could not decrypt payload packet")
+				continue
+			}
+
+			// split packet into various pieces
+
+			if !readClientHeader(packetData, &packet) {
+				logger.Debug("bad payload size: %d", len(packet.Payload))
+				continue
+			}
+
+			payload := packet.Payload
+
+			// ignore packet types we don't support. the type in the prefix is sent in the clear, so it must match
+
+			if packet.Header.PacketType != core.PacketType_Payload && packet.Header.PacketType != core.PacketType_Keepalive || packet.Header.PacketType != packet.Prefix.PacketType {
+				logger.Debug("invalid packet type: %d", packet.Header.PacketType)
+				continue
+			}
+
+			keepalive := packet.Header.PacketType == core.PacketType_Keepalive
+
+			sequence := packet.Header.Sequence
+			packetGatewayId := packet.Header.GatewayId
+
+			challengeTokenData := packet.ChallengeTokenData
+			hasChallengeToken := challengeTokenData != nil
+
+			// clear flags in header
+
+			packet.Header.Flags = 0
+
+			// process payload packet
+
+			if logger.DebugEnabled() {
+				logger.Debug("payload is %d bytes", len(payload))
+			}
+
+			if sessionEntry != nil && sessionMap_New[sessionId] == nil {
+				// migrate old -> new session map
+				sessionMap_New[sessionId] = sessionEntry
+				gateway.sharedKeys.store(sessionId, &sessionEntry.SharedKey, clock.Now().Unix())
+			}
+
+			if sessionEntry == nil {
+
+				// *** no session entry ***
+
+				if keepalive {
+
+					// keepalives are smaller than challenge packets, so they don't get a response that could be used for amplification
+
+					logger.Debug("keepalive for unknown session")
+
+				} else if hasChallengeToken {
+
+					// payload packet has a challenge token (challenge/response)
+
+					index := 0
+					result := core.ReadEncryptedChallengeToken(challengeTokenData, &index, &challengeToken, challengePrivateKey)
+					if !result {
+						logger.Debug("challenge token did not decrypt")
+						continue
+					}
+
+					if challengeToken.ExpireTimestamp <= uint64(clock.Now().Unix()) {
+						logger.Debug("challenge token expired")
+						continue
+					}
+
+					if !core.AddressEqual(&challengeToken.ClientAddress, from) {
+						logger.Debug("challenge token client address mismatch")
+						continue
+					}
+
+					var sessionId [core.SessionIdBytes]byte
+					for i := 0; i < core.SessionIdBytes; i++ {
+						sessionId[i] = senderPublicKey[i]
+					}
+
+					// create new session entry
+
+					sessionEntry := &SessionEntry{}
+
+					sessionEntry.Logger = logger.WithSession(sessionId[:]).With("client", from.String())
+
+					core.CopyAddress(&sessionEntry.ClientAddress, from)
+
+					sessionEntry.SharedKey = sharedKey
+
+					sessionEntry.ReplayProtection.Reset(challengeToken.Sequence)
+					sessionEntry.ReplayProtection.Advance(sequence)
+
+					sessionEntry.SessionTokenChannel = make(chan SessionTokenUpdate, 1)
+					copy(sessionEntry.SessionTokenData[:], packet.Prefix.SessionTokenData[:])
+					sessionEntry.SessionTokenExpireTimestamp = sessionToken.ExpireTimestamp
+					sessionEntry.SessionTokenSequence = sessionTokenSequence
+					sessionEntry.ReceiveBandwidthBitsPerSecondMax = uint64(sessionToken.EnvelopeUpKbps * 1000.0)
+					sessionEntry.PacketsPerSecondMax = uint64(float32(sessionToken.PacketsPerSecond) * 1.1)
+
+					sessionEntry.ReceiveBandwidthBitsResetTime = clock.Now().Add(time.Second)
+
+					sessionMap_New[sessionId] = sessionEntry
+
+					gateway.sharedKeys.store(sessionId, &sharedKey, clock.Now().Unix())
+
+					atomic.AddUint64(&gateway.counters.SessionsCreated, 1)
+
+					sessionEntry.Logger.Info("new session")
+
+				} else {
+
+					// respond with a challenge
+
+					challengeToken.ExpireTimestamp = uint64(clock.Now().Unix() + ChallengeTokenTimeout)
+					core.CopyAddress(&challengeToken.ClientAddress, from)
+					challengeToken.Sequence = sequence
+
+					index := 0
+					core.WriteEncryptedChallengeToken(challengePacket.ChallengeTokenData[:], &index, &challengeToken, challengePrivateKey)
+					challengePacket.Sequence = sequence
+					copy(challengePacket.GatewayId[:], gatewayId)
+
+					challengePacketData := batchConn.WritePacket()
+
+					challengePacketBytes := challengePacket.Write(challengePacketData, sharedKey[:], gatewayAddress, from)
+
+					// send it to the client
+
+					batchConn.CommitPacket(challengePacketBytes, from)
+
+					atomic.AddUint64(&gateway.counters.ChallengePacketsSent, 1)
+
+					logger.Debug("send %d byte challenge packet to %s", challengePacketBytes, from.String())
+
+				}
+
+				continue
+			}
+
+			// drop packets without the correct gateway id
+
+			if !core.IdEqual(packetGatewayId[:], gatewayId[:]) {
+				sessionEntry.Logger.Debug("wrong gateway id")
+				continue
+			}
+
+			// drop packets that are too old, too far ahead, or have already been forwarded to the server
+
+			switch sessionEntry.ReplayProtection.Check(sequence) {
+			case core.ReplayProtection_TooOld:
+				sessionEntry.Logger.Debug("sequence number is too old: %d", sequence)
+				continue
+			case core.ReplayProtection_TooNew:
+				sessionEntry.Logger.Debug("sequence number is too far ahead: %d", sequence)
+				continue
+			case core.ReplayProtection_Duplicate:
+				sessionEntry.Logger.Debug("packet %d has already been forwarded to the server", sequence)
+				continue
+			}
+
+			// clients that missed their disconnect packet keep sending, so send it again
+
+			core.CopyAddress(&sessionEntry.ClientAddress, from)
+
+			if sentDisconnectPackets && clock.Now().Sub(sessionEntry.DisconnectSendTime) >= DisconnectResendTime {
+				gateway.sendDisconnectPacket(batchConn, sessionEntry, clock.Now())
+			}
+
+			// does this packet fit in the session's bandwidth and packets per-second envelope?
+
+			if !sessionEntry.allowPacket(packetBytes, clock.Now()) {
+				continue
+			}
+
+			// update session token
+
+			gateway.updateSessionEntry(sessionEntry, reloadable, &packet.Prefix.SessionTokenData)
+
+			// forward payload packet to server
+
+			forwardPacket.GatewayAddress = *gatewayInternalAddress
+			forwardPacket.ClientAddress = *from
+			forwardPacket.SessionTokenData = sessionEntry.SessionTokenData
+			forwardPacket.SessionTokenSequence = sessionEntry.SessionTokenSequence
+			forwardPacket.Header = packet.Header
+			forwardPacket.Payload = payload
+
+			forwardPacketData := batchConn.WritePacket()
+
+			index = 0
+			forwardPacket.Write(forwardPacketData, &index)
+
+			forwardPacketBytes := index
+
+			batchConn.CommitPacket(forwardPacketBytes, serverAddress)
+
+			if sessionEntry.Logger.DebugEnabled() {
+				sessionEntry.Logger.Debug("send %d byte packet to %s", forwardPacketBytes, serverAddress.String())
+			}
+
+			// mark packet as received
+
+			sessionEntry.ReplayProtection.Advance(sequence)
+		}
+
+		// send packets generated by this batch
+
+		if err := batchConn.Flush(); err != nil {
+			logger.ErrorLimited(gateway.forwardErrorLog, "failed to forward payload to server: %v", err)
+		}
+	}
+
+	gateway.wg.Done()
+
+}
+
+// readSessionToken decrypts a copy of a session token. Tokens issued before the keys were last reloaded are still accepted.
+func readSessionToken(reloadable *ReloadableConfig, sessionTokenData []byte, sessionToken *core.SessionToken) bool {
+	index := 0
+	result := core.ReadEncryptedSessionToken(sessionTokenData, &index, sessionToken, reloadable.AuthPublicKey, reloadable.GatewayPrivateKey)
+	if !result && reloadable.Previous != nil {
+		// a failed decrypt leaves the data untouched
+		index = 0
+		result = core.ReadEncryptedSessionToken(sessionTokenData, &index, sessionToken, reloadable.Previous.AuthPublicKey, reloadable.Previous.GatewayPrivateKey)
+	}
+	return result
+}
+
+// allowPacket checks a packet from the client against the bandwidth and packets per-second in its session token,
+// and counts it if it fits.
+func (sessionEntry *SessionEntry) allowPacket(packetBytes int, currentTime time.Time) bool {
+
+	if sessionEntry.ReceiveBandwidthBitsResetTime.Before(currentTime) {
+		receiveBandwidthMbps := float64(sessionEntry.ReceiveBandwidthBitsAccumulator) / 1000000.0
+		sessionEntry.ReceiveBandwidthBitsResetTime = currentTime.Add(time.Second)
+		sessionEntry.ReceiveBandwidthBitsAccumulator = 0
+		sessionEntry.PacketsReceivedInLastSecond = 0
+		sessionEntry.Logger.Debug("session is %.2f mbps", receiveBandwidthMbps)
+	}
+
+	wireBits := uint64(core.WirePacketBits(packetBytes))
+
+	if sessionEntry.ReceiveBandwidthBitsAccumulator+wireBits > sessionEntry.ReceiveBandwidthBitsPerSecondMax {
+		sessionEntry.Logger.Debug("choke bw")
+		return false
+	}
+
+	sessionEntry.ReceiveBandwidthBitsAccumulator += wireBits
+
+	if sessionEntry.PacketsReceivedInLastSecond > sessionEntry.PacketsPerSecondMax {
+		sessionEntry.Logger.Debug("choke pps")
+		return false
+	}
+
+	sessionEntry.PacketsReceivedInLastSecond++
+
+	return true
+}
+
+// updateSessionEntry asks auth for a new session token when the session's token is about to expire, and picks up
+// the new token once it arrives. The server passes it on to the client in the prefix of its next packet.
+func (gateway *Gateway) updateSessionEntry(sessionEntry *SessionEntry, reloadable *ReloadableConfig, sessionTokenData *[core.EncryptedSessionTokenBytes]byte) {
+
+	clock := gateway.clock
+
+	if sessionEntry.SessionTokenExpireTimestamp-uint64(10) <= uint64(clock.Now().Unix()) && !sessionEntry.UpdatingSessionToken && sessionEntry.SessionTokenCooldown.Before(clock.Now()) {
+
+		sessionEntry.UpdatingSessionToken = true
+
+		if sessionEntry.SessionTokenRetryCount == 0 {
+			sessionEntry.Logger.Debug("updating session token")
+		} else {
+			sessionEntry.Logger.Debug("updating session token retry #%d", sessionEntry.SessionTokenRetryCount)
+		}
+
+		go gateway.updateSessionToken(sessionEntry.Logger, reloadable, sessionEntry.SessionTokenChannel, *sessionTokenData)
+	}
+
+	if sessionEntry.UpdatingSessionToken {
+		select {
+		case update := <-sessionEntry.SessionTokenChannel:
+			if len(update.SessionTokenData) != 0 {
+				copy(sessionEntry.SessionTokenData[:], update.SessionTokenData[:])
+				sessionEntry.SessionTokenExpireTimestamp = update.ExpireTimestamp
+				sessionEntry.SessionTokenSequence++
+				sessionEntry.SessionTokenRetryCount = 0
+				atomic.AddUint64(&gateway.counters.SessionTokenUpdates, 1)
+				sessionEntry.Logger.Info("updated session token %d", sessionEntry.SessionTokenSequence)
+			} else {
+				atomic.AddUint64(&gateway.counters.SessionTokenUpdateFailures, 1)
+				sessionEntry.Logger.Debug("failed to update session token :(")
+				sessionEntry.SessionTokenRetryCount++
+				sessionEntry.SessionTokenCooldown = clock.Now().Add(time.Second)
+			}
+			sessionEntry.UpdatingSessionToken = false
+		default:
+		}
+	}
+}
+
+func (gateway *Gateway) updateSessionToken(logger *core.Logger, reloadable *ReloadableConfig, channel chan SessionTokenUpdate, inputSessionTokenData [core.EncryptedSessionTokenBytes]byte) {
+	r, err := http.NewRequest("POST", gateway.config.AuthURL+"/session_token", bytes.NewBuffer(inputSessionTokenData[:]))
+	if err != nil {
+		logger.Debug("failed to create post request: %v", err)
+		channel <- SessionTokenUpdate{}
+		return
+	}
+	response, err := gateway.httpClient.Do(r)
+
+	if response == nil {
+		logger.Debug("nil response from post")
+		channel <- SessionTokenUpdate{}
+		return
+	}
+
+	defer response.Body.Close()
+
+	if err != nil {
+		logger.Debug("error on post request: %s", err)
+		channel <- SessionTokenUpdate{}
+		return
+	}
+
+	responseData, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		logger.Debug("error reading response data: %v", err)
+		channel <- SessionTokenUpdate{}
+		return
+	}
+
+	if len(responseData) != core.EncryptedSessionTokenBytes {
+		logger.Debug("bad response size: %d", len(responseData))
+		channel <- SessionTokenUpdate{}
+		return
+	}
+
+	sessionTokenData := make([]byte, core.EncryptedSessionTokenBytes)
+	copy(sessionTokenData[:], responseData[:])
+
+	index := 0
+	var sessionToken core.SessionToken
+	result := core.ReadEncryptedSessionToken(responseData[:], &index, &sessionToken, reloadable.AuthPublicKey, reloadable.GatewayPrivateKey)
+	if !result {
+		logger.Debug("invalid session token")
+		channel <- SessionTokenUpdate{}
+		return
+	}
+
+	channel <- SessionTokenUpdate{SessionTokenData: sessionTokenData, ExpireTimestamp: sessionToken.ExpireTimestamp}
+
+}
+
+func (gateway *Gateway) internalThread(thread int) {
+	config := &gateway.config
+	clock := gateway.clock
+
+	gatewayId := gateway.gatewayId
+	gatewayAddress := config.GatewayAddress
+
+	logger := gateway.logger.With("thread", thread).With("socket", "internal")
+
+	socket := gateway.internalSocket[thread]
+
+	defer socket.Close()
+
+	batchConn := gateway.transport.NewPacketConn(socket, config.BatchSize, MaxPacketSize)
+
+	// packets are forwarded to clients through the public socket for this thread
+
+	publicBatchConn := gateway.transport.NewPacketConn(gateway.publicSocket[thread], config.BatchSize, MaxPacketSize)
+
+	// per-thread buffers, so forwarding a packet doesn't allocate
+
+	var disconnectPacket core.InternalDisconnectPacket
+	var payloadPacket core.InternalForwardPacket
+	var prefix core.PacketPrefix
+	disconnectPacket.ClientAddress.IP = make(net.IP, net.IPv6len)
+	payloadPacket.GatewayAddress.IP = make(net.IP, net.IPv6len)
+	payloadPacket.ClientAddress.IP = make(net.IP, net.IPv6len)
+
+	// keys shared with clients are cached per-thread, and timed out the same way as sessions. they come from the
+	// public threads, so they are the keys the clients connected with, even after the gateway keys are reloaded
+
+	sharedKeyMap_Old := make(map[[core.SessionIdBytes]byte][core.SharedKeyBytes_Box]byte)
+	sharedKeyMap_New := make(map[[core.SessionIdBytes]byte][core.SharedKeyBytes_Box]byte)
+
+	swapTime := clock.Now().Unix() + SessionMapSwapTime
+	swapCount := 0
+
+	getSharedKey := func(sessionId []byte) [core.SharedKeyBytes_Box]byte {
+		var sharedKeyId [core.SessionIdBytes]byte
+		copy(sharedKeyId[:], sessionId)
+		sharedKey, ok := sharedKeyMap_New[sharedKeyId]
+		if ok {
+			return sharedKey
+		}
+		sharedKey, ok = sharedKeyMap_Old[sharedKeyId]
+		if !ok {
+			sharedKey, ok = gateway.sharedKeys.load(sharedKeyId, clock.Now().Unix())
+		}
+		if !ok {
+			// not a session this gateway has seen recently, so the best guess is the current key. it isn't cached,
+			// so the key the client connected with is picked up once the public thread sees the session
+			core.SharedKey_Box(sessionId, gateway.reloadableConfig.Load().(*ReloadableConfig).GatewayPrivateKey, sharedKey[:])
+			return sharedKey
+		}
+		sharedKeyMap_New[sharedKeyId] = sharedKey
+		return sharedKey
+	}
+
+	for {
+
+		numPackets, err := batchConn.ReadBatch()
+		if err != nil {
+			if gateway.isDraining() {
+				logger.Debug("internal socket closed")
+			} else {
+				logger.Error("failed to read internal udp packets: %v", err)
+			}
+			break
+		}
+
+		atomic.StoreInt64(&gateway.lastInternalPacketTime, time.Now().UnixNano())
+
+		for packetIndex := 0; packetIndex < numPackets; packetIndex++ {
+
+			packetData, from := batchConn.Packet(packetIndex)
+
+			packetBytes := len(packetData)
+
+			swapCount++
+			if swapCount > 100 {
+				currentTime := clock.Now().Unix()
+				if currentTime >= swapTime {
+					swapCount = 0
+					swapTime = currentTime + SessionMapSwapTime
+					sharedKeyMap_Old = sharedKeyMap_New
+					sharedKeyMap_New = make(map[[core.SessionIdBytes]byte][core.SharedKeyBytes_Box]byte)
+				}
+			}
+
+			if logger.DebugEnabled() {
+				logger.Debug("recv internal %d byte packet from %s", packetBytes, from.String())
+			}
+
+			if packetBytes < core.VersionBytes+core.PacketTypeBytes {
+				logger.Debug("internal packet is too small")
+				continue
+			}
+
+			if packetData[0] != core.PacketVersion {
+				logger.Debug("unknown internal packet version: %d", packetData[0])
+				continue
+			}
+
+			// servers send a disconnect packet for each of their sessions when they shut down. pass it on to the client
+
+			if packetData[1] == core.PacketType_Disconnect {
+
+				index := 0
+				if !disconnectPacket.Read(packetData, &index) {
+					logger.Debug("bad internal disconnect packet (%d bytes)", packetBytes)
+					continue
+				}
+
+				clientAddress := &disconnectPacket.ClientAddress
+				reason := disconnectPacket.Reason
+
+				sharedKey := getSharedKey(disconnectPacket.SessionId[:])
+
+				clientDisconnectPacket := core.DisconnectPacket{Reason: reason}
+				copy(clientDisconnectPacket.GatewayId[:], gatewayId)
+
+				disconnectPacketData := publicBatchConn.WritePacket()
+
+				disconnectPacketBytes := clientDisconnectPacket.Write(disconnectPacketData, sharedKey[:], gatewayAddress, clientAddress)
+
+				publicBatchConn.CommitPacket(disconnectPacketBytes, clientAddress)
+
+				logger.Debug("send %d byte disconnect packet to %s (%s)", disconnectPacketBytes, clientAddress.String(), core.DisconnectReasonString(reason))
+
+				continue
+			}
+
+			if packetData[1] != core.PacketType_Payload {
+				logger.Debug("unknown internal packet type: %d", packetData[1])
+				continue
+			}
+
+			if !readInternalPayloadPacket(packetData, &payloadPacket) {
+				logger.Debug("bad internal payload packet (%d bytes)", packetBytes)
+				continue
+			}
+
+			clientAddress := &payloadPacket.ClientAddress
+
+			if logger.DebugEnabled() {
+				logger.Debug("payload bytes is %d", len(payloadPacket.Payload))
+			}
+
+			// build the packet to send to the client
+
+			sharedKey := getSharedKey(payloadPacket.Header.SessionId[:])
+
+			forwardPacketData := publicBatchConn.WritePacket()
+
+			forwardPacketBytes := writeClientPacket(forwardPacketData, &prefix, &payloadPacket, sharedKey[:])
+			forwardPacketData = forwardPacketData[:forwardPacketBytes]
+
+			core.WritePacketFilter(forwardPacketData, gatewayAddress, clientAddress)
+
+			// send it to the client
+
+			publicBatchConn.CommitPacket(forwardPacketBytes, clientAddress)
+
+			if logger.DebugEnabled() {
+				logger.Debug("send %d byte packet to %s", forwardPacketBytes, clientAddress.String())
+			}
+		}
+
+		// send packets generated by this batch
+
+		if err := publicBatchConn.Flush(); err != nil {
+			logger.ErrorLimited(gateway.forwardErrorLog, "failed to forward packets to clients: %v", err)
+		}
+	}
+
+	gateway.internalWg.Done()
+
+}
+
+// readInternalPayloadPacket reads a payload or keepalive packet from a server. It returns false if the packet doesn't
+// read, or the payload is the wrong size for the packet type in the header.
+func readInternalPayloadPacket(packetData []byte, packet *core.InternalForwardPacket) bool {
+	index := 0
+	if !packet.Read(packetData, &index) {
+		return false
+	}
+	switch packet.Header.PacketType {
+	case core.PacketType_Payload:
+		return len(packet.Payload) >= core.MinPayloadBytes
+	case core.PacketType_Keepalive:
+		return len(packet.Payload) == 0
+	default:
+		return false
+	}
+}
+
+// writeClientPacket writes the encrypted packet a client receives for a payload or keepalive from a server, and
+// returns its size. The packet filter in the postfix is left to the caller, since it depends on the addresses.
+func writeClientPacket(packetData []byte, prefix *core.PacketPrefix, packet *core.InternalForwardPacket, sharedKey []byte) int {
+
+	prefix.PacketType = packet.Header.PacketType
+	prefix.SessionTokenData = packet.SessionTokenData
+	prefix.SessionTokenSequence = packet.SessionTokenSequence
+
+	index := 0
+	core.WriteObject(packetData, &index, prefix)
+	core.WriteObject(packetData, &index, &packet.Header)
+	core.WriteBytes(packetData, &index, packet.Payload, len(packet.Payload))
+	encryptFinish := index
+	index += core.PostfixBytes
+
+	var nonce [core.NonceBytes_Box]byte
+	nonceIndex := 0
+	core.WriteUint64(nonce[:], &nonceIndex, packet.Header.Sequence)
+	nonce[9] |= (1 << 0)
+	nonce[9] &= 1 ^ (1 << 1)
+
+	core.Encrypt_SharedBox(sharedKey, nonce[:], packetData[core.PayloadPacketEncryptIndex:encryptFinish+core.HMACBytes_Box], encryptFinish-core.PayloadPacketEncryptIndex)
+
+	return index
+}
+
+// Shutdown drains the gateway: new sessions are refused, connected clients are sent disconnect packets,
+// packets in flight are still forwarded, and /health reports draining so load balancers stop sending
+// clients here. Then the sockets are closed. It returns false if this didn't finish within the shutdown timeout.
+func (gateway *Gateway) Shutdown() bool {
+
+	shutdownStartTime := time.Now()
+	shutdownDeadline := shutdownStartTime.Add(gateway.config.ShutdownTimeout)
+
+	// stop accepting new sessions, and wake up the public threads so they send disconnect packets even if no packets arrive
+
+	atomic.StoreUint32(&gateway.draining, 1)
+
+	for i := range gateway.publicSocket {
+		gateway.publicSocket[i].SetReadDeadline(time.Now())
+	}
+
+	gateway.disconnectBrowsers()
+
+	// keep forwarding packets in flight between servers and clients, until the internal sockets go quiet
+
+	for time.Now().Before(shutdownDeadline) {
+		quietSince := time.Unix(0, atomic.LoadInt64(&gateway.lastInternalPacketTime))
+		if quietSince.Before(shutdownStartTime) {
+			quietSince = shutdownStartTime
+		}
+		if atomic.LoadInt32(&gateway.drainedThreads) == int32(gateway.config.NumThreads) && time.Since(quietSince) >= DrainQuietTime {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// close sockets so the read loops end. the internal threads send through the public sockets, so they are closed first
+
+	for i := range gateway.internalSocket {
+		gateway.internalSocket[i].Close()
+	}
+
+	if gateway.browserSocket != nil {
+		gateway.browserSocket.Close()
+	}
+
+	completed := core.WaitDeadline(&gateway.internalWg, shutdownDeadline)
+
+	for i := range gateway.publicSocket {
+		gateway.publicSocket[i].Close()
+	}
+
+	completed = core.WaitDeadline(&gateway.wg, shutdownDeadline) && completed
+
+	return completed
+}
+
+// sendDisconnectPacket tells a client the gateway is shutting down, so it should get a new connect token and reconnect.
+func (gateway *Gateway) sendDisconnectPacket(batchConn core.PacketConn, sessionEntry *SessionEntry, currentTime time.Time) {
+	disconnectPacket := core.DisconnectPacket{Reason: core.DisconnectReason_GatewayShutdown}
+	copy(disconnectPacket.GatewayId[:], gateway.gatewayId)
+	disconnectPacketData := batchConn.WritePacket()
+	disconnectPacketBytes := disconnectPacket.Write(disconnectPacketData, sessionEntry.SharedKey[:], gateway.config.GatewayAddress, &sessionEntry.ClientAddress)
+	batchConn.CommitPacket(disconnectPacketBytes, &sessionEntry.ClientAddress)
+	sessionEntry.DisconnectSendTime = currentTime
+	sessionEntry.Logger.Debug("send %d byte disconnect packet", disconnectPacketBytes)
+}
+
+func (gateway *Gateway) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+	if gateway.isDraining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("draining"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+func (gateway *Gateway) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	counters := gateway.Counters()
+	fmt.Fprintf(w, "hello world\n")
+	fmt.Fprintf(w, "challenge packets sent: %d\n", counters.ChallengePacketsSent)
+	fmt.Fprintf(w, "prefilter shed (per address): %d\n", counters.PrefilterShedPerAddress)
+	fmt.Fprintf(w, "prefilter shed (per session): %d\n", counters.PrefilterShedPerSession)
+	fmt.Fprintf(w, "prefilter shed (global): %d\n", counters.PrefilterShedGlobal)
+	fmt.Fprintf(w, "sessions created: %d\n", counters.SessionsCreated)
+	fmt.Fprintf(w, "session token updates: %d\n", counters.SessionTokenUpdates)
+	fmt.Fprintf(w, "session token update failures: %d\n", counters.SessionTokenUpdateFailures)
+	fmt.Fprintf(w, "websocket sessions created: %d\n", counters.WebSocketSessionsCreated)
+	fmt.Fprintf(w, "webrtc sessions created: %d\n", counters.WebRTCSessionsCreated)
+}
+
+// MetricsHandler writes the counters as JSON, for tools like soak that scrape them.
+func (gateway *Gateway) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gateway.Counters())
+}
@@ -0,0 +1,141 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefilter(t *testing.T) {
+
+	t.Parallel()
+
+	counters := Counters{}
+	prefilter := NewPrefilter(2, 3, 10, &counters)
+
+	currentTime := time.Unix(1000, 0)
+
+	a := core.ParseAddress("127.0.0.1:30000")
+	b := core.ParseAddress("127.0.0.2:30000")
+
+	var sessionId [core.SessionIdBytes]byte
+	newSessionId := func() [core.SessionIdBytes]byte {
+		sessionId[0]++
+		return sessionId
+	}
+
+	// each address gets its own rate, whatever sessions it sends for
+
+	assert.True(t, prefilter.Allow(a, newSessionId(), currentTime))
+	assert.True(t, prefilter.Allow(a, newSessionId(), currentTime))
+	assert.False(t, prefilter.Allow(a, newSessionId(), currentTime))
+	assert.Equal(t, uint64(1), counters.PrefilterShedPerAddress)
+
+	// and so does each session, whatever addresses send for it
+
+	flooded := newSessionId()
+
+	for i := 0; i < 3; i++ {
+		from := core.ParseAddress("127.0.1.1:30000")
+		from.IP[15] = byte(i)
+		assert.True(t, prefilter.Allow(from, flooded, currentTime))
+	}
+
+	// packets shed for their session don't spend their address's budget
+
+	assert.False(t, prefilter.Allow(b, flooded, currentTime))
+	assert.False(t, prefilter.Allow(b, flooded, currentTime))
+	assert.Equal(t, uint64(2), counters.PrefilterShedPerSession)
+
+	assert.True(t, prefilter.Allow(b, newSessionId(), currentTime))
+	assert.True(t, prefilter.Allow(b, newSessionId(), currentTime))
+
+	// everything together is limited to the global rate. 7 packets have gone through so far
+
+	for i := 0; i < 3; i++ {
+		from := core.ParseAddress("127.0.2.1:30000")
+		from.IP[15] = byte(i)
+		assert.True(t, prefilter.Allow(from, newSessionId(), currentTime))
+	}
+
+	c := core.ParseAddress("127.0.3.1:30000")
+
+	assert.False(t, prefilter.Allow(c, newSessionId(), currentTime))
+	assert.Equal(t, uint64(1), counters.PrefilterShedGlobal)
+
+	assert.Equal(t, uint64(1), counters.PrefilterShedPerAddress)
+	assert.Equal(t, uint64(2), counters.PrefilterShedPerSession)
+
+	// packets shed globally don't spend their address's budget either
+
+	currentTime = currentTime.Add(200 * time.Millisecond)
+
+	assert.True(t, prefilter.Allow(c, newSessionId(), currentTime))
+	assert.True(t, prefilter.Allow(c, newSessionId(), currentTime))
+	assert.False(t, prefilter.Allow(c, newSessionId(), currentTime))
+	assert.Equal(t, uint64(2), counters.PrefilterShedPerAddress)
+}
+
+func TestPrefilterSetRates(t *testing.T) {
+
+	t.Parallel()
+
+	counters := Counters{}
+	prefilter := NewPrefilter(2, 100, 100, &counters)
+
+	currentTime := time.Unix(1000, 0)
+
+	a := core.ParseAddress("127.0.0.1:30000")
+
+	var sessionId [core.SessionIdBytes]byte
+
+	assert.True(t, prefilter.Allow(a, sessionId, currentTime))
+	assert.True(t, prefilter.Allow(a, sessionId, currentTime))
+	assert.False(t, prefilter.Allow(a, sessionId, currentTime))
+
+	// new rates keep the buckets, so a drained address isn't given a fresh burst
+
+	prefilter.SetRates(4, 100, 100)
+
+	assert.False(t, prefilter.Allow(a, sessionId, currentTime))
+
+	// it refills at the new rate, up to the new burst
+
+	currentTime = currentTime.Add(500 * time.Millisecond)
+
+	assert.True(t, prefilter.Allow(a, sessionId, currentTime))
+	assert.True(t, prefilter.Allow(a, sessionId, currentTime))
+	assert.False(t, prefilter.Allow(a, sessionId, currentTime))
+
+	currentTime = currentTime.Add(10 * time.Second)
+
+	for i := 0; i < 4; i++ {
+		assert.True(t, prefilter.Allow(a, sessionId, currentTime))
+	}
+	assert.False(t, prefilter.Allow(a, sessionId, currentTime))
+
+	assert.Equal(t, uint64(4), counters.PrefilterShedPerAddress)
+	assert.Equal(t, uint64(0), counters.PrefilterShedPerSession)
+	assert.Equal(t, uint64(0), counters.PrefilterShedGlobal)
+}
@@ -0,0 +1,314 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gateway
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// WebRTCMaxOfferBytes is the largest offer request the gateway reads.
+const WebRTCMaxOfferBytes = 64 * 1024
+
+// WebRTCGatherTimeout is how long the gateway waits to gather its ICE candidates before giving up on an answer.
+const WebRTCGatherTimeout = 5 * time.Second
+
+// WebRTCConnectTimeout is how long a peer has after the answer to open its data channel, before it is closed.
+const WebRTCConnectTimeout = 10 * time.Second
+
+// WebRTCCloseTimeout is how long the gateway waits for a data channel to send what it has buffered, like a
+// disconnect packet, before closing the peer.
+const WebRTCCloseTimeout = time.Second
+
+// WebRTCMaxPeersPerSession is how many peer connections a session can have open at once. A client that lost its
+// connection can reconnect while the old peer is still timing out, but one connect token can't hold open ports
+// without limit.
+const WebRTCMaxPeersPerSession = 4
+
+// WebRTCOffer is what a browser client posts to connect over WebRTC: the connect token it got from auth, and its
+// offer. The offer must have one data channel, unordered and with no retransmits, so packets that are lost stay
+// lost, like they do over UDP. Candidates aren't trickled, so the offer must have them all.
+type WebRTCOffer struct {
+	ConnectToken []byte                    `json:"connect_token"`
+	Offer        webrtc.SessionDescription `json:"offer"`
+}
+
+// newWebRTCAPI sets up the ports and addresses the gateway's WebRTC peers use. Only data channels are used, so
+// no codecs are registered.
+func (gateway *Gateway) newWebRTCAPI() (*webrtc.API, error) {
+	config := &gateway.config
+	settingEngine := webrtc.SettingEngine{}
+	if config.WebRTCPortMin != 0 || config.WebRTCPortMax != 0 {
+		if err := settingEngine.SetEphemeralUDPPortRange(config.WebRTCPortMin, config.WebRTCPortMax); err != nil {
+			return nil, err
+		}
+	}
+	if config.WebRTCPublicIP != "" {
+		settingEngine.SetNAT1To1IPs([]string{config.WebRTCPublicIP}, webrtc.ICECandidateTypeHost)
+	}
+	return webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine)), nil
+}
+
+// WebRTCHandler answers a WebRTCOffer from a browser client. The connect token is checked before any WebRTC work
+// is done, and the peer can only send packets for the session in it. Each data channel message is a payload or
+// keepalive packet in the same format clients send over UDP, and each message back is a packet in the format
+// clients receive. Servers see the client's address from the ICE candidate pair.
+func (gateway *Gateway) WebRTCHandler(w http.ResponseWriter, r *http.Request) {
+
+	if atomic.LoadUint32(&gateway.browserStarted) == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("browser clients are not enabled"))
+		return
+	}
+
+	if gateway.isDraining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("draining"))
+		return
+	}
+
+	logger := gateway.logger.With("webrtc", r.RemoteAddr)
+
+	var offer WebRTCOffer
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, WebRTCMaxOfferBytes)).Decode(&offer); err != nil {
+		logger.Debug("could not read offer: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// check the session token in the connect token
+
+	if len(offer.ConnectToken) != core.ConnectTokenBytes {
+		logger.Debug("bad connect token size: %d", len(offer.ConnectToken))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var sessionToken core.SessionToken
+	var sessionTokenData [core.EncryptedSessionTokenBytes]byte
+	copy(sessionTokenData[:], offer.ConnectToken[core.ConnectDataBytes:])
+
+	reloadable := gateway.reloadableConfig.Load().(*ReloadableConfig)
+
+	if !readSessionToken(reloadable, sessionTokenData[:], &sessionToken) {
+		logger.Debug("could not decrypt session token")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if sessionToken.ExpireTimestamp < uint64(gateway.clock.Now().Unix()) {
+		logger.Debug("session token has expired")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	sessionId := sessionToken.SessionId
+
+	logger = logger.WithSession(sessionId[:])
+
+	if !gateway.addWebRTCPeer(sessionId) {
+		logger.Debug("session has too many peer connections")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	// answer the offer
+
+	peerConnection, err := gateway.webRTC.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		gateway.removeWebRTCPeer(sessionId)
+		logger.Error("could not create peer connection: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var opened uint32
+
+	peerConnection.OnDataChannel(func(dataChannel *webrtc.DataChannel) {
+		gateway.webRTCDataChannel(logger, peerConnection, dataChannel, &sessionId, &opened)
+	})
+
+	// the peer stops counting against its session once it is closed
+
+	var removeOnce sync.Once
+
+	closePeer := func() {
+		peerConnection.Close()
+		removeOnce.Do(func() {
+			gateway.removeWebRTCPeer(sessionId)
+		})
+	}
+
+	// a disconnected peer can still recover, so it is only closed once it has failed
+
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		logger.Debug("peer connection is %s", state.String())
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			closePeer()
+		}
+	})
+
+	if err := peerConnection.SetRemoteDescription(offer.Offer); err != nil {
+		logger.Debug("could not set remote description: %v", err)
+		closePeer()
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		logger.Debug("could not create answer: %v", err)
+		closePeer()
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		logger.Error("could not set local description: %v", err)
+		closePeer()
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	gatherTimer := time.NewTimer(WebRTCGatherTimeout)
+	defer gatherTimer.Stop()
+
+	select {
+	case <-gatherComplete:
+	case <-gatherTimer.C:
+		logger.Error("timed out gathering candidates")
+		closePeer()
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// peers that never open a data channel don't get to hold on to their ports
+
+	time.AfterFunc(WebRTCConnectTimeout, func() {
+		if atomic.LoadUint32(&opened) == 0 {
+			logger.Debug("data channel did not open")
+			peerConnection.Close()
+		}
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(peerConnection.LocalDescription())
+}
+
+// addWebRTCPeer counts a new peer connection for a session. It returns false if the session already has
+// WebRTCMaxPeersPerSession peers.
+func (gateway *Gateway) addWebRTCPeer(sessionId [core.SessionIdBytes]byte) bool {
+	gateway.browserMutex.Lock()
+	defer gateway.browserMutex.Unlock()
+	if gateway.webRTCPeers[sessionId] >= WebRTCMaxPeersPerSession {
+		return false
+	}
+	gateway.webRTCPeers[sessionId]++
+	return true
+}
+
+// removeWebRTCPeer stops counting a closed peer connection against its session.
+func (gateway *Gateway) removeWebRTCPeer(sessionId [core.SessionIdBytes]byte) {
+	gateway.browserMutex.Lock()
+	defer gateway.browserMutex.Unlock()
+	if gateway.webRTCPeers[sessionId] <= 1 {
+		delete(gateway.webRTCPeers, sessionId)
+		return
+	}
+	gateway.webRTCPeers[sessionId]--
+}
+
+// webRTCDataChannel sets up a data channel from a peer to carry its packets.
+func (gateway *Gateway) webRTCDataChannel(logger *core.Logger, peerConnection *webrtc.PeerConnection, dataChannel *webrtc.DataChannel, sessionId *[core.SessionIdBytes]byte, opened *uint32) {
+
+	maxRetransmits := dataChannel.MaxRetransmits()
+	if dataChannel.Ordered() || maxRetransmits == nil || *maxRetransmits != 0 {
+		logger.Debug("data channel %s must be unordered with no retransmits", dataChannel.Label())
+		peerConnection.Close()
+		return
+	}
+
+	if !atomic.CompareAndSwapUint32(opened, 0, 1) {
+		logger.Debug("peer has more than one data channel")
+		peerConnection.Close()
+		return
+	}
+
+	// this runs before the data channel starts reading, so its messages are only handled once the connection is set
+	// up. messages are handled one at a time, on the data channel's read goroutine
+
+	write := func(packetData []byte) error {
+		return dataChannel.Send(packetData)
+	}
+
+	closeConn := func() {
+		// sends are only queued, so closing the peer straight away would lose the last packets
+		closeTime := time.Now().Add(WebRTCCloseTimeout)
+		for dataChannel.BufferedAmount() > 0 && time.Now().Before(closeTime) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		peerConnection.Close()
+	}
+
+	connection := gateway.newBrowserConnection(logger, webRTCClientAddress(peerConnection), sessionId, &gateway.counters.WebRTCSessionsCreated, write, closeConn)
+
+	dataChannel.OnMessage(func(message webrtc.DataChannelMessage) {
+		if message.IsString {
+			return
+		}
+		if !connection.receivePacket(message.Data) {
+			peerConnection.Close()
+		}
+	})
+
+	dataChannel.OnClose(func() {
+		connection.close()
+	})
+}
+
+// webRTCClientAddress is the address servers see for a WebRTC client, which is the remote address of its selected
+// candidate pair.
+func webRTCClientAddress(peerConnection *webrtc.PeerConnection) *net.UDPAddr {
+	address := &net.UDPAddr{IP: net.IPv4zero}
+	sctp := peerConnection.SCTP()
+	if sctp == nil {
+		return address
+	}
+	pair, err := sctp.Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return address
+	}
+	if ip := net.ParseIP(pair.Remote.Address); ip != nil {
+		address.IP = ip
+		address.Port = int(pair.Remote.Port)
+	}
+	return address
+}
@@ -0,0 +1,107 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gateway
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketReadTimeout is how long a WebSocket client can go without sending a packet before its connection is
+// closed. Connected clients send at least a keepalive every core.KeepaliveInterval.
+const WebSocketReadTimeout = 10 * time.Second
+
+// WebSocketWriteTimeout is how long writing a packet to a WebSocket client can take before its connection is closed.
+const WebSocketWriteTimeout = time.Second
+
+// WebSocketHandler accepts WebSocket connections from browser clients. Each binary message from the client is a
+// payload or keepalive packet in the same format clients send over UDP, and each message back is a packet in the
+// format clients receive. There is no challenge, because the TCP handshake has already shown the client can receive
+// at its address. Servers see the client's TCP address.
+func (gateway *Gateway) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadUint32(&gateway.browserStarted) == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("browser clients are not enabled"))
+		return
+	}
+	if gateway.isDraining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("draining"))
+		return
+	}
+	// any origin is accepted. clients get in with the session token in each packet, not with cookies
+	server := websocket.Server{Handler: func(conn *websocket.Conn) {
+		gateway.webSocketConnection(conn, webSocketClientAddress(r.RemoteAddr))
+	}}
+	server.ServeHTTP(w, r)
+}
+
+// webSocketClientAddress is the address servers see for a WebSocket client, which is the address of its TCP connection.
+func webSocketClientAddress(remoteAddress string) *net.UDPAddr {
+	address, err := net.ResolveUDPAddr("udp", remoteAddress)
+	if err != nil || len(address.IP) == 0 {
+		return &net.UDPAddr{IP: net.IPv4zero}
+	}
+	return address
+}
+
+// webSocketConnection reads packets from a WebSocket client until the connection closes.
+func (gateway *Gateway) webSocketConnection(conn *websocket.Conn, clientAddress *net.UDPAddr) {
+
+	defer conn.Close()
+
+	conn.PayloadType = websocket.BinaryFrame
+	conn.MaxPayloadBytes = MaxPacketSize
+
+	logger := gateway.logger.With("websocket", clientAddress.String())
+
+	write := func(packetData []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(WebSocketWriteTimeout))
+		return websocket.Message.Send(conn, packetData)
+	}
+
+	closeConn := func() {
+		conn.Close()
+	}
+
+	connection := gateway.newBrowserConnection(logger, clientAddress, nil, &gateway.counters.WebSocketSessionsCreated, write, closeConn)
+
+	defer connection.close()
+
+	var packetData []byte
+
+	for {
+
+		conn.SetReadDeadline(time.Now().Add(WebSocketReadTimeout))
+
+		if err := websocket.Message.Receive(conn, &packetData); err != nil {
+			logger.Debug("websocket closed: %v", err)
+			return
+		}
+
+		if !connection.receivePacket(packetData) {
+			return
+		}
+	}
+}
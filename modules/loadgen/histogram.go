@@ -0,0 +1,99 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package loadgen
+
+import (
+	"math"
+	"time"
+)
+
+// HistogramBuckets covers latencies from a microsecond to several minutes.
+const HistogramBuckets = 2048
+
+const histogramGrowth = 1.01
+
+// Histogram counts latencies in buckets 1% wider than the last, so percentiles are within 1% of the true
+// value, and recording one is cheap and never allocates however many are recorded.
+type Histogram struct {
+	counts [HistogramBuckets]uint64
+	total  uint64
+	max    time.Duration
+}
+
+func histogramBucket(latency time.Duration) int {
+	microseconds := float64(latency) / float64(time.Microsecond)
+	if microseconds < histogramGrowth {
+		return 0
+	}
+	bucket := int(math.Log(microseconds) / math.Log(histogramGrowth))
+	if bucket >= HistogramBuckets {
+		bucket = HistogramBuckets - 1
+	}
+	return bucket
+}
+
+func (histogram *Histogram) Record(latency time.Duration) {
+	histogram.counts[histogramBucket(latency)]++
+	histogram.total++
+	if latency > histogram.max {
+		histogram.max = latency
+	}
+}
+
+func (histogram *Histogram) Merge(other *Histogram) {
+	for i := range histogram.counts {
+		histogram.counts[i] += other.counts[i]
+	}
+	histogram.total += other.total
+	if other.max > histogram.max {
+		histogram.max = other.max
+	}
+}
+
+func (histogram *Histogram) Count() uint64 {
+	return histogram.total
+}
+
+func (histogram *Histogram) Max() time.Duration {
+	return histogram.max
+}
+
+// Percentile returns the latency that p percent of samples are at or below, rounded up to the top of its bucket.
+func (histogram *Histogram) Percentile(p float64) time.Duration {
+	if histogram.total == 0 {
+		return 0
+	}
+	target := uint64(math.Ceil(p / 100 * float64(histogram.total)))
+	if target < 1 {
+		target = 1
+	}
+	count := uint64(0)
+	for i := range histogram.counts {
+		count += histogram.counts[i]
+		if count >= target {
+			latency := time.Duration(math.Pow(histogramGrowth, float64(i+1)) * float64(time.Microsecond))
+			if latency > histogram.max {
+				latency = histogram.max
+			}
+			return latency
+		}
+	}
+	return histogram.max
+}
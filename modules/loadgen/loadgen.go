@@ -0,0 +1,785 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package loadgen
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/networknext/udpx/modules/client"
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/testmessage"
+)
+
+const MaxPacketSize = 1500
+const SequenceBufferSize = 1024
+
+// SendTickTime is how often each socket thread sends the packets that are due. Sessions are spread across
+// ticks, so a socket with many sessions sends a steady stream instead of a burst each frame.
+const SendTickTime = time.Millisecond
+
+// ConnectWorkers is how many connect token requests are made at once.
+const ConnectWorkers = 16
+
+// ConnectRetryTime is how long a session waits to ask auth again after a connect token request fails.
+const ConnectRetryTime = time.Second
+
+type Config struct {
+	AuthURL          string
+	BindAddress      string
+	BasePort         int
+	ClientIP         net.IP
+	Sessions         int
+	Sockets          int
+	PayloadBytes     int
+	PacketsPerSecond int
+	RampTime         time.Duration
+	ReadBuffer       int
+	WriteBuffer      int
+	BatchSize        int
+	HTTPClient       *http.Client
+	Logger           *core.Logger
+	Clock            core.Clock
+}
+
+type Counters struct {
+	SessionsStarted          uint64
+	SessionsConnected        uint64
+	SessionsTimedOut         uint64
+	SessionsDisconnected     uint64
+	ConnectTokenFailures     uint64
+	ChallengePacketsReceived uint64
+	PacketsSent              uint64
+	PacketsReceived          uint64
+	PacketsAcked             uint64
+	BytesSent                uint64
+	BytesReceived            uint64
+}
+
+// session is one simulated client. Its socket's send thread and receive thread both use it, under its mutex.
+type session struct {
+	mutex                    sync.Mutex
+	index                    int
+	ended                    bool
+	connected                bool
+	sessionId                []byte
+	sharedKey                [core.SharedKeyBytes_Box]byte
+	gatewayAddress           net.UDPAddr
+	sessionTokenData         [core.EncryptedSessionTokenBytes]byte
+	sessionTokenSequence     uint64
+	sessionTokenExpireTime   time.Time
+	sendInterval             time.Duration
+	nextSendTime             time.Time
+	sendSequence             uint64
+	receiveSequence          uint64
+	replayProtection         core.ReplayProtection
+	receivedPackets          [SequenceBufferSize]uint64
+	ackedPackets             [SequenceBufferSize]uint64
+	sentPackets              [SequenceBufferSize]uint64
+	sendTimes                [SequenceBufferSize]time.Time
+	gatewayId                [core.GatewayIdBytes]byte
+	serverId                 [core.ServerIdBytes]byte
+	hasChallengeToken        bool
+	challengeTokenData       [core.EncryptedChallengeTokenBytes]byte
+	challengeTokenSequence   uint64
+	challengeTokenExpireTime time.Time
+	challengeTokenGatewayId  [core.GatewayIdBytes]byte
+}
+
+// loadSocket is one socket in the pool, and the sessions spread onto it. Many sessions share each socket, so
+// the gateway sees many sessions from one address, like clients behind a NAT.
+type loadSocket struct {
+	index    int
+	socket   core.Socket
+	address  net.UDPAddr
+	mutex    sync.Mutex
+	sessions map[string]*session
+	latency  Histogram
+
+	// only used by the send and receive threads of the socket, so packets are written and read without allocating
+
+	sendPrefix    core.PacketPrefix
+	sendHeader    core.PayloadHeader
+	receivePrefix core.PacketPrefix
+	receiveHeader core.PayloadHeader
+}
+
+// LoadGen simulates thousands of clients from one process. Sessions get connect tokens from auth like real
+// clients, and send payload packets through the gateway to a server at a fixed rate. Sessions that time out
+// or are disconnected get a new connect token, so the load stays the same for the whole run.
+type LoadGen struct {
+	counters     Counters
+	connected    int64
+	config       Config
+	transport    core.Transport
+	logger       *core.Logger
+	clock        core.Clock
+	httpClient   *http.Client
+	sendErrorLog *core.LogLimiter
+	payload      []byte
+	sockets      []*loadSocket
+	startQueue   chan int
+	done         chan struct{}
+	doneOnce     sync.Once
+	wg           sync.WaitGroup
+}
+
+func New(config *Config, transport core.Transport) *LoadGen {
+	loadgen := &LoadGen{config: *config, transport: transport}
+	loadgen.logger = config.Logger
+	if loadgen.logger == nil {
+		loadgen.logger = core.Log
+	}
+	loadgen.clock = config.Clock
+	if loadgen.clock == nil {
+		loadgen.clock = core.SystemClock
+	}
+	loadgen.httpClient = config.HTTPClient
+	if loadgen.httpClient == nil {
+		loadgen.httpClient = &http.Client{Timeout: time.Second}
+	}
+	if loadgen.config.ClientIP == nil {
+		loadgen.config.ClientIP = net.IPv4(127, 0, 0, 1)
+	}
+	// send errors repeat for every batch until the socket recovers, so they are logged at most once per second
+	loadgen.sendErrorLog = core.NewLogLimiter(time.Second)
+	loadgen.startQueue = make(chan int, config.Sessions)
+	loadgen.done = make(chan struct{})
+	return loadgen
+}
+
+func (loadgen *LoadGen) Counters() Counters {
+	counters := Counters{}
+	counters.SessionsStarted = atomic.LoadUint64(&loadgen.counters.SessionsStarted)
+	counters.SessionsConnected = atomic.LoadUint64(&loadgen.counters.SessionsConnected)
+	counters.SessionsTimedOut = atomic.LoadUint64(&loadgen.counters.SessionsTimedOut)
+	counters.SessionsDisconnected = atomic.LoadUint64(&loadgen.counters.SessionsDisconnected)
+	counters.ConnectTokenFailures = atomic.LoadUint64(&loadgen.counters.ConnectTokenFailures)
+	counters.ChallengePacketsReceived = atomic.LoadUint64(&loadgen.counters.ChallengePacketsReceived)
+	counters.PacketsSent = atomic.LoadUint64(&loadgen.counters.PacketsSent)
+	counters.PacketsReceived = atomic.LoadUint64(&loadgen.counters.PacketsReceived)
+	counters.PacketsAcked = atomic.LoadUint64(&loadgen.counters.PacketsAcked)
+	counters.BytesSent = atomic.LoadUint64(&loadgen.counters.BytesSent)
+	counters.BytesReceived = atomic.LoadUint64(&loadgen.counters.BytesReceived)
+	return counters
+}
+
+// Connected is the number of sessions whose packets are getting through to a server and back right now.
+func (loadgen *LoadGen) Connected() int {
+	return int(atomic.LoadInt64(&loadgen.connected))
+}
+
+// Latency is the round trip time from sending each packet to getting the ack for it back from the server,
+// over the whole run so far.
+func (loadgen *LoadGen) Latency() *Histogram {
+	latency := &Histogram{}
+	for _, socket := range loadgen.sockets {
+		socket.mutex.Lock()
+		latency.Merge(&socket.latency)
+		socket.mutex.Unlock()
+	}
+	return latency
+}
+
+// Start binds the sockets, and starts sessions evenly over the ramp time.
+func (loadgen *LoadGen) Start() error {
+
+	config := &loadgen.config
+
+	if config.Sessions <= 0 || config.Sockets <= 0 {
+		return fmt.Errorf("sessions and sockets must be positive")
+	}
+
+	if config.PayloadBytes < core.MinPayloadBytes || config.PayloadBytes > core.MaxPayloadBytes {
+		return fmt.Errorf("payload must be between %d and %d bytes", core.MinPayloadBytes, core.MaxPayloadBytes)
+	}
+
+	// every payload is packed with test messages, so the server accepts it
+
+	loadgen.payload = testmessage.Payload(config.PayloadBytes)
+
+	// create sockets
+
+	for i := 0; i < config.Sockets; i++ {
+
+		port := 0
+		if config.BasePort != 0 {
+			port = config.BasePort + i
+		}
+
+		socket, err := loadgen.transport.Listen(fmt.Sprintf("%s:%d", config.BindAddress, port), core.SocketOptions{ReadBuffer: config.ReadBuffer, WriteBuffer: config.WriteBuffer})
+		if err != nil {
+			loadgen.closeSockets()
+			return fmt.Errorf("could not bind socket: %v", err)
+		}
+
+		loadSocket := &loadSocket{index: i, socket: socket, sessions: make(map[string]*session)}
+		loadSocket.address.IP = config.ClientIP
+		loadSocket.address.Port = socket.LocalAddr().(*net.UDPAddr).Port
+
+		loadgen.sockets = append(loadgen.sockets, loadSocket)
+	}
+
+	loadgen.logger.Info("starting %d sessions on %d sockets", config.Sessions, config.Sockets)
+
+	for _, socket := range loadgen.sockets {
+		loadgen.wg.Add(2)
+		go loadgen.sendThread(socket)
+		go loadgen.receiveThread(socket)
+	}
+
+	for i := 0; i < ConnectWorkers; i++ {
+		loadgen.wg.Add(1)
+		go loadgen.connectThread()
+	}
+
+	// ramp up
+
+	loadgen.wg.Add(1)
+	go func() {
+		defer loadgen.wg.Done()
+		for i := 0; i < config.Sessions; i++ {
+			if i > 0 && config.RampTime > 0 {
+				timer := loadgen.clock.NewTimer(config.RampTime / time.Duration(config.Sessions))
+				select {
+				case <-timer.C():
+				case <-loadgen.done:
+					timer.Stop()
+					return
+				}
+			}
+			loadgen.startQueue <- i
+		}
+	}()
+
+	return nil
+}
+
+// Stop ends every session, closes the sockets and waits for the goroutines to finish.
+func (loadgen *LoadGen) Stop() {
+	loadgen.doneOnce.Do(func() { close(loadgen.done) })
+	loadgen.closeSockets()
+	loadgen.wg.Wait()
+}
+
+func (loadgen *LoadGen) stopping() bool {
+	select {
+	case <-loadgen.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (loadgen *LoadGen) closeSockets() {
+	for _, socket := range loadgen.sockets {
+		socket.socket.Close()
+	}
+}
+
+// connectThread gets connect tokens for sessions waiting to start, and puts them on a socket.
+func (loadgen *LoadGen) connectThread() {
+
+	defer loadgen.wg.Done()
+
+	for {
+		select {
+		case <-loadgen.done:
+			return
+		case index := <-loadgen.startQueue:
+			if err := loadgen.startSession(index); err != nil {
+				atomic.AddUint64(&loadgen.counters.ConnectTokenFailures, 1)
+				loadgen.logger.Debug("session %d could not start: %v", index, err)
+				timer := loadgen.clock.NewTimer(ConnectRetryTime)
+				select {
+				case <-timer.C():
+				case <-loadgen.done:
+					timer.Stop()
+					return
+				}
+				loadgen.startQueue <- index
+			}
+		}
+	}
+}
+
+func (loadgen *LoadGen) startSession(index int) error {
+
+	clientPublicKey, clientPrivateKey := core.Keygen_Box()
+
+	connectToken, err := client.RequestConnectToken(loadgen.httpClient, loadgen.config.AuthURL, clientPublicKey)
+	if err != nil {
+		return fmt.Errorf("could not get connect token: %v", err)
+	}
+
+	tokenIndex := 0
+	var connectData core.ConnectData
+	if !core.ReadObject(connectToken, &tokenIndex, &connectData) {
+		return fmt.Errorf("invalid connect data")
+	}
+
+	if !core.IdEqual(connectData.ClientPublicKey[:], clientPublicKey) {
+		return fmt.Errorf("connect token is for a different client public key")
+	}
+
+	packetsPerSecond := loadgen.config.PacketsPerSecond
+	if packetsPerSecond <= 0 {
+		packetsPerSecond = int(connectData.PacketsPerSecond)
+	}
+
+	currentTime := loadgen.clock.Now()
+
+	session := &session{index: index}
+	session.sessionId = clientPublicKey
+	core.SharedKey_Box(connectData.GatewayPublicKey[:], clientPrivateKey, session.sharedKey[:])
+	core.CopyAddress(&session.gatewayAddress, &connectData.GatewayAddress)
+	copy(session.sessionTokenData[:], connectToken[core.ConnectDataBytes:])
+	session.sessionTokenExpireTime = currentTime.Add(time.Second * core.ConnectTokenExpireSeconds)
+	session.sendInterval = time.Second / time.Duration(packetsPerSecond)
+	session.nextSendTime = currentTime.Add(time.Duration(rand.Int63n(int64(session.sendInterval))))
+	session.sendSequence = uint64(10000) + uint64(rand.Intn(10000))
+
+	socket := loadgen.sockets[index%len(loadgen.sockets)]
+	socket.mutex.Lock()
+	socket.sessions[string(session.sessionId)] = session
+	socket.mutex.Unlock()
+
+	atomic.AddUint64(&loadgen.counters.SessionsStarted, 1)
+
+	return nil
+}
+
+// endSession takes a session off its socket, and queues it to start again with a new connect token.
+// The session mutex must be held.
+func (loadgen *LoadGen) endSession(socket *loadSocket, session *session) {
+	session.ended = true
+	if session.connected {
+		session.connected = false
+		atomic.AddInt64(&loadgen.connected, -1)
+	}
+	socket.mutex.Lock()
+	delete(socket.sessions, string(session.sessionId))
+	socket.mutex.Unlock()
+	select {
+	case loadgen.startQueue <- session.index:
+	default:
+	}
+}
+
+func (loadgen *LoadGen) setConnected(session *session) {
+	if !session.connected {
+		session.connected = true
+		atomic.AddInt64(&loadgen.connected, 1)
+		atomic.AddUint64(&loadgen.counters.SessionsConnected, 1)
+	}
+}
+
+func (socket *loadSocket) sessionList(buffer []*session) []*session {
+	socket.mutex.Lock()
+	for _, session := range socket.sessions {
+		buffer = append(buffer, session)
+	}
+	socket.mutex.Unlock()
+	return buffer
+}
+
+// sendThread sends a payload packet for each session on the socket as it comes due.
+func (loadgen *LoadGen) sendThread(socket *loadSocket) {
+
+	defer loadgen.wg.Done()
+
+	clock := loadgen.clock
+
+	logger := loadgen.logger.With("socket", socket.index)
+
+	batchConn := loadgen.transport.NewPacketConn(socket.socket, loadgen.config.BatchSize, MaxPacketSize)
+
+	var sessions []*session
+
+	for {
+
+		timer := clock.NewTimer(SendTickTime)
+		select {
+		case <-timer.C():
+		case <-loadgen.done:
+			timer.Stop()
+			return
+		}
+
+		currentTime := clock.Now()
+
+		sessions = socket.sessionList(sessions[:0])
+
+		packetsSent := uint64(0)
+		bytesSent := uint64(0)
+
+		for _, session := range sessions {
+
+			session.mutex.Lock()
+
+			if session.ended {
+				session.mutex.Unlock()
+				continue
+			}
+
+			if session.sessionTokenExpireTime.Before(currentTime) {
+				logger.Debug("session %s timed out", core.IdString(session.sessionId))
+				atomic.AddUint64(&loadgen.counters.SessionsTimedOut, 1)
+				loadgen.endSession(socket, session)
+				session.mutex.Unlock()
+				continue
+			}
+
+			if session.hasChallengeToken && !session.challengeTokenExpireTime.After(currentTime) {
+				session.hasChallengeToken = false
+			}
+
+			if currentTime.Before(session.nextSendTime) {
+				session.mutex.Unlock()
+				continue
+			}
+
+			// don't try to catch up after a stall, or every late session would send a burst
+
+			session.nextSendTime = session.nextSendTime.Add(session.sendInterval)
+			if session.nextSendTime.Before(currentTime) {
+				session.nextSendTime = currentTime.Add(session.sendInterval)
+			}
+
+			packetData := batchConn.WritePacket()
+			packetBytes := loadgen.writePayloadPacket(packetData, socket, session, currentTime)
+			batchConn.CommitPacket(packetBytes, &session.gatewayAddress)
+
+			session.mutex.Unlock()
+
+			packetsSent++
+			bytesSent += uint64(packetBytes)
+		}
+
+		if packetsSent > 0 {
+			if err := batchConn.Flush(); err != nil && !loadgen.stopping() {
+				logger.ErrorLimited(loadgen.sendErrorLog, "failed to send packets: %v", err)
+			}
+			atomic.AddUint64(&loadgen.counters.PacketsSent, packetsSent)
+			atomic.AddUint64(&loadgen.counters.BytesSent, bytesSent)
+		}
+	}
+}
+
+// writePayloadPacket writes the same payload packet a client sends. The session mutex must be held.
+func (loadgen *LoadGen) writePayloadPacket(packetData []byte, socket *loadSocket, session *session, currentTime time.Time) int {
+
+	ack_bits := [core.AckBitsBytes]byte{}
+
+	core.GetAckBits(session.receiveSequence, session.receivedPackets[:], ack_bits[:])
+
+	prefix := &socket.sendPrefix
+	prefix.PacketType = core.PacketType_Payload
+	prefix.SessionTokenData = session.sessionTokenData
+	prefix.SessionTokenSequence = session.sessionTokenSequence
+
+	header := &socket.sendHeader
+	*header = core.PayloadHeader{}
+	copy(header.SessionId[:], session.sessionId)
+	header.Sequence = session.sendSequence
+	header.Ack = session.receiveSequence
+	header.AckBits = ack_bits
+	if session.hasChallengeToken {
+		header.GatewayId = session.challengeTokenGatewayId
+		header.Flags = core.Flags_ChallengeToken
+	} else {
+		header.GatewayId = session.gatewayId
+	}
+	header.ServerId = session.serverId
+	header.PacketType = core.PacketType_Payload
+
+	index := 0
+
+	core.WriteObject(packetData, &index, prefix)
+	core.WriteObject(packetData, &index, header)
+	if session.hasChallengeToken {
+		core.WriteBytes(packetData, &index, session.challengeTokenData[:], core.EncryptedChallengeTokenBytes)
+	}
+	core.WriteBytes(packetData, &index, loadgen.payload, len(loadgen.payload))
+	encryptFinish := index
+	index += core.PostfixBytes
+
+	var nonce [core.NonceBytes_Box]byte
+	nonceIndex := 0
+	core.WriteUint64(nonce[:], &nonceIndex, session.sendSequence)
+
+	core.Encrypt_SharedBox(session.sharedKey[:], nonce[:], packetData[core.PayloadPacketEncryptIndex:encryptFinish+core.HMACBytes_Box], encryptFinish-core.PayloadPacketEncryptIndex)
+
+	packetBytes := index
+
+	core.WritePacketFilter(packetData[:packetBytes], &socket.address, &session.gatewayAddress)
+
+	// remember when each packet was sent, to time the round trip when it is acked
+
+	session.sentPackets[session.sendSequence%SequenceBufferSize] = session.sendSequence
+	session.sendTimes[session.sendSequence%SequenceBufferSize] = currentTime
+	session.sendSequence++
+
+	return packetBytes
+}
+
+// receiveThread reads packets from the gateway and hands each one to the session it is for.
+func (loadgen *LoadGen) receiveThread(socket *loadSocket) {
+
+	defer loadgen.wg.Done()
+
+	logger := loadgen.logger.With("socket", socket.index)
+
+	batchConn := loadgen.transport.NewPacketConn(socket.socket, loadgen.config.BatchSize, MaxPacketSize)
+
+	ackBuffer := make([]uint64, SequenceBufferSize)
+	scratch := make([]byte, MaxPacketSize)
+
+	var sessions []*session
+
+	for {
+
+		numPackets, err := batchConn.ReadBatch()
+		if err != nil {
+			logger.Debug("failed to read udp packets: %v", err)
+			return
+		}
+
+		packetsReceived := uint64(0)
+		bytesReceived := uint64(0)
+
+		for packetIndex := 0; packetIndex < numPackets; packetIndex++ {
+
+			packetData, from := batchConn.Packet(packetIndex)
+
+			packetBytes := len(packetData)
+
+			if packetBytes < core.PrefixBytes || packetData[0] != core.PacketVersion {
+				continue
+			}
+
+			if !core.BasicPacketFilter(packetData, packetBytes) {
+				continue
+			}
+
+			var magic [core.MagicBytes]byte
+
+			var fromAddressData [4]byte
+			var fromAddressPort uint16
+
+			var toAddressData [4]byte
+			var toAddressPort uint16
+
+			core.GetAddressData(from, fromAddressData[:], &fromAddressPort)
+			core.GetAddressData(&socket.address, toAddressData[:], &toAddressPort)
+
+			if !core.AdvancedPacketFilter(packetData, magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, packetBytes) {
+				continue
+			}
+
+			switch packetData[core.VersionBytes] {
+
+			case core.PacketType_Payload, core.PacketType_Keepalive:
+
+				if packetBytes < core.KeepalivePacketBytes {
+					continue
+				}
+
+				sessionId := packetData[core.PrefixBytes : core.PrefixBytes+core.SessionIdBytes]
+
+				socket.mutex.Lock()
+				session := socket.sessions[string(sessionId)]
+				socket.mutex.Unlock()
+
+				if session == nil {
+					continue
+				}
+
+				session.mutex.Lock()
+				if !session.ended && core.AddressEqual(from, &session.gatewayAddress) {
+					if loadgen.processPayloadPacket(socket, session, packetData, ackBuffer) {
+						packetsReceived++
+						bytesReceived += uint64(packetBytes)
+					}
+				}
+				session.mutex.Unlock()
+
+			case core.PacketType_Challenge, core.PacketType_Disconnect:
+
+				// these don't say which session they are for, so each session on the socket tries to decrypt it
+
+				sessions = socket.sessionList(sessions[:0])
+
+				for _, session := range sessions {
+					session.mutex.Lock()
+					processed := false
+					if !session.ended && core.AddressEqual(from, &session.gatewayAddress) {
+						copy(scratch, packetData)
+						if packetData[core.VersionBytes] == core.PacketType_Challenge {
+							processed = loadgen.processChallengePacket(session, scratch[:packetBytes])
+						} else {
+							processed = loadgen.processDisconnectPacket(socket, session, scratch[:packetBytes])
+						}
+					}
+					session.mutex.Unlock()
+					if processed {
+						break
+					}
+				}
+			}
+		}
+
+		atomic.AddUint64(&loadgen.counters.PacketsReceived, packetsReceived)
+		atomic.AddUint64(&loadgen.counters.BytesReceived, bytesReceived)
+	}
+}
+
+// processPayloadPacket decrypts a payload or keepalive packet from the gateway in place, and processes its acks and
+// session token the same way a client does. It returns false if the packet is dropped. The session mutex must be held.
+func (loadgen *LoadGen) processPayloadPacket(socket *loadSocket, session *session, packetData []byte, ackBuffer []uint64) bool {
+
+	packetBytes := len(packetData)
+
+	prefix := &socket.receivePrefix
+	header := &socket.receiveHeader
+
+	index := 0
+	if !core.ReadObject(packetData, &index, prefix) || !core.ReadObject(packetData, &index, header) {
+		return false
+	}
+
+	encryptedData := packetData[core.PayloadPacketEncryptIndex : packetBytes-core.PittleBytes]
+
+	var nonce [core.NonceBytes_Box]byte
+	nonceIndex := 0
+	core.WriteUint64(nonce[:], &nonceIndex, header.Sequence)
+	nonce[9] |= (1 << 0)
+	nonce[9] &= 1 ^ (1 << 1)
+
+	if err := core.Decrypt_SharedBox(session.sharedKey[:], nonce[:], encryptedData, len(encryptedData)); err != nil {
+		return false
+	}
+
+	index = core.PrefixBytes
+	core.ReadObject(packetData, &index, header)
+
+	if header.PacketType != prefix.PacketType {
+		return false
+	}
+
+	sequence := header.Sequence
+
+	if session.replayProtection.Check(sequence) != core.ReplayProtection_Accept {
+		return false
+	}
+
+	session.replayProtection.Advance(sequence)
+
+	if sequence > session.receiveSequence {
+		session.receiveSequence = sequence
+	}
+
+	session.receivedPackets[sequence%SequenceBufferSize] = sequence
+
+	// update session token if the gateway has a newer one
+
+	if prefix.SessionTokenSequence > session.sessionTokenSequence {
+		session.sessionTokenData = prefix.SessionTokenData
+		session.sessionTokenSequence = prefix.SessionTokenSequence
+		session.sessionTokenExpireTime = loadgen.clock.Now().Add(time.Second * core.ConnectTokenExpireSeconds)
+	}
+
+	// process acks, and time the round trip of each newly acked packet
+
+	acks := core.ProcessAcks(header.Ack, header.AckBits[:], session.ackedPackets[:], ackBuffer)
+
+	currentTime := loadgen.clock.Now()
+
+	socket.mutex.Lock()
+	for _, ack := range acks {
+		session.ackedPackets[ack%SequenceBufferSize] = ack
+		if session.sentPackets[ack%SequenceBufferSize] == ack {
+			socket.latency.Record(currentTime.Sub(session.sendTimes[ack%SequenceBufferSize]))
+		}
+	}
+	socket.mutex.Unlock()
+
+	atomic.AddUint64(&loadgen.counters.PacketsAcked, uint64(len(acks)))
+
+	// remember the gateway and server, they go in every packet we send
+
+	session.gatewayId = header.GatewayId
+	session.serverId = header.ServerId
+
+	session.hasChallengeToken = false
+
+	loadgen.setConnected(session)
+
+	return true
+}
+
+// processChallengePacket returns false if the challenge packet is not for this session. The session mutex must be held.
+func (loadgen *LoadGen) processChallengePacket(session *session, packetData []byte) bool {
+
+	var challengePacket core.ChallengePacket
+	if !challengePacket.Read(packetData, session.sharedKey[:]) {
+		return false
+	}
+
+	atomic.AddUint64(&loadgen.counters.ChallengePacketsReceived, 1)
+
+	packetChallengeSequence := challengePacket.Sequence
+
+	if !session.hasChallengeToken || session.challengeTokenSequence < packetChallengeSequence {
+		if session.connected {
+			session.connected = false
+			atomic.AddInt64(&loadgen.connected, -1)
+		}
+		session.hasChallengeToken = true
+		session.challengeTokenData = challengePacket.ChallengeTokenData
+		session.challengeTokenSequence = packetChallengeSequence
+		session.challengeTokenExpireTime = loadgen.clock.Now().Add(2 * time.Second)
+		session.challengeTokenGatewayId = challengePacket.GatewayId
+	}
+
+	return true
+}
+
+// processDisconnectPacket returns false if the disconnect packet is not for this session. The session mutex must be held.
+func (loadgen *LoadGen) processDisconnectPacket(socket *loadSocket, session *session, packetData []byte) bool {
+
+	var disconnectPacket core.DisconnectPacket
+	if !disconnectPacket.Read(packetData, session.sharedKey[:]) {
+		return false
+	}
+
+	loadgen.logger.Debug("session %s disconnected by gateway %s: %s", core.IdString(session.sessionId), core.IdString(disconnectPacket.GatewayId[:]), core.DisconnectReasonString(disconnectPacket.Reason))
+
+	atomic.AddUint64(&loadgen.counters.SessionsDisconnected, 1)
+
+	loadgen.endSession(socket, session)
+
+	return true
+}
@@ -0,0 +1,102 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package loadgen
+
+import (
+	"testing"
+	"time"
+
+	"github.com/networknext/udpx/modules/cluster"
+	"github.com/networknext/udpx/modules/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+
+	t.Parallel()
+
+	histogram := &Histogram{}
+
+	assert.Equal(t, time.Duration(0), histogram.Percentile(50))
+
+	for i := 1; i <= 1000; i++ {
+		histogram.Record(time.Duration(i) * time.Millisecond)
+	}
+
+	assert.Equal(t, uint64(1000), histogram.Count())
+	assert.Equal(t, time.Second, histogram.Max())
+	assert.InEpsilon(t, float64(500*time.Millisecond), float64(histogram.Percentile(50)), 0.01)
+	assert.InEpsilon(t, float64(990*time.Millisecond), float64(histogram.Percentile(99)), 0.01)
+	assert.Equal(t, time.Second, histogram.Percentile(100))
+
+	other := &Histogram{}
+	other.Record(time.Minute)
+	histogram.Merge(other)
+
+	assert.Equal(t, uint64(1001), histogram.Count())
+	assert.Equal(t, time.Minute, histogram.Percentile(100))
+}
+
+func TestLoadGen(t *testing.T) {
+
+	t.Parallel()
+
+	c, err := cluster.New(3, core.SystemClock)
+	assert.Nil(t, err)
+
+	config := &Config{}
+	config.AuthURL = cluster.AuthURL
+	config.BindAddress = "0.0.0.0"
+	config.Sessions = 10
+	config.Sockets = 2
+	config.PayloadBytes = core.MaxPayloadBytes
+	config.PacketsPerSecond = 20
+	config.BatchSize = core.DefaultBatchSize
+	config.HTTPClient = c.HTTPClient
+
+	loadgen := New(config, c.Network)
+	assert.Nil(t, loadgen.Start())
+
+	// every socket sends from the same address, so the gateway lets sessions through the handshake a few at a time
+
+	connected := false
+	for i := 0; i < 100 && !connected; i++ {
+		time.Sleep(100 * time.Millisecond)
+		connected = loadgen.Connected() == config.Sessions
+	}
+	assert.True(t, connected)
+
+	time.Sleep(time.Second)
+
+	loadgen.Stop()
+
+	counters := loadgen.Counters()
+	assert.Equal(t, uint64(10), counters.SessionsStarted)
+	assert.Equal(t, uint64(0), counters.SessionsTimedOut)
+	assert.True(t, counters.PacketsAcked > 0)
+	assert.True(t, counters.PacketsReceived > 0)
+	assert.True(t, loadgen.Latency().Count() > 0)
+
+	assert.Equal(t, uint64(10), c.Gateway.Counters().SessionsCreated)
+	assert.Equal(t, uint64(0), c.Server.Counters().PayloadMismatches)
+
+	assert.True(t, c.Close())
+}
@@ -0,0 +1,60 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Messages are read from client payloads, so any input must be rejected cleanly, not panic.
+
+func FuzzReadMessage(f *testing.F) {
+
+	registry := NewRegistry(2)
+	registry.Register(0, &testChat{})
+	registry.Register(1, &testMessage{})
+
+	buffer := make([]byte, 1024)
+	bytes, _ := registry.Write(buffer, &testMessage{Name: "player", Items: []int32{1, 2, 3}, Target: &testVector{X: 1}})
+	f.Add(append([]byte(nil), buffer[:bytes]...))
+	bytes, _ = registry.Write(buffer, &testChat{Text: "hello"})
+	f.Add(append([]byte(nil), buffer[:bytes]...))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		message, bytes, err := registry.Read(data)
+		if err != nil {
+			return
+		}
+		assert.True(t, bytes <= len(data))
+
+		// anything that reads must write back at the same size
+
+		buffer := make([]byte, len(data))
+		writeBytes, err := registry.Write(buffer, message)
+		assert.Nil(t, err)
+		assert.Equal(t, bytes, writeBytes)
+	})
+}
@@ -0,0 +1,583 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package message serializes Go structs to and from payload bytes through a core.Stream, so game code doesn't hand roll
+// offsets. Fields are bit-packed according to their struct tags, eg.
+//
+//	type PlayerInput struct {
+//		Frame    uint32
+//		Buttons  uint16  `serialize:"bits=10"`
+//		Health   int32   `serialize:"min=0,max=100"`
+//		Aim      float32 `serialize:"min=-180,max=180,resolution=0.1"`
+//		Name     string  `serialize:"maxlen=32"`
+//		Items    []int32 `serialize:"maxcount=8,min=0,max=255"`
+//		Target   *Vector `serialize:"optional"`
+//		Internal int     `serialize:"-"`
+//	}
+//
+// Untagged integers and floats are written at full width. Strings need maxlen, and slices need maxcount. Options
+// other than maxcount apply to each element of a slice or array. Pointers must be optional, and are sent with a bit
+// saying whether they are set. Types that implement core.Serializable serialize themselves.
+package message
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/networknext/udpx/modules/core"
+)
+
+const TagName = "serialize"
+
+type codec interface {
+	serialize(stream core.Stream, value reflect.Value)
+}
+
+var codecs sync.Map
+
+var serializableType = reflect.TypeOf((*core.Serializable)(nil)).Elem()
+
+// codecFor builds the codec for a struct type the first time it is seen, and caches it, so tags are only parsed once.
+func codecFor(structType reflect.Type) (codec, error) {
+	if cached, ok := codecs.Load(structType); ok {
+		return cached.(codec), nil
+	}
+	if structType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%v is not a struct", structType)
+	}
+	result, err := newCodec(structType, tagOptions{})
+	if err != nil {
+		return nil, err
+	}
+	codecs.Store(structType, result)
+	return result, nil
+}
+
+// ------------------------------------------------------------
+
+type tagOptions struct {
+	skip          bool
+	optional      bool
+	bits          int
+	hasRange      bool
+	min           float64
+	max           float64
+	resolution    float64
+	hasResolution bool
+	maxLength     int
+	maxCount      int
+}
+
+func parseTag(tag string) (tagOptions, error) {
+	var options tagOptions
+	if tag == "" {
+		return options, nil
+	}
+	if tag == "-" {
+		options.skip = true
+		return options, nil
+	}
+	hasMin := false
+	hasMax := false
+	for _, option := range strings.Split(tag, ",") {
+		option = strings.TrimSpace(option)
+		if option == "optional" {
+			options.optional = true
+			continue
+		}
+		keyValue := strings.SplitN(option, "=", 2)
+		if len(keyValue) != 2 {
+			return options, fmt.Errorf("unknown option '%s'", option)
+		}
+		key, value := keyValue[0], keyValue[1]
+		var err error
+		switch key {
+		case "bits":
+			options.bits, err = strconv.Atoi(value)
+			if err == nil && (options.bits < 1 || options.bits > 64) {
+				err = fmt.Errorf("must be between 1 and 64")
+			}
+		case "min":
+			options.min, err = strconv.ParseFloat(value, 64)
+			hasMin = true
+		case "max":
+			options.max, err = strconv.ParseFloat(value, 64)
+			hasMax = true
+		case "resolution":
+			options.resolution, err = strconv.ParseFloat(value, 64)
+			options.hasResolution = true
+			if err == nil && options.resolution <= 0 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "maxlen":
+			options.maxLength, err = strconv.Atoi(value)
+			if err == nil && options.maxLength < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "maxcount":
+			options.maxCount, err = strconv.Atoi(value)
+			if err == nil && options.maxCount < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		default:
+			return options, fmt.Errorf("unknown option '%s'", key)
+		}
+		if err != nil {
+			return options, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	if hasMin != hasMax {
+		return options, fmt.Errorf("min and max must be set together")
+	}
+	if hasMin {
+		if options.min >= options.max {
+			return options, fmt.Errorf("min must be less than max")
+		}
+		options.hasRange = true
+	}
+	if options.hasResolution && !options.hasRange {
+		return options, fmt.Errorf("resolution needs min and max")
+	}
+	if options.bits != 0 && options.hasRange {
+		return options, fmt.Errorf("bits can't be set with min and max")
+	}
+	return options, nil
+}
+
+func newCodec(valueType reflect.Type, options tagOptions) (codec, error) {
+
+	if valueType.Kind() != reflect.Ptr && reflect.PtrTo(valueType).Implements(serializableType) {
+		return serializableCodec{}, nil
+	}
+
+	switch valueType.Kind() {
+
+	case reflect.Bool:
+		return boolCodec{}, nil
+
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint:
+		return newIntegerCodec(valueType, options, false)
+
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int:
+		return newIntegerCodec(valueType, options, true)
+
+	case reflect.Float32, reflect.Float64:
+		if options.bits != 0 {
+			return nil, fmt.Errorf("floats can't have bits, use min, max and resolution")
+		}
+		if options.hasRange && !options.hasResolution {
+			return nil, fmt.Errorf("quantized floats need a resolution")
+		}
+		if options.hasResolution && (options.max-options.min)/options.resolution > math.MaxUint32 {
+			return nil, fmt.Errorf("resolution is too fine for the range")
+		}
+		return floatCodec{options: options}, nil
+
+	case reflect.String:
+		if options.maxLength == 0 {
+			return nil, fmt.Errorf("strings need maxlen")
+		}
+		return stringCodec{maxLength: options.maxLength}, nil
+
+	case reflect.Slice:
+		if options.maxCount == 0 {
+			return nil, fmt.Errorf("slices need maxcount")
+		}
+		countBits := core.BitsRequired(uint32(options.maxCount))
+		if valueType.Elem().Kind() == reflect.Uint8 && options.bits == 0 && !options.hasRange {
+			return bytesCodec{maxCount: options.maxCount, countBits: countBits}, nil
+		}
+		elementOptions := options
+		elementOptions.maxCount = 0
+		element, err := newCodec(valueType.Elem(), elementOptions)
+		if err != nil {
+			return nil, err
+		}
+		return sliceCodec{maxCount: options.maxCount, countBits: countBits, element: element}, nil
+
+	case reflect.Array:
+		element, err := newCodec(valueType.Elem(), options)
+		if err != nil {
+			return nil, err
+		}
+		return arrayCodec{element: element}, nil
+
+	case reflect.Ptr:
+		if !options.optional {
+			return nil, fmt.Errorf("pointers must be optional")
+		}
+		elementOptions := options
+		elementOptions.optional = false
+		element, err := newCodec(valueType.Elem(), elementOptions)
+		if err != nil {
+			return nil, err
+		}
+		return optionalCodec{elementType: valueType.Elem(), element: element}, nil
+
+	case reflect.Struct:
+		return newStructCodec(valueType)
+	}
+
+	return nil, fmt.Errorf("can't serialize %v", valueType)
+}
+
+func newStructCodec(structType reflect.Type) (codec, error) {
+	var result structCodec
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		options, err := parseTag(field.Tag.Get(TagName))
+		if err != nil {
+			return nil, fmt.Errorf("%v.%s: %v", structType, field.Name, err)
+		}
+		if options.skip {
+			continue
+		}
+		fieldCodec, err := newCodec(field.Type, options)
+		if err != nil {
+			return nil, fmt.Errorf("%v.%s: %v", structType, field.Name, err)
+		}
+		result.fields = append(result.fields, structField{index: i, codec: fieldCodec})
+	}
+	return result, nil
+}
+
+func newIntegerCodec(valueType reflect.Type, options tagOptions, signed bool) (codec, error) {
+	if options.hasResolution {
+		return nil, fmt.Errorf("integers can't have a resolution")
+	}
+	width := valueType.Bits()
+	result := integerCodec{signed: signed, bits: width}
+	if options.bits != 0 {
+		if signed {
+			return nil, fmt.Errorf("signed integers need min and max instead of bits")
+		}
+		if options.bits > width {
+			return nil, fmt.Errorf("%d bits don't fit in %v", options.bits, valueType)
+		}
+		result.bits = options.bits
+	}
+	if options.hasRange {
+		if options.min != math.Trunc(options.min) || options.max != math.Trunc(options.max) {
+			return nil, fmt.Errorf("integer min and max must be whole numbers")
+		}
+		if !signed && options.min < 0 {
+			return nil, fmt.Errorf("unsigned integers can't have a negative min")
+		}
+		var limit float64
+		if signed {
+			limit = math.Ldexp(1, width-1)
+		} else {
+			limit = math.Ldexp(1, width)
+		}
+		if options.min < -limit || options.max >= limit {
+			return nil, fmt.Errorf("min and max don't fit in %v", valueType)
+		}
+		result.hasRange = true
+		result.min = int64(options.min)
+		result.max = int64(options.max)
+		result.bits = bitsRequired64(uint64(result.max - result.min))
+	}
+	return result, nil
+}
+
+func bitsRequired64(max uint64) int {
+	if max > math.MaxUint32 {
+		return 32 + core.BitsRequired(uint32(max>>32))
+	}
+	return core.BitsRequired(uint32(max))
+}
+
+// serializeUint64 serializes up to 64 bits, 32 at a time.
+func serializeUint64(stream core.Stream, value *uint64, bits int) {
+	low := uint32(*value)
+	high := uint32(*value >> 32)
+	if bits <= 32 {
+		stream.SerializeBits(&low, bits)
+	} else {
+		stream.SerializeBits(&low, 32)
+		stream.SerializeBits(&high, bits-32)
+	}
+	*value = uint64(low) | uint64(high)<<32
+}
+
+// ------------------------------------------------------------
+
+type boolCodec struct{}
+
+func (boolCodec) serialize(stream core.Stream, value reflect.Value) {
+	boolValue := value.Bool()
+	stream.SerializeBool(&boolValue)
+	if stream.IsReading() {
+		value.SetBool(boolValue)
+	}
+}
+
+type integerCodec struct {
+	signed   bool
+	bits     int
+	hasRange bool
+	min      int64
+	max      int64
+}
+
+func (integer integerCodec) serialize(stream core.Stream, value reflect.Value) {
+	var uintValue uint64
+	if stream.IsWriting() {
+		if integer.signed {
+			intValue := value.Int()
+			if integer.hasRange && (intValue < integer.min || intValue > integer.max) {
+				stream.SetError(core.ErrStreamInvalid)
+				return
+			}
+			uintValue = uint64(intValue - integer.min)
+		} else {
+			uintValue = value.Uint()
+			if integer.hasRange && (uintValue < uint64(integer.min) || uintValue > uint64(integer.max)) {
+				stream.SetError(core.ErrStreamInvalid)
+				return
+			}
+			uintValue -= uint64(integer.min)
+		}
+		if integer.bits < 64 {
+			uintValue &= (1 << uint(integer.bits)) - 1
+			if !integer.hasRange && !integer.signed && uintValue != value.Uint() {
+				stream.SetError(core.ErrStreamInvalid)
+				return
+			}
+		}
+	}
+	serializeUint64(stream, &uintValue, integer.bits)
+	if !stream.IsReading() || stream.Error() != nil {
+		return
+	}
+	if integer.hasRange && uintValue > uint64(integer.max-integer.min) {
+		stream.SetError(core.ErrStreamInvalid)
+		return
+	}
+	if integer.signed {
+		intValue := int64(uintValue) + integer.min
+		if !integer.hasRange && integer.bits < 64 {
+			// sign extend full width values
+			shift := uint(64 - integer.bits)
+			intValue = intValue << shift >> shift
+		}
+		value.SetInt(intValue)
+	} else {
+		value.SetUint(uintValue + uint64(integer.min))
+	}
+}
+
+type floatCodec struct {
+	options tagOptions
+}
+
+func (float floatCodec) serialize(stream core.Stream, value reflect.Value) {
+	if float.options.hasResolution {
+		floatValue := float32(value.Float())
+		stream.SerializeCompressedFloat(&floatValue, float32(float.options.min), float32(float.options.max), float32(float.options.resolution))
+		if stream.IsReading() {
+			value.SetFloat(float64(floatValue))
+		}
+		return
+	}
+	if value.Kind() == reflect.Float32 {
+		floatValue := float32(value.Float())
+		stream.SerializeFloat32(&floatValue)
+		if stream.IsReading() {
+			value.SetFloat(float64(floatValue))
+		}
+		return
+	}
+	floatValue := value.Float()
+	stream.SerializeFloat64(&floatValue)
+	if stream.IsReading() {
+		value.SetFloat(floatValue)
+	}
+}
+
+type stringCodec struct {
+	maxLength int
+}
+
+func (str stringCodec) serialize(stream core.Stream, value reflect.Value) {
+	stringValue := value.String()
+	stream.SerializeString(&stringValue, str.maxLength)
+	if stream.IsReading() && stream.Error() == nil {
+		value.SetString(stringValue)
+	}
+}
+
+type bytesCodec struct {
+	maxCount  int
+	countBits int
+}
+
+func (bytes bytesCodec) serialize(stream core.Stream, value reflect.Value) {
+	count := uint32(value.Len())
+	if stream.IsWriting() && count > uint32(bytes.maxCount) {
+		stream.SetError(core.ErrStreamInvalid)
+		return
+	}
+	stream.SerializeBits(&count, bytes.countBits)
+	if stream.IsReading() {
+		if stream.Error() != nil || count > uint32(bytes.maxCount) {
+			stream.SetError(core.ErrStreamInvalid)
+			return
+		}
+		value.SetBytes(make([]byte, count))
+	}
+	stream.SerializeBytes(value.Bytes())
+}
+
+type sliceCodec struct {
+	maxCount  int
+	countBits int
+	element   codec
+}
+
+func (slice sliceCodec) serialize(stream core.Stream, value reflect.Value) {
+	count := uint32(value.Len())
+	if stream.IsWriting() && count > uint32(slice.maxCount) {
+		stream.SetError(core.ErrStreamInvalid)
+		return
+	}
+	stream.SerializeBits(&count, slice.countBits)
+	if stream.IsReading() {
+		if stream.Error() != nil || count > uint32(slice.maxCount) {
+			stream.SetError(core.ErrStreamInvalid)
+			return
+		}
+		value.Set(reflect.MakeSlice(value.Type(), int(count), int(count)))
+	}
+	for i := 0; i < int(count) && stream.Error() == nil; i++ {
+		slice.element.serialize(stream, value.Index(i))
+	}
+}
+
+type arrayCodec struct {
+	element codec
+}
+
+func (array arrayCodec) serialize(stream core.Stream, value reflect.Value) {
+	for i := 0; i < value.Len() && stream.Error() == nil; i++ {
+		array.element.serialize(stream, value.Index(i))
+	}
+}
+
+type optionalCodec struct {
+	elementType reflect.Type
+	element     codec
+}
+
+func (optional optionalCodec) serialize(stream core.Stream, value reflect.Value) {
+	present := !value.IsNil()
+	stream.SerializeBool(&present)
+	if !present || stream.Error() != nil {
+		if stream.IsReading() {
+			value.Set(reflect.Zero(value.Type()))
+		}
+		return
+	}
+	if stream.IsReading() {
+		value.Set(reflect.New(optional.elementType))
+	}
+	optional.element.serialize(stream, value.Elem())
+}
+
+type structField struct {
+	index int
+	codec codec
+}
+
+type structCodec struct {
+	fields []structField
+}
+
+func (structure structCodec) serialize(stream core.Stream, value reflect.Value) {
+	for _, field := range structure.fields {
+		if stream.Error() != nil {
+			return
+		}
+		field.codec.serialize(stream, value.Field(field.index))
+	}
+}
+
+type serializableCodec struct{}
+
+func (serializableCodec) serialize(stream core.Stream, value reflect.Value) {
+	value.Addr().Interface().(core.Serializable).Serialize(stream)
+}
+
+// ------------------------------------------------------------
+
+func structValue(message interface{}) (reflect.Value, error) {
+	value := reflect.ValueOf(message)
+	if value.Kind() != reflect.Ptr || value.IsNil() || value.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("message must be a pointer to a struct, not %T", message)
+	}
+	return value.Elem(), nil
+}
+
+// Serialize writes, reads or measures a message with the stream, according to the struct tags of its fields. The message must be a pointer to a struct.
+func Serialize(stream core.Stream, message interface{}) error {
+	value, err := structValue(message)
+	if err != nil {
+		return err
+	}
+	messageCodec, err := codecFor(value.Type())
+	if err != nil {
+		return err
+	}
+	messageCodec.serialize(stream, value)
+	return stream.Error()
+}
+
+// Write writes the message to the start of the buffer, and returns the number of bytes written.
+func Write(buffer []byte, message interface{}) (int, error) {
+	stream := core.NewWriteStream(buffer)
+	if err := Serialize(stream, message); err != nil {
+		return 0, err
+	}
+	return stream.BytesProcessed(), nil
+}
+
+// Read reads the message from the start of the buffer, and returns the number of bytes read.
+func Read(buffer []byte, message interface{}) (int, error) {
+	stream := core.NewReadStream(buffer)
+	if err := Serialize(stream, message); err != nil {
+		return 0, err
+	}
+	return stream.BytesProcessed(), nil
+}
+
+// Measure returns the number of bytes Write would write.
+func Measure(message interface{}) (int, error) {
+	stream := core.NewMeasureStream()
+	if err := Serialize(stream, message); err != nil {
+		return 0, err
+	}
+	return stream.BytesProcessed(), nil
+}
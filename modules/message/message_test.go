@@ -0,0 +1,283 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package message
+
+import (
+	"testing"
+
+	"github.com/networknext/udpx/modules/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testVector struct {
+	X float32 `serialize:"min=-100,max=100,resolution=0.01"`
+	Y float32 `serialize:"min=-100,max=100,resolution=0.01"`
+}
+
+type testMessage struct {
+	Frame    uint32
+	Buttons  uint16 `serialize:"bits=10"`
+	Health   int32  `serialize:"min=-10,max=100"`
+	Big      int64
+	Small    int8
+	Aim      float32 `serialize:"min=-180,max=180,resolution=0.1"`
+	Speed    float64
+	Alive    bool
+	Name     string  `serialize:"maxlen=16"`
+	Items    []int32 `serialize:"maxcount=8,min=0,max=255"`
+	Data     []byte  `serialize:"maxcount=32"`
+	Corners  [2]testVector
+	Target   *testVector `serialize:"optional"`
+	Missing  *testVector `serialize:"optional"`
+	Token    core.SessionToken
+	Internal int `serialize:"-"`
+	private  int
+}
+
+type testChat struct {
+	Text string `serialize:"maxlen=64"`
+}
+
+func TestMessage(t *testing.T) {
+
+	t.Parallel()
+
+	message := testMessage{
+		Frame:    123456789,
+		Buttons:  1000,
+		Health:   -5,
+		Big:      -1234567890123,
+		Small:    -100,
+		Aim:      45.5,
+		Speed:    3.14159,
+		Alive:    true,
+		Name:     "player",
+		Items:    []int32{1, 2, 255},
+		Data:     []byte{1, 2, 3, 4, 5},
+		Corners:  [2]testVector{{X: 1.5, Y: -2.25}, {X: 99.99, Y: -100}},
+		Target:   &testVector{X: 10, Y: 20},
+		Internal: 7,
+		private:  8,
+	}
+	message.Token.ExpireTimestamp = 0x1234567890
+	message.Token.SessionId[0] = 42
+
+	buffer := make([]byte, 1024)
+	bytes, err := Write(buffer, &message)
+	assert.Nil(t, err)
+
+	measured, err := Measure(&message)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes, measured)
+
+	var readMessage testMessage
+	readBytes, err := Read(buffer[:bytes], &readMessage)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes, readBytes)
+
+	assert.Equal(t, message.Frame, readMessage.Frame)
+	assert.Equal(t, message.Buttons, readMessage.Buttons)
+	assert.Equal(t, message.Health, readMessage.Health)
+	assert.Equal(t, message.Big, readMessage.Big)
+	assert.Equal(t, message.Small, readMessage.Small)
+	assert.InDelta(t, message.Aim, readMessage.Aim, 0.1)
+	assert.Equal(t, message.Speed, readMessage.Speed)
+	assert.Equal(t, message.Alive, readMessage.Alive)
+	assert.Equal(t, message.Name, readMessage.Name)
+	assert.Equal(t, message.Items, readMessage.Items)
+	assert.Equal(t, message.Data, readMessage.Data)
+	for i := range message.Corners {
+		assert.InDelta(t, message.Corners[i].X, readMessage.Corners[i].X, 0.01)
+		assert.InDelta(t, message.Corners[i].Y, readMessage.Corners[i].Y, 0.01)
+	}
+	assert.NotNil(t, readMessage.Target)
+	assert.InDelta(t, message.Target.X, readMessage.Target.X, 0.01)
+	assert.InDelta(t, message.Target.Y, readMessage.Target.Y, 0.01)
+	assert.Nil(t, readMessage.Missing)
+	assert.Equal(t, message.Token, readMessage.Token)
+	assert.Equal(t, 0, readMessage.Internal)
+	assert.Equal(t, 0, readMessage.private)
+
+	// truncated messages fail to read
+
+	for i := 0; i < bytes-1; i++ {
+		_, err := Read(buffer[:i], &readMessage)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestMessageBits(t *testing.T) {
+
+	t.Parallel()
+
+	type packed struct {
+		A uint8 `serialize:"bits=3"`
+		B int32 `serialize:"min=0,max=15"`
+		C bool
+	}
+
+	bytes, err := Measure(&packed{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, bytes)
+}
+
+func TestMessageOutOfRange(t *testing.T) {
+
+	t.Parallel()
+
+	buffer := make([]byte, 1024)
+
+	_, err := Write(buffer, &testMessage{Health: 101})
+	assert.NotNil(t, err)
+
+	_, err = Write(buffer, &testMessage{Buttons: 1024})
+	assert.NotNil(t, err)
+
+	_, err = Write(buffer, &testMessage{Name: "this name is far too long"})
+	assert.NotNil(t, err)
+
+	_, err = Write(buffer, &testMessage{Items: make([]int32, 9)})
+	assert.NotNil(t, err)
+
+	_, err = Write(buffer, &testMessage{Items: []int32{256}})
+	assert.NotNil(t, err)
+
+	_, err = Write(buffer[:4], &testMessage{})
+	assert.NotNil(t, err)
+}
+
+func TestMessageBadTags(t *testing.T) {
+
+	t.Parallel()
+
+	buffer := make([]byte, 1024)
+
+	_, err := Write(buffer, &struct {
+		Name string
+	}{})
+	assert.NotNil(t, err)
+
+	_, err = Write(buffer, &struct {
+		Items []int32
+	}{})
+	assert.NotNil(t, err)
+
+	_, err = Write(buffer, &struct {
+		Target *testVector
+	}{})
+	assert.NotNil(t, err)
+
+	_, err = Write(buffer, &struct {
+		Value int32 `serialize:"bits=8"`
+	}{})
+	assert.NotNil(t, err)
+
+	_, err = Write(buffer, &struct {
+		Value uint8 `serialize:"bits=9"`
+	}{})
+	assert.NotNil(t, err)
+
+	_, err = Write(buffer, &struct {
+		Value float32 `serialize:"min=0,max=1"`
+	}{})
+	assert.NotNil(t, err)
+
+	_, err = Write(buffer, &struct {
+		Value int32 `serialize:"min=5,max=1"`
+	}{})
+	assert.NotNil(t, err)
+
+	_, err = Write(buffer, &struct {
+		Value int32 `serialize:"unknown=1"`
+	}{})
+	assert.NotNil(t, err)
+
+	_, err = Write(buffer, &struct {
+		Values map[int]int
+	}{})
+	assert.NotNil(t, err)
+
+	_, err = Write(buffer, testChat{})
+	assert.NotNil(t, err)
+}
+
+func TestRegistry(t *testing.T) {
+
+	t.Parallel()
+
+	registry := NewRegistry(3)
+
+	assert.Nil(t, registry.Register(0, &testChat{}))
+	assert.Nil(t, registry.Register(2, &testMessage{}))
+
+	assert.NotNil(t, registry.Register(0, &testVector{}))
+	assert.NotNil(t, registry.Register(1, &testChat{}))
+	assert.NotNil(t, registry.Register(3, &testVector{}))
+	assert.NotNil(t, registry.Register(1, &struct{ Name string }{}))
+
+	messageType, ok := registry.MessageType(&testChat{})
+	assert.True(t, ok)
+	assert.Equal(t, 0, messageType)
+
+	_, ok = registry.MessageType(&testVector{})
+	assert.False(t, ok)
+
+	buffer := make([]byte, 1024)
+
+	bytes, err := registry.Write(buffer, &testChat{Text: "hello"})
+	assert.Nil(t, err)
+
+	message, readBytes, err := registry.Read(buffer[:bytes])
+	assert.Nil(t, err)
+	assert.Equal(t, bytes, readBytes)
+	assert.Equal(t, &testChat{Text: "hello"}, message)
+
+	// messages can be packed one after another in the same stream
+
+	writeStream := core.NewWriteStream(buffer)
+	assert.Nil(t, registry.WriteMessage(writeStream, &testChat{Text: "first"}))
+	assert.Nil(t, registry.WriteMessage(writeStream, &testMessage{Frame: 10, Name: "second"}))
+	assert.Nil(t, registry.WriteMessage(writeStream, &testChat{Text: "third"}))
+
+	readStream := core.NewReadStream(buffer[:writeStream.BytesProcessed()])
+
+	message, err = registry.ReadMessage(readStream)
+	assert.Nil(t, err)
+	assert.Equal(t, &testChat{Text: "first"}, message)
+
+	message, err = registry.ReadMessage(readStream)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(10), message.(*testMessage).Frame)
+	assert.Equal(t, "second", message.(*testMessage).Name)
+
+	message, err = registry.ReadMessage(readStream)
+	assert.Nil(t, err)
+	assert.Equal(t, &testChat{Text: "third"}, message)
+
+	// unregistered messages can't be written, and unregistered types can't be read
+
+	_, err = registry.Write(buffer, &testVector{})
+	assert.NotNil(t, err)
+
+	buffer[0] = 1
+	_, _, err = registry.Read(buffer[:1])
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,139 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package message
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/networknext/udpx/modules/core"
+)
+
+// Registry maps message types to the structs that carry them, so a payload can say which message it holds. Client and
+// server must register the same types with the same ids. Register every type before the registry is shared between goroutines.
+type Registry struct {
+	typeBits int
+	types    []reflect.Type
+	ids      map[reflect.Type]int
+}
+
+func NewRegistry(numMessageTypes int) *Registry {
+	if numMessageTypes < 1 {
+		panic("registry needs at least one message type")
+	}
+	return &Registry{
+		typeBits: core.BitsRequired(uint32(numMessageTypes - 1)),
+		types:    make([]reflect.Type, numMessageTypes),
+		ids:      make(map[reflect.Type]int),
+	}
+}
+
+// Register associates the message type with the struct the prototype points to. Struct tags are checked here, so mistakes show up at startup.
+func (registry *Registry) Register(messageType int, prototype interface{}) error {
+	if messageType < 0 || messageType >= len(registry.types) {
+		return fmt.Errorf("message type %d is out of range [0,%d)", messageType, len(registry.types))
+	}
+	value, err := structValue(prototype)
+	if err != nil {
+		return err
+	}
+	structType := value.Type()
+	if registry.types[messageType] != nil {
+		return fmt.Errorf("message type %d is already registered to %v", messageType, registry.types[messageType])
+	}
+	if existing, ok := registry.ids[structType]; ok {
+		return fmt.Errorf("%v is already registered as message type %d", structType, existing)
+	}
+	if _, err := codecFor(structType); err != nil {
+		return err
+	}
+	registry.types[messageType] = structType
+	registry.ids[structType] = messageType
+	return nil
+}
+
+// MessageType returns the registered type of a message.
+func (registry *Registry) MessageType(message interface{}) (int, bool) {
+	value, err := structValue(message)
+	if err != nil {
+		return 0, false
+	}
+	messageType, ok := registry.ids[value.Type()]
+	return messageType, ok
+}
+
+// Create returns a new zeroed message of the given type, or nil if the type isn't registered.
+func (registry *Registry) Create(messageType int) interface{} {
+	if messageType < 0 || messageType >= len(registry.types) || registry.types[messageType] == nil {
+		return nil
+	}
+	return reflect.New(registry.types[messageType]).Interface()
+}
+
+// WriteMessage writes the message type followed by the message. The stream may be a write or measure stream.
+func (registry *Registry) WriteMessage(stream core.Stream, message interface{}) error {
+	value, err := structValue(message)
+	if err != nil {
+		return err
+	}
+	messageType, ok := registry.ids[value.Type()]
+	if !ok {
+		return fmt.Errorf("%v is not a registered message", value.Type())
+	}
+	typeValue := uint32(messageType)
+	stream.SerializeBits(&typeValue, registry.typeBits)
+	return Serialize(stream, message)
+}
+
+// ReadMessage reads a message type and a new message of that type.
+func (registry *Registry) ReadMessage(stream core.Stream) (interface{}, error) {
+	var typeValue uint32
+	stream.SerializeBits(&typeValue, registry.typeBits)
+	if err := stream.Error(); err != nil {
+		return nil, err
+	}
+	message := registry.Create(int(typeValue))
+	if message == nil {
+		return nil, fmt.Errorf("message type %d is not registered", typeValue)
+	}
+	if err := Serialize(stream, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// Write writes the message with its type to the start of the buffer, and returns the number of bytes written.
+func (registry *Registry) Write(buffer []byte, message interface{}) (int, error) {
+	stream := core.NewWriteStream(buffer)
+	if err := registry.WriteMessage(stream, message); err != nil {
+		return 0, err
+	}
+	return stream.BytesProcessed(), nil
+}
+
+// Read reads a message written by Write from the start of the buffer, and returns it with the number of bytes read.
+func (registry *Registry) Read(buffer []byte) (interface{}, int, error) {
+	stream := core.NewReadStream(buffer)
+	message, err := registry.ReadMessage(stream)
+	if err != nil {
+		return nil, 0, err
+	}
+	return message, stream.BytesProcessed(), nil
+}
@@ -0,0 +1,787 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/testmessage"
+)
+
+const MaxPacketSize = 1500
+const SessionMapSwapTime = 60
+const SequenceBufferSize = 1024
+const QueueSize = 1024
+const DisconnectResendTime = 100 * time.Millisecond
+const DrainQuietTime = 250 * time.Millisecond
+const DefaultTickRate = 60
+
+// KeepaliveTimeout is how long a session is sent keepalives after the client stops sending, so the server goes quiet
+// once clients have left.
+const KeepaliveTimeout = 2 * core.KeepaliveInterval
+
+// SendQueueBytes is how many bytes of messages can wait for a session's next send tick, as length prefixed entries.
+const SendQueueBytes = 4 * core.MaxPayloadBytes
+
+type Config struct {
+	BindAddress     string
+	NumThreads      int
+	ReadBuffer      int
+	WriteBuffer     int
+	BatchSize       int
+	TickRate        int
+	ShutdownTimeout time.Duration
+	Logger          *core.Logger
+	Clock           core.Clock
+
+	// ValidateTestMessages counts messages that aren't test traffic from the testmessage package as payload
+	// mismatches, for load and soak tests. Otherwise any message is echoed back.
+	ValidateTestMessages bool
+}
+
+type SessionEntry struct {
+	Logger                        *core.Logger
+	GatewayInternalAddress        net.UDPAddr
+	ClientAddress                 net.UDPAddr
+	SendSequence                  uint64
+	ReceiveSequence               uint64
+	AckedPackets                  [SequenceBufferSize]uint64
+	ReceivedPackets               [SequenceBufferSize]uint64
+	ReplayProtection              core.ReplayProtection
+	SendPayloadId                 uint64
+	SequenceToPayloadId           [SequenceBufferSize]uint64
+	SendBandwidthBitsAccumulator  uint64
+	SendBandwidthBitsPerSecondMax uint64
+	SendBandwidthBitsResetTime    time.Time
+	DisconnectSendTime            time.Time
+	GatewayId                     [core.GatewayIdBytes]byte
+	SessionTokenData              [core.EncryptedSessionTokenBytes]byte
+	SessionTokenSequence          uint64
+	AckPending                    bool
+	IdleKeepaliveSent             bool
+	LastSendTime                  time.Time
+	LastReceiveTime               time.Time
+	SendQueue                     [SendQueueBytes]byte
+	SendQueueLength               int
+}
+
+// queueMessage copies a message onto the session's send queue. It returns false if the queue is full.
+func (sessionEntry *SessionEntry) queueMessage(message []byte) bool {
+	if len(message) == 0 || len(message) > core.MaxMessageBytes || sessionEntry.SendQueueLength+core.MessageLengthBytes+len(message) > SendQueueBytes {
+		return false
+	}
+	core.WriteUint16(sessionEntry.SendQueue[:], &sessionEntry.SendQueueLength, uint16(len(message)))
+	core.WriteBytes(sessionEntry.SendQueue[:], &sessionEntry.SendQueueLength, message, len(message))
+	return true
+}
+
+// writeQueuedMessages adds queued messages to the payload, oldest first, until the next one doesn't fit. It returns
+// how many bytes of the queue were written, to remove once the packet is sent.
+func (sessionEntry *SessionEntry) writeQueuedMessages(writer *core.PayloadWriter) int {
+	index := 0
+	for index < sessionEntry.SendQueueLength {
+		messageIndex := index
+		var messageBytes uint16
+		core.ReadUint16(sessionEntry.SendQueue[:], &messageIndex, &messageBytes)
+		if !writer.AddMessage(sessionEntry.SendQueue[messageIndex : messageIndex+int(messageBytes)]) {
+			break
+		}
+		index = messageIndex + int(messageBytes)
+	}
+	return index
+}
+
+func (sessionEntry *SessionEntry) removeQueuedMessages(queueBytes int) {
+	sessionEntry.SendQueueLength = copy(sessionEntry.SendQueue[:], sessionEntry.SendQueue[queueBytes:sessionEntry.SendQueueLength])
+}
+
+// threadSessions are the sessions a thread's socket receives packets for. They are shared by the thread's receive
+// loop and its send tick, so they are only touched with the mutex held.
+type threadSessions struct {
+	mutex          sync.Mutex
+	sessionMap_Old map[[core.SessionIdBytes]byte]*SessionEntry
+	sessionMap_New map[[core.SessionIdBytes]byte]*SessionEntry
+}
+
+type Counters struct {
+	SessionsCreated          uint64
+	PayloadPacketsReceived   uint64
+	PayloadPacketsSent       uint64
+	PayloadMismatches        uint64
+	MessagesReceived         uint64
+	MessagesDropped          uint64
+	KeepalivePacketsSent     uint64
+	KeepalivePacketsReceived uint64
+}
+
+// Server receives payload packets forwarded by gateways, and sends each session a payload packet back through
+// its gateway every tick, with the messages queued for it and acks for the packets it has received.
+type Server struct {
+	counters       Counters
+	lastPacketTime int64
+	draining       uint32
+	drainedThreads int32
+	config         Config
+	transport      core.Transport
+	logger         *core.Logger
+	clock          core.Clock
+	serverId       []byte
+	sendErrorLog   *core.LogLimiter
+	socket         []core.Socket
+	done           chan struct{}
+	wg             sync.WaitGroup
+}
+
+func New(config *Config, transport core.Transport) *Server {
+	server := &Server{config: *config, transport: transport}
+	server.logger = config.Logger
+	if server.logger == nil {
+		server.logger = core.Log
+	}
+	server.clock = config.Clock
+	if server.clock == nil {
+		server.clock = core.SystemClock
+	}
+	server.serverId = core.RandomBytes(core.ServerIdBytes)
+	// send errors repeat for every batch until the socket recovers, so they are logged at most once per second
+	server.sendErrorLog = core.NewLogLimiter(time.Second)
+	if server.config.TickRate <= 0 {
+		server.config.TickRate = DefaultTickRate
+	}
+	server.done = make(chan struct{})
+	return server
+}
+
+func (server *Server) Id() []byte {
+	return server.serverId
+}
+
+func (server *Server) Counters() Counters {
+	counters := Counters{}
+	counters.SessionsCreated = atomic.LoadUint64(&server.counters.SessionsCreated)
+	counters.PayloadPacketsReceived = atomic.LoadUint64(&server.counters.PayloadPacketsReceived)
+	counters.PayloadPacketsSent = atomic.LoadUint64(&server.counters.PayloadPacketsSent)
+	counters.PayloadMismatches = atomic.LoadUint64(&server.counters.PayloadMismatches)
+	counters.MessagesReceived = atomic.LoadUint64(&server.counters.MessagesReceived)
+	counters.MessagesDropped = atomic.LoadUint64(&server.counters.MessagesDropped)
+	counters.KeepalivePacketsSent = atomic.LoadUint64(&server.counters.KeepalivePacketsSent)
+	counters.KeepalivePacketsReceived = atomic.LoadUint64(&server.counters.KeepalivePacketsReceived)
+	return counters
+}
+
+func (server *Server) isDraining() bool {
+	return atomic.LoadUint32(&server.draining) != 0
+}
+
+// Start binds the sockets and starts the threads.
+func (server *Server) Start() error {
+
+	config := &server.config
+
+	server.logger.Info("starting server on %s", config.BindAddress)
+
+	server.logger.Info("server id is %s", core.IdString(server.serverId))
+
+	options := core.SocketOptions{ReadBuffer: config.ReadBuffer, WriteBuffer: config.WriteBuffer, ReusePort: true}
+
+	server.socket = make([]core.Socket, config.NumThreads)
+
+	for i := 0; i < config.NumThreads; i++ {
+		socket, err := server.transport.Listen(config.BindAddress, options)
+		if err != nil {
+			for j := 0; j < i; j++ {
+				server.socket[j].Close()
+			}
+			return fmt.Errorf("could not bind socket: %v", err)
+		}
+		server.socket[i] = socket
+	}
+
+	server.wg.Add(config.NumThreads * 2)
+
+	for i := 0; i < config.NumThreads; i++ {
+		sessions := &threadSessions{}
+		sessions.sessionMap_Old = make(map[[core.SessionIdBytes]byte]*SessionEntry)
+		sessions.sessionMap_New = make(map[[core.SessionIdBytes]byte]*SessionEntry)
+		go server.thread(i, sessions)
+		go server.sendThread(i, sessions)
+	}
+
+	return nil
+}
+
+// thread reads payload packets from gateways, and queues messages for the send tick to send back.
+func (server *Server) thread(thread int, sessions *threadSessions) {
+
+	config := &server.config
+	clock := server.clock
+	logger := server.logger.With("thread", thread)
+
+	conn := server.socket[thread]
+
+	defer conn.Close()
+
+	batchConn := server.transport.NewPacketConn(conn, config.BatchSize, MaxPacketSize)
+
+	swapTime := clock.Now().Unix() + SessionMapSwapTime
+	swapCount := 0
+
+	// per-thread buffers, so reading a packet doesn't allocate
+
+	var packet core.InternalForwardPacket
+	packet.GatewayAddress.IP = make(net.IP, net.IPv6len)
+	packet.ClientAddress.IP = make(net.IP, net.IPv6len)
+
+	var ackBuffer [SequenceBufferSize]uint64
+
+	var messageBuffer [core.MaxPayloadMessages][]byte
+
+	sentDisconnectPackets := false
+
+	for {
+
+		// read packet
+
+		numPackets, err := batchConn.ReadBatch()
+		if err != nil {
+			if !core.IsTimeout(err) {
+				logger.Debug("failed to read udp packets: %v", err)
+				break
+			}
+			// woken up to start draining
+			conn.SetReadDeadline(time.Time{})
+			numPackets = 0
+		}
+
+		if numPackets > 0 {
+			atomic.StoreInt64(&server.lastPacketTime, time.Now().UnixNano())
+		}
+
+		sessions.mutex.Lock()
+
+		// once draining, tell every session on this thread to reconnect to another server
+
+		if !sentDisconnectPackets && server.isDraining() {
+			for sessionId, sessionEntry := range sessions.sessionMap_Old {
+				if sessions.sessionMap_New[sessionId] == nil {
+					sessions.sessionMap_New[sessionId] = sessionEntry
+				}
+			}
+			currentTime := clock.Now()
+			for sessionId, sessionEntry := range sessions.sessionMap_New {
+				server.sendDisconnectPacket(batchConn, sessionId, sessionEntry, currentTime)
+			}
+			if err := batchConn.Flush(); err != nil {
+				logger.Error("failed to send disconnect packets: %v", err)
+			}
+			logger.Info("sent disconnect packets to %d sessions", len(sessions.sessionMap_New))
+			sentDisconnectPackets = true
+			atomic.AddInt32(&server.drainedThreads, 1)
+		}
+
+		for packetIndex := 0; packetIndex < numPackets; packetIndex++ {
+
+			packetData, _ := batchConn.Packet(packetIndex)
+
+			packetBytes := len(packetData)
+
+			if packetBytes <= 0 {
+				continue
+			}
+
+			// swap session map periodically. times out old sessions without O(n) walk or contention
+
+			swapCount++
+			if swapCount > 100 {
+				currentTime := clock.Now().Unix()
+				if currentTime >= swapTime {
+					swapCount = 0
+					swapTime = currentTime + SessionMapSwapTime
+					sessions.sessionMap_Old = sessions.sessionMap_New
+					sessions.sessionMap_New = make(map[[core.SessionIdBytes]byte]*SessionEntry)
+				}
+			}
+
+			// read packet
+
+			if packetData[0] != core.PacketVersion {
+				logger.Debug("unknown packet version: %d", packetData[0])
+				continue
+			}
+
+			index := 0
+			if !packet.Read(packetData, &index) {
+				logger.Debug("could not read %d byte packet", packetBytes)
+				continue
+			}
+
+			if packet.Header.PacketType != core.PacketType_Payload && packet.Header.PacketType != core.PacketType_Keepalive {
+				logger.Debug("unknown packet type: %d", packet.Header.PacketType)
+				continue
+			}
+
+			if packet.Header.Flags != 0 {
+				logger.Debug("unknown flags")
+				continue
+			}
+
+			sessionId := packet.Header.SessionId
+			sequence := packet.Header.Sequence
+
+			// lookup or create a session entry
+
+			sessionEntry := sessions.sessionMap_New[sessionId]
+
+			if sessionEntry == nil {
+
+				sessionEntry = sessions.sessionMap_Old[sessionId]
+
+				if sessionEntry == nil {
+
+					if server.isDraining() {
+						logger.Debug("draining, ignoring packet for new session")
+						continue
+					}
+
+					// add new session entry
+
+					sessionEntry = &SessionEntry{}
+					sessionEntry.Logger = logger.WithSession(sessionId[:]).With("client", packet.ClientAddress.String())
+					sessionEntry.SendSequence = packet.Header.Ack + 10000
+					sessionEntry.ReceiveSequence = sequence
+					sessionEntry.SendBandwidthBitsPerSecondMax = 10000 * 1000 // todo: gateway needs to pass this up to server (envelopeDownKbps)
+					sessionEntry.SendBandwidthBitsResetTime = clock.Now().Add(time.Second)
+					for i := range sessionEntry.SequenceToPayloadId {
+						sessionEntry.SequenceToPayloadId[i] = ^uint64(0)
+					}
+
+					sessions.sessionMap_New[sessionId] = sessionEntry
+
+					atomic.AddUint64(&server.counters.SessionsCreated, 1)
+
+					sessionEntry.Logger.Info("new session")
+
+				} else {
+
+					// migrate old -> new session map
+					sessions.sessionMap_New[sessionId] = sessionEntry
+
+				}
+			}
+
+			if sessionEntry == nil {
+				// this should never happen
+				panic("no session entry")
+			}
+
+			if sessionEntry.Logger.DebugEnabled() {
+				sessionEntry.Logger.Debug("recv packet sequence = %d ack = %d ack_bits = %x", sequence, packet.Header.Ack, packet.Header.AckBits[:])
+			}
+
+			// drop duplicate and replayed packets
+
+			switch sessionEntry.ReplayProtection.Check(sequence) {
+			case core.ReplayProtection_TooOld:
+				sessionEntry.Logger.Debug("sequence number is too old: %d", sequence)
+				continue
+			case core.ReplayProtection_TooNew:
+				sessionEntry.Logger.Debug("sequence number is too far ahead: %d", sequence)
+				continue
+			case core.ReplayProtection_Duplicate:
+				sessionEntry.Logger.Debug("packet %d has already been received", sequence)
+				continue
+			}
+
+			sessionEntry.ReplayProtection.Advance(sequence)
+
+			sessionEntry.LastReceiveTime = clock.Now()
+
+			// remember where to send the disconnect packet when the server shuts down
+
+			core.CopyAddress(&sessionEntry.GatewayInternalAddress, &packet.GatewayAddress)
+			core.CopyAddress(&sessionEntry.ClientAddress, &packet.ClientAddress)
+
+			// responses go back through the same gateway, with the newest session token it has passed up
+
+			sessionEntry.GatewayId = packet.Header.GatewayId
+			if packet.SessionTokenSequence > sessionEntry.SessionTokenSequence {
+				sessionEntry.SessionTokenData = packet.SessionTokenData
+				sessionEntry.SessionTokenSequence = packet.SessionTokenSequence
+			}
+
+			if sentDisconnectPackets && clock.Now().Sub(sessionEntry.DisconnectSendTime) >= DisconnectResendTime {
+				server.sendDisconnectPacket(batchConn, sessionId, sessionEntry, clock.Now())
+			}
+
+			// update received packet reliability
+
+			if sessionEntry.ReceiveSequence < sequence {
+				sessionEntry.ReceiveSequence = sequence
+			}
+
+			sessionEntry.ReceivedPackets[sequence%SequenceBufferSize] = sequence
+
+			// process packet acks
+
+			acks := core.ProcessAcks(packet.Header.Ack, packet.Header.AckBits[:], sessionEntry.AckedPackets[:], ackBuffer[:])
+
+			for i := range acks {
+				sessionEntry.AckedPackets[acks[i]%SequenceBufferSize] = acks[i]
+				if sessionEntry.Logger.DebugEnabled() {
+					sessionEntry.Logger.Debug("ack packet %d", acks[i])
+					payloadAck := sessionEntry.SequenceToPayloadId[acks[i]%SequenceBufferSize]
+					if payloadAck != ^uint64(0) {
+						sessionEntry.Logger.Debug("ack payload %d", payloadAck)
+					}
+				}
+			}
+
+			// keepalives only carry acks. they are acked too, so the client hears back while neither side has anything to send.
+			// a keepalive that arrives late, within KeepaliveInterval of an idle keepalive from the server, has already been
+			// answered by it. its ack goes in the next packet, so the server sends no more keepalives than the client does
+
+			if packet.Header.PacketType == core.PacketType_Keepalive {
+				atomic.AddUint64(&server.counters.KeepalivePacketsReceived, 1)
+				if !sessionEntry.IdleKeepaliveSent || clock.Now().Sub(sessionEntry.LastSendTime) >= core.KeepaliveInterval {
+					sessionEntry.AckPending = true
+				}
+				continue
+			}
+
+			atomic.AddUint64(&server.counters.PayloadPacketsReceived, 1)
+
+			// split the payload into its messages. a malformed payload is a mismatch, and so is a message that isn't test
+			// traffic, when the server is checking for it
+
+			payload := packet.Payload
+
+			if sessionEntry.Logger.DebugEnabled() {
+				sessionEntry.Logger.Debug("received packet %d with %d byte payload", sequence, len(payload))
+			}
+
+			messages, ok := core.ReadPayloadMessages(payload, messageBuffer[:])
+			if !ok {
+				atomic.AddUint64(&server.counters.PayloadMismatches, 1)
+				sessionEntry.Logger.Error("malformed payload in packet %d (%d bytes)", sequence, len(payload))
+				continue
+			}
+
+			validMessages := true
+			if config.ValidateTestMessages {
+				for i := range messages {
+					if !testmessage.Valid(messages[i]) {
+						validMessages = false
+					}
+				}
+			}
+
+			if !validMessages {
+				atomic.AddUint64(&server.counters.PayloadMismatches, 1)
+				sessionEntry.Logger.Error("message mismatch in packet %d (%d bytes)", sequence, len(payload))
+				continue
+			}
+
+			atomic.AddUint64(&server.counters.MessagesReceived, uint64(len(messages)))
+
+			// echo the messages back on the next send tick (temporary). acks go back then too, even if none fit
+
+			for i := range messages {
+				if !sessionEntry.queueMessage(messages[i]) {
+					atomic.AddUint64(&server.counters.MessagesDropped, 1)
+				}
+			}
+
+			sessionEntry.AckPending = true
+		}
+
+		sessions.mutex.Unlock()
+
+		// send disconnect packets generated by this batch
+
+		if err := batchConn.Flush(); err != nil {
+			logger.ErrorLimited(server.sendErrorLog, "failed to send disconnect packets to gateway: %v", err)
+		}
+	}
+
+	server.wg.Done()
+}
+
+// sendThread sends each of the thread's sessions a payload packet every tick, so downstream traffic runs at the
+// server's rate rather than following the packets the client sends. Sessions with nothing queued and nothing new
+// to ack are only sent a keepalive now and then.
+func (server *Server) sendThread(thread int, sessions *threadSessions) {
+
+	defer server.wg.Done()
+
+	config := &server.config
+	clock := server.clock
+	serverId := server.serverId
+	logger := server.logger.With("thread", thread)
+
+	batchConn := server.transport.NewPacketConn(server.socket[thread], config.BatchSize, MaxPacketSize)
+
+	tickTime := time.Second / time.Duration(config.TickRate)
+
+	// per-thread buffers, so sending a packet doesn't allocate
+
+	var packet core.InternalForwardPacket
+	var payloadWriter core.PayloadWriter
+	payloadBuffer := make([]byte, core.MaxPayloadBytes)
+
+	timer := clock.NewTimer(tickTime)
+	defer timer.Stop()
+
+	for {
+
+		select {
+		case <-timer.C():
+		case <-server.done:
+			return
+		}
+
+		timer.Reset(tickTime)
+
+		currentTime := clock.Now()
+
+		sessions.mutex.Lock()
+
+		for sessionId, sessionEntry := range sessions.sessionMap_New {
+			server.sendPayloadPackets(batchConn, &packet, &payloadWriter, payloadBuffer, serverId, sessionId, sessionEntry, currentTime)
+		}
+
+		// sessions not heard from since the last map swap are still sent to, until they time out of the old map
+
+		for sessionId, sessionEntry := range sessions.sessionMap_Old {
+			if sessions.sessionMap_New[sessionId] == nil {
+				server.sendPayloadPackets(batchConn, &packet, &payloadWriter, payloadBuffer, serverId, sessionId, sessionEntry, currentTime)
+			}
+		}
+
+		sessions.mutex.Unlock()
+
+		if err := batchConn.Flush(); err != nil {
+			logger.ErrorLimited(server.sendErrorLog, "failed to send payloads to gateway: %v", err)
+		}
+	}
+}
+
+// sendPayloadPackets sends a session its queued messages, with acks for the packets received from it. It sends
+// as many packets as it takes to empty the queue, while they fit in the session's downstream bandwidth. With nothing
+// queued, acks go back in a keepalive on the next tick, so the client isn't left waiting for them. With nothing to
+// ack either, a keepalive still goes once nothing has been sent or received for KeepaliveInterval, to hold the
+// session open, until the client has been quiet for KeepaliveTimeout.
+func (server *Server) sendPayloadPackets(batchConn core.PacketConn, packet *core.InternalForwardPacket, payloadWriter *core.PayloadWriter, payloadBuffer []byte, serverId []byte, sessionId [core.SessionIdBytes]byte, sessionEntry *SessionEntry, currentTime time.Time) {
+
+	if sessionEntry.SendQueueLength == 0 && !sessionEntry.AckPending {
+		sinceReceive := currentTime.Sub(sessionEntry.LastReceiveTime)
+		if currentTime.Sub(sessionEntry.LastSendTime) < core.KeepaliveInterval || sinceReceive < core.KeepaliveInterval || sinceReceive >= KeepaliveTimeout {
+			return
+		}
+	}
+
+	if sessionEntry.SendBandwidthBitsResetTime.Before(currentTime) {
+		sendBandwidthMbps := float64(sessionEntry.SendBandwidthBitsAccumulator) / 1000000.0
+		sessionEntry.SendBandwidthBitsResetTime = currentTime.Add(time.Second)
+		sessionEntry.SendBandwidthBitsAccumulator = 0
+		sessionEntry.Logger.Debug("session is %.2f mbps", sendBandwidthMbps)
+	}
+
+	for server.sendPayloadPacket(batchConn, packet, payloadWriter, payloadBuffer, serverId, sessionId, sessionEntry, currentTime) && sessionEntry.SendQueueLength > 0 {
+	}
+}
+
+// sendPayloadPacket sends a session one payload packet with as many queued messages as fit, or a keepalive if none
+// are queued. It returns false if the packet would exceed the session's downstream bandwidth, so the messages wait
+// for a later tick.
+func (server *Server) sendPayloadPacket(batchConn core.PacketConn, packet *core.InternalForwardPacket, payloadWriter *core.PayloadWriter, payloadBuffer []byte, serverId []byte, sessionId [core.SessionIdBytes]byte, sessionEntry *SessionEntry, currentTime time.Time) bool {
+
+	// pack as many queued messages as fit
+
+	payloadWriter.Reset(payloadBuffer)
+	queueBytes := sessionEntry.writeQueuedMessages(payloadWriter)
+
+	packetType := core.PacketType_Keepalive
+	payload := payloadBuffer[:0]
+	packetBytes := core.KeepalivePacketBytes
+	if payloadWriter.NumMessages() > 0 {
+		packetType = core.PacketType_Payload
+		payload = payloadWriter.Finish()
+		packetBytes = core.PacketBytesFromPayload(len(payload))
+	}
+
+	// do we have enough bandwidth available to send this packet?
+
+	wireBits := uint64(core.WirePacketBits(packetBytes))
+
+	if sessionEntry.SendBandwidthBitsAccumulator+wireBits > sessionEntry.SendBandwidthBitsPerSecondMax {
+		sessionEntry.Logger.Info("choke")
+		return false
+	}
+
+	sessionEntry.SendBandwidthBitsAccumulator += wireBits
+
+	// build the payload packet. it goes back through the gateway the session's packets last came from
+
+	packet.GatewayAddress = sessionEntry.GatewayInternalAddress
+	packet.ClientAddress = sessionEntry.ClientAddress
+	packet.SessionTokenData = sessionEntry.SessionTokenData
+	packet.SessionTokenSequence = sessionEntry.SessionTokenSequence
+	packet.Header.SessionId = sessionId
+	packet.Header.Sequence = sessionEntry.SendSequence
+	packet.Header.Ack = sessionEntry.ReceiveSequence
+	core.GetAckBits(sessionEntry.ReceiveSequence, sessionEntry.ReceivedPackets[:], packet.Header.AckBits[:])
+	packet.Header.GatewayId = sessionEntry.GatewayId
+	copy(packet.Header.ServerId[:], serverId)
+	packet.Header.PacketType = packetType
+	packet.Header.Flags = 0
+	packet.Payload = payload
+
+	if sessionEntry.Logger.DebugEnabled() {
+		sessionEntry.Logger.Debug("send packet sequence = %d ack = %d ack_bits = %x", packet.Header.Sequence, packet.Header.Ack, packet.Header.AckBits[:])
+	}
+
+	packetData := batchConn.WritePacket()
+
+	index := 0
+	packet.Write(packetData, &index)
+
+	batchConn.CommitPacket(index, &sessionEntry.GatewayInternalAddress)
+
+	sessionEntry.LastSendTime = currentTime
+	sessionEntry.IdleKeepaliveSent = packetType == core.PacketType_Keepalive && !sessionEntry.AckPending
+
+	if packetType == core.PacketType_Keepalive {
+		atomic.AddUint64(&server.counters.KeepalivePacketsSent, 1)
+	} else {
+		atomic.AddUint64(&server.counters.PayloadPacketsSent, 1)
+	}
+
+	if sessionEntry.Logger.DebugEnabled() {
+		sessionEntry.Logger.Debug("send %d byte packet to %s", index, sessionEntry.GatewayInternalAddress.String())
+	}
+
+	// update reliability
+
+	sessionEntry.removeQueuedMessages(queueBytes)
+	sessionEntry.AckPending = false
+	if packetType == core.PacketType_Payload {
+		sessionEntry.SequenceToPayloadId[sessionEntry.SendSequence%SequenceBufferSize] = sessionEntry.SendPayloadId
+		sessionEntry.SendPayloadId++
+	} else {
+		sessionEntry.SequenceToPayloadId[sessionEntry.SendSequence%SequenceBufferSize] = ^uint64(0)
+	}
+	sessionEntry.SendSequence++
+
+	return true
+}
+
+// Shutdown drains the server: new sessions are refused, each session is sent a disconnect packet through
+// its gateway, responses to packets in flight are still sent, and /health reports draining. Then the sockets
+// are closed. It returns false if this didn't finish within the shutdown timeout.
+func (server *Server) Shutdown() bool {
+
+	shutdownStartTime := time.Now()
+	shutdownDeadline := shutdownStartTime.Add(server.config.ShutdownTimeout)
+
+	// stop accepting new sessions, and wake up the threads so they send disconnect packets even if no packets arrive
+
+	atomic.StoreUint32(&server.draining, 1)
+
+	for i := range server.socket {
+		server.socket[i].SetReadDeadline(time.Now())
+	}
+
+	// keep responding to packets in flight, until clients have stopped sending
+
+	for time.Now().Before(shutdownDeadline) {
+		quietSince := time.Unix(0, atomic.LoadInt64(&server.lastPacketTime))
+		if quietSince.Before(shutdownStartTime) {
+			quietSince = shutdownStartTime
+		}
+		if atomic.LoadInt32(&server.drainedThreads) == int32(server.config.NumThreads) && time.Since(quietSince) >= DrainQuietTime {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// stop the send ticks, and close sockets so the read loops end
+
+	close(server.done)
+
+	for i := range server.socket {
+		server.socket[i].Close()
+	}
+
+	return core.WaitDeadline(&server.wg, shutdownDeadline)
+}
+
+// sendDisconnectPacket asks the session's gateway to tell the client the server is shutting down.
+func (server *Server) sendDisconnectPacket(batchConn core.PacketConn, sessionId [core.SessionIdBytes]byte, sessionEntry *SessionEntry, currentTime time.Time) {
+	disconnectPacket := core.InternalDisconnectPacket{ClientAddress: sessionEntry.ClientAddress, SessionId: sessionId, Reason: core.DisconnectReason_ServerShutdown}
+	disconnectPacketData := batchConn.WritePacket()
+	index := 0
+	core.WriteObject(disconnectPacketData, &index, &disconnectPacket)
+	batchConn.CommitPacket(index, &sessionEntry.GatewayInternalAddress)
+	sessionEntry.DisconnectSendTime = currentTime
+	sessionEntry.Logger.Debug("send %d byte disconnect packet to %s", index, sessionEntry.GatewayInternalAddress.String())
+}
+
+func (server *Server) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+	if server.isDraining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("draining"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+func (server *Server) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	counters := server.Counters()
+	fmt.Fprintf(w, "hello world\n")
+	fmt.Fprintf(w, "sessions created: %d\n", counters.SessionsCreated)
+	fmt.Fprintf(w, "payload packets received: %d\n", counters.PayloadPacketsReceived)
+	fmt.Fprintf(w, "payload packets sent: %d\n", counters.PayloadPacketsSent)
+	fmt.Fprintf(w, "payload mismatches: %d\n", counters.PayloadMismatches)
+	fmt.Fprintf(w, "messages received: %d\n", counters.MessagesReceived)
+	fmt.Fprintf(w, "messages dropped: %d\n", counters.MessagesDropped)
+	fmt.Fprintf(w, "keepalive packets sent: %d\n", counters.KeepalivePacketsSent)
+	fmt.Fprintf(w, "keepalive packets received: %d\n", counters.KeepalivePacketsReceived)
+}
+
+// MetricsHandler writes the counters as JSON, for tools like soak that scrape them.
+func (server *Server) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(server.Counters())
+}
@@ -0,0 +1,258 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdleAcks(t *testing.T) {
+
+	t.Parallel()
+
+	clock := core.NewFakeClock(time.Unix(1700000000, 0))
+
+	network := core.NewVirtualNetwork(1, clock)
+	defer network.Close()
+
+	config := &Config{}
+	config.BindAddress = "0.0.0.0:50000"
+	config.NumThreads = 1
+	config.BatchSize = core.DefaultBatchSize
+	config.ShutdownTimeout = time.Second
+	config.Clock = clock
+
+	server := New(config, network)
+	assert.Nil(t, server.Start())
+
+	// the test is the gateway, passing on keepalives from an idle client
+
+	gatewayAddress := core.ParseAddress("127.0.0.1:40001")
+	serverAddress := core.ParseAddress("127.0.0.1:50000")
+
+	socket, err := network.Listen(gatewayAddress.String(), core.SocketOptions{})
+	assert.Nil(t, err)
+
+	conn := network.NewPacketConn(socket, core.DefaultBatchSize, MaxPacketSize)
+
+	tickTime := time.Second / DefaultTickRate
+
+	var packet core.InternalForwardPacket
+	packet.GatewayAddress = *gatewayAddress
+	packet.ClientAddress = *core.ParseAddress("127.0.0.1:30000")
+	copy(packet.Header.SessionId[:], core.RandomBytes(core.SessionIdBytes))
+	packet.Header.PacketType = core.PacketType_Keepalive
+
+	var response core.InternalForwardPacket
+	response.GatewayAddress.IP = make(net.IP, net.IPv6len)
+	response.ClientAddress.IP = make(net.IP, net.IPv6len)
+
+	readResponse := func() bool {
+		socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+		numPackets, err := conn.ReadBatch()
+		if !assert.Nil(t, err) || !assert.Equal(t, 1, numPackets) {
+			return false
+		}
+		packetData, _ := conn.Packet(0)
+		index := 0
+		return assert.True(t, response.Read(packetData, &index))
+	}
+
+	sendKeepalive := func(sequence uint64) {
+
+		keepalivesReceived := server.Counters().KeepalivePacketsReceived
+
+		packet.Header.Sequence = sequence
+		packetData := conn.WritePacket()
+		index := 0
+		packet.Write(packetData, &index)
+		conn.CommitPacket(index, serverAddress)
+		assert.Nil(t, conn.Flush())
+
+		for start := time.Now(); server.Counters().KeepalivePacketsReceived == keepalivesReceived && time.Since(start) < 5*time.Second; {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// each keepalive is acked on the next tick, even though the last ack went out less than a keepalive interval ago
+
+	for sequence := uint64(1000); sequence < 1010; sequence++ {
+
+		sendKeepalive(sequence)
+
+		clock.Advance(tickTime)
+
+		if !readResponse() {
+			break
+		}
+
+		assert.Equal(t, core.PacketType_Keepalive, response.Header.PacketType)
+		assert.Equal(t, sequence, response.Header.Ack)
+	}
+
+	// with nothing to ack, keepalives only go once nothing has been sent or received for a keepalive interval
+
+	clock.Advance(tickTime)
+
+	socket.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	numPackets, _ := conn.ReadBatch()
+	assert.Equal(t, 0, numPackets)
+
+	clock.Advance(core.KeepaliveInterval)
+
+	if readResponse() {
+		assert.Equal(t, core.PacketType_Keepalive, response.Header.PacketType)
+		assert.Equal(t, uint64(1009), response.Header.Ack)
+	}
+
+	// a late keepalive from the client has already been answered by that one, so it isn't acked by itself. its ack
+	// goes in the next keepalive
+
+	sendKeepalive(1010)
+
+	clock.Advance(tickTime)
+
+	socket.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	numPackets, _ = conn.ReadBatch()
+	assert.Equal(t, 0, numPackets)
+
+	clock.Advance(core.KeepaliveInterval)
+
+	if readResponse() {
+		assert.Equal(t, core.PacketType_Keepalive, response.Header.PacketType)
+		assert.Equal(t, uint64(1010), response.Header.Ack)
+	}
+
+	// they stop once the client has been quiet for the keepalive timeout
+
+	clock.Advance(KeepaliveTimeout)
+
+	socket.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	numPackets, _ = conn.ReadBatch()
+	assert.Equal(t, 0, numPackets)
+
+	assert.Equal(t, uint64(12), server.Counters().KeepalivePacketsSent)
+
+	assert.True(t, server.Shutdown())
+}
+
+func TestEchoMessages(t *testing.T) {
+
+	t.Parallel()
+
+	for _, validate := range []bool{false, true} {
+
+		clock := core.NewFakeClock(time.Unix(1700000000, 0))
+
+		network := core.NewVirtualNetwork(1, clock)
+
+		config := &Config{}
+		config.BindAddress = "0.0.0.0:50000"
+		config.NumThreads = 1
+		config.BatchSize = core.DefaultBatchSize
+		config.ShutdownTimeout = time.Second
+		config.Clock = clock
+		config.ValidateTestMessages = validate
+
+		server := New(config, network)
+		assert.Nil(t, server.Start())
+
+		// the test is the gateway, passing on a payload from a client with messages that aren't test traffic
+
+		gatewayAddress := core.ParseAddress("127.0.0.1:40001")
+		serverAddress := core.ParseAddress("127.0.0.1:50000")
+
+		socket, err := network.Listen(gatewayAddress.String(), core.SocketOptions{})
+		assert.Nil(t, err)
+
+		conn := network.NewPacketConn(socket, core.DefaultBatchSize, MaxPacketSize)
+
+		var payloadWriter core.PayloadWriter
+		payloadWriter.Reset(make([]byte, core.MaxPayloadBytes))
+		assert.True(t, payloadWriter.AddMessage([]byte("hello")))
+		assert.True(t, payloadWriter.AddMessage([]byte("world")))
+
+		var packet core.InternalForwardPacket
+		packet.GatewayAddress = *gatewayAddress
+		packet.ClientAddress = *core.ParseAddress("127.0.0.1:30000")
+		copy(packet.Header.SessionId[:], core.RandomBytes(core.SessionIdBytes))
+		packet.Header.Sequence = 1000
+		packet.Header.PacketType = core.PacketType_Payload
+		packet.Payload = payloadWriter.Finish()
+
+		packetData := conn.WritePacket()
+		index := 0
+		packet.Write(packetData, &index)
+		conn.CommitPacket(index, serverAddress)
+		assert.Nil(t, conn.Flush())
+
+		for start := time.Now(); server.Counters().MessagesReceived+server.Counters().PayloadMismatches == 0 && time.Since(start) < 5*time.Second; {
+			time.Sleep(time.Millisecond)
+		}
+
+		if !validate {
+
+			// any message is echoed back on a send tick. ticks are stepped until it comes, since the send thread
+			// may not have started its timer yet
+
+			assert.Equal(t, uint64(0), server.Counters().PayloadMismatches)
+			assert.Equal(t, uint64(2), server.Counters().MessagesReceived)
+
+			var response core.InternalForwardPacket
+			response.GatewayAddress.IP = make(net.IP, net.IPv6len)
+			response.ClientAddress.IP = make(net.IP, net.IPv6len)
+
+			numPackets := 0
+			for i := 0; i < 100 && numPackets == 0; i++ {
+				clock.Advance(time.Second / DefaultTickRate)
+				socket.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+				numPackets, _ = conn.ReadBatch()
+			}
+
+			if assert.Equal(t, 1, numPackets) {
+				packetData, _ := conn.Packet(0)
+				index := 0
+				assert.True(t, response.Read(packetData, &index))
+				assert.Equal(t, core.PacketType_Payload, response.Header.PacketType)
+				var messageBuffer [core.MaxPayloadMessages][]byte
+				messages, ok := core.ReadPayloadMessages(response.Payload, messageBuffer[:])
+				assert.True(t, ok)
+				assert.Equal(t, [][]byte{[]byte("hello"), []byte("world")}, messages)
+			}
+
+		} else {
+
+			// checking for test traffic, they are a mismatch
+
+			assert.Equal(t, uint64(1), server.Counters().PayloadMismatches)
+			assert.Equal(t, uint64(0), server.Counters().MessagesReceived)
+		}
+
+		assert.True(t, server.Shutdown())
+
+		network.Close()
+	}
+}
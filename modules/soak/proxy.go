@@ -0,0 +1,185 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package soak
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+)
+
+const MaxPacketSize = 1500
+
+// Proxy sits between clients and a gateway on real sockets, and impairs packets in both directions the same
+// way the virtual network does. Each client gets its own upstream socket, so the gateway still sees one address
+// per client. The upstream port is fixed by the client port, so a client can be told its address as the gateway
+// sees it before it sends anything.
+type Proxy struct {
+	conn             *net.UDPConn
+	gatewayAddress   *net.UDPAddr
+	clientBasePort   int
+	upstreamBasePort int
+	conditions       core.NetworkConditions
+	logger           *core.Logger
+	mutex            sync.Mutex
+	random           *rand.Rand
+	upstreams        map[int]*net.UDPConn
+	closed           bool
+	wg               sync.WaitGroup
+}
+
+// UpstreamPort is the port the gateway sees packets from the client on.
+func UpstreamPort(clientPort int, clientBasePort int, upstreamBasePort int) int {
+	return clientPort - clientBasePort + upstreamBasePort
+}
+
+// NewProxy listens on the proxy address and starts forwarding to the gateway.
+func NewProxy(proxyAddress *net.UDPAddr, gatewayAddress *net.UDPAddr, clientBasePort int, upstreamBasePort int, conditions core.NetworkConditions, seed int64) (*Proxy, error) {
+	conn, err := net.ListenUDP("udp", proxyAddress)
+	if err != nil {
+		return nil, fmt.Errorf("could not bind proxy socket: %v", err)
+	}
+	proxy := &Proxy{
+		conn:             conn,
+		gatewayAddress:   gatewayAddress,
+		clientBasePort:   clientBasePort,
+		upstreamBasePort: upstreamBasePort,
+		conditions:       conditions,
+		logger:           core.Log.With("proxy", proxyAddress.String()),
+		random:           rand.New(rand.NewSource(seed)),
+		upstreams:        make(map[int]*net.UDPConn),
+	}
+	proxy.wg.Add(1)
+	go proxy.clientThread()
+	return proxy, nil
+}
+
+// Close closes every socket and waits for the proxy goroutines to finish. Packets still being delayed are dropped.
+func (proxy *Proxy) Close() {
+	proxy.mutex.Lock()
+	proxy.closed = true
+	proxy.conn.Close()
+	for _, upstream := range proxy.upstreams {
+		upstream.Close()
+	}
+	proxy.mutex.Unlock()
+	proxy.wg.Wait()
+}
+
+func (proxy *Proxy) clientThread() {
+
+	defer proxy.wg.Done()
+
+	buffer := make([]byte, MaxPacketSize)
+
+	for {
+		packetBytes, from, err := proxy.conn.ReadFromUDP(buffer)
+		if err != nil {
+			proxy.logger.Debug("proxy stopped: %v", err)
+			return
+		}
+		upstream := proxy.upstream(from)
+		if upstream == nil {
+			continue
+		}
+		proxy.forward(upstream, proxy.gatewayAddress, buffer[:packetBytes])
+	}
+}
+
+func (proxy *Proxy) gatewayThread(upstream *net.UDPConn, clientAddress *net.UDPAddr) {
+
+	defer proxy.wg.Done()
+
+	buffer := make([]byte, MaxPacketSize)
+
+	for {
+		packetBytes, from, err := upstream.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if !core.AddressEqual(from, proxy.gatewayAddress) {
+			continue
+		}
+		proxy.forward(proxy.conn, clientAddress, buffer[:packetBytes])
+	}
+}
+
+// upstream gets the socket for packets from a client to the gateway, binding it the first time the client is seen
+func (proxy *Proxy) upstream(clientAddress *net.UDPAddr) *net.UDPConn {
+
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+
+	if proxy.closed {
+		return nil
+	}
+
+	if upstream, ok := proxy.upstreams[clientAddress.Port]; ok {
+		return upstream
+	}
+
+	upstreamPort := UpstreamPort(clientAddress.Port, proxy.clientBasePort, proxy.upstreamBasePort)
+	if upstreamPort <= 0 || upstreamPort > 65535 {
+		proxy.logger.Warn("dropped packet from unexpected client %s", clientAddress)
+		return nil
+	}
+
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: upstreamPort})
+	if err != nil {
+		proxy.logger.Error("could not bind upstream socket for client %s: %v", clientAddress, err)
+		return nil
+	}
+
+	proxy.upstreams[clientAddress.Port] = upstream
+
+	upstreamClientAddress := &net.UDPAddr{}
+	core.CopyAddress(upstreamClientAddress, clientAddress)
+
+	proxy.wg.Add(1)
+	go proxy.gatewayThread(upstream, upstreamClientAddress)
+
+	return upstream
+}
+
+func (proxy *Proxy) forward(conn *net.UDPConn, to *net.UDPAddr, packetData []byte) {
+
+	var delays [2]time.Duration
+	var reordered [2]bool
+
+	proxy.mutex.Lock()
+	copies := core.ImpairPacket(proxy.random, &proxy.conditions, &delays, &reordered)
+	proxy.mutex.Unlock()
+
+	for i := 0; i < copies; i++ {
+		if delays[i] <= 0 {
+			conn.WriteToUDP(packetData, to)
+			continue
+		}
+		packetCopy := make([]byte, len(packetData))
+		copy(packetCopy, packetData)
+		time.AfterFunc(delays[i], func() {
+			conn.WriteToUDP(packetCopy, to)
+		})
+	}
+}
@@ -0,0 +1,235 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package soak
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+
+	"gopkg.in/yaml.v3"
+)
+
+const MaxClients = 1000
+const MaxGateways = 100
+const MaxServers = 100
+
+const (
+	Service_Auth    = "auth"
+	Service_Gateway = "gateway"
+	Service_Server  = "server"
+)
+
+// Scenario is what a soak run does, and what it must see to pass. Auth runs once per gateway, so restarts
+// of auth take the same index as the gateway it hands out.
+type Scenario struct {
+	Name       string        `yaml:"name"`
+	Clients    int           `yaml:"clients"`
+	Duration   time.Duration `yaml:"duration"`
+	Churn      float64       `yaml:"churn"`
+	Gateways   int           `yaml:"gateways"`
+	Servers    int           `yaml:"servers"`
+	Impairment Impairment    `yaml:"impairment"`
+	Restarts   []Restart     `yaml:"restarts"`
+	Thresholds Thresholds    `yaml:"thresholds"`
+}
+
+// Impairment is applied to packets between clients and gateways, in both directions.
+type Impairment struct {
+	Latency   time.Duration `yaml:"latency"`
+	Jitter    time.Duration `yaml:"jitter"`
+	Loss      float64       `yaml:"loss"`
+	Duplicate float64       `yaml:"duplicate"`
+	Reorder   float64       `yaml:"reorder"`
+}
+
+// Restart stops a service at a time into the run with SIGTERM, and starts it again.
+type Restart struct {
+	At      time.Duration `yaml:"at"`
+	Service string        `yaml:"service"`
+	Index   int           `yaml:"index"`
+}
+
+// Thresholds are the limits a run must stay within. Zero means none of that thing is allowed, except for the
+// minimum payload ack rate, where zero turns the check off.
+type Thresholds struct {
+	MaxDisconnectRate       float64 `yaml:"max_disconnect_rate"`
+	MaxClientErrors         uint64  `yaml:"max_client_errors"`
+	MaxTokenRefreshFailures uint64  `yaml:"max_token_refresh_failures"`
+	MaxPayloadMismatches    uint64  `yaml:"max_payload_mismatches"`
+	MinPayloadAckRate       float64 `yaml:"min_payload_ack_rate"`
+}
+
+// Stats are collected from the exit codes and metrics of every process in a run.
+type Stats struct {
+	ClientSessions             uint64
+	Disconnects                uint64
+	Reconnects                 uint64
+	ClientErrors               uint64
+	Crashes                    uint64
+	ShutdownFailures           uint64
+	PayloadsSent               uint64
+	PayloadsAcked              uint64
+	PayloadMismatches          uint64
+	SessionTokenUpdates        uint64
+	SessionTokenUpdateFailures uint64
+}
+
+// LoadScenario reads a scenario from a YAML file. Unknown keys are an error, so a typo in a threshold can't
+// quietly turn a check off.
+func LoadScenario(filename string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read scenario: %v", err)
+	}
+	scenario, err := ParseScenario(data)
+	if err != nil {
+		return nil, fmt.Errorf("scenario %s: %v", filename, err)
+	}
+	return scenario, nil
+}
+
+// ParseScenario parses a scenario, fills in defaults and validates it.
+func ParseScenario(data []byte) (*Scenario, error) {
+	scenario := &Scenario{Clients: 10, Duration: time.Minute, Gateways: 1, Servers: 1}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(scenario); err != nil {
+		return nil, err
+	}
+	if err := scenario.Validate(); err != nil {
+		return nil, err
+	}
+	return scenario, nil
+}
+
+func (scenario *Scenario) Validate() error {
+	if scenario.Clients < 1 || scenario.Clients > MaxClients {
+		return fmt.Errorf("clients must be between 1 and %d", MaxClients)
+	}
+	if scenario.Duration <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+	if scenario.Churn < 0 {
+		return fmt.Errorf("churn must not be negative")
+	}
+	if scenario.Gateways < 1 || scenario.Gateways > MaxGateways {
+		return fmt.Errorf("gateways must be between 1 and %d", MaxGateways)
+	}
+	if scenario.Servers < 1 || scenario.Servers > MaxServers {
+		return fmt.Errorf("servers must be between 1 and %d", MaxServers)
+	}
+	impairment := &scenario.Impairment
+	if impairment.Latency < 0 || impairment.Jitter < 0 {
+		return fmt.Errorf("impairment latency and jitter must not be negative")
+	}
+	if !isProbability(impairment.Loss) || !isProbability(impairment.Duplicate) || !isProbability(impairment.Reorder) {
+		return fmt.Errorf("impairment loss, duplicate and reorder must be between 0 and 1")
+	}
+	for i, restart := range scenario.Restarts {
+		count := 0
+		switch restart.Service {
+		case Service_Auth, Service_Gateway:
+			count = scenario.Gateways
+		case Service_Server:
+			count = scenario.Servers
+		default:
+			return fmt.Errorf("restart %d: unknown service '%s'", i, restart.Service)
+		}
+		if restart.Index < 0 || restart.Index >= count {
+			return fmt.Errorf("restart %d: there is no %s %d", i, restart.Service, restart.Index)
+		}
+		if restart.At < 0 || restart.At >= scenario.Duration {
+			return fmt.Errorf("restart %d: must be during the run", i)
+		}
+	}
+	thresholds := &scenario.Thresholds
+	if !isProbability(thresholds.MaxDisconnectRate) || !isProbability(thresholds.MinPayloadAckRate) {
+		return fmt.Errorf("thresholds max_disconnect_rate and min_payload_ack_rate must be between 0 and 1")
+	}
+	return nil
+}
+
+func isProbability(value float64) bool {
+	return value >= 0 && value <= 1
+}
+
+func (impairment *Impairment) Conditions() core.NetworkConditions {
+	return core.NetworkConditions{
+		Latency:   impairment.Latency,
+		Jitter:    impairment.Jitter,
+		Loss:      impairment.Loss,
+		Duplicate: impairment.Duplicate,
+		Reorder:   impairment.Reorder,
+	}
+}
+
+// DisconnectRate is the fraction of client sessions that timed out.
+func (stats *Stats) DisconnectRate() float64 {
+	if stats.ClientSessions == 0 {
+		return 0
+	}
+	return float64(stats.Disconnects) / float64(stats.ClientSessions)
+}
+
+// PayloadAckRate is the fraction of payloads sent by clients that were acked by a server.
+func (stats *Stats) PayloadAckRate() float64 {
+	if stats.PayloadsSent == 0 {
+		return 0
+	}
+	return float64(stats.PayloadsAcked) / float64(stats.PayloadsSent)
+}
+
+// Check returns a description of each threshold the stats break. A service crashing, or not shutting down
+// cleanly when it is restarted, always fails the run.
+func (scenario *Scenario) Check(stats *Stats) []string {
+	thresholds := &scenario.Thresholds
+	failures := []string{}
+	if stats.Crashes > 0 {
+		failures = append(failures, fmt.Sprintf("%d services crashed", stats.Crashes))
+	}
+	if stats.ShutdownFailures > 0 {
+		failures = append(failures, fmt.Sprintf("%d services did not shut down cleanly", stats.ShutdownFailures))
+	}
+	if stats.ClientSessions == 0 {
+		failures = append(failures, "no clients were started")
+	}
+	if rate := stats.DisconnectRate(); rate > thresholds.MaxDisconnectRate {
+		failures = append(failures, fmt.Sprintf("disconnect rate %.4f is above %.4f", rate, thresholds.MaxDisconnectRate))
+	}
+	if stats.ClientErrors > thresholds.MaxClientErrors {
+		failures = append(failures, fmt.Sprintf("%d client errors, more than %d", stats.ClientErrors, thresholds.MaxClientErrors))
+	}
+	if stats.SessionTokenUpdateFailures > thresholds.MaxTokenRefreshFailures {
+		failures = append(failures, fmt.Sprintf("%d token refresh failures, more than %d", stats.SessionTokenUpdateFailures, thresholds.MaxTokenRefreshFailures))
+	}
+	if stats.PayloadMismatches > thresholds.MaxPayloadMismatches {
+		failures = append(failures, fmt.Sprintf("%d payload mismatches, more than %d", stats.PayloadMismatches, thresholds.MaxPayloadMismatches))
+	}
+	if thresholds.MinPayloadAckRate > 0 {
+		if rate := stats.PayloadAckRate(); rate < thresholds.MinPayloadAckRate {
+			failures = append(failures, fmt.Sprintf("payload ack rate %.4f is below %.4f", rate, thresholds.MinPayloadAckRate))
+		}
+	}
+	return failures
+}
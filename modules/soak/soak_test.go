@@ -0,0 +1,128 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package soak
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseScenario(t *testing.T) {
+
+	t.Parallel()
+
+	scenario, err := ParseScenario([]byte(`
+name: test
+clients: 100
+duration: 10m
+churn: 5
+gateways: 2
+servers: 3
+impairment:
+  latency: 20ms
+  jitter: 5ms
+  loss: 0.01
+restarts:
+  - at: 2m
+    service: gateway
+    index: 1
+  - at: 5m
+    service: auth
+thresholds:
+  max_disconnect_rate: 0.01
+  min_payload_ack_rate: 0.9
+`))
+	assert.Nil(t, err)
+
+	assert.Equal(t, "test", scenario.Name)
+	assert.Equal(t, 100, scenario.Clients)
+	assert.Equal(t, 10*time.Minute, scenario.Duration)
+	assert.Equal(t, 5.0, scenario.Churn)
+	assert.Equal(t, 2, scenario.Gateways)
+	assert.Equal(t, 3, scenario.Servers)
+	assert.Equal(t, 20*time.Millisecond, scenario.Impairment.Conditions().Latency)
+	assert.Equal(t, 0.01, scenario.Impairment.Conditions().Loss)
+	assert.Equal(t, []Restart{{At: 2 * time.Minute, Service: Service_Gateway, Index: 1}, {At: 5 * time.Minute, Service: Service_Auth}}, scenario.Restarts)
+	assert.Equal(t, 0.01, scenario.Thresholds.MaxDisconnectRate)
+	assert.Equal(t, uint64(0), scenario.Thresholds.MaxPayloadMismatches)
+
+	scenario, err = ParseScenario([]byte("name: defaults\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 10, scenario.Clients)
+	assert.Equal(t, time.Minute, scenario.Duration)
+	assert.Equal(t, 1, scenario.Gateways)
+	assert.Equal(t, 1, scenario.Servers)
+}
+
+func TestParseScenarioInvalid(t *testing.T) {
+
+	t.Parallel()
+
+	invalid := []string{
+		"client: 10",
+		"clients: 0",
+		"clients: 1001",
+		"duration: 0s",
+		"duration: soon",
+		"churn: -1",
+		"gateways: 0",
+		"servers: 101",
+		"impairment: {loss: 2}",
+		"impairment: {latency: -1ms}",
+		"restarts: [{at: 10s, service: client}]",
+		"restarts: [{at: 10s, service: server, index: 1}]",
+		"restarts: [{at: 2m, service: gateway}]",
+		"thresholds: {max_disconnect_rate: 1.5}",
+		"thresholds: {max_token_refresh_failure: 1}",
+	}
+
+	for _, data := range invalid {
+		_, err := ParseScenario([]byte(data))
+		assert.NotNil(t, err, data)
+	}
+}
+
+func TestCheck(t *testing.T) {
+
+	t.Parallel()
+
+	scenario, err := ParseScenario([]byte(`
+thresholds:
+  max_disconnect_rate: 0.1
+  max_token_refresh_failures: 2
+  min_payload_ack_rate: 0.9
+`))
+	assert.Nil(t, err)
+
+	stats := Stats{ClientSessions: 10, Disconnects: 1, SessionTokenUpdateFailures: 2, PayloadsSent: 100, PayloadsAcked: 95}
+	assert.Empty(t, scenario.Check(&stats))
+
+	stats.Disconnects = 2
+	stats.SessionTokenUpdateFailures = 3
+	stats.PayloadsAcked = 80
+	stats.PayloadMismatches = 1
+	stats.Crashes = 1
+	stats.ShutdownFailures = 1
+	assert.Len(t, scenario.Check(&stats), 6)
+
+	assert.NotEmpty(t, scenario.Check(&Stats{}))
+}
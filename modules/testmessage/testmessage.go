@@ -0,0 +1,67 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package testmessage generates the test traffic the client, load generator and soak tests send, and checks it
+// comes back intact. Messages are a counting byte pattern in a range of sizes, so aggregation is exercised with
+// messages of different sizes, and corruption on the way shows up as a mismatch.
+package testmessage
+
+import (
+	"github.com/networknext/udpx/modules/core"
+)
+
+// messageBytes are the sizes of the test messages, in the order they are sent.
+var messageBytes = [...]int{16, 48, 100, 24, 200, 64, 300, 32}
+
+var pattern = func() []byte {
+	message := make([]byte, 300)
+	for i := range message {
+		message[i] = byte(i)
+	}
+	return message
+}()
+
+// Message returns the i'th test message. It is shared, so it must not be modified.
+func Message(i int) []byte {
+	return pattern[:messageBytes[i%len(messageBytes)]]
+}
+
+// Payload returns a payload packed with test messages, zero padded to exactly payloadBytes.
+func Payload(payloadBytes int) []byte {
+	payload := make([]byte, payloadBytes)
+	var writer core.PayloadWriter
+	writer.Reset(payload)
+	for i := 0; writer.AddMessage(Message(i)); i++ {
+	}
+	writer.Finish()
+	return payload
+}
+
+// Valid checks a message is the test pattern, so messages corrupted on the way are counted as mismatches.
+func Valid(message []byte) bool {
+	if len(message) == 0 {
+		return false
+	}
+	for i := range message {
+		if message[i] != byte(i) {
+			return false
+		}
+	}
+	return true
+}
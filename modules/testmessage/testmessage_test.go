@@ -0,0 +1,57 @@
+/*
+	UDPX
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC, All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package testmessage
+
+import (
+	"testing"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPayload(t *testing.T) {
+
+	t.Parallel()
+
+	var messageBuffer [core.MaxPayloadMessages][]byte
+
+	// test payloads are exactly the size asked for, and packed with valid test messages
+
+	for _, payloadBytes := range []int{core.MinPayloadBytes, 1100, core.MaxPayloadBytes} {
+		payload := Payload(payloadBytes)
+		assert.Equal(t, payloadBytes, len(payload))
+		messages, ok := core.ReadPayloadMessages(payload, messageBuffer[:])
+		assert.True(t, ok)
+		assert.True(t, len(messages) > 0)
+		for i := range messages {
+			assert.Equal(t, Message(i), messages[i])
+			assert.True(t, Valid(messages[i]))
+		}
+	}
+
+	// anything else is a mismatch
+
+	assert.False(t, Valid(nil))
+	assert.False(t, Valid([]byte{1, 2, 3}))
+
+	message := append([]byte(nil), Message(2)...)
+	message[50] ^= 1
+	assert.False(t, Valid(message))
+}